@@ -4,10 +4,12 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"bulletproof/backend/internal/api"
 	"bulletproof/backend/internal/core"
@@ -34,11 +36,16 @@ func main() {
 	}
 
 	mgr := core.NewManager(*state, providers)
+	mgr.SetAPIAddr(*addr)
 	if err := mgr.Init(context.Background()); err != nil {
 		log.Fatalf("manager init: %v", err)
 	}
 
-	hs := &http.Server{Addr: *addr, Handler: api.NewHTTP(mgr)}
+	// Requests run on baseCtx, which Shutdown cancels so that event streams
+	// end instead of holding the server open.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	hs := &http.Server{Addr: *addr, Handler: api.NewHTTP(mgr), BaseContext: func(net.Listener) context.Context { return baseCtx }}
+	hs.RegisterOnShutdown(cancelBase)
 
 	go func() {
 		log.Printf("bulletproofd listening on http://%s", *addr)
@@ -51,10 +58,15 @@ func main() {
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
 	log.Println("shutting down…")
-	if err := hs.Shutdown(context.Background()); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
 		log.Printf("shutdown error: %v", err)
 	}
-	if err := mgr.Close(context.Background()); err != nil {
+	// Helpers get their own stop grace period, whatever Shutdown used up.
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelClose()
+	if err := mgr.Close(closeCtx); err != nil {
 		log.Printf("manager close error: %v", err)
 	}
 }
@@ -1,3 +1,10 @@
 module bulletproof/backend
 
 go 1.22
+
+require (
+	golang.org/x/crypto v0.33.0
+	rsc.io/qr v0.2.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
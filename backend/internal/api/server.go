@@ -1,15 +1,24 @@
 package api
 
 import (
+    "context"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
     "log"
     "net/http"
     "os"
     "net"
+    "net/url"
+    "strconv"
+    "strings"
     "time"
 
     "bulletproof/backend/internal/core"
     "bulletproof/backend/internal/engine/warpplus"
+    "bulletproof/backend/internal/net/pac"
+    "bulletproof/backend/internal/net/rules"
     "bulletproof/backend/internal/net/socks5"
     "bulletproof/backend/internal/system/proxy"
     "bulletproof/backend/internal/warpreg"
@@ -26,17 +35,30 @@ func NewHTTP(mgr *core.Manager) http.Handler {
 		w.Write([]byte("ok"))
 	})
     mux.HandleFunc("/v1/status", h.status)
-    mux.HandleFunc("/v1/connect", h.connect)
-    mux.HandleFunc("/v1/disconnect", h.disconnect)
+    mux.HandleFunc("/v1/events", h.events)
+    mux.HandleFunc("/v1/connect", localOnly(h.connect))
+    mux.HandleFunc("/v1/disconnect", localOnly(h.disconnect))
+    mux.HandleFunc("/v1/profiles", localWrites(h.profiles))
+    mux.HandleFunc("/v1/profiles/", localWrites(h.profile))
     mux.HandleFunc("/v1/ping", h.ping)
-    mux.HandleFunc("/v1/scan", h.scan)
-    mux.HandleFunc("/v1/proxy/enable", h.proxyEnable)
-    mux.HandleFunc("/v1/proxy/disable", h.proxyDisable)
+    mux.HandleFunc("/v1/scan", localOnly(h.scan))
+    mux.HandleFunc("/v1/endpoints", localWrites(h.endpoints))
+    mux.HandleFunc("/v1/rules", localWrites(h.rules))
+    mux.HandleFunc("/v1/rules/match", h.rulesMatch)
+    mux.HandleFunc("/v1/proxy/enable", localOnly(h.proxyEnable))
+    mux.HandleFunc("/v1/proxy/disable", localOnly(h.proxyDisable))
     mux.HandleFunc("/proxy.pac", h.servePAC)
+    mux.HandleFunc("/v1/pac", localWrites(h.pacSettings))
     mux.HandleFunc("/v1/identity", h.identity)
-    mux.HandleFunc("/v1/identity/reset", h.identityReset)
+    mux.HandleFunc("/v1/identity/reset", localWrites(h.identityReset))
+    mux.HandleFunc("/v1/identity/license", localWrites(h.identityLicense))
+    mux.HandleFunc("/v1/identity/export", localOnly(h.identityExport))
+    mux.HandleFunc("/v1/identity/import", localOnly(h.identityImport))
+    mux.HandleFunc("/v1/identity/rotate", localWrites(h.identityRotate))
+    mux.HandleFunc("/v1/identities", localWrites(h.identities))
+    mux.HandleFunc("/v1/identities/", localWrites(h.identitySlot))
     mux.HandleFunc("/v1/diag", h.diag)
-    mux.HandleFunc("/v1/test/socks", h.testSocks)
+    mux.HandleFunc("/v1/test/socks", localOnly(h.testSocks))
 
 	return withCORS(mux)
 }
@@ -45,7 +67,7 @@ func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -54,10 +76,109 @@ func withCORS(next http.Handler) http.Handler {
 	})
 }
 
+// clientHeader must be set on requests to endpoints that expose the identity's
+// private key or change state. Browsers only send custom headers cross-origin
+// after a CORS preflight, which withCORS does not allow for it.
+const clientHeader = "X-Bulletproof-Client"
+
+// localOnly keeps web pages from reading secrets or changing state through
+// the local API: the response carries no CORS grant, a foreign Origin is
+// refused and clientHeader is required, which rules out simple cross-origin
+// POSTs. The Host must name the loopback interface, so that a page whose
+// domain was rebound to 127.0.0.1 does not pass as same-origin.
+func localOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Del("Access-Control-Allow-Origin")
+		if !loopbackHost(r.Host) {
+			writeErr(w, http.StatusForbidden, fmt.Errorf("host %q is not allowed here", r.Host))
+			return
+		}
+		if o := r.Header.Get("Origin"); o != "" {
+			if u, err := url.Parse(o); err != nil || u.Host != r.Host {
+				writeErr(w, http.StatusForbidden, fmt.Errorf("cross-origin requests are not allowed here"))
+				return
+			}
+		}
+		if r.Header.Get(clientHeader) == "" {
+			writeErr(w, http.StatusForbidden, fmt.Errorf("missing %s header", clientHeader))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// loopbackHost reports whether host, with or without a port, is localhost
+// or a loopback IP.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localWrites applies localOnly to requests that change state, such as
+// identities, profiles (which autoconnect replays at every start), rules or
+// PAC settings; reads stay open to the UI like the rest of the API.
+func localWrites(next http.HandlerFunc) http.HandlerFunc {
+	guarded := localOnly(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
 func (h *httpAPI) status(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, h.mgr.Status(r.Context()))
 }
 
+// events streams lifecycle events as Server-Sent Events. The first message is a
+// "status" snapshot; clients reconnecting with Last-Event-ID resume from history.
+func (h *httpAPI) events(w http.ResponseWriter, r *http.Request) {
+    fl, ok := w.(http.Flusher)
+    if !ok {
+        writeErr(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+        return
+    }
+    after, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+    ch, cancel := h.mgr.Events().Subscribe(after)
+    defer cancel()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.WriteHeader(http.StatusOK)
+    if b, err := json.Marshal(h.mgr.Status(r.Context())); err == nil {
+        fmt.Fprintf(w, "event: status\ndata: %s\n\n", b)
+    }
+    fl.Flush()
+
+    keepAlive := time.NewTicker(15 * time.Second)
+    defer keepAlive.Stop()
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-keepAlive.C:
+            fmt.Fprint(w, ": keep-alive\n\n")
+            fl.Flush()
+        case ev, ok := <-ch:
+            if !ok { return }
+            b, err := json.Marshal(ev)
+            if err != nil { continue }
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b)
+            fl.Flush()
+        }
+    }
+}
+
 func (h *httpAPI) connect(w http.ResponseWriter, r *http.Request) {
 	var req core.ConnectRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -77,74 +198,332 @@ func (h *httpAPI) disconnect(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, st)
 }
 
+// profiles lists saved profiles (GET) or creates a new one (POST).
+func (h *httpAPI) profiles(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        list, last, err := h.mgr.Profiles()
+        if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        if list == nil { list = []core.Profile{} }
+        writeJSON(w, http.StatusOK, map[string]any{"profiles": list, "lastUsed": last})
+    case http.MethodPost:
+        var p core.Profile
+        if err := json.NewDecoder(r.Body).Decode(&p); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        if _, err := h.mgr.Profile(p.Name); err == nil {
+            writeErr(w, http.StatusConflict, fmt.Errorf("profile %q already exists", p.Name))
+            return
+        }
+        if err := h.mgr.SaveProfile(p); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        saved, _ := h.mgr.Profile(p.Name)
+        writeJSON(w, http.StatusCreated, saved)
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+// profile handles /v1/profiles/{name} (GET, PUT, DELETE) and
+// POST /v1/profiles/{name}/connect.
+func (h *httpAPI) profile(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/v1/profiles/")
+    if n, ok := strings.CutSuffix(name, "/connect"); ok {
+        if r.Method != http.MethodPost { w.WriteHeader(http.StatusMethodNotAllowed); return }
+        st, err := h.mgr.Connect(r.Context(), core.ConnectRequest{Profile: n})
+        if err != nil { writeErr(w, profileErrCode(err, http.StatusBadRequest), err); return }
+        writeJSON(w, http.StatusOK, st)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        p, err := h.mgr.Profile(name)
+        if err != nil { writeErr(w, profileErrCode(err, http.StatusInternalServerError), err); return }
+        writeJSON(w, http.StatusOK, p)
+    case http.MethodPut:
+        var p core.Profile
+        if err := json.NewDecoder(r.Body).Decode(&p); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        p.Name = name
+        if err := h.mgr.SaveProfile(p); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        saved, _ := h.mgr.Profile(name)
+        writeJSON(w, http.StatusOK, saved)
+    case http.MethodDelete:
+        if err := h.mgr.DeleteProfile(name); err != nil { writeErr(w, profileErrCode(err, http.StatusInternalServerError), err); return }
+        writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+func profileErrCode(err error, fallback int) int {
+    if errors.Is(err, core.ErrProfileNotFound) { return http.StatusNotFound }
+    return fallback
+}
+
 func (h *httpAPI) ping(w http.ResponseWriter, r *http.Request) {
     writeJSON(w, http.StatusOK, map[string]string{"pong": "ok"})
 }
 
-// scan returns a list of candidate WARP endpoints using warp-plus --scan.
+// scan probes WARP endpoints with WireGuard handshakes using the active
+// identity and returns them ranked by score. All body fields are optional.
 func (h *httpAPI) scan(w http.ResponseWriter, r *http.Request) {
-    type reqT struct { Bin string `json:"bin"` }
+    type reqT struct {
+        Targets   []string `json:"targets"`   // explicit ip:port list
+        Prefixes  []string `json:"prefixes"`  // CIDRs to sample
+        Ports     []int    `json:"ports"`
+        IPv6      bool     `json:"ipv6"`
+        Samples   int      `json:"samples"`
+        Probes    int      `json:"probes"`
+        TimeoutMs int      `json:"timeoutMs"` // per handshake
+        Top       int      `json:"top"`
+    }
     var body reqT
     _ = json.NewDecoder(r.Body).Decode(&body)
     ctx := r.Context()
-    eps, err := warpplus.Scan(ctx, body.Bin)
+    _, idDir := h.mgr.ActiveIdentity()
+    id, err := warpreg.EnsureIdentity(ctx, idDir)
+    if err != nil { writeErr(w, http.StatusBadGateway, err); return }
+    eps, err := warpplus.Scan(ctx, warpplus.ScanOptions{
+        PrivateKey: id.PrivateKey,
+        Targets:    body.Targets,
+        Prefixes:   body.Prefixes,
+        Ports:      body.Ports,
+        IPv6:       body.IPv6,
+        Samples:    body.Samples,
+        Probes:     body.Probes,
+        Timeout:    time.Duration(body.TimeoutMs) * time.Millisecond,
+        Top:        body.Top,
+    })
     if err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    _ = warpplus.OpenCache(h.mgr.StateDir()).RecordScan(eps)
     writeJSON(w, http.StatusOK, eps)
 }
 
-// proxyEnable enables system-wide PAC to route through local SOCKS5.
-// Currently implemented for macOS only; other OSes return not implemented.
+// endpoints lists the endpoint quality history (GET) or clears it (DELETE).
+func (h *httpAPI) endpoints(w http.ResponseWriter, r *http.Request) {
+    cache := warpplus.OpenCache(h.mgr.StateDir())
+    switch r.Method {
+    case http.MethodGet:
+        list, err := cache.List()
+        if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        writeJSON(w, http.StatusOK, list)
+    case http.MethodDelete:
+        if err := cache.Reset(); err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+// rules lists the active routing rules (GET), replaces api.rules with a JSON
+// rule set or the text format (PUT), or reloads the rule files (POST).
+func (h *httpAPI) rules(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        writeJSON(w, http.StatusOK, h.mgr.Rules().Snapshot())
+    case http.MethodPut:
+        var rs rules.RuleSet
+        body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+        if err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        if strings.HasPrefix(r.Header.Get("Content-Type"), "text/") {
+            rs, err = rules.Parse("request", string(body))
+        } else {
+            err = json.Unmarshal(body, &rs)
+        }
+        if err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        if err := h.mgr.SaveRules(rs); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        writeJSON(w, http.StatusOK, h.mgr.Rules().Snapshot())
+    case http.MethodPost:
+        if err := h.mgr.ReloadRules(); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        writeJSON(w, http.StatusOK, h.mgr.Rules().Snapshot())
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+// rulesMatch reports how ?host=&port= would be routed.
+func (h *httpAPI) rulesMatch(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    host := q.Get("host")
+    if host == "" { writeErr(w, http.StatusBadRequest, errors.New("missing host")); return }
+    port := 443
+    if v := q.Get("port"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil { writeErr(w, http.StatusBadRequest, errors.New("invalid port")); return }
+        port = n
+    }
+    act, rule := h.mgr.Rules().Match(host, port)
+    writeJSON(w, http.StatusOK, map[string]any{"host": host, "port": port, "action": act, "rule": rule})
+}
+
+// proxyEnable points the system proxy at the daemon's PAC file (default) or,
+// with ?mode=manual, directly at the session's SOCKS and HTTP binds.
+// proxyEnable points the system proxy at the session's binds, or at ?bind=,
+// which must be a loopback address.
 func (h *httpAPI) proxyEnable(w http.ResponseWriter, r *http.Request) {
-    bind := r.URL.Query().Get("bind")
-    if bind == "" { bind = "127.0.0.1:8086" }
-    if err := proxy.EnablePAC(r.Context(), "http://127.0.0.1:4765/proxy.pac"); err != nil {
+    if r.Method != http.MethodPost { w.WriteHeader(http.StatusMethodNotAllowed); return }
+    st := h.mgr.Status(r.Context())
+    bind, httpBind := r.URL.Query().Get("bind"), st.HTTPBind
+    if bind != "" {
+        if err := loopbackBind(bind); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    }
+    if bind == "" { bind = st.Bind } else { httpBind = "" }
+    if bind == "" { writeErr(w, http.StatusConflict, errors.New("not connected; no SOCKS bind")); return }
+    sys := proxy.Settings{SOCKS: bind, HTTP: httpBind}
+    switch mode := r.URL.Query().Get("mode"); mode {
+    case "", "pac":
+        sys.PACURL = h.mgr.PACURL()
+        if q := r.URL.Query().Get("bind"); q != "" { sys.PACURL += "?bind=" + url.QueryEscape(q) }
+    case "manual":
+    default:
+        writeErr(w, http.StatusBadRequest, fmt.Errorf("unknown mode %q", mode))
+        return
+    }
+    if err := proxy.Enable(r.Context(), h.mgr.StateDir(), sys); err != nil {
         writeErr(w, http.StatusNotImplemented, err)
         return
     }
-    writeJSON(w, http.StatusOK, map[string]string{"status":"enabled","bind":bind})
+    writeJSON(w, http.StatusOK, map[string]string{"status":"enabled","mode":sys.Mode(),"bind":bind,"httpBind":httpBind,"pacUrl":sys.PACURL})
 }
 
 func (h *httpAPI) proxyDisable(w http.ResponseWriter, r *http.Request) {
-    if err := proxy.DisablePAC(r.Context()); err != nil {
+    if r.Method != http.MethodPost { w.WriteHeader(http.StatusMethodNotAllowed); return }
+    if err := proxy.Disable(r.Context(), h.mgr.StateDir()); err != nil {
         writeErr(w, http.StatusNotImplemented, err)
         return
     }
     writeJSON(w, http.StatusOK, map[string]string{"status":"disabled"})
 }
 
-// servePAC returns a PAC file that sends all traffic through SOCKS5 at 127.0.0.1:8086.
+// loopbackBind accepts a bind given in a request only as a loopback IP
+// literal with a port, so that it cannot point clients at another host or
+// smuggle anything into the settings it ends up in.
+func loopbackBind(bind string) error {
+    host, port, err := net.SplitHostPort(bind)
+    if err == nil {
+        if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+            err = errors.New("not a loopback IP")
+        } else if n, perr := strconv.Atoi(port); perr != nil || n < 1 || n > 65535 {
+            err = errors.New("invalid port")
+        }
+    }
+    if err != nil { return fmt.Errorf("invalid bind %q: %w", bind, err) }
+    return nil
+}
+
+// servePAC returns the PAC file generated from the PAC settings, routing
+// rules and the session's binds (or ?bind=). Its version doubles as ETag.
 func (h *httpAPI) servePAC(w http.ResponseWriter, r *http.Request) {
     bind := r.URL.Query().Get("bind")
-    if bind == "" { bind = "127.0.0.1:8086" }
-    pac := "function FindProxyForURL(url, host) { return \"SOCKS5 " + bind + "; DIRECT\"; }"
+    if bind != "" {
+        if err := loopbackBind(bind); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    }
+    f, err := h.mgr.PAC(r.Context(), bind)
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    etag := `"` + f.Version + `"`
+    w.Header().Set("ETag", etag)
+    w.Header().Set("X-PAC-Version", f.Version)
+    w.Header().Set("Cache-Control", "no-cache")
+    if r.Header.Get("If-None-Match") == etag { w.WriteHeader(http.StatusNotModified); return }
     w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
     w.WriteHeader(http.StatusOK)
-    _, _ = w.Write([]byte(pac))
+    _, _ = w.Write([]byte(f.Script))
 }
 
-// identity returns current identity status (sanitized) or ensures/creates one if requested.
+// pacSettings returns (GET) or replaces (PUT) the PAC preferences.
+func (h *httpAPI) pacSettings(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        var s pac.Settings
+        if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&s); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        if err := h.mgr.SavePACSettings(s); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    s, err := h.mgr.PACSettings()
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    f, err := h.mgr.PAC(r.Context(), "")
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    writeJSON(w, http.StatusOK, map[string]any{"settings": s, "version": f.Version, "url": h.mgr.PACURL()})
+}
+
+// identity returns the active slot's identity status (sanitized): device,
+// account type and WARP+ data left, the account's devices and the WireGuard
+// peer config. ?refresh=1 fetches them from the API first; on failure the
+// cached values are returned with accountError set.
 func (h *httpAPI) identity(w http.ResponseWriter, r *http.Request) {
-    stDir := h.mgr.StateDir()
+    slot, stDir := h.mgr.ActiveIdentity()
     id, ok, err := warpreg.Load(stDir)
     if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
-    type resp struct {
-        Exists       bool   `json:"exists"`
-        DeviceID     string `json:"deviceId,omitempty"`
-        AccountID    string `json:"accountId,omitempty"`
-        PublicKey    string `json:"publicKey,omitempty"`
-        HasPrivate   bool   `json:"hasPrivateKey"`
-        HasToken     bool   `json:"hasToken"`
-        Path         string `json:"path"`
-    }
-    out := resp{Exists: ok, Path: warpreg.Path(stDir)}
+    var accountErr string
+    if ok && r.URL.Query().Get("refresh") != "" {
+        ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+        defer cancel()
+        if fresh, err := warpreg.RefreshAccount(ctx, stDir); err != nil {
+            accountErr = err.Error()
+        } else {
+            id = fresh
+        }
+    }
+    out := sanitizeIdentity(id, ok, stDir)
+    out.Slot, out.AccountError = slot, accountErr
+    writeJSON(w, http.StatusOK, out)
+}
+
+// identityOut is an identity without its secrets.
+type identityOut struct {
+    Slot         string `json:"slot,omitempty"`
+    Exists       bool   `json:"exists"`
+    DeviceID     string `json:"deviceId,omitempty"`
+    AccountID    string `json:"accountId,omitempty"`
+    PublicKey    string `json:"publicKey,omitempty"`
+    HasPrivate   bool   `json:"hasPrivateKey"`
+    HasToken     bool   `json:"hasToken"`
+    License      string `json:"license,omitempty"` // masked
+    Account      *warpreg.Account `json:"account,omitempty"`
+    Config       *warpreg.Config  `json:"config,omitempty"`
+    AccountError string `json:"accountError,omitempty"`
+    Path         string `json:"path"`
+}
+
+func sanitizeIdentity(id warpreg.Identity, ok bool, stDir string) identityOut {
+    out := identityOut{Exists: ok, Path: warpreg.Path(stDir)}
     if ok {
         out.DeviceID = id.DeviceID
         out.AccountID = id.AccountID
         out.PublicKey = id.PublicKey
         out.HasPrivate = id.PrivateKey != ""
         out.HasToken = id.Token != ""
+        out.License = warpreg.MaskLicense(id.License)
+        out.Account, out.Config = id.Account, id.Config
     }
-    writeJSON(w, http.StatusOK, out)
+    return out
+}
+
+// identityImport saves an identity from the request body: a wgcf-account.toml,
+// a warp-plus or bulletproof identity JSON, or a WireGuard .conf.
+// ?slot=name imports into that slot instead of the active one; ?replace=1
+// overwrites an existing identity; ?offline=1 skips checking the device with
+// the API (which also detects the account type).
+func (h *httpAPI) identityImport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+    if err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    if _, _, err := warpreg.ParseImport(b); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    q := r.URL.Query()
+    _, stDir := h.mgr.ActiveIdentity()
+    if slot := q.Get("slot"); slot != "" {
+        if !warpreg.ValidSlot(slot) { writeErr(w, http.StatusBadRequest, fmt.Errorf("invalid slot name %q", slot)); return }
+        stDir = warpreg.SlotDir(h.mgr.StateDir(), slot)
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+    defer cancel()
+    id, format, err := warpreg.Import(ctx, stDir, b, warpreg.ImportOptions{Replace: q.Get("replace") != "", Offline: q.Get("offline") != ""})
+    if errors.Is(err, warpreg.ErrIdentityExists) { writeErr(w, http.StatusConflict, err); return }
+    if err != nil { writeErr(w, http.StatusBadGateway, err); return }
+    writeJSON(w, http.StatusOK, map[string]any{"format": format, "identity": sanitizeIdentity(id, true, stDir)})
 }
 
 func (h *httpAPI) identityReset(w http.ResponseWriter, r *http.Request) {
@@ -152,26 +531,223 @@ func (h *httpAPI) identityReset(w http.ResponseWriter, r *http.Request) {
         w.WriteHeader(http.StatusMethodNotAllowed)
         return
     }
-    if err := warpreg.Reset(h.mgr.StateDir()); err != nil {
+    _, idDir := h.mgr.ActiveIdentity()
+    if err := warpreg.Reset(idDir); err != nil {
         writeErr(w, http.StatusInternalServerError, err)
         return
     }
     writeJSON(w, http.StatusOK, map[string]string{"status":"reset"})
 }
 
+// identityLicense reports the WARP+ license and account of the active slot's
+// device (GET; ?refresh=1 fetches the account first) or binds a license key
+// (PUT or POST {"license": "..."}). The key is always returned masked.
+func (h *httpAPI) identityLicense(w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+    defer cancel()
+    _, stDir := h.mgr.ActiveIdentity()
+    var id warpreg.Identity
+    var err error
+    switch r.Method {
+    case http.MethodGet:
+        var ok bool
+        if r.URL.Query().Get("refresh") != "" {
+            id, err = warpreg.RefreshAccount(ctx, stDir)
+        } else if id, ok, err = warpreg.Load(stDir); err == nil && !ok {
+            err = warpreg.ErrNoIdentity
+        }
+    case http.MethodPut, http.MethodPost:
+        var body struct{ License string `json:"license"` }
+        if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        id, err = warpreg.SetLicense(ctx, stDir, strings.TrimSpace(body.License))
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    switch {
+    case errors.Is(err, warpreg.ErrNoIdentity):
+        writeErr(w, http.StatusNotFound, err)
+    case errors.Is(err, warpreg.ErrNoToken):
+        writeErr(w, http.StatusConflict, err)
+    case errors.Is(err, warpreg.ErrInvalidLicense):
+        writeErr(w, http.StatusBadRequest, err)
+    case err != nil:
+        writeErr(w, http.StatusBadGateway, err)
+    default:
+        writeJSON(w, http.StatusOK, map[string]any{"license": warpreg.MaskLicense(id.License), "account": id.Account})
+    }
+}
+
+// identityExport renders the active identity for other WireGuard clients:
+// ?format=wg (wg-quick .conf, the default), singbox or xray (outbound JSON),
+// or qr (the .conf as a PNG QR code; &render=text draws it for a terminal).
+// Identities saved without a WireGuard config are refreshed first.
+func (h *httpAPI) identityExport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    _, stDir := h.mgr.ActiveIdentity()
+    id, ok, err := warpreg.Load(stDir)
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    if !ok { writeErr(w, http.StatusNotFound, warpreg.ErrNoIdentity); return }
+    if id.Config == nil {
+        ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+        defer cancel()
+        if id, err = warpreg.RefreshAccount(ctx, stDir); err != nil { writeErr(w, http.StatusBadGateway, err); return }
+    }
+    // The export carries the private key.
+    w.Header().Set("Cache-Control", "no-store")
+    tag := r.URL.Query().Get("tag")
+    if tag == "" { tag = "warp" }
+    switch format := r.URL.Query().Get("format"); format {
+    case "", "wg":
+        conf, err := warpreg.WireGuardConf(id)
+        if err != nil { writeErr(w, http.StatusConflict, err); return }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="bulletproof-warp.conf"`)
+        io.WriteString(w, conf)
+    case "singbox", "xray":
+        render := warpreg.SingBoxOutbound
+        if format == "xray" { render = warpreg.XrayOutbound }
+        out, err := render(id, tag)
+        if err != nil { writeErr(w, http.StatusConflict, err); return }
+        writeJSON(w, http.StatusOK, out)
+    case "qr":
+        conf, err := warpreg.WireGuardConf(id)
+        if err != nil { writeErr(w, http.StatusConflict, err); return }
+        if r.URL.Query().Get("render") == "text" {
+            text, err := warpreg.QRTerminal(conf)
+            if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+            w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+            io.WriteString(w, text)
+            return
+        }
+        b, err := warpreg.QRPNG(conf)
+        if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        w.Header().Set("Content-Type", "image/png")
+        w.Write(b)
+    default:
+        writeErr(w, http.StatusBadRequest, fmt.Errorf("unknown format %q (want wg, singbox, xray or qr)", format))
+    }
+}
+
+// identityRotate switches to another identity slot and reconnects a
+// warp-based session on it: the next slot with an identity, or with
+// ?fresh=1 a newly registered one. ?retire=1 then deletes the slot left and
+// unregisters its device.
+func (h *httpAPI) identityRotate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    q := r.URL.Query()
+    ctx, cancel := context.WithTimeout(r.Context(), 90*time.Second)
+    defer cancel()
+    to, err := h.mgr.RotateIdentity(ctx, warpreg.RotateOptions{Fresh: q.Get("fresh") != "", Retire: q.Get("retire") != ""})
+    if errors.Is(err, warpreg.ErrNoOtherSlot) { writeErr(w, http.StatusConflict, err); return }
+    if to == "" && err != nil { writeErr(w, http.StatusBadGateway, err); return }
+    out := map[string]any{"active": to, "status": h.mgr.Status(r.Context())}
+    if err != nil { out["error"] = err.Error() }
+    writeJSON(w, http.StatusOK, out)
+}
+
+// identities lists the identity slots with the rotation schedule (GET) or
+// sets the schedule (PUT {"every": "6h", "fresh": true, "retire": true};
+// an empty or zero interval turns scheduled rotation off).
+func (h *httpAPI) identities(w http.ResponseWriter, r *http.Request) {
+    stDir := h.mgr.StateDir()
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        var body struct {
+            Every  string `json:"every"`
+            Fresh  bool   `json:"fresh"`
+            Retire bool   `json:"retire"`
+        }
+        if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+        var every time.Duration
+        if body.Every != "" {
+            d, err := time.ParseDuration(body.Every)
+            if err != nil { writeErr(w, http.StatusBadRequest, err); return }
+            every = d
+        }
+        if _, err := warpreg.SetSchedule(stDir, every, warpreg.RotateOptions{Fresh: body.Fresh, Retire: body.Retire}); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    s, err := warpreg.LoadSlots(stDir)
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    slots, err := warpreg.ListSlots(stDir)
+    if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+    out := []identityOut{}
+    for _, sl := range slots {
+        o := sanitizeIdentity(sl.Identity, sl.Exists, warpreg.SlotDir(stDir, sl.Name))
+        o.Slot = sl.Name
+        out = append(out, o)
+    }
+    writeJSON(w, http.StatusOK, struct {
+        warpreg.Slots
+        List []identityOut `json:"slots"`
+    }{s, out})
+}
+
+// identitySlot manages one slot: GET shows it, POST registers a device in
+// it, POST .../activate makes it the active slot for the next connect, and
+// DELETE removes it (?unregister=1 also deletes the device from the API).
+// The slot of the running session cannot be deleted.
+func (h *httpAPI) identitySlot(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/v1/identities/")
+    name, activate := strings.CutSuffix(name, "/activate")
+    if !warpreg.ValidSlot(name) { writeErr(w, http.StatusBadRequest, fmt.Errorf("invalid slot name %q", name)); return }
+    dir := warpreg.SlotDir(h.mgr.StateDir(), name)
+    ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+    defer cancel()
+    if activate {
+        if r.Method != http.MethodPost { w.WriteHeader(http.StatusMethodNotAllowed); return }
+        if err := warpreg.SetActive(h.mgr.StateDir(), name); err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        writeJSON(w, http.StatusOK, map[string]string{"active": name})
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        id, ok, err := warpreg.Load(dir)
+        if err != nil { writeErr(w, http.StatusInternalServerError, err); return }
+        if !ok { writeErr(w, http.StatusNotFound, warpreg.ErrSlotNotFound); return }
+        out := sanitizeIdentity(id, ok, dir)
+        out.Slot = name
+        writeJSON(w, http.StatusOK, out)
+    case http.MethodPost:
+        id, err := warpreg.CreateSlot(ctx, h.mgr.StateDir(), name)
+        if errors.Is(err, warpreg.ErrSlotExists) { writeErr(w, http.StatusConflict, err); return }
+        if err != nil { writeErr(w, http.StatusBadGateway, err); return }
+        out := sanitizeIdentity(id, true, dir)
+        out.Slot = name
+        writeJSON(w, http.StatusOK, out)
+    case http.MethodDelete:
+        if h.mgr.Status(r.Context()).Identity == name {
+            writeErr(w, http.StatusConflict, fmt.Errorf("identity %s is in use by the current session", name))
+            return
+        }
+        err := warpreg.DeleteSlot(ctx, h.mgr.StateDir(), name, r.URL.Query().Get("unregister") != "")
+        if errors.Is(err, warpreg.ErrSlotNotFound) { writeErr(w, http.StatusNotFound, err); return }
+        if err != nil { writeErr(w, http.StatusBadGateway, err); return }
+        writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
 // diag returns a snapshot for E2E smoke checks.
 func (h *httpAPI) diag(w http.ResponseWriter, r *http.Request) {
     st := h.mgr.Status(r.Context())
-    id, ok, _ := warpreg.Load(h.mgr.StateDir())
-    // quick socks listen probe
-    socks := "127.0.0.1:8086"
-    if st.Bind != "" { socks = st.Bind }
-    listening := probeTCP(socks, 350*time.Millisecond)
-    // also probe warp-plus internal bind if using shim (canonical 8086 on same host)
-    warpBind := ""
-    if host, _, err := net.SplitHostPort(socks); err == nil {
-        warpBind = net.JoinHostPort(host, "8086")
-    }
+    _, idDir := h.mgr.ActiveIdentity()
+    id, ok, _ := warpreg.Load(idDir)
+    // quick socks listen probes of the shim and the engine behind it
+    socks := st.Bind
+    listening := socks != "" && probeTCP(socks, 350*time.Millisecond)
+    warpBind := st.EngineBind
     warpUp := false
     if warpBind != "" { warpUp = probeTCP(warpBind, 250*time.Millisecond) }
     type idOut struct {
@@ -188,14 +764,14 @@ func (h *httpAPI) diag(w http.ResponseWriter, r *http.Request) {
             DeviceID: id.DeviceID,
             AccountID: id.AccountID,
             PublicKey: id.PublicKey,
-            Path: warpreg.Path(h.mgr.StateDir()),
+            Path: warpreg.Path(idDir),
         },
         "env": map[string]string{
             "WARPPLUS_BIN": os.Getenv("WARPPLUS_BIN"),
             "SINGBOX_BIN": os.Getenv("SINGBOX_BIN"),
         },
         "paths": map[string]string{
-            "warpLog": h.mgr.StateDir()+"/warp-plus.log",
+            "warpLog": st.EngineLog,
             "singboxConfig": h.mgr.StateDir()+"/singbox.json",
         },
         "socks": map[string]any{
@@ -203,7 +779,12 @@ func (h *httpAPI) diag(w http.ResponseWriter, r *http.Request) {
             "listening": listening,
             "warpBind": warpBind,
             "warpListening": warpUp,
+            "httpBind": st.HTTPBind,
+            "udp": st.UDP,
+            "udpSupported": st.UDP == "upstream" || st.UDP == "direct",
         },
+        "ports": h.mgr.Ports().Held(),
+        "pacUrl": h.mgr.PACURL(),
     }
     writeJSON(w, http.StatusOK, out)
 }
@@ -220,11 +801,15 @@ func probeTCP(addr string, timeout time.Duration) bool {
 }
 
 // testSocks performs a simple HTTP GET via the local SOCKS5 proxy to confirm connectivity.
-// Query params: bind (default 127.0.0.1:8086) host (default ip-api.com) path (default /json)
+// Query params: bind (default: the session's bind, with its credentials) host (default ip-api.com) path (default /json)
 func (h *httpAPI) testSocks(w http.ResponseWriter, r *http.Request) {
     q := r.URL.Query()
     bind := q.Get("bind")
-    if bind == "" { bind = "127.0.0.1:8086" }
+    if bind != "" {
+        if err := loopbackBind(bind); err != nil { writeErr(w, http.StatusBadRequest, err); return }
+    }
+    if bind == "" { bind = h.mgr.ClientBind() }
+    if bind == "" { writeErr(w, http.StatusBadRequest, errors.New("not connected; pass ?bind=")); return }
     host := q.Get("host")
     if host == "" { host = "ip-api.com" }
     path := q.Get("path")
@@ -0,0 +1,172 @@
+package api
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "bulletproof/backend/internal/core"
+    "bulletproof/backend/internal/warpreg"
+)
+
+func TestIdentityWrites_RefuseCrossOrigin(t *testing.T) {
+    // Nothing refused may reach the client API.
+    prev := warpreg.BaseURL
+    warpreg.BaseURL = "http://127.0.0.1:1"
+    defer func() { warpreg.BaseURL = prev }()
+
+    dir := t.TempDir()
+    warpreg.SaveForTest(t, dir)
+    warpreg.SaveForTest(t, warpreg.SlotDir(dir, "spare"))
+    h := NewHTTP(core.NewManager(dir, map[string]core.Provider{}))
+    do := func(method, path, body string, hdr map[string]string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, "http://127.0.0.1:4765"+path, strings.NewReader(body))
+        for k, v := range hdr { req.Header.Set(k, v) }
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        return rec
+    }
+
+    writes := []struct{ method, path string }{
+        {http.MethodDelete, "/v1/identities/spare?unregister=1"},
+        {http.MethodPost, "/v1/identities/fresh"},
+        {http.MethodPost, "/v1/identities/spare/activate"},
+        {http.MethodPut, "/v1/identities"},
+        {http.MethodPost, "/v1/identity/rotate?fresh=1"},
+        {http.MethodPut, "/v1/identity/license"},
+        {http.MethodPost, "/v1/identity/reset"},
+        {http.MethodPost, "/v1/identity/import"},
+        {http.MethodGet, "/v1/identity/export"},
+        {http.MethodPost, "/v1/profiles"},
+        {http.MethodPut, "/v1/profiles/home"},
+        {http.MethodDelete, "/v1/profiles/home"},
+        {http.MethodPost, "/v1/profiles/home/connect"},
+        {http.MethodPost, "/v1/proxy/enable?mode=manual&bind=127.0.0.1:1080"},
+        {http.MethodPost, "/v1/proxy/disable"},
+        {http.MethodPost, "/v1/connect"},
+        {http.MethodPost, "/v1/disconnect"},
+        {http.MethodPost, "/v1/scan"},
+        {http.MethodDelete, "/v1/endpoints"},
+        {http.MethodPost, "/v1/rules"},
+        {http.MethodPut, "/v1/pac"},
+        {http.MethodGet, "/v1/test/socks?bind=127.0.0.1:1080"},
+    }
+    for _, c := range writes {
+        for name, hdr := range map[string]map[string]string{
+            "foreign origin":   {"Origin": "https://example.com", clientHeader: "1"},
+            "no client header": {"Content-Type": "text/plain"},
+        } {
+            rec := do(c.method, c.path, "{}", hdr)
+            if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+                t.Errorf("%s %s with %s: %d, CORS %q", c.method, c.path, name, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+            }
+        }
+    }
+    // Connect may not pick a slot or bind a key for a web page either.
+    for _, body := range []string{`{"provider":"warp","options":{"identity":"fresh"}}`, `{"provider":"warp","options":{"key":"a1B2c3D4-e5F6g7H8-i9J0k1L2"}}`} {
+        if rec := do(http.MethodPost, "/v1/connect", body, map[string]string{"Origin": "https://example.com", clientHeader: "1"}); rec.Code != http.StatusForbidden {
+            t.Errorf("cross-origin connect %s: %d", body, rec.Code)
+        }
+    }
+    // A rebound domain passes the Origin check, but its Host is not loopback.
+    rebound := httptest.NewRequest(http.MethodPost, "http://evil.example:4765/v1/identity/reset", strings.NewReader("{}"))
+    rebound.Header.Set("Origin", "http://evil.example:4765")
+    rebound.Header.Set(clientHeader, "1")
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, rebound)
+    if rec.Code != http.StatusForbidden { t.Errorf("rebound host: %d", rec.Code) }
+    if _, ok, _ := warpreg.Load(warpreg.SlotDir(dir, "fresh")); ok { t.Fatal("refused connect registered a slot") }
+    if _, ok, _ := warpreg.Load(warpreg.SlotDir(dir, "spare")); !ok { t.Fatal("refused delete removed the slot") }
+    if _, ok, _ := warpreg.Load(dir); !ok { t.Fatal("refused reset removed the identity") }
+    if name, _ := warpreg.Active(dir); name != warpreg.DefaultSlot { t.Fatalf("refused activate switched to %q", name) }
+
+    // Reads stay open to web pages; the daemon's own clients may write.
+    if rec := do(http.MethodGet, "/v1/identities", "", map[string]string{"Origin": "https://example.com"}); rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+        t.Fatalf("cross-origin read: %d, CORS %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+    }
+    if rec := do(http.MethodDelete, "/v1/identities/spare", "", map[string]string{"Origin": "http://127.0.0.1:4765", clientHeader: "1"}); rec.Code != http.StatusOK {
+        t.Fatalf("same-origin delete: %d %s", rec.Code, rec.Body)
+    }
+    if _, ok, _ := warpreg.Load(warpreg.SlotDir(dir, "spare")); ok { t.Fatal("slot not deleted") }
+}
+
+func TestProxyEnable_RefusesForeignBinds(t *testing.T) {
+    h := NewHTTP(core.NewManager(t.TempDir(), map[string]core.Provider{}))
+    for _, c := range []struct {
+        method, bind string
+        code         int
+    }{
+        {http.MethodGet, "127.0.0.1:1080", http.StatusMethodNotAllowed},
+        {http.MethodPost, "$(touch%20x):1080", http.StatusBadRequest},
+        {http.MethodPost, "203.0.113.5:1080", http.StatusBadRequest},
+        {http.MethodPost, "localhost:1080", http.StatusBadRequest},
+        {http.MethodPost, "127.0.0.1:0", http.StatusBadRequest},
+    } {
+        req := httptest.NewRequest(c.method, "http://127.0.0.1:4765/v1/proxy/enable?mode=manual&bind="+c.bind, nil)
+        req.Header.Set(clientHeader, "1")
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        if rec.Code != c.code { t.Errorf("%s bind=%s: %d, want %d", c.method, c.bind, rec.Code, c.code) }
+    }
+}
+
+func TestEvents_StatusFirstThenResume(t *testing.T) {
+    mgr := core.NewManager(t.TempDir(), map[string]core.Provider{})
+    srv := httptest.NewServer(NewHTTP(mgr))
+    defer srv.Close()
+
+    // open subscribes to /v1/events and returns a reader for its messages.
+    open := func(lastID string) (*bufio.Reader, func()) {
+        ctx, cancel := context.WithCancel(context.Background())
+        req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/events", nil)
+        if lastID != "" { req.Header.Set("Last-Event-ID", lastID) }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil { cancel(); t.Fatal(err) }
+        if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" { t.Fatalf("content type %q", ct) }
+        return bufio.NewReader(resp.Body), func() { cancel(); resp.Body.Close() }
+    }
+    // next reads one message as its field lines, skipping keep-alives.
+    next := func(r *bufio.Reader) map[string]string {
+        msg := map[string]string{}
+        for {
+            line, err := r.ReadString('\n')
+            if err != nil { t.Fatalf("reading event: %v", err) }
+            line = strings.TrimSuffix(line, "\n")
+            if line == "" {
+                if len(msg) > 0 { return msg }
+                continue
+            }
+            if strings.HasPrefix(line, ":") { continue }
+            k, v, _ := strings.Cut(line, ": ")
+            msg[k] = v
+        }
+    }
+
+    r, closeFirst := open("")
+    if msg := next(r); msg["event"] != "status" || !strings.Contains(msg["data"], `"phase"`) {
+        t.Fatalf("first message = %v, want a status snapshot", msg)
+    }
+    first := mgr.Events().Publish(core.Event{Type: core.EventError, Message: "one"})
+    mgr.Events().Publish(core.Event{Type: core.EventEndpoint, Message: "two"})
+    if msg := next(r); msg["id"] != strconv.FormatUint(first.ID, 10) || msg["event"] != "error" {
+        t.Fatalf("live message = %v", msg)
+    }
+    closeFirst()
+
+    // A client reconnecting after the first event gets the status, then the rest.
+    r, closeSecond := open(strconv.FormatUint(first.ID, 10))
+    defer closeSecond()
+    if msg := next(r); msg["event"] != "status" {
+        t.Fatalf("first message on resume = %v", msg)
+    }
+    msg := next(r)
+    var ev core.Event
+    if err := json.Unmarshal([]byte(msg["data"]), &ev); err != nil || msg["id"] != strconv.FormatUint(first.ID+1, 10) || msg["event"] != "endpoint" || ev.Message != "two" {
+        t.Fatalf("resumed message = %v (%v)", msg, err)
+    }
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of lifecycle event published on the bus.
+type EventType string
+
+const (
+	EventPhase       EventType = "phase"        // connection phase/status message changed
+	EventEngineStart EventType = "engine.start" // helper process (warp-plus, sing-box) started
+	EventEngineExit  EventType = "engine.exit"  // helper process exited
+	EventEndpoint    EventType = "endpoint"     // engine switched to another endpoint
+	EventIntegration EventType = "integration"  // pac/manual/tun integration applied or removed
+	EventError       EventType = "error"        // non-fatal or fatal error worth surfacing
+	EventFailover    EventType = "failover"     // health monitor re-ran selection or switched provider
+	EventRules       EventType = "rules"        // routing rules reloaded
+	EventEngineLog   EventType = "engine.log"   // notable engine log line: handshake, exit country, connectivity test
+	EventIdentity    EventType = "identity"     // active WARP identity slot rotated
+)
+
+// Event is a single lifecycle notification. Data carries type-specific fields.
+type Event struct {
+	ID       uint64         `json:"id"`
+	Type     EventType      `json:"type"`
+	Time     time.Time      `json:"time"`
+	Provider string         `json:"provider,omitempty"`
+	Message  string         `json:"message,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+// Reporter lets providers push lifecycle events to the manager while a session runs,
+// including from background goroutines started during Connect. Providers report
+// progress through Transition rather than writing Status.Message directly.
+type Reporter interface {
+	Emit(ev Event)
+	Transition(to Phase, msg string) error
+	// TransitionFrom moves to phase to only if the session is in one of from,
+	// for progress that may be reported again later (a WireGuard rekey logs
+	// another handshake). It reports whether the phase was changed.
+	TransitionFrom(from []Phase, to Phase, msg string) bool
+}
+
+// historySize is how many recent events the bus keeps for late subscribers.
+const historySize = 64
+
+// Bus is a small in-process fan-out for Events. Slow subscribers drop events
+// rather than block publishers.
+type Bus struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[chan Event]struct{}
+	history []Event
+}
+
+func NewBus() *Bus { return &Bus{subs: map[chan Event]struct{}{}} }
+
+// Publish stamps ev with an ID and time (if unset) and delivers it to all subscribers.
+func (b *Bus) Publish(ev Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev.ID = b.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.history = append(b.history, ev)
+	if len(b.history) > historySize {
+		b.history = b.history[len(b.history)-historySize:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	return ev
+}
+
+// Subscribe returns a channel of events and a cancel func that must be called
+// when the subscriber is done. Events with ID greater than after are replayed
+// from history first, so reconnecting clients can resume.
+func (b *Bus) Subscribe(after uint64) (<-chan Event, func()) {
+	ch := make(chan Event, historySize+16)
+	b.mu.Lock()
+	for _, ev := range b.history {
+		if after > 0 && ev.ID > after {
+			ch <- ev
+		}
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// drain returns the IDs buffered in ch without blocking.
+func drain(ch <-chan Event) []uint64 {
+	var ids []uint64
+	for {
+		select {
+		case ev := <-ch:
+			ids = append(ids, ev.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestBus_SubscribeReplaysHistory(t *testing.T) {
+	b := NewBus()
+	for i := 0; i < 100; i++ {
+		b.Publish(Event{Type: EventPhase})
+	}
+
+	ch, cancel := b.Subscribe(90)
+	ids := drain(ch)
+	cancel()
+	if len(ids) != 10 || ids[0] != 91 || ids[9] != 100 {
+		t.Fatalf("after 90: replayed %v, want 91-100", ids)
+	}
+
+	// Only the last historySize events are kept.
+	ch, cancel = b.Subscribe(1)
+	ids = drain(ch)
+	cancel()
+	if len(ids) != historySize || ids[0] != 100-historySize+1 || ids[len(ids)-1] != 100 {
+		t.Fatalf("after 1: replayed %d events from %v, want the last %d", len(ids), ids[:1], historySize)
+	}
+
+	// A new subscriber (after 0) and one that is up to date get nothing old.
+	last := uint64(100)
+	for _, fresh := range []bool{true, false} {
+		after := last
+		if fresh {
+			after = 0
+		}
+		ch, cancel = b.Subscribe(after)
+		if ids := drain(ch); len(ids) != 0 {
+			t.Fatalf("after %d: replayed %v", after, ids)
+		}
+		ev := b.Publish(Event{Type: EventError})
+		if got := drain(ch); len(got) != 1 || got[0] != ev.ID {
+			t.Fatalf("after %d: live %v, want [%d]", after, got, ev.ID)
+		}
+		cancel()
+		last = ev.ID
+	}
+}
+
+func TestBus_SlowSubscriberDoesNotBlockPublish(t *testing.T) {
+	b := NewBus()
+	slow, cancel := b.Subscribe(0) // not read until the end
+	defer cancel()
+
+	const n = 4 * historySize
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < n; i++ {
+			b.Publish(Event{Type: EventEngineLog})
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	// The subscriber keeps what fit in its buffer and drops the rest, but
+	// stays subscribed.
+	if ids := drain(slow); len(ids) != cap(slow) || ids[0] != 1 {
+		t.Fatalf("slow subscriber got %d events starting at %v, want the first %d", len(ids), ids[:1], cap(slow))
+	}
+	ev := b.Publish(Event{Type: EventPhase})
+	if ids := drain(slow); len(ids) != 1 || ids[0] != ev.ID {
+		t.Fatalf("after catching up: %v, want [%d]", ids, ev.ID)
+	}
+}
+
+func TestBus_CancelClosesOnce(t *testing.T) {
+	b := NewBus()
+	ch, cancel := b.Subscribe(0)
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel still open after cancel")
+	}
+	b.Publish(Event{Type: EventPhase}) // must not send on the closed channel
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bulletproof/backend/internal/net/socks5"
+)
+
+// ProbeFunc checks that traffic actually flows through the SOCKS proxy at bind.
+type ProbeFunc func(ctx context.Context, bind string) error
+
+// HealthConfig controls the tunnel health monitor. Zero values use defaults.
+type HealthConfig struct {
+	Interval      time.Duration // time between probes (default 30s)
+	Timeout       time.Duration // per-probe timeout (default 10s)
+	FailThreshold int           // consecutive failures before the session is degraded (default 3)
+	Probe         ProbeFunc     // default: HTTP GET of the Cloudflare trace page via the bind
+}
+
+// Health is the monitor's view of the tunnel, exposed on Status.
+type Health struct {
+	LastProbe     time.Time `json:"lastProbe,omitempty"`
+	LatencyMs     int64     `json:"latencyMs,omitempty"`    // last successful probe
+	AvgLatencyMs  int64     `json:"avgLatencyMs,omitempty"` // moving average of successful probes
+	Failures      int       `json:"failures"`               // current consecutive failure streak
+	Probes        int       `json:"probes"`
+	TotalFailures int       `json:"totalFailures"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+const (
+	defaultProbeHost = "connectivity.cloudflareclient.com"
+	defaultProbePath = "/cdn-cgi/trace"
+)
+
+// HTTPProbe returns a ProbeFunc that fetches http://host/path through the
+// SOCKS bind and expects a 2xx status.
+func HTTPProbe(host, path string) ProbeFunc {
+	return func(ctx context.Context, bind string) error {
+		status, _, err := socks5.HTTPGetVia(ctx, bind, host, path, 512)
+		if err != nil {
+			return err
+		}
+		parts := strings.Fields(status)
+		if len(parts) < 2 || len(parts[1]) != 3 || parts[1][0] != '2' {
+			return fmt.Errorf("probe %s%s: unexpected status %q", host, path, status)
+		}
+		return nil
+	}
+}
+
+// healthConfigFrom reads health options from a connect request. Set
+// options.health=off to disable monitoring.
+func healthConfigFrom(req ConnectRequest) (HealthConfig, bool, error) {
+	var cfg HealthConfig
+	o := req.Options
+	if o["health"] == "off" {
+		return cfg, false, nil
+	}
+	if v := o["healthInterval"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, false, fmt.Errorf("invalid healthInterval: %q", v)
+		}
+		cfg.Interval = d
+	}
+	if v := o["healthThreshold"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, false, fmt.Errorf("invalid healthThreshold: %q", v)
+		}
+		cfg.FailThreshold = n
+	}
+	if v := o["probeURL"]; v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return cfg, false, errors.New("probeURL must be an http:// URL")
+		}
+		path := u.RequestURI()
+		cfg.Probe = HTTPProbe(u.Host, path)
+	}
+	return cfg, true, nil
+}
+
+func (c HealthConfig) withDefaults() HealthConfig {
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.FailThreshold <= 0 {
+		c.FailThreshold = 3
+	}
+	if c.Probe == nil {
+		c.Probe = HTTPProbe(defaultProbeHost, defaultProbePath)
+	}
+	return c
+}
+
+// healthMonitor periodically probes through the active shim bind and reports
+// each result to onResult.
+type healthMonitor struct {
+	cfg      HealthConfig
+	bind     string
+	onResult func(ok bool, streak int)
+	mu       sync.Mutex
+	h        Health
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newHealthMonitor(cfg HealthConfig, bind string, onResult func(ok bool, streak int)) *healthMonitor {
+	return &healthMonitor{cfg: cfg.withDefaults(), bind: bind, onResult: onResult, stop: make(chan struct{})}
+}
+
+func (hm *healthMonitor) start() { go hm.loop() }
+
+func (hm *healthMonitor) close() { hm.once.Do(func() { close(hm.stop) }) }
+
+func (hm *healthMonitor) snapshot() Health {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	return hm.h
+}
+
+func (hm *healthMonitor) loop() {
+	t := time.NewTicker(hm.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hm.stop:
+			return
+		case <-t.C:
+		}
+		ok, streak := hm.probe()
+		select {
+		case <-hm.stop:
+			return
+		default:
+		}
+		if hm.onResult != nil {
+			hm.onResult(ok, streak)
+		}
+	}
+}
+
+// probe runs one check and records latency and the failure streak.
+func (hm *healthMonitor) probe() (bool, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), hm.cfg.Timeout)
+	defer cancel()
+	begin := time.Now()
+	err := hm.cfg.Probe(ctx, hm.bind)
+	lat := time.Since(begin).Milliseconds()
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hm.h.LastProbe = begin
+	hm.h.Probes++
+	if err != nil {
+		hm.h.Failures++
+		hm.h.TotalFailures++
+		hm.h.LastError = err.Error()
+		return false, hm.h.Failures
+	}
+	hm.h.Failures = 0
+	hm.h.LastError = ""
+	hm.h.LatencyMs = lat
+	if hm.h.AvgLatencyMs == 0 {
+		hm.h.AvgLatencyMs = lat
+	} else {
+		hm.h.AvgLatencyMs = (hm.h.AvgLatencyMs*3 + lat) / 4
+	}
+	return true, 0
+}
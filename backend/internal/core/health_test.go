@@ -0,0 +1,155 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bulletproof/backend/internal/warpreg"
+)
+
+// fakeProvider reaches ready synchronously and reports a fixed bind.
+type fakeProvider struct {
+	name        string
+	bind        string
+	connects    atomic.Int32
+	disconnects atomic.Int32
+	options     map[string]string // of the last Connect
+	giveUp      bool              // fail each session once ready, like a supervisor giving up
+	stopCtx     context.Context   // of the last Disconnect
+}
+
+func (f *fakeProvider) Name() string { return f.name }
+func (f *fakeProvider) Connect(req ConnectRequest) error {
+	f.connects.Add(1)
+	f.options = req.Options
+	for _, ph := range []Phase{PhaseStartingShim, PhaseStartingEngine, PhaseReady} {
+		if err := req.Reporter.Transition(ph, ""); err != nil {
+			return err
+		}
+	}
+	if f.giveUp {
+		go req.Reporter.Transition(PhaseFailed, "warp-plus stopped: restart limit reached")
+	}
+	return nil
+}
+func (f *fakeProvider) Disconnect(ctx context.Context) error {
+	f.stopCtx = ctx
+	f.disconnects.Add(1)
+	return nil
+}
+func (f *fakeProvider) Status() Status { return Status{Provider: f.name, Bind: f.bind} }
+
+func TestHealth_FailoverChain(t *testing.T) {
+	a := &fakeProvider{name: "a", bind: "bad"}
+	b := &fakeProvider{name: "b", bind: "good"}
+	m := NewManager(t.TempDir(), map[string]Provider{"a": a, "b": b})
+	m.healthBase = HealthConfig{
+		Interval:      5 * time.Millisecond,
+		FailThreshold: 2,
+		Probe: func(ctx context.Context, bind string) error {
+			if bind == "bad" {
+				return errors.New("no route")
+			}
+			return nil
+		},
+	}
+	if _, err := m.Connect(context.Background(), ConnectRequest{Provider: "a", Server: "1.2.3.4", Failover: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		st := m.Status(context.Background())
+		if st.Provider == "b" && st.Phase == PhaseReady && st.Health != nil && st.Health.Probes > 0 {
+			if a.connects.Load() != 2 {
+				t.Fatalf("provider a connects=%d, want 2 (initial + endpoint reselection)", a.connects.Load())
+			}
+			_, _ = m.Disconnect(context.Background())
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("did not fail over to b: %+v", m.Status(context.Background()))
+}
+
+func TestFailed_ReselectsThenFailsOver(t *testing.T) {
+	a := &fakeProvider{name: "a", bind: "127.0.0.1:1", giveUp: true}
+	b := &fakeProvider{name: "b", bind: "127.0.0.1:2"}
+	m := NewManager(t.TempDir(), map[string]Provider{"a": a, "b": b})
+	events, cancel := m.Events().Subscribe(0)
+	defer cancel()
+	req := ConnectRequest{Provider: "a", Server: "1.2.3.4", Port: 2408, Failover: []string{"b"}, Options: map[string]string{"health": "off"}}
+	if _, err := m.Connect(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		st := m.Status(context.Background())
+		if st.Provider == "b" && st.Phase == PhaseReady {
+			if a.connects.Load() != 2 || b.connects.Load() != 1 {
+				t.Fatalf("connects a=%d b=%d, want 2 and 1", a.connects.Load(), b.connects.Load())
+			}
+			dropped := false
+			for len(events) > 0 {
+				if ev := <-events; ev.Type == EventFailover && ev.Data["droppedEndpoint"] == "1.2.3.4:2408" {
+					dropped = true
+				}
+			}
+			if !dropped {
+				t.Fatal("no failover event names the dropped endpoint")
+			}
+			_, _ = m.Disconnect(context.Background())
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("did not fail over to b: %+v", m.Status(context.Background()))
+}
+
+func TestHealth_FailoverRegistersWithoutLock(t *testing.T) {
+	registering, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registering <- struct{}{}
+		<-release
+		http.Error(w, `{"success":false}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer close(release)
+	prev := warpreg.BaseURL
+	warpreg.BaseURL = srv.URL
+	defer func() { warpreg.BaseURL = prev }()
+
+	a := &fakeProvider{name: "a", bind: "bad"}
+	w := &fakeProvider{name: "warp", bind: "good"}
+	m := NewManager(t.TempDir(), map[string]Provider{"a": a, "warp": w})
+	m.healthBase = HealthConfig{
+		Interval:      5 * time.Millisecond,
+		FailThreshold: 2,
+		Probe:         func(ctx context.Context, bind string) error { return errors.New("no route") },
+	}
+	if _, err := m.Connect(context.Background(), ConnectRequest{Provider: "a", Failover: []string{"warp"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-registering:
+	case <-time.After(2 * time.Second):
+		t.Fatal("failover to warp did not register a device")
+	}
+
+	// Registration is stuck; the session stays up and Status answers.
+	done := make(chan Status, 1)
+	go func() { done <- m.Status(context.Background()) }()
+	select {
+	case st := <-done:
+		if st.Provider != "a" || !st.Phase.Connected() {
+			t.Fatalf("status during registration = %+v", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Status blocked while the failover registered")
+	}
+	_, _ = m.Disconnect(context.Background())
+}
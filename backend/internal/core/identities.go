@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"bulletproof/backend/internal/warpreg"
+)
+
+// rotationCheck is how often the scheduler looks at the rotation schedule.
+var rotationCheck = time.Minute
+
+// usesWarpIdentity reports whether provider runs on a registered WARP device.
+func usesWarpIdentity(provider string) bool {
+	switch provider {
+	case "warp", "gool", "psiphon":
+		return true
+	}
+	return false
+}
+
+// identitySlot resolves the identity slot for a connect: the request's
+// identity option, which becomes the active slot, or else the active one.
+func (m *Manager) identitySlot(name string) (string, error) {
+	if name == "" {
+		name, _ = warpreg.Active(m.store.Dir())
+		return name, nil
+	}
+	return name, warpreg.SetActive(m.store.Dir(), name)
+}
+
+// ActiveIdentity returns the active identity slot's name and directory.
+func (m *Manager) ActiveIdentity() (name, dir string) { return warpreg.Active(m.store.Dir()) }
+
+// RotateIdentity switches the active identity slot (see warpreg.Rotate). A
+// warp-based session is reconnected on the new identity; with opts.Retire
+// the slot left is then deleted and its device unregistered. It returns the
+// slot now active. Rotations are serialised on m.rotMu; m.mu is held only
+// while the session is replaced.
+func (m *Manager) RotateIdentity(ctx context.Context, opts warpreg.RotateOptions) (string, error) {
+	m.rotMu.Lock()
+	defer m.rotMu.Unlock()
+	from, to, err := warpreg.Rotate(ctx, m.store.Dir(), opts.Fresh)
+	if err != nil {
+		return "", err
+	}
+	msg := "rotating identity from " + from + " to " + to
+	m.Emit(Event{Type: EventIdentity, Message: msg, Data: map[string]any{"from": from, "to": to, "fresh": opts.Fresh}})
+	if err := m.reconnectIdentity(ctx, to, msg); err != nil {
+		return to, fmt.Errorf("reconnect on identity %s: %w", to, err)
+	}
+	if opts.Retire && from != warpreg.DefaultSlot {
+		if err := warpreg.DeleteSlot(ctx, m.store.Dir(), from, true); err != nil {
+			return to, fmt.Errorf("retire identity %s: %w", from, err)
+		}
+	}
+	return to, nil
+}
+
+// reconnectIdentity moves an active warp-based session onto slot. The slot
+// is prepared without m.mu held; a session replaced meanwhile is left alone.
+func (m *Manager) reconnectIdentity(ctx context.Context, slot, msg string) error {
+	m.mu.RLock()
+	id, _ := m.fsm.current()
+	active, req := m.active != nil, m.lastReq
+	m.mu.RUnlock()
+	if !active || !usesWarpIdentity(req.Provider) {
+		return nil
+	}
+	opts := make(map[string]string, len(req.Options))
+	for k, v := range req.Options {
+		opts[k] = v
+	}
+	opts["identity"] = slot
+	req.Options = opts
+	req, err := m.prepareIdentity(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, _ := m.fsm.current(); cur != id || m.active == nil {
+		return nil
+	}
+	_ = m.transition(id, PhaseReconnecting, msg)
+	_, err = m.connectLocked(ctx, req, true)
+	return err
+}
+
+// startRotation runs the rotation schedule kept in identities.json. A failed
+// rotation is retried one interval later.
+func (m *Manager) startRotation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rotStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	m.rotStop = stop
+	go func() {
+		t := time.NewTicker(rotationCheck)
+		defer t.Stop()
+		var retryAt time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				s, err := warpreg.LoadSlots(m.store.Dir())
+				if err != nil || !s.RotationDue(now) || now.Before(retryAt) {
+					continue
+				}
+				if _, err := m.RotateIdentity(context.Background(), s.Schedule()); err != nil {
+					retryAt = now.Add(s.Interval())
+					m.Emit(Event{Type: EventError, Message: "scheduled identity rotation: " + err.Error()})
+				}
+			}
+		}
+	}()
+}
+
+func (m *Manager) stopRotation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rotStop != nil {
+		close(m.rotStop)
+		m.rotStop = nil
+	}
+}
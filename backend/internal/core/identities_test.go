@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"bulletproof/backend/internal/warpreg"
+)
+
+func TestRotateIdentity_ReconnectsOnNextSlot(t *testing.T) {
+	dir := t.TempDir()
+	warpreg.SaveForTest(t, dir)
+	warpreg.SaveForTest(t, warpreg.SlotDir(dir, "b"))
+	p := &fakeProvider{name: "warp", bind: "127.0.0.1:1"}
+	m := NewManager(dir, map[string]Provider{"warp": p})
+	ctx := context.Background()
+
+	// The request's identity option picks the slot and makes it active.
+	st, err := m.Connect(ctx, ConnectRequest{Provider: "warp", Options: map[string]string{"health": "off", "identity": "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Identity != "b" || p.options["identityDir"] != warpreg.SlotDir(dir, "b") {
+		t.Fatalf("identity = %q, dir = %q", st.Identity, p.options["identityDir"])
+	}
+	if name, _ := m.ActiveIdentity(); name != "b" {
+		t.Fatalf("active slot = %q", name)
+	}
+
+	events, cancel := m.Events().Subscribe(0)
+	defer cancel()
+	to, err := m.RotateIdentity(ctx, warpreg.RotateOptions{})
+	if err != nil || to != warpreg.DefaultSlot {
+		t.Fatalf("RotateIdentity = %q, %v", to, err)
+	}
+	if p.connects.Load() != 2 || p.disconnects.Load() != 1 || p.options["identityDir"] != dir {
+		t.Fatalf("connects = %d, disconnects = %d, dir = %q", p.connects.Load(), p.disconnects.Load(), p.options["identityDir"])
+	}
+	if st := m.Status(ctx); st.Phase != PhaseReady || st.Identity != warpreg.DefaultSlot {
+		t.Fatalf("status after rotation = %+v", st)
+	}
+	if ev := <-events; ev.Type != EventIdentity || ev.Data["from"] != "b" || ev.Data["to"] != warpreg.DefaultSlot {
+		t.Fatalf("first event = %+v", ev)
+	}
+
+	// Retiring the slot left deletes it; the default slot is never retired.
+	if _, err := m.RotateIdentity(ctx, warpreg.RotateOptions{Retire: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.RotateIdentity(ctx, warpreg.RotateOptions{Retire: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(warpreg.SlotDir(dir, "b")); !os.IsNotExist(err) {
+		t.Fatalf("retired slot still present: %v", err)
+	}
+	if _, err := m.RotateIdentity(ctx, warpreg.RotateOptions{}); err != warpreg.ErrNoOtherSlot {
+		t.Fatalf("rotation with one slot left = %v", err)
+	}
+}
+
+func TestRotateIdentity_RegistersWithoutLock(t *testing.T) {
+	registering, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registering <- struct{}{}
+		<-release
+		http.Error(w, `{"success":false}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	prev := warpreg.BaseURL
+	warpreg.BaseURL = srv.URL
+	defer func() { warpreg.BaseURL = prev }()
+
+	dir := t.TempDir()
+	warpreg.SaveForTest(t, dir)
+	p := &fakeProvider{name: "warp", bind: "127.0.0.1:1"}
+	m := NewManager(dir, map[string]Provider{"warp": p})
+	ctx := context.Background()
+	if _, err := m.Connect(ctx, ConnectRequest{Provider: "warp", Options: map[string]string{"health": "off"}}); err != nil {
+		t.Fatal(err)
+	}
+	rotated := make(chan error, 1)
+	go func() {
+		_, err := m.RotateIdentity(ctx, warpreg.RotateOptions{Fresh: true})
+		rotated <- err
+	}()
+	<-registering
+
+	// A fresh slot is being registered; the session stays up and Status answers.
+	done := make(chan Status, 1)
+	go func() { done <- m.Status(ctx) }()
+	select {
+	case st := <-done:
+		if st.Phase != PhaseReady || st.Identity != warpreg.DefaultSlot {
+			t.Fatalf("status during rotation = %+v", st)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Status blocked while the rotation registered")
+	}
+	close(release)
+	if err := <-rotated; err == nil {
+		t.Fatal("rotation succeeded without a registered slot")
+	}
+	if p.connects.Load() != 1 {
+		t.Fatalf("connects = %d after a failed rotation", p.connects.Load())
+	}
+}
@@ -3,9 +3,15 @@ package core
 import (
     "context"
     "errors"
+    "fmt"
+    "net"
+    "strconv"
     "sync"
-    "time"
 
+    "bulletproof/backend/internal/net/rules"
+    "bulletproof/backend/internal/net/socks5"
+    "bulletproof/backend/internal/system/procs"
+    "bulletproof/backend/internal/system/proxy"
     "bulletproof/backend/internal/warpreg"
 )
 
@@ -13,74 +19,455 @@ type Manager struct {
 	mu        sync.RWMutex
 	providers map[string]Provider
 	active    Provider
-	status    Status
 	store     *Store
+	events    *Bus
+	fsm       *machine
+	pmu       sync.Mutex // guards profiles.json
+	ports     *PortAllocator
+	rules     *rules.Table
+	apiAddr   string // daemon HTTP address, used for the PAC URL
+
+	health     *healthMonitor
+	healthBase HealthConfig   // defaults merged under per-request health options
+	lastReq    ConnectRequest // request that produced the active session
+	recovery   recoveryState
+	rotStop    chan struct{} // stops the identity rotation scheduler
+	rotMu      sync.Mutex    // serialises identity rotations
+}
+
+// recoveryState tracks automatic recovery steps since the last user connect.
+type recoveryState struct {
+	reselected bool // endpoint selection was re-run once
+	next       int  // index of the next provider in lastReq.Failover
 }
 
 func NewManager(stateDir string, providers map[string]Provider) *Manager {
-	return &Manager{providers: providers, store: NewStore(stateDir)}
+	return &Manager{
+		providers: providers,
+		store:     NewStore(stateDir),
+		events:    NewBus(),
+		fsm:       newMachine(),
+		ports:     NewPortAllocator(stateDir),
+		rules:     &rules.Table{},
+		apiAddr:   defaultAPIAddr,
+	}
+}
+
+const defaultAPIAddr = "127.0.0.1:4765"
+
+// SetAPIAddr records the address the daemon's HTTP API listens on.
+func (m *Manager) SetAPIAddr(addr string) {
+	m.mu.Lock()
+	m.apiAddr = addr
+	m.mu.Unlock()
 }
 
+// PACURL returns the URL under which the daemon serves proxy.pac.
+func (m *Manager) PACURL() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pacURLLocked()
+}
+
+func (m *Manager) pacURLLocked() string {
+	host, port, err := net.SplitHostPort(m.apiAddr)
+	if err != nil {
+		return "http://" + m.apiAddr + "/proxy.pac"
+	}
+	// A wildcard listen address is not something clients can fetch from.
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = loopback
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/proxy.pac"
+}
+
+// ClientBind returns the session's SOCKS bind for the daemon's own clients,
+// with the primary shim credentials attached when auth is enabled. It is ""
+// when not connected and must not be exposed, as it may carry a password.
+func (m *Manager) ClientBind() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.active == nil {
+		return ""
+	}
+	return clientBind(m.lastReq, m.active.Status().Bind)
+}
+
+func clientBind(req ConnectRequest, bind string) string {
+	if bind == "" {
+		return ""
+	}
+	return socks5.WithAuth(bind, req.Options["socksUser"], req.Options["socksPass"])
+}
+
+// Ports returns the allocator that hands out local listen addresses.
+func (m *Manager) Ports() *PortAllocator { return m.ports }
+
+// Init kills helpers orphaned by a previous run, loads routing rules and
+// restores the autoconnect profile in the background so daemon startup is
+// not blocked by registration or engine warm-up. It also starts the identity
+// rotation scheduler. Broken rule files are reported as events and leave
+// routing at the default.
 func (m *Manager) Init(ctx context.Context) error {
+	killed, err := procs.Reap(procs.Dir(m.store.Dir()))
+	for _, r := range killed {
+		m.Emit(Event{Type: EventEngineExit, Message: fmt.Sprintf("killed orphaned %s (pid %d) left by a previous run", r.Name, r.PID), Data: map[string]any{"pid": r.PID, "orphan": true}})
+	}
+	if err != nil {
+		m.Emit(Event{Type: EventError, Message: "orphaned helpers: " + err.Error()})
+	}
+	_ = m.ReloadRules()
+	// A snapshot still on disk means the daemon died with the system proxy
+	// pointing at it; put the user's settings back before anything else.
+	if restored, err := proxy.Recover(ctx, m.store.Dir()); err != nil {
+		m.Emit(Event{Type: EventError, Message: "system proxy: " + err.Error()})
+	} else if restored {
+		m.Emit(Event{Type: EventIntegration, Message: "restored system proxy settings left by an unclean shutdown", Data: map[string]any{"enabled": false}})
+	}
+	go m.restoreSession(context.Background())
+	m.startRotation()
 	return nil
 }
 
 func (m *Manager) Connect(ctx context.Context, req ConnectRequest) (Status, error) {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-
-    p, ok := m.providers[req.Provider]
-    if !ok {
-        return Status{}, errors.New("unknown provider")
-    }
-    if req.Options == nil { req.Options = map[string]string{} }
-    req.Options["stateDir"] = m.store.Dir()
-    // Ensure WARP identity exists for warp-based providers.
-    switch req.Provider {
-    case "warp", "gool", "psiphon":
-        if _, err := warpreg.EnsureIdentity(ctx, m.store.Dir()); err != nil {
-            m.status = Status{Connected: false, Provider: req.Provider, Message: "registration failed: " + err.Error()}
-            return m.status, err
-        }
-    }
+	if req.Profile != "" {
+		var err error
+		if req, err = m.withProfile(req); err != nil {
+			return Status{}, err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range req.Failover {
+		if _, ok := m.providers[name]; !ok {
+			return Status{}, fmt.Errorf("unknown failover provider: %s", name)
+		}
+	}
+	m.recovery = recoveryState{}
+	st, err := m.connectLocked(ctx, req, false)
+	if err == nil && req.Profile != "" {
+		_ = m.markUsed(req.Profile)
+	}
+	return st, err
+}
+
+// connectLocked replaces any active session with a new one for req. With
+// prepared set, req already went through prepareIdentity. Caller must hold
+// m.mu.
+func (m *Manager) connectLocked(ctx context.Context, req ConnectRequest, prepared bool) (Status, error) {
+	p, ok := m.providers[req.Provider]
+	if !ok {
+		return Status{}, errors.New("unknown provider")
+	}
+	hcfg, monitor, err := healthConfigFrom(req)
+	if err != nil {
+		return Status{}, err
+	}
 	if m.active != nil {
-		_ = m.active.Disconnect()
+		m.teardown(ctx)
+	}
+	m.ports.ReleaseAll()
+	sess := m.begin(req.Provider)
+	if req.Options == nil { req.Options = map[string]string{} }
+	req.Options["stateDir"] = m.store.Dir()
+	req.Options["pacURL"] = m.pacURLLocked()
+	req.Reporter = sess
+	req.Ports = m.ports
+	req.Rules = m.rules
+	// Ensure WARP identity exists for warp-based providers.
+	if usesWarpIdentity(req.Provider) && !prepared {
+		_ = sess.Transition(PhaseRegistering, "ensuring WARP identity")
+		if req, err = m.prepareIdentity(ctx, req); err != nil {
+			_ = sess.Transition(PhaseFailed, err.Error())
+			return m.statusLocked(), err
+		}
 	}
 	if err := p.Connect(req); err != nil {
-		m.status = Status{Connected: false, Provider: req.Provider, Message: err.Error()}
-		return m.status, err
+		// Keep the provider's own failure message if it already reported one.
+		if _, ph := m.fsm.current(); ph != PhaseFailed {
+			_ = sess.Transition(PhaseFailed, err.Error())
+		}
+		return m.statusLocked(), err
 	}
 	m.active = p
-	st := p.Status()
-	st.Connected = true
-	st.Since = time.Now()
-	m.status = st
-	return m.status, nil
+	m.lastReq = req
+	if monitor {
+		m.startHealth(sess.id, hcfg, clientBind(req, p.Status().Bind))
+	}
+	return m.statusLocked(), nil
+}
+
+// prepareIdentity resolves the identity slot for a warp-based req, registers
+// a device in it if there is none yet, binds the request's WARP+ key and
+// hands the device to warp-plus (see warpreg.WriteWarpPlus). It returns req
+// with its own copy of Options naming the slot. Registration talks to the
+// API, so recovery and rotation call it without m.mu held.
+func (m *Manager) prepareIdentity(ctx context.Context, req ConnectRequest) (ConnectRequest, error) {
+	if !usesWarpIdentity(req.Provider) {
+		return req, nil
+	}
+	opts := make(map[string]string, len(req.Options)+2)
+	for k, v := range req.Options {
+		opts[k] = v
+	}
+	req.Options = opts
+	slot, err := m.identitySlot(opts["identity"])
+	if err != nil {
+		return req, err
+	}
+	dir := warpreg.SlotDir(m.store.Dir(), slot)
+	opts["identity"], opts["identityDir"] = slot, dir
+	id, err := warpreg.EnsureIdentity(ctx, dir)
+	if err != nil {
+		return req, fmt.Errorf("registration failed: %w", err)
+	}
+	// Bind a new WARP+ key to the device, which warp-plus then runs as.
+	if key := opts["key"]; key != "" && key != id.License {
+		if _, err := warpreg.SetLicense(ctx, dir, key); err != nil {
+			m.Emit(Event{Type: EventError, Provider: req.Provider, Message: "license: " + err.Error()})
+		}
+	}
+	if err := warpreg.WriteWarpPlus(ctx, dir); err != nil {
+		m.Emit(Event{Type: EventError, Provider: req.Provider, Message: "warp-plus identity: " + err.Error()})
+	}
+	return req, nil
 }
 
 func (m *Manager) Disconnect(ctx context.Context) (Status, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.active == nil {
-		m.status = Status{}
-		return m.status, nil
+		// Clear a failed session so the UI returns to idle.
+		if id, ph := m.fsm.current(); ph != PhaseIdle {
+			_ = m.transition(id, PhaseIdle, "")
+		}
+		return m.statusLocked(), nil
+	}
+	m.teardown(ctx)
+	return m.statusLocked(), nil
+}
+
+// teardown disconnects the active provider, walking the phase through
+// disconnecting to idle; helpers still running when ctx ends are killed.
+// Caller must hold m.mu.
+func (m *Manager) teardown(ctx context.Context) {
+	id, _ := m.fsm.current()
+	if m.health != nil {
+		m.health.close()
+		m.health = nil
 	}
-	_ = m.active.Disconnect()
+	_ = m.transition(id, PhaseDisconnecting, "disconnecting")
+	_ = m.active.Disconnect(ctx)
 	m.active = nil
-	m.status = Status{}
-	return m.status, nil
+	m.ports.ReleaseAll()
+	_ = m.transition(id, PhaseIdle, "")
 }
 
 func (m *Manager) Status(ctx context.Context) Status {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.statusLocked()
+}
+
+// statusLocked merges the active provider's status with the phase machine.
+// Caller must hold m.mu.
+func (m *Manager) statusLocked() Status {
+	var st Status
 	if m.active != nil {
-		return m.active.Status()
+		st = m.active.Status()
+		st.Identity = m.lastReq.Options["identity"]
+	}
+	if m.health != nil {
+		h := m.health.snapshot()
+		st.Health = &h
+	}
+	m.fsm.apply(&st)
+	return st
+}
+
+// startHealth begins probing the session's bind. Caller must hold m.mu.
+func (m *Manager) startHealth(id uint64, cfg HealthConfig, bind string) {
+	if bind == "" {
+		return
+	}
+	base := m.healthBase
+	if cfg.Interval > 0 {
+		base.Interval = cfg.Interval
+	}
+	if cfg.FailThreshold > 0 {
+		base.FailThreshold = cfg.FailThreshold
+	}
+	if cfg.Probe != nil {
+		base.Probe = cfg.Probe
+	}
+	var hm *healthMonitor
+	hm = newHealthMonitor(base, bind, func(ok bool, streak int) { m.onHealth(id, hm, ok, streak) })
+	m.health = hm
+	hm.start()
+}
+
+// onHealth reacts to a probe result: failures past the threshold degrade a
+// ready session and trigger recovery; a success restores a degraded one.
+// Probes are ignored while the session is not ready or degraded.
+func (m *Manager) onHealth(id uint64, hm *healthMonitor, ok bool, streak int) {
+	cur, ph := m.fsm.current()
+	if cur != id || !ph.Connected() {
+		return
+	}
+	if ok {
+		if ph == PhaseDegraded {
+			_ = m.transition(id, PhaseReady, "tunnel recovered")
+		}
+		return
+	}
+	if streak < hm.cfg.FailThreshold {
+		return
+	}
+	if ph == PhaseReady {
+		_ = m.transition(id, PhaseDegraded, fmt.Sprintf("tunnel degraded: %d failed probes (%s)", streak, hm.snapshot().LastError))
+	}
+	// Act once per threshold crossing; keep probing afterwards.
+	if streak == hm.cfg.FailThreshold {
+		go m.recover(id)
+	}
+}
+
+// recover first re-runs endpoint selection for the current provider, then
+// walks the request's failover chain, one step per unhealthy or failed
+// episode. The next provider's identity is prepared without m.mu held; the
+// step is dropped if the session changed meanwhile.
+func (m *Manager) recover(id uint64) {
+	m.mu.Lock()
+	if cur, _ := m.fsm.current(); cur != id || m.active == nil {
+		m.mu.Unlock()
+		return
+	}
+	req := m.lastReq
+	var msg string
+	var data map[string]any
+	switch {
+	case !m.recovery.reselected:
+		m.recovery.reselected = true
+		msg = "re-running endpoint selection for " + req.Provider
+		if req.Server != "" {
+			// The pinned endpoint is what failed; say that it is dropped.
+			pinned := req.Server
+			if req.Port > 0 {
+				pinned = net.JoinHostPort(req.Server, strconv.Itoa(req.Port))
+			}
+			msg += " (dropping pinned endpoint " + pinned + ")"
+			data = map[string]any{"droppedEndpoint": pinned}
+		}
+		req.Server, req.Port = "", 0
+	case m.recovery.next < len(req.Failover):
+		from := req.Provider
+		req.Provider = req.Failover[m.recovery.next]
+		m.recovery.next++
+		msg = "failing over from " + from + " to " + req.Provider
+	default:
+		m.Emit(Event{Type: EventError, Provider: req.Provider, Message: "tunnel unhealthy or failed and no failover left"})
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	ctx := context.Background()
+	req, err := m.prepareIdentity(ctx, req)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, _ := m.fsm.current(); cur != id || m.active == nil {
+		return
+	}
+	if err != nil {
+		m.Emit(Event{Type: EventError, Provider: req.Provider, Message: "recovery failed: " + err.Error()})
+		return
+	}
+	_ = m.transition(id, PhaseReconnecting, msg)
+	m.Emit(Event{Type: EventFailover, Provider: req.Provider, Message: msg, Data: data})
+	if _, err := m.connectLocked(ctx, req, true); err != nil {
+		m.Emit(Event{Type: EventError, Provider: req.Provider, Message: "recovery failed: " + err.Error()})
 	}
-	return m.status
 }
 
-func (m *Manager) Close(ctx context.Context) error { return nil }
+// Close stops identity rotation and tears down the active session, stopping
+// its helpers and restoring the system proxy, so nothing outlives the daemon.
+// Helpers still running when ctx ends are killed.
+func (m *Manager) Close(ctx context.Context) error {
+	m.stopRotation()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		m.teardown(ctx)
+	}
+	return nil
+}
+
+// begin starts a new phase-machine session and returns the reporter that
+// providers use for it.
+func (m *Manager) begin(provider string) *session {
+	return &session{m: m, id: m.fsm.begin(provider), provider: provider}
+}
+
+// transition applies a phase change for session id and publishes it.
+func (m *Manager) transition(id uint64, to Phase, msg string) error {
+	from, err := m.fsm.transition(id, to, msg)
+	if err != nil {
+		if !errors.Is(err, ErrStaleSession) {
+			m.Emit(Event{Type: EventError, Message: err.Error(), Data: map[string]any{"from": from, "to": to}})
+		}
+		return err
+	}
+	m.Emit(Event{Type: EventPhase, Provider: m.fsm.providerName(), Message: msg, Data: map[string]any{"from": from, "to": to, "connected": to.Connected()}})
+	// A session that fails once up (the engine race or its restarts gave up)
+	// is recovered like an unhealthy one. recover skips sessions whose
+	// Connect failed, as they never became active.
+	if to == PhaseFailed && from != PhaseFailed {
+		go m.recover(id)
+	}
+	return nil
+}
+
+// transitionFrom is transition for a session in one of the phases from; a
+// session in another phase is left alone without an error event.
+func (m *Manager) transitionFrom(id uint64, from []Phase, to Phase, msg string) bool {
+	prev, ok, err := m.fsm.transitionFrom(id, from, to, msg)
+	if err != nil && !errors.Is(err, ErrStaleSession) {
+		m.Emit(Event{Type: EventError, Message: err.Error(), Data: map[string]any{"from": prev, "to": to}})
+	}
+	if !ok {
+		return false
+	}
+	m.Emit(Event{Type: EventPhase, Provider: m.fsm.providerName(), Message: msg, Data: map[string]any{"from": prev, "to": to, "connected": to.Connected()}})
+	return true
+}
+
+// session is the Reporter handed to a provider for one Connect call. Phase
+// changes from a superseded session are ignored.
+type session struct {
+	m        *Manager
+	id       uint64
+	provider string
+}
+
+func (s *session) Emit(ev Event) {
+	if ev.Provider == "" { ev.Provider = s.provider }
+	s.m.Emit(ev)
+}
+
+func (s *session) Transition(to Phase, msg string) error { return s.m.transition(s.id, to, msg) }
+
+func (s *session) TransitionFrom(from []Phase, to Phase, msg string) bool {
+	return s.m.transitionFrom(s.id, from, to, msg)
+}
+
+// Emit publishes a lifecycle event on the manager's bus. It is safe to call
+// from provider goroutines.
+func (m *Manager) Emit(ev Event) { m.events.Publish(ev) }
+
+// Events returns the manager's event bus for streaming subscribers.
+func (m *Manager) Events() *Bus { return m.events }
 
 // StateDir returns the manager's state directory path.
 func (m *Manager) StateDir() string { return m.store.Dir() }
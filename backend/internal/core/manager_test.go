@@ -0,0 +1,34 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClose_TearsDownSession(t *testing.T) {
+	p := &fakeProvider{name: "a", bind: "127.0.0.1:1"}
+	m := NewManager(t.TempDir(), map[string]Provider{"a": p})
+	if _, err := m.Connect(context.Background(), ConnectRequest{Provider: "a", Options: map[string]string{"health": "off"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := m.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.disconnects.Load(); n != 1 {
+		t.Fatalf("disconnects = %d, want 1", n)
+	}
+	if want, _ := ctx.Deadline(); p.stopCtx == nil {
+		t.Fatal("Disconnect got no context")
+	} else if got, ok := p.stopCtx.Deadline(); !ok || !got.Equal(want) {
+		t.Fatalf("Disconnect deadline = %v, %v; want Close's %v", got, ok, want)
+	}
+	if st := m.Status(context.Background()); st.Phase != PhaseIdle || st.Provider != "" {
+		t.Fatalf("status after Close = %+v", st)
+	}
+	if err := m.Close(context.Background()); err != nil || p.disconnects.Load() != 1 {
+		t.Fatalf("second Close: err = %v, disconnects = %d", err, p.disconnects.Load())
+	}
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"context"
+	"os"
+
+	"bulletproof/backend/internal/net/pac"
+)
+
+const pacFile = "pac.json"
+
+// PACSettings returns the persisted PAC preferences (defaults when unset).
+func (m *Manager) PACSettings() (pac.Settings, error) {
+	var s pac.Settings
+	if err := m.store.read(pacFile, &s); err != nil && !os.IsNotExist(err) {
+		return pac.Settings{}, err
+	}
+	return s, nil
+}
+
+// SavePACSettings validates and persists s. The served PAC file changes
+// version, so clients that poll it pick the new settings up.
+func (m *Manager) SavePACSettings(s pac.Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	return m.store.write(pacFile, s)
+}
+
+// PAC generates the PAC file for the current session. bind overrides the
+// session's SOCKS bind when non-empty.
+func (m *Manager) PAC(ctx context.Context, bind string) (pac.File, error) {
+	s, err := m.PACSettings()
+	if err != nil {
+		return pac.File{}, err
+	}
+	st := m.Status(ctx)
+	in := pac.Input{Settings: s, Bind: st.Bind, HTTPBind: st.HTTPBind, Rules: m.rules.Snapshot().RuleSet}
+	if bind != "" {
+		in.Bind, in.HTTPBind = bind, ""
+	}
+	return pac.Generate(in), nil
+}
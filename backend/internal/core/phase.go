@@ -0,0 +1,171 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Phase is a step of the connection lifecycle tracked by the Manager.
+type Phase string
+
+const (
+	PhaseIdle           Phase = "idle"
+	PhaseRegistering    Phase = "registering"
+	PhaseStartingShim   Phase = "starting-shim"
+	PhaseStartingEngine Phase = "starting-engine"
+	PhaseHandshaking    Phase = "handshaking"
+	PhaseReady          Phase = "ready"
+	PhaseDegraded       Phase = "degraded"
+	PhaseReconnecting   Phase = "reconnecting"
+	PhaseDisconnecting  Phase = "disconnecting"
+	PhaseFailed         Phase = "failed"
+)
+
+// transitions lists the legal next phases for each phase. Staying in the same
+// phase is always allowed and only refreshes the status message.
+var transitions = map[Phase][]Phase{
+	PhaseIdle:           {PhaseRegistering, PhaseStartingShim, PhaseFailed},
+	PhaseRegistering:    {PhaseStartingShim, PhaseFailed, PhaseDisconnecting},
+	PhaseStartingShim:   {PhaseStartingEngine, PhaseFailed, PhaseDisconnecting},
+	PhaseStartingEngine: {PhaseHandshaking, PhaseReady, PhaseReconnecting, PhaseFailed, PhaseDisconnecting},
+	PhaseHandshaking:    {PhaseStartingEngine, PhaseReady, PhaseReconnecting, PhaseFailed, PhaseDisconnecting},
+	PhaseReady:          {PhaseDegraded, PhaseReconnecting, PhaseFailed, PhaseDisconnecting},
+	PhaseDegraded:       {PhaseReady, PhaseReconnecting, PhaseFailed, PhaseDisconnecting},
+	PhaseReconnecting:   {PhaseStartingEngine, PhaseHandshaking, PhaseReady, PhaseFailed, PhaseDisconnecting},
+	PhaseDisconnecting:  {PhaseIdle, PhaseFailed},
+	PhaseFailed:         {PhaseIdle, PhaseRegistering, PhaseStartingShim, PhaseReconnecting, PhaseDisconnecting},
+}
+
+var (
+	// ErrIllegalTransition is returned when a phase change is not permitted.
+	ErrIllegalTransition = errors.New("illegal phase transition")
+	// ErrStaleSession is returned when a provider goroutine from a previous
+	// connect attempts to change the phase of the current session.
+	ErrStaleSession = errors.New("stale session")
+)
+
+// CanTransition reports whether moving from one phase to another is legal.
+func CanTransition(from, to Phase) bool {
+	if from == to {
+		return true
+	}
+	for _, p := range transitions[from] {
+		if p == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Connected reports whether traffic is expected to flow in this phase.
+func (p Phase) Connected() bool { return p == PhaseReady || p == PhaseDegraded }
+
+// machine holds the current phase and its timestamps for one Manager.
+// It has its own lock so providers can report from goroutines while the
+// Manager holds its main lock during Connect/Disconnect.
+type machine struct {
+	mu          sync.Mutex
+	session     uint64
+	provider    string
+	phase       Phase
+	message     string
+	phaseSince  time.Time
+	connectedAt time.Time
+	updatedAt   time.Time
+}
+
+func newMachine() *machine {
+	now := time.Now()
+	return &machine{phase: PhaseIdle, phaseSince: now, updatedAt: now}
+}
+
+// begin starts a new session for provider and returns its id. Transitions
+// reported under older ids are rejected with ErrStaleSession.
+func (m *machine) begin(provider string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.session++
+	m.provider = provider
+	return m.session
+}
+
+// transition moves session id to phase to and returns the previous phase.
+func (m *machine) transition(id uint64, to Phase, msg string) (Phase, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.transitionLocked(id, to, msg)
+}
+
+// transitionFrom is transition for a session that is in one of the phases
+// from; ok is false, and nothing changes, if it is in another.
+func (m *machine) transitionFrom(id uint64, from []Phase, to Phase, msg string) (prev Phase, ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id != m.session {
+		return m.phase, false, ErrStaleSession
+	}
+	for _, p := range from {
+		if p == m.phase {
+			prev, err = m.transitionLocked(id, to, msg)
+			return prev, err == nil, err
+		}
+	}
+	return m.phase, false, nil
+}
+
+func (m *machine) transitionLocked(id uint64, to Phase, msg string) (Phase, error) {
+	from := m.phase
+	if id != m.session {
+		return from, ErrStaleSession
+	}
+	if !CanTransition(from, to) {
+		return from, fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, from, to)
+	}
+	now := time.Now()
+	if from != to {
+		m.phaseSince = now
+	}
+	if to.Connected() && !from.Connected() && m.connectedAt.IsZero() {
+		m.connectedAt = now
+	}
+	if to == PhaseIdle || to == PhaseFailed {
+		m.connectedAt = time.Time{}
+	}
+	m.phase = to
+	m.message = msg
+	m.updatedAt = now
+	return from, nil
+}
+
+// current returns the active session id and phase.
+func (m *machine) current() (uint64, Phase) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session, m.phase
+}
+
+// providerName returns the provider of the active session.
+func (m *machine) providerName() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.provider
+}
+
+// apply overlays the machine state onto a provider-reported status.
+func (m *machine) apply(st *Status) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st.Phase = m.phase
+	st.PhaseSince = m.phaseSince
+	st.UpdatedAt = m.updatedAt
+	st.Connected = m.phase.Connected()
+	st.Since = m.connectedAt
+	if m.message != "" {
+		st.Message = m.message
+	}
+	if st.Provider == "" && m.phase != PhaseIdle {
+		st.Provider = m.provider
+	}
+}
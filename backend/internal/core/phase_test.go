@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMachine_Transitions(t *testing.T) {
+	m := newMachine()
+	id := m.begin("warp")
+	steps := []Phase{PhaseRegistering, PhaseStartingShim, PhaseStartingEngine, PhaseHandshaking, PhaseReady, PhaseDegraded, PhaseReady, PhaseDisconnecting, PhaseIdle}
+	for _, to := range steps {
+		if _, err := m.transition(id, to, ""); err != nil {
+			t.Fatalf("transition to %s: %v", to, err)
+		}
+	}
+	if _, err := m.transition(id, PhaseReady, ""); !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("idle -> ready: want ErrIllegalTransition, got %v", err)
+	}
+}
+
+func TestMachine_ConnectedAndStale(t *testing.T) {
+	m := newMachine()
+	old := m.begin("warp")
+	_, _ = m.transition(old, PhaseStartingShim, "")
+	id := m.begin("gool")
+	if _, err := m.transition(old, PhaseStartingEngine, ""); !errors.Is(err, ErrStaleSession) {
+		t.Fatalf("want ErrStaleSession, got %v", err)
+	}
+	var st Status
+	m.apply(&st)
+	if st.Connected || st.Phase != PhaseStartingShim {
+		t.Fatalf("unexpected status before ready: %+v", st)
+	}
+	for _, to := range []Phase{PhaseStartingEngine, PhaseReady} {
+		if _, err := m.transition(id, to, "ok"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.apply(&st)
+	if !st.Connected || st.Since.IsZero() || st.Provider != "gool" || st.Message != "ok" {
+		t.Fatalf("unexpected status when ready: %+v", st)
+	}
+}
+
+func TestReporter_TransitionFromLeavesOtherPhases(t *testing.T) {
+	m := NewManager(t.TempDir(), nil)
+	events, cancel := m.Events().Subscribe(0)
+	defer cancel()
+	s := m.begin("warp")
+	waiting := []Phase{PhaseStartingEngine, PhaseReconnecting, PhaseHandshaking}
+	for _, to := range []Phase{PhaseStartingShim, PhaseStartingEngine} {
+		if err := s.Transition(to, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.TransitionFrom(waiting, PhaseHandshaking, "handshake") {
+		t.Fatal("starting-engine -> handshaking refused")
+	}
+	for _, ph := range []Phase{PhaseReady, PhaseDegraded, PhaseFailed} {
+		if err := s.Transition(ph, ""); err != nil {
+			t.Fatal(err)
+		}
+		if s.TransitionFrom(waiting, PhaseHandshaking, "rekey") {
+			t.Fatalf("%s -> handshaking applied", ph)
+		}
+		if _, cur := m.fsm.current(); cur != ph {
+			t.Fatalf("phase = %s, want %s", cur, ph)
+		}
+	}
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == EventError {
+			t.Fatalf("error event: %s", ev.Message)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	bindFile = "socks-bind.json"
+	loopback = "127.0.0.1"
+
+	// Client-facing SOCKS ports tried in order before falling back to any free port.
+	publicPortFirst = 8087
+	publicPortLast  = 8099
+
+	// Same for the optional HTTP proxy listener.
+	httpPortFirst = 8100
+	httpPortLast  = 8110
+)
+
+// ErrBindUnavailable is returned when an explicitly requested bind is in use.
+var ErrBindUnavailable = errors.New("requested bind is not available")
+
+// PortAllocator hands out free local ports for the client-facing SOCKS bind
+// and for engine-internal listeners, so nothing depends on fixed ports and
+// two daemons, or another program holding a port, do not collide.
+type PortAllocator struct {
+	mu     sync.Mutex
+	store  *Store
+	held   map[string]string // addr -> purpose
+	listen func(addr string) bool
+}
+
+// NewPortAllocator returns an allocator that persists the public bind in dir.
+func NewPortAllocator(dir string) *PortAllocator {
+	return &PortAllocator{store: NewStore(dir), held: map[string]string{}, listen: canListen}
+}
+
+func canListen(addr string) bool {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	_ = ln.Close()
+	return true
+}
+
+// Public picks the client-facing SOCKS bind: requested if set, failing with
+// ErrBindUnavailable if it is taken; otherwise the last persisted bind, else
+// the first free port in 8087-8099, else any free loopback port. The choice
+// is persisted for the next run.
+func (a *PortAllocator) Public(requested string) (string, error) {
+	return a.public("bind", "public", requested, publicPortFirst, publicPortLast)
+}
+
+// HTTP picks the HTTP proxy bind like Public, from ports 8100-8110.
+func (a *PortAllocator) HTTP(requested string) (string, error) {
+	return a.public("http", "http", requested, httpPortFirst, httpPortLast)
+}
+
+// public picks a persisted client-facing bind stored under key in bindFile.
+func (a *PortAllocator) public(key, purpose, requested string, first, last int) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	saved := map[string]string{}
+	_ = a.store.read(bindFile, &saved)
+	var addr string
+	if requested != "" {
+		// The user asked for this port; handing out another would go unnoticed.
+		if _, ok := a.held[requested]; ok || !a.listen(requested) {
+			return "", fmt.Errorf("%w: %s", ErrBindUnavailable, requested)
+		}
+		addr = requested
+	} else {
+		cands := []string{saved[key]}
+		for p := first; p <= last; p++ {
+			cands = append(cands, net.JoinHostPort(loopback, strconv.Itoa(p)))
+		}
+		var err error
+		if addr, err = a.pickLocked(cands, loopback); err != nil {
+			return "", err
+		}
+	}
+	a.held[addr] = purpose
+	if saved == nil {
+		saved = map[string]string{}
+	}
+	saved[key] = addr
+	_ = a.store.write(bindFile, saved)
+	return addr, nil
+}
+
+// Internal returns a port for an engine listener: preferred if set, failing
+// with ErrBindUnavailable if it is taken, else any free loopback port. The
+// port is held until released.
+func (a *PortAllocator) Internal(preferred string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	addr := preferred
+	if preferred != "" {
+		// Pinned for a build that ignores --bind; another port would not be used.
+		if _, ok := a.held[preferred]; ok || !a.listen(preferred) {
+			return "", fmt.Errorf("%w: %s", ErrBindUnavailable, preferred)
+		}
+	} else {
+		var err error
+		if addr, err = a.pickLocked(nil, loopback); err != nil {
+			return "", err
+		}
+	}
+	a.held[addr] = "engine"
+	return addr, nil
+}
+
+// pickLocked returns the first candidate that is free and not already handed
+// out, or an ephemeral port on host. Caller must hold a.mu.
+func (a *PortAllocator) pickLocked(cands []string, host string) (string, error) {
+	for _, c := range cands {
+		if c == "" {
+			continue
+		}
+		if _, ok := a.held[c]; ok {
+			continue
+		}
+		if a.listen(c) {
+			return c, nil
+		}
+	}
+	for i := 0; i < 8; i++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return "", err
+		}
+		addr := ln.Addr().String()
+		_ = ln.Close()
+		if _, ok := a.held[addr]; !ok {
+			return addr, nil
+		}
+	}
+	return "", errors.New("no free local port")
+}
+
+// Release returns addr to the pool.
+func (a *PortAllocator) Release(addr string) {
+	a.mu.Lock()
+	delete(a.held, addr)
+	a.mu.Unlock()
+}
+
+// ReleaseAll forgets every held port, e.g. when a session ends.
+func (a *PortAllocator) ReleaseAll() {
+	a.mu.Lock()
+	a.held = map[string]string{}
+	a.mu.Unlock()
+}
+
+// Held returns the ports currently handed out, keyed by address.
+func (a *PortAllocator) Held() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]string, len(a.held))
+	for k, v := range a.held {
+		out[k] = v
+	}
+	return out
+}
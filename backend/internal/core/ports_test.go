@@ -0,0 +1,110 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPortAllocator_PublicPersistsAndSkipsBusy(t *testing.T) {
+	dir := t.TempDir()
+	a := NewPortAllocator(dir)
+	busy := map[string]bool{"127.0.0.1:8087": true}
+	a.listen = func(addr string) bool { return !busy[addr] }
+
+	got, err := a.Public("")
+	if err != nil || got != "127.0.0.1:8088" {
+		t.Fatalf("Public() = %q, %v; want 127.0.0.1:8088", got, err)
+	}
+	// A fresh allocator prefers the persisted bind over the range.
+	b := NewPortAllocator(dir)
+	b.listen = a.listen
+	if got, _ := b.Public(""); got != "127.0.0.1:8088" {
+		t.Fatalf("persisted bind not reused: %q", got)
+	}
+	// An explicit request wins when free, and is refused when not.
+	if got, _ := b.Public("127.0.0.1:9999"); got != "127.0.0.1:9999" {
+		t.Fatalf("requested bind not used: %q", got)
+	}
+	busy["127.0.0.1:9998"] = true
+	if got, err := b.Public("127.0.0.1:9998"); !errors.Is(err, ErrBindUnavailable) {
+		t.Fatalf("busy requested bind: %q, %v; want ErrBindUnavailable", got, err)
+	}
+	// So is one already handed out, e.g. the SOCKS bind asked for as the HTTP bind.
+	if got, err := b.HTTP("127.0.0.1:9999"); !errors.Is(err, ErrBindUnavailable) {
+		t.Fatalf("held requested bind: %q, %v; want ErrBindUnavailable", got, err)
+	}
+	// A persisted bind that is taken is still replaced silently.
+	busy["127.0.0.1:9999"] = true
+	c := NewPortAllocator(dir)
+	c.listen = a.listen
+	if got, err := c.Public(""); err != nil || got != "127.0.0.1:8088" {
+		t.Fatalf("Public() with busy persisted bind = %q, %v; want 127.0.0.1:8088", got, err)
+	}
+}
+
+func TestPortAllocator_HTTPKeepsSocksBind(t *testing.T) {
+	dir := t.TempDir()
+	a := NewPortAllocator(dir)
+	a.listen = func(string) bool { return true }
+	socks, _ := a.Public("")
+	if got, err := a.HTTP(""); err != nil || got != "127.0.0.1:8100" {
+		t.Fatalf("HTTP() = %q, %v; want 127.0.0.1:8100", got, err)
+	}
+	b := NewPortAllocator(dir)
+	b.listen = a.listen
+	if got, _ := b.Public(""); got != socks {
+		t.Fatalf("socks bind lost after HTTP allocation: %q, want %q", got, socks)
+	}
+	if got, _ := b.HTTP("127.0.0.1:3128"); got != "127.0.0.1:3128" {
+		t.Fatalf("requested HTTP bind not used: %q", got)
+	}
+}
+
+func TestPortAllocator_InternalDistinct(t *testing.T) {
+	a := NewPortAllocator(t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	taken := ln.Addr().String()
+
+	// A pinned engine bind is never swapped for another port.
+	if x, err := a.Internal(taken); !errors.Is(err, ErrBindUnavailable) {
+		t.Fatalf("Internal(%s) = %q, %v; want ErrBindUnavailable", taken, x, err)
+	}
+	x, err := a.Internal("")
+	if err != nil || x == taken {
+		t.Fatalf("Internal() = %q, %v; want a free port", x, err)
+	}
+	if y, err := a.Internal(x); !errors.Is(err, ErrBindUnavailable) {
+		t.Fatalf("held port handed out twice: %q, %v", y, err)
+	}
+	y, _ := a.Internal("")
+	if y == x {
+		t.Fatalf("held port handed out twice: %s", y)
+	}
+	if h := a.Held(); h[x] != "engine" || h[y] != "engine" {
+		t.Fatalf("held = %v", h)
+	}
+	a.Release(x)
+	if z, _ := a.Internal(x); z != x {
+		t.Fatalf("released port should be reusable, got %s", z)
+	}
+	a.ReleaseAll()
+	if len(a.Held()) != 0 {
+		t.Fatalf("ReleaseAll left %v", a.Held())
+	}
+}
+
+func TestManager_PACURL(t *testing.T) {
+	m := NewManager(t.TempDir(), nil)
+	if got := m.PACURL(); got != "http://127.0.0.1:4765/proxy.pac" {
+		t.Fatalf("default PAC URL = %s", got)
+	}
+	m.SetAPIAddr("0.0.0.0:5000")
+	if got := m.PACURL(); got != "http://127.0.0.1:5000/proxy.pac" {
+		t.Fatalf("PAC URL = %s", got)
+	}
+}
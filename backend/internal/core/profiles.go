@@ -0,0 +1,329 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile is a named, persisted set of connect parameters.
+type Profile struct {
+	Name        string            `json:"name"`
+	Provider    string            `json:"provider"`
+	ExitCountry string            `json:"exitCountry,omitempty"`
+	Server      string            `json:"server,omitempty"` // endpoint host/IP
+	Port        int               `json:"port,omitempty"`
+	Integration string            `json:"integration,omitempty"` // direct | pac | manual | tun
+	DNS         string            `json:"dns,omitempty"`
+	Bind        string            `json:"bind,omitempty"`
+	KeyRef      string            `json:"keyRef,omitempty"` // "env:NAME", "file:<path in the state dir>" or an entry in keys.json
+	Failover    []string          `json:"failover,omitempty"`
+	Options     map[string]string `json:"options,omitempty"` // extra connect options; socksPassRef is resolved like KeyRef
+	Autoconnect bool              `json:"autoconnect,omitempty"`
+	LastUsed    time.Time         `json:"lastUsed,omitempty"`
+}
+
+// ErrProfileNotFound is returned when a named profile does not exist.
+var ErrProfileNotFound = errors.New("profile not found")
+
+const (
+	profilesFile = "profiles.json"
+	keysFile     = "keys.json"
+)
+
+type profileSet struct {
+	Profiles []Profile `json:"profiles"`
+	LastUsed string    `json:"lastUsed,omitempty"`
+}
+
+var reProfileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _.-]{0,63}$`)
+
+// reservedOptions may not be saved in a profile: the daemon sets the paths
+// itself, bin picks the binary autoconnect starts at every boot, and secrets
+// are kept as references (KeyRef, socksPassRef) only.
+var reservedOptions = []string{"bin", "stateDir", "identityDir", "key", "socksPass"}
+
+func (m *Manager) loadProfiles() (profileSet, error) {
+	var ps profileSet
+	if err := m.store.read(profilesFile, &ps); err != nil && !os.IsNotExist(err) {
+		return ps, err
+	}
+	return ps, nil
+}
+
+func (ps *profileSet) index(name string) int {
+	for i, p := range ps.Profiles {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Profiles returns all saved profiles sorted by name and the last used one.
+func (m *Manager) Profiles() ([]Profile, string, error) {
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(ps.Profiles, func(i, j int) bool { return ps.Profiles[i].Name < ps.Profiles[j].Name })
+	return ps.Profiles, ps.LastUsed, nil
+}
+
+// Profile returns a saved profile by name.
+func (m *Manager) Profile(name string) (Profile, error) {
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return Profile{}, err
+	}
+	i := ps.index(name)
+	if i < 0 {
+		return Profile{}, ErrProfileNotFound
+	}
+	return ps.Profiles[i], nil
+}
+
+// SaveProfile creates or replaces a profile. LastUsed is preserved.
+func (m *Manager) SaveProfile(p Profile) error {
+	if !reProfileName.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name: %q", p.Name)
+	}
+	if _, ok := m.providers[p.Provider]; !ok {
+		return fmt.Errorf("unknown provider: %s", p.Provider)
+	}
+	for _, name := range p.Failover {
+		if _, ok := m.providers[name]; !ok {
+			return fmt.Errorf("unknown failover provider: %s", name)
+		}
+	}
+	for _, k := range reservedOptions {
+		if _, ok := p.Options[k]; ok {
+			return fmt.Errorf("option %s cannot be saved in a profile", k)
+		}
+	}
+	for _, ref := range []string{p.KeyRef, p.Options["socksPassRef"]} {
+		if _, err := m.keyFile(ref); err != nil {
+			return err
+		}
+	}
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return err
+	}
+	if i := ps.index(p.Name); i >= 0 {
+		p.LastUsed = ps.Profiles[i].LastUsed
+		ps.Profiles[i] = p
+	} else {
+		p.LastUsed = time.Time{}
+		ps.Profiles = append(ps.Profiles, p)
+	}
+	return m.store.write(profilesFile, ps)
+}
+
+// DeleteProfile removes a profile by name.
+func (m *Manager) DeleteProfile(name string) error {
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return err
+	}
+	i := ps.index(name)
+	if i < 0 {
+		return ErrProfileNotFound
+	}
+	ps.Profiles = append(ps.Profiles[:i], ps.Profiles[i+1:]...)
+	if ps.LastUsed == name {
+		ps.LastUsed = ""
+	}
+	return m.store.write(profilesFile, ps)
+}
+
+// markUsed records name as the last used profile.
+func (m *Manager) markUsed(name string) error {
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return err
+	}
+	i := ps.index(name)
+	if i < 0 {
+		return ErrProfileNotFound
+	}
+	ps.Profiles[i].LastUsed = time.Now()
+	ps.LastUsed = name
+	return m.store.write(profilesFile, ps)
+}
+
+// autoconnectProfile picks the profile to restore at startup: the last used
+// one if it has autoconnect set, otherwise the most recently used autoconnect profile.
+func (m *Manager) autoconnectProfile() (Profile, bool, error) {
+	m.pmu.Lock()
+	defer m.pmu.Unlock()
+	ps, err := m.loadProfiles()
+	if err != nil {
+		return Profile{}, false, err
+	}
+	if i := ps.index(ps.LastUsed); i >= 0 && ps.Profiles[i].Autoconnect {
+		return ps.Profiles[i], true, nil
+	}
+	var best Profile
+	found := false
+	for _, p := range ps.Profiles {
+		if p.Autoconnect && (!found || p.LastUsed.After(best.LastUsed)) {
+			best, found = p, true
+		}
+	}
+	return best, found, nil
+}
+
+// profileRequest converts a profile into a connect request, resolving its key reference.
+func (m *Manager) profileRequest(p Profile) (ConnectRequest, error) {
+	opts := make(map[string]string, len(p.Options)+4)
+	for k, v := range p.Options {
+		opts[k] = v
+	}
+	if p.Integration != "" {
+		opts["integration"] = p.Integration
+	}
+	if p.DNS != "" {
+		opts["dns"] = p.DNS
+	}
+	if p.Bind != "" {
+		opts["bind"] = p.Bind
+	}
+	if p.KeyRef != "" {
+		key, err := m.resolveKey(p.KeyRef)
+		if err != nil {
+			return ConnectRequest{}, err
+		}
+		opts["key"] = key
+	}
+	if ref := opts["socksPassRef"]; ref != "" {
+		pass, err := m.resolveKey(ref)
+		if err != nil {
+			return ConnectRequest{}, err
+		}
+		opts["socksPass"] = pass
+		delete(opts, "socksPassRef")
+	}
+	return ConnectRequest{
+		Provider:    p.Provider,
+		ExitCountry: p.ExitCountry,
+		Server:      p.Server,
+		Port:        p.Port,
+		Options:     opts,
+		Failover:    append([]string(nil), p.Failover...),
+		Profile:     p.Name,
+	}, nil
+}
+
+// resolveKey looks up a secret (license key or SOCKS password) by reference so
+// profiles never store it inline.
+func (m *Manager) resolveKey(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		v := os.Getenv(strings.TrimPrefix(ref, "env:"))
+		if v == "" {
+			return "", fmt.Errorf("key reference %s: variable is empty", ref)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		path, err := m.keyFile(ref)
+		if err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("key reference %s: %w", ref, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		keys := map[string]string{}
+		if err := m.store.read(keysFile, &keys); err != nil {
+			return "", fmt.Errorf("key reference %s: %w", ref, err)
+		}
+		v, ok := keys[ref]
+		if !ok || v == "" {
+			return "", fmt.Errorf("key reference %s: not found in %s", ref, keysFile)
+		}
+		return v, nil
+	}
+}
+
+// keyFile returns the path a "file:" reference points at, which must lie in
+// the state directory; relative paths are taken from there. It returns ""
+// for other references.
+func (m *Manager) keyFile(ref string) (string, error) {
+	name, ok := strings.CutPrefix(ref, "file:")
+	if !ok {
+		return "", nil
+	}
+	dir := m.store.Dir()
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if rel, err := filepath.Rel(dir, filepath.Clean(path)); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key reference %s: file must be in the state directory", ref)
+	}
+	return path, nil
+}
+
+// withProfile overlays the explicit fields of req onto the named profile.
+func (m *Manager) withProfile(req ConnectRequest) (ConnectRequest, error) {
+	p, err := m.Profile(req.Profile)
+	if err != nil {
+		return req, err
+	}
+	base, err := m.profileRequest(p)
+	if err != nil {
+		return req, err
+	}
+	if req.Provider != "" {
+		base.Provider = req.Provider
+	}
+	if req.ExitCountry != "" {
+		base.ExitCountry = req.ExitCountry
+	}
+	if req.Server != "" {
+		base.Server, base.Port = req.Server, req.Port
+	}
+	if len(req.Failover) > 0 {
+		base.Failover = req.Failover
+	}
+	for k, v := range req.Options {
+		base.Options[k] = v
+	}
+	base.Reporter = req.Reporter
+	return base, nil
+}
+
+// restoreSession reconnects the autoconnect profile, if any. Errors are
+// surfaced on the event bus since nobody is waiting on the result.
+func (m *Manager) restoreSession(ctx context.Context) {
+	p, ok, err := m.autoconnectProfile()
+	if err != nil {
+		m.Emit(Event{Type: EventError, Message: "load profiles: " + err.Error()})
+		return
+	}
+	if !ok {
+		return
+	}
+	if _, err := m.Connect(ctx, ConnectRequest{Profile: p.Name}); err != nil {
+		m.Emit(Event{Type: EventError, Provider: p.Provider, Message: "autoconnect " + p.Name + ": " + err.Error()})
+	}
+}
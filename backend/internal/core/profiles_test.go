@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfiles_ConnectAndAutoconnect(t *testing.T) {
+	a := &fakeProvider{name: "a", bind: "127.0.0.1:1"}
+	m := NewManager(t.TempDir(), map[string]Provider{"a": a})
+	t.Setenv("BP_TEST_KEY", "k-123")
+	p := Profile{Name: "home", Provider: "a", KeyRef: "env:BP_TEST_KEY", Autoconnect: true, Options: map[string]string{"health": "off"}}
+	if err := m.SaveProfile(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveProfile(Profile{Name: "bad", Provider: "missing"}); err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+	req, err := m.withProfile(ConnectRequest{Profile: "home", Options: map[string]string{"dns": "9.9.9.9"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Options["key"] != "k-123" || req.Options["dns"] != "9.9.9.9" || req.Provider != "a" {
+		t.Fatalf("unexpected request from profile: %+v", req)
+	}
+	if _, err := m.Connect(context.Background(), ConnectRequest{Profile: "home"}); err != nil {
+		t.Fatal(err)
+	}
+	list, last, err := m.Profiles()
+	if err != nil || len(list) != 1 || last != "home" || list[0].LastUsed.IsZero() {
+		t.Fatalf("profiles=%+v last=%q err=%v", list, last, err)
+	}
+	if got, ok, _ := m.autoconnectProfile(); !ok || got.Name != "home" {
+		t.Fatalf("autoconnect profile = %+v, %v", got, ok)
+	}
+	if err := m.DeleteProfile("home"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Profile("home"); !errors.Is(err, ErrProfileNotFound) {
+		t.Fatalf("want ErrProfileNotFound, got %v", err)
+	}
+}
+
+func TestSaveProfile_RefusesUnsafeOptions(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(dir, map[string]Provider{"a": &fakeProvider{name: "a"}})
+	for _, p := range []Profile{
+		{Name: "bin", Provider: "a", Options: map[string]string{"bin": "/tmp/evil"}},
+		{Name: "state", Provider: "a", Options: map[string]string{"stateDir": "/tmp"}},
+		{Name: "key", Provider: "a", Options: map[string]string{"key": "k-123"}},
+		{Name: "pass", Provider: "a", Options: map[string]string{"socksPass": "secret"}},
+		{Name: "keyfile", Provider: "a", KeyRef: "file:/etc/passwd"},
+		{Name: "escape", Provider: "a", KeyRef: "file:../key"},
+		{Name: "passfile", Provider: "a", Options: map[string]string{"socksPassRef": "file:/etc/shadow"}},
+	} {
+		if err := m.SaveProfile(p); err == nil {
+			t.Errorf("profile %s saved", p.Name)
+		}
+	}
+	if list, _, _ := m.Profiles(); len(list) != 0 {
+		t.Fatalf("refused profiles stored: %+v", list)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "license"), []byte("k-456\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveProfile(Profile{Name: "ok", Provider: "a", KeyRef: "file:license"}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := m.withProfile(ConnectRequest{Profile: "ok"})
+	if err != nil || req.Options["key"] != "k-456" {
+		t.Fatalf("key from state dir file: %q, %v", req.Options["key"], err)
+	}
+}
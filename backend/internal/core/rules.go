@@ -0,0 +1,51 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	"bulletproof/backend/internal/net/rules"
+)
+
+const (
+	rulesDir     = "rules"
+	apiRulesFile = "api" + rules.Ext // written by SaveRules
+)
+
+// Rules returns the routing table shared with every listener of the session.
+func (m *Manager) Rules() *rules.Table { return m.rules }
+
+// RulesDir returns the directory rule files are loaded from.
+func (m *Manager) RulesDir() string { return filepath.Join(m.store.Dir(), rulesDir) }
+
+// ReloadRules re-reads the rule files. Listeners use the new rules for the
+// next connection; on error the previous rules stay active.
+func (m *Manager) ReloadRules() error {
+	if err := m.rules.LoadDir(m.RulesDir()); err != nil {
+		m.Emit(Event{Type: EventError, Message: "rules: " + err.Error()})
+		return err
+	}
+	snap := m.rules.Snapshot()
+	m.Emit(Event{Type: EventRules, Message: "rules reloaded", Data: map[string]any{"rules": len(snap.Rules), "default": snap.Default}})
+	return nil
+}
+
+// SaveRules validates rs, stores it as api.rules in the rules directory and
+// reloads. Other rule files are kept and still apply in name order.
+func (m *Manager) SaveRules(rs rules.RuleSet) error {
+	if _, err := rules.Compile(rs); err != nil {
+		return err
+	}
+	dir := m.RulesDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	p := filepath.Join(dir, apiRulesFile)
+	if err := os.WriteFile(p+".tmp", []byte(rules.Format(rs)), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	return m.ReloadRules()
+}
@@ -12,14 +12,18 @@ func NewStore(dir string) *Store { return &Store{dir: dir} }
 
 func (s *Store) Dir() string { return s.dir }
 
+// write atomically replaces name with the JSON encoding of v.
 func (s *Store) write(name string, v any) error {
 	p := filepath.Join(s.dir, name)
-	f, err := os.Create(p)
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(v)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
 }
 
 func (s *Store) read(name string, v any) error {
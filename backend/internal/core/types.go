@@ -1,6 +1,11 @@
 package core
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"bulletproof/backend/internal/net/rules"
+)
 
 type ConnectRequest struct {
 	Provider    string            `json:"provider"` // "warp" | "gool" | "psiphon"
@@ -8,10 +13,24 @@ type ConnectRequest struct {
 	Server      string            `json:"server,omitempty"`
 	Port        int               `json:"port,omitempty"`
 	Options     map[string]string `json:"options,omitempty"`
+	// Profile names a saved profile to connect with; other fields override it.
+	Profile string `json:"profile,omitempty"`
+	// Failover lists providers to try, in order, when health checks keep
+	// failing or the session fails.
+	Failover []string `json:"failover,omitempty"`
+	// Reporter is set by the Manager so providers can publish lifecycle events.
+	Reporter Reporter `json:"-"`
+	// Ports is set by the Manager; providers take their listen addresses from it.
+	Ports *PortAllocator `json:"-"`
+	// Rules is set by the Manager; listeners route each destination with it.
+	Rules *rules.Table `json:"-"`
 }
 
 type Status struct {
-    Connected   bool      `json:"connected"`
+    Connected   bool      `json:"connected"`              // true only in ready/degraded phases
+    Phase       Phase     `json:"phase"`
+    PhaseSince  time.Time `json:"phaseSince,omitempty"`   // when the current phase was entered
+    UpdatedAt   time.Time `json:"updatedAt,omitempty"`    // last phase or message change
     Provider    string    `json:"provider,omitempty"`
     Since       time.Time `json:"since,omitempty"`
     ExitIP      string    `json:"exitIp,omitempty"`
@@ -19,13 +38,24 @@ type Status struct {
     Message     string    `json:"message,omitempty"`
     Integration string    `json:"integration,omitempty"`
     Bind        string    `json:"bind,omitempty"`          // local SOCKS bind
+    EngineBind  string    `json:"engineBind,omitempty"`    // internal engine SOCKS bind behind Bind
+    EngineLog   string    `json:"engineLog,omitempty"`     // log file of the engine in use
+    Endpoint    string    `json:"endpoint,omitempty"`      // engine endpoint in use, from its log
+    Handshake   time.Time `json:"handshake,omitempty"`     // last handshake the engine logged
+    Identity    string    `json:"identity,omitempty"`      // WARP identity slot the session uses
+    HTTPBind    string    `json:"httpBind,omitempty"`      // HTTP proxy bind; equals Bind on a mixed port
+    SocksAuth   bool      `json:"socksAuth,omitempty"`     // Bind requires username/password
+    UDP         string    `json:"udp,omitempty"`           // UDP ASSOCIATE relay: upstream | direct | unavailable ("" until checked)
     PacEnabled  bool      `json:"pacEnabled,omitempty"`
     SingBox     bool      `json:"singBox,omitempty"`       // sing-box active
+    Health      *Health   `json:"health,omitempty"`       // tunnel probe results while connected
 }
 
 type Provider interface {
 	Name() string
 	Connect(req ConnectRequest) error
-	Disconnect() error
+	// Disconnect stops the session's helpers; ctx bounds how long they get
+	// to exit before they are killed.
+	Disconnect(ctx context.Context) error
 	Status() Status
 }
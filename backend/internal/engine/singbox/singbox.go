@@ -4,11 +4,17 @@ import (
     "context"
     "encoding/json"
     "fmt"
+    "net"
     "os"
     "os/exec"
     "path/filepath"
     "runtime"
+    "strconv"
     "sync"
+    "time"
+
+    "bulletproof/backend/internal/net/socks5"
+    "bulletproof/backend/internal/system/procs"
 )
 
 // Runner abstracts process spawn for testability.
@@ -20,29 +26,24 @@ type Runner interface {
 type Process interface {
     Wait() error
     Kill() error
+    Terminate() error // ask the process to exit (SIGTERM)
 }
 
-type execRunner struct{}
+// execRunner starts sing-box, recording its PID in pidDir.
+type execRunner struct{ pidDir string }
 
-func (execRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
-    cmd := exec.CommandContext(ctx, name, args...)
-    if err := cmd.Start(); err != nil {
-        return nil, err
-    }
-    return &execProcess{cmd: cmd}, nil
+func (r execRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
+    return procs.Start(exec.CommandContext(ctx, name, args...), r.pidDir, "sing-box")
 }
 
-type execProcess struct{ cmd *exec.Cmd }
-
-func (p *execProcess) Wait() error { return p.cmd.Wait() }
-func (p *execProcess) Kill() error { return p.cmd.Process.Kill() }
-
 // Config for starting sing-box in TUN mode that forwards to a local SOCKS5.
 type Config struct {
     Bin       string // path to sing-box/sb-helper (optional; auto-detect)
-    SocksAddr string // local SOCKS5, e.g. 127.0.0.1:8086
+    SocksAddr string // local SOCKS5 to forward to (required), e.g. the shim bind; may carry user:pass@
     StateDir  string // where to place generated config
     LogPath   string // reserved for future use
+    PIDDir    string // optional PID file directory for orphan cleanup (procs.Dir)
+    StopTimeout time.Duration // grace period between SIGTERM and kill on Stop (default procs.DefaultGrace)
 }
 
 // Engine supervises a sing-box process running with a generated config.
@@ -51,12 +52,13 @@ type Engine struct {
     run    Runner
     mu     sync.RWMutex
     proc   Process
+    exited chan struct{} // closed when proc has exited
     active bool
     lastErr error
     configPath string
 }
 
-func New(cfg Config) *Engine { return &Engine{cfg: cfg, run: execRunner{}} }
+func New(cfg Config) *Engine { return &Engine{cfg: cfg, run: execRunner{pidDir: cfg.PIDDir}} }
 
 func defaultBin() string {
     if b := os.Getenv("SINGBOX_BIN"); b != "" { return b }
@@ -74,7 +76,7 @@ func (e *Engine) Start(ctx context.Context) error {
     defer e.mu.Unlock()
     if e.active { return nil }
 
-    if e.cfg.SocksAddr == "" { e.cfg.SocksAddr = "127.0.0.1:8086" }
+    if e.cfg.SocksAddr == "" { return fmt.Errorf("missing SocksAddr") }
     if e.cfg.StateDir == "" { return fmt.Errorf("missing StateDir") }
     if err := os.MkdirAll(e.cfg.StateDir, 0o755); err != nil { return err }
 
@@ -96,24 +98,30 @@ func (e *Engine) Start(ctx context.Context) error {
 
     proc, err := e.run.Start(ctx, bin, args...)
     if err != nil { e.lastErr = err; return err }
-    e.proc = proc
+    exited := make(chan struct{})
+    e.proc, e.exited = proc, exited
     e.active = true
     go func() {
         err := proc.Wait()
         e.mu.Lock()
-        defer e.mu.Unlock()
         e.lastErr = err
         e.active = false
         e.proc = nil
+        e.mu.Unlock()
+        close(exited)
     }()
     return nil
 }
 
-func (e *Engine) Stop() error {
-    e.mu.Lock()
-    defer e.mu.Unlock()
-    if !e.active || e.proc == nil { return nil }
-    return e.proc.Kill()
+// Stop asks sing-box to exit, giving it time to remove the TUN device and
+// its routes, and waits until it has. It is killed after Config.StopTimeout
+// or once ctx ends.
+func (e *Engine) Stop(ctx context.Context) error {
+    e.mu.RLock()
+    proc, exited, active := e.proc, e.exited, e.active
+    e.mu.RUnlock()
+    if !active || proc == nil { return nil }
+    return procs.Stop(ctx, proc, exited, e.cfg.StopTimeout)
 }
 
 func (e *Engine) Active() bool { e.mu.RLock(); defer e.mu.RUnlock(); return e.active }
@@ -122,9 +130,9 @@ func (e *Engine) LastError() error { e.mu.RLock(); defer e.mu.RUnlock(); return
 // writeConfig writes a minimal config that exposes a TUN device and forwards all traffic
 // to a local SOCKS5 proxy at socksAddr.
 func writeConfig(path string, socksAddr string) error {
-    // split host:port
-    host, port := "127.0.0.1", 8086
-    if h, p, ok := splitHostPort(socksAddr); ok { host, port = h, p }
+    addr, user, pass, auth := socks5.SplitAuth(socksAddr)
+    host, port, ok := splitHostPort(addr)
+    if !ok { return fmt.Errorf("invalid SOCKS address: %q", addr) }
     cfg := map[string]any{
         "log": map[string]any{"disabled": true},
         "dns": map[string]any{"servers": []any{"https://1.1.1.1/dns-query"}},
@@ -153,19 +161,22 @@ func writeConfig(path string, socksAddr string) error {
             "final": "socks-out",
         },
     }
+    if auth {
+        out := cfg["outbounds"].([]any)[0].(map[string]any)
+        out["username"], out["password"] = user, pass
+    }
     // Tag the first outbound so route.final can reference it (older versions ignore unknown tag)
     if outs, ok := cfg["outbounds"].([]any); ok && len(outs) > 0 {
         if m, ok := outs[0].(map[string]any); ok { m["tag"] = "socks-out" }
     }
     b, _ := json.MarshalIndent(cfg, "", "  ")
-    return os.WriteFile(path, b, 0o644)
+    return os.WriteFile(path, b, 0o600) // may hold SOCKS credentials
 }
 
 func splitHostPort(addr string) (string, int, bool) {
-    var host string
-    var port int
-    n, err := fmt.Sscanf(addr, "%[^:]:%d", &host, &port)
-    if err != nil || n != 2 { return "", 0, false }
+    host, ps, err := net.SplitHostPort(addr)
+    if err != nil { return "", 0, false }
+    port, err := strconv.Atoi(ps)
+    if err != nil || port <= 0 || port > 65535 { return "", 0, false }
     return host, port, true
 }
-
@@ -0,0 +1,260 @@
+package warpplus
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+
+    "bulletproof/backend/internal/net/socks5"
+)
+
+// EndpointStats is the connection history of one endpoint in the cache.
+type EndpointStats struct {
+    Address        string    `json:"address"`
+    Successes      int       `json:"successes"`
+    Failures       int       `json:"failures"`
+    FailStreak     int       `json:"failStreak"`               // consecutive failed connects
+    RTTMs          int64     `json:"rttMs,omitempty"`          // last scanned handshake RTT
+    ConnectMs      int64     `json:"connectMs,omitempty"`      // moving average time until the tunnel was up
+    ThroughputKBps float64   `json:"throughputKBps,omitempty"` // moving average download rate
+    LastSeen       time.Time `json:"lastSeen,omitempty"`       // last successful scan or connect
+    LastFailure    time.Time `json:"lastFailure,omitempty"`
+    Quality        int       `json:"quality"`                  // derived 0..100, see quality
+    Benched        bool      `json:"benched,omitempty"`        // skipped by Best after repeated failures
+}
+
+const (
+    endpointsFile = "endpoints.json"
+    cacheMaxAge   = 14 * 24 * time.Hour // entries not seen for this long are dropped
+    benchStreak   = 3                   // failures in a row before an endpoint is benched
+    benchFor      = time.Hour
+    dropStreak    = 6                   // failures in a row before an endpoint is forgotten
+)
+
+// cacheMu serialises read-modify-write of cache files; providers and the API
+// may open the same state dir concurrently.
+var cacheMu sync.Mutex
+
+// EndpointCache persists endpoint quality history in the state dir.
+type EndpointCache struct {
+    path string
+    now  func() time.Time
+}
+
+// OpenCache returns the endpoint cache stored in dir. The file is created on first write.
+func OpenCache(dir string) *EndpointCache {
+    return &EndpointCache{path: filepath.Join(dir, endpointsFile), now: time.Now}
+}
+
+type cacheFile struct {
+    Endpoints map[string]*EndpointStats `json:"endpoints"`
+}
+
+func (c *EndpointCache) load() (cacheFile, error) {
+    f := cacheFile{Endpoints: map[string]*EndpointStats{}}
+    b, err := os.ReadFile(c.path)
+    if errors.Is(err, os.ErrNotExist) { return f, nil }
+    if err != nil { return f, err }
+    if err := json.Unmarshal(b, &f); err != nil { return f, err }
+    if f.Endpoints == nil { f.Endpoints = map[string]*EndpointStats{} }
+    return f, nil
+}
+
+func (c *EndpointCache) save(f cacheFile) error {
+    now := c.now()
+    for addr, s := range f.Endpoints {
+        last := s.LastSeen
+        if s.LastFailure.After(last) { last = s.LastFailure }
+        if s.FailStreak >= dropStreak || now.Sub(last) > cacheMaxAge { delete(f.Endpoints, addr) }
+    }
+    b, err := json.MarshalIndent(f, "", "  ")
+    if err != nil { return err }
+    if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil { return err }
+    tmp := c.path + ".tmp"
+    if err := os.WriteFile(tmp, b, 0o644); err != nil { return err }
+    return os.Rename(tmp, c.path)
+}
+
+func (c *EndpointCache) update(addr string, fn func(s *EndpointStats)) error {
+    if addr == "" { return nil }
+    cacheMu.Lock()
+    defer cacheMu.Unlock()
+    f, err := c.load()
+    if err != nil { return err }
+    s := f.Endpoints[addr]
+    if s == nil {
+        s = &EndpointStats{Address: addr}
+        f.Endpoints[addr] = s
+    }
+    fn(s)
+    return c.save(f)
+}
+
+// RecordSuccess notes that a tunnel through addr came up after connect.
+func (c *EndpointCache) RecordSuccess(addr string, connect time.Duration) error {
+    return c.update(addr, func(s *EndpointStats) {
+        s.Successes++
+        s.FailStreak = 0
+        s.LastSeen = c.now()
+        s.ConnectMs = ewma(s.ConnectMs, connect.Milliseconds())
+    })
+}
+
+// RecordFailure notes a failed connect through addr.
+func (c *EndpointCache) RecordFailure(addr string) error {
+    return c.update(addr, func(s *EndpointStats) {
+        s.Failures++
+        s.FailStreak++
+        s.LastFailure = c.now()
+    })
+}
+
+// RecordThroughput folds a download rate sample for addr into its history.
+func (c *EndpointCache) RecordThroughput(addr string, kbps float64) error {
+    return c.update(addr, func(s *EndpointStats) {
+        if s.ThroughputKBps == 0 {
+            s.ThroughputKBps = kbps
+        } else {
+            s.ThroughputKBps = (s.ThroughputKBps*3 + kbps) / 4
+        }
+    })
+}
+
+// RecordScan stores handshake results from Scan. Endpoints that responded
+// count as seen; connect history is left untouched.
+func (c *EndpointCache) RecordScan(eps []Endpoint) error {
+    if len(eps) == 0 { return nil }
+    cacheMu.Lock()
+    defer cacheMu.Unlock()
+    f, err := c.load()
+    if err != nil { return err }
+    now := c.now()
+    for _, ep := range eps {
+        if ep.Received == 0 { continue }
+        s := f.Endpoints[ep.Address]
+        if s == nil {
+            s = &EndpointStats{Address: ep.Address}
+            f.Endpoints[ep.Address] = s
+        }
+        s.RTTMs = ep.RTTMs
+        s.LastSeen = now
+    }
+    return c.save(f)
+}
+
+// List returns all cached endpoints with derived quality, best first.
+func (c *EndpointCache) List() ([]EndpointStats, error) {
+    cacheMu.Lock()
+    f, err := c.load()
+    cacheMu.Unlock()
+    if err != nil { return nil, err }
+    now := c.now()
+    out := make([]EndpointStats, 0, len(f.Endpoints))
+    for _, s := range f.Endpoints {
+        v := *s
+        v.Quality = quality(v, now)
+        v.Benched = benched(v, now)
+        out = append(out, v)
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Benched != out[j].Benched { return !out[i].Benched }
+        if out[i].Quality != out[j].Quality { return out[i].Quality > out[j].Quality }
+        return out[i].Address < out[j].Address
+    })
+    return out, nil
+}
+
+// Best returns up to n endpoints that have connected before and are not
+// benched, best first.
+func (c *EndpointCache) Best(n int) ([]string, error) {
+    list, err := c.List()
+    if err != nil { return nil, err }
+    out := make([]string, 0, n)
+    for _, s := range list {
+        if len(out) >= n { break }
+        if s.Benched || s.Successes == 0 { continue }
+        out = append(out, s.Address)
+    }
+    return out, nil
+}
+
+// Order sorts scanned endpoints so ones with good history come first, keeping
+// scan rank among the rest. Benched endpoints move to the end.
+func (c *EndpointCache) Order(eps []Endpoint) []Endpoint {
+    list, err := c.List()
+    if err != nil { return eps }
+    hist := make(map[string]EndpointStats, len(list))
+    for _, s := range list { hist[s.Address] = s }
+    key := func(ep Endpoint) (int, int) {
+        s, ok := hist[ep.Address]
+        switch {
+        case !ok || (s.Successes == 0 && !s.Benched):
+            return 1, 0
+        case s.Benched:
+            return 2, 0
+        default:
+            return 0, -s.Quality
+        }
+    }
+    out := append([]Endpoint(nil), eps...)
+    sort.SliceStable(out, func(i, j int) bool {
+        gi, qi := key(out[i])
+        gj, qj := key(out[j])
+        if gi != gj { return gi < gj }
+        return qi < qj
+    })
+    return out
+}
+
+// Reset forgets all endpoint history.
+func (c *EndpointCache) Reset() error {
+    cacheMu.Lock()
+    defer cacheMu.Unlock()
+    if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) { return err }
+    return nil
+}
+
+func benched(s EndpointStats, now time.Time) bool {
+    return s.FailStreak >= benchStreak && now.Sub(s.LastFailure) < benchFor
+}
+
+// quality blends connect success rate (60), handshake/connect latency (25) and
+// throughput (15), discounted when the endpoint has not been seen for a day.
+func quality(s EndpointStats, now time.Time) int {
+    q := 60 * float64(s.Successes+1) / float64(s.Successes+s.Failures+2)
+    switch {
+    case s.RTTMs > 0 && s.RTTMs < 1000:
+        q += 25 * (1 - float64(s.RTTMs)/1000)
+    case s.RTTMs == 0 && s.ConnectMs > 0 && s.ConnectMs < 30000:
+        // No scan sample: fall back to engine start-up time on a 30s scale.
+        q += 25 * (1 - float64(s.ConnectMs)/30000)
+    }
+    if s.ThroughputKBps > 0 {
+        t := s.ThroughputKBps / 2048
+        if t > 1 { t = 1 }
+        q += 15 * t
+    }
+    if age := now.Sub(s.LastSeen); age > 24*time.Hour {
+        q *= 0.8
+    }
+    return int(q)
+}
+
+func ewma(prev, sample int64) int64 {
+    if prev == 0 { return sample }
+    return (prev*3 + sample) / 4
+}
+
+// MeasureThroughput downloads a fixed-size object through the SOCKS proxy at
+// bind and returns the rate in KB/s.
+func MeasureThroughput(ctx context.Context, bind string) (float64, error) {
+    n, d, err := socks5.DownloadVia(ctx, bind, "speed.cloudflare.com", "/__down?bytes=262144", 262144)
+    if err != nil { return 0, err }
+    if n < 16*1024 || d <= 0 { return 0, errors.New("throughput sample too small") }
+    return float64(n) / 1024 / d.Seconds(), nil
+}
@@ -0,0 +1,50 @@
+package warpplus
+
+import (
+    "testing"
+    "time"
+)
+
+func TestEndpointCache_RankAndBench(t *testing.T) {
+    c := OpenCache(t.TempDir())
+    now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    c.now = func() time.Time { return now }
+
+    if err := c.RecordScan([]Endpoint{{Address: "a:1", RTTMs: 40, Received: 3}, {Address: "b:1", RTTMs: 300, Received: 3}, {Address: "dead:1"}}); err != nil { t.Fatal(err) }
+    _ = c.RecordSuccess("a:1", 3*time.Second)
+    _ = c.RecordSuccess("b:1", 8*time.Second)
+    _ = c.RecordThroughput("a:1", 1500)
+    best, err := c.Best(5)
+    if err != nil { t.Fatal(err) }
+    if len(best) != 2 || best[0] != "a:1" || best[1] != "b:1" {
+        t.Fatalf("best = %v", best)
+    }
+
+    for i := 0; i < benchStreak; i++ { _ = c.RecordFailure("a:1") }
+    if best, _ = c.Best(5); len(best) != 1 || best[0] != "b:1" {
+        t.Fatalf("a:1 should be benched, best = %v", best)
+    }
+    ordered := c.Order([]Endpoint{{Address: "a:1"}, {Address: "new:1"}, {Address: "b:1"}})
+    if ordered[0].Address != "b:1" || ordered[1].Address != "new:1" || ordered[2].Address != "a:1" {
+        t.Fatalf("order = %+v", ordered)
+    }
+
+    now = now.Add(2 * benchFor)
+    if best, _ = c.Best(5); len(best) != 2 {
+        t.Fatalf("bench should expire, best = %v", best)
+    }
+
+    for i := benchStreak; i < dropStreak; i++ { _ = c.RecordFailure("a:1") }
+    list, _ := c.List()
+    if len(list) != 1 || list[0].Address != "b:1" {
+        t.Fatalf("a:1 should age out, list = %+v", list)
+    }
+
+    now = now.Add(cacheMaxAge + time.Hour)
+    _ = c.RecordFailure("c:1")
+    if list, _ = c.List(); len(list) != 1 || list[0].Address != "c:1" {
+        t.Fatalf("stale entries should be dropped, list = %+v", list)
+    }
+    if err := c.Reset(); err != nil { t.Fatal(err) }
+    if list, _ = c.List(); len(list) != 0 { t.Fatalf("reset left %+v", list) }
+}
@@ -0,0 +1,153 @@
+package warpplus
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "hash"
+    "time"
+
+    "golang.org/x/crypto/blake2s"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+)
+
+// WireGuard handshake constants (Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s).
+const (
+    noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+    wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+    wgLabelMAC1       = "mac1----"
+
+    msgInitiationType = 1
+    msgResponseType   = 2
+    msgInitiationSize = 148
+    msgResponseSize   = 92
+)
+
+// CloudflarePublicKey is the WireGuard public key of Cloudflare WARP endpoints.
+const CloudflarePublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+
+// decodeKey parses a base64 32-byte Curve25519 key.
+func decodeKey(s string) ([32]byte, error) {
+    var k [32]byte
+    b, err := base64.StdEncoding.DecodeString(s)
+    if err != nil { return k, err }
+    if len(b) != 32 { return k, errors.New("key must be 32 bytes") }
+    copy(k[:], b)
+    return k, nil
+}
+
+func mixHash(h *[32]byte, data []byte) {
+    d, _ := blake2s.New256(nil)
+    d.Write(h[:])
+    d.Write(data)
+    d.Sum(h[:0])
+}
+
+func newHMAC(key []byte) hash.Hash {
+    return hmac.New(func() hash.Hash { d, _ := blake2s.New256(nil); return d }, key)
+}
+
+func hmacSum(key, data []byte) [32]byte {
+    var out [32]byte
+    m := newHMAC(key)
+    m.Write(data)
+    m.Sum(out[:0])
+    return out
+}
+
+// kdf2 implements the Noise HKDF with two outputs.
+func kdf2(ck *[32]byte, input []byte) (c, k [32]byte) {
+    t0 := hmacSum(ck[:], input)
+    c = hmacSum(t0[:], []byte{0x1})
+    k = hmacSum(t0[:], append(c[:], 0x2))
+    return c, k
+}
+
+func kdf1(ck *[32]byte, input []byte) [32]byte {
+    t0 := hmacSum(ck[:], input)
+    return hmacSum(t0[:], []byte{0x1})
+}
+
+// tai64n encodes t as a 12-byte TAI64N timestamp.
+func tai64n(t time.Time) []byte {
+    b := make([]byte, 12)
+    binary.BigEndian.PutUint64(b[:8], uint64(0x400000000000000a+t.Unix()))
+    binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+    return b
+}
+
+// initialChainHash returns the chaining key and hash before the first message.
+func initialChainHash(responderPub [32]byte) (ck, h [32]byte) {
+    ck = blake2s.Sum256([]byte(noiseConstruction))
+    h = ck
+    mixHash(&h, []byte(wgIdentifier))
+    mixHash(&h, responderPub[:])
+    return ck, h
+}
+
+func mac1Key(responderPub [32]byte) [32]byte {
+    d, _ := blake2s.New256(nil)
+    d.Write([]byte(wgLabelMAC1))
+    d.Write(responderPub[:])
+    var k [32]byte
+    d.Sum(k[:0])
+    return k
+}
+
+func mac1(responderPub [32]byte, msg []byte) [16]byte {
+    key := mac1Key(responderPub)
+    d, _ := blake2s.New128(key[:])
+    d.Write(msg)
+    var out [16]byte
+    d.Sum(out[:0])
+    return out
+}
+
+// buildInitiation returns a WireGuard handshake initiation from the static
+// private key priv to the responder with public key peer.
+func buildInitiation(priv, peer [32]byte, sender uint32, now time.Time) ([]byte, error) {
+    var ePriv [32]byte
+    if _, err := rand.Read(ePriv[:]); err != nil { return nil, err }
+    ePub, err := curve25519.X25519(ePriv[:], curve25519.Basepoint)
+    if err != nil { return nil, err }
+    sPub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+    if err != nil { return nil, err }
+
+    msg := make([]byte, msgInitiationSize)
+    msg[0] = msgInitiationType
+    binary.LittleEndian.PutUint32(msg[4:8], sender)
+    copy(msg[8:40], ePub)
+
+    ck, h := initialChainHash(peer)
+    ck = kdf1(&ck, ePub)
+    mixHash(&h, ePub)
+
+    ss, err := curve25519.X25519(ePriv[:], peer[:])
+    if err != nil { return nil, err }
+    var key [32]byte
+    ck, key = kdf2(&ck, ss)
+    aead, _ := chacha20poly1305.New(key[:])
+    var nonce [chacha20poly1305.NonceSize]byte
+    aead.Seal(msg[40:40], nonce[:], sPub, h[:])
+    mixHash(&h, msg[40:88])
+
+    ss, err = curve25519.X25519(priv[:], peer[:])
+    if err != nil { return nil, err }
+    _, key = kdf2(&ck, ss)
+    aead, _ = chacha20poly1305.New(key[:])
+    aead.Seal(msg[88:88], nonce[:], tai64n(now), h[:])
+
+    m := mac1(peer, msg[:116])
+    copy(msg[116:132], m[:])
+    // mac2 stays zero: no cookie.
+    return msg, nil
+}
+
+// isResponse reports whether b is a handshake response addressed to sender.
+func isResponse(b []byte, sender uint32) bool {
+    return len(b) == msgResponseSize && b[0] == msgResponseType &&
+        binary.LittleEndian.Uint32(b[8:12]) == sender
+}
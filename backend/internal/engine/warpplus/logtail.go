@@ -0,0 +1,226 @@
+package warpplus
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// LogKind classifies a warp-plus log line.
+type LogKind string
+
+const (
+    LogHandshake LogKind = "handshake" // WireGuard handshake with the endpoint completed
+    LogEndpoint  LogKind = "endpoint"  // endpoint chosen
+    LogCountry   LogKind = "country"   // Psiphon exit country requested or established
+    LogTest      LogKind = "test"      // connectivity test-URL result
+    LogError     LogKind = "error"     // error-level line
+)
+
+// LogEvent is one recognised warp-plus log line.
+type LogEvent struct {
+    Kind     LogKind   `json:"kind"`
+    Time     time.Time `json:"time,omitempty"` // from the line; zero if it has none
+    Level    string    `json:"level,omitempty"`
+    Message  string    `json:"message"`
+    Endpoint string    `json:"endpoint,omitempty"` // LogEndpoint, and LogHandshake when logged
+    Country  string    `json:"country,omitempty"`  // LogCountry
+    URL      string    `json:"url,omitempty"`      // LogTest
+    OK       bool      `json:"ok,omitempty"`       // LogTest passed
+    Error    string    `json:"error,omitempty"`    // LogError, failed LogTest
+}
+
+// ParseLine recognises one line of warp-plus output: slog text or JSON
+// records, Psiphon JSON notices and plain text. Lines that carry none of
+// the LogKinds return false.
+func ParseLine(line string) (LogEvent, bool) {
+    line = strings.TrimSpace(line)
+    if line == "" { return LogEvent{}, false }
+    fields, ok := jsonFields(line)
+    if !ok { fields, ok = textFields(line) }
+    if !ok { fields = map[string]string{"msg": line} }
+    if n := fields["noticeType"]; n != "" { return psiphonNotice(n, fields) }
+
+    ev := LogEvent{Message: fields["msg"], Level: strings.ToUpper(fields["level"])}
+    if t, err := time.Parse(time.RFC3339Nano, fields["time"]); err == nil { ev.Time = t }
+    msg := strings.ToLower(ev.Message)
+    errText := firstNonEmpty(fields["error"], fields["err"])
+    switch {
+    case strings.Contains(msg, "handshake complete") || strings.Contains(msg, "received handshake response"):
+        ev.Kind, ev.Endpoint = LogHandshake, fields["endpoint"]
+    case strings.Contains(msg, "connectivity test") || strings.Contains(msg, "connection test") || strings.Contains(msg, "test url"):
+        ev.Kind, ev.URL = LogTest, fields["url"]
+        ev.OK = errText == "" && ev.Level != "ERROR" && ev.Level != "WARN" && !strings.Contains(msg, "fail")
+        if !ev.OK { ev.Error = errText }
+    case ev.Level == "ERROR" || (ev.Level == "" && (strings.HasPrefix(msg, "error") || strings.HasPrefix(msg, "fatal"))):
+        ev.Kind, ev.Error = LogError, firstNonEmpty(errText, ev.Message)
+    case fields["country"] != "":
+        ev.Kind, ev.Country = LogCountry, strings.ToUpper(fields["country"])
+    case fields["endpoint"] != "" || (fields["endpoints"] != "" && strings.Contains(msg, "using")):
+        ev.Kind, ev.Endpoint = LogEndpoint, firstEndpoint(firstNonEmpty(fields["endpoint"], fields["endpoints"]))
+        if ev.Endpoint == "" { return LogEvent{}, false }
+    default:
+        return LogEvent{}, false
+    }
+    return ev, true
+}
+
+// psiphonNotice handles psiphon-tunnel-core notices, which warp-plus passes
+// through as JSON lines.
+func psiphonNotice(notice string, f map[string]string) (LogEvent, bool) {
+    ev := LogEvent{Message: notice}
+    if t, err := time.Parse(time.RFC3339Nano, f["timestamp"]); err == nil { ev.Time = t }
+    switch notice {
+    case "ActiveTunnel":
+        if f["data.region"] == "" { return LogEvent{}, false }
+        ev.Kind, ev.Country = LogCountry, strings.ToUpper(f["data.region"])
+    case "Alert", "Error":
+        ev.Kind, ev.Level, ev.Error = LogError, "ERROR", firstNonEmpty(f["data.message"], notice)
+    default:
+        return LogEvent{}, false
+    }
+    return ev, true
+}
+
+// jsonFields flattens a JSON object into strings; nested objects become
+// dotted keys one level deep.
+func jsonFields(line string) (map[string]string, bool) {
+    if !strings.HasPrefix(line, "{") { return nil, false }
+    var m map[string]any
+    if json.Unmarshal([]byte(line), &m) != nil { return nil, false }
+    f := map[string]string{}
+    for k, v := range m {
+        if sub, ok := v.(map[string]any); ok {
+            for sk, sv := range sub { f[k+"."+sk] = jsonString(sv) }
+            continue
+        }
+        f[k] = jsonString(v)
+    }
+    return f, true
+}
+
+func jsonString(v any) string {
+    switch v := v.(type) {
+    case string:
+        return v
+    case []any:
+        parts := make([]string, 0, len(v))
+        for _, e := range v {
+            // scan results log objects such as {"AddrPort": ..., "RTT": ...}
+            if m, ok := e.(map[string]any); ok && m["AddrPort"] != nil { e = m["AddrPort"] }
+            parts = append(parts, jsonString(e))
+        }
+        return "[" + strings.Join(parts, " ") + "]"
+    case nil:
+        return ""
+    }
+    b, _ := json.Marshal(v)
+    return string(b)
+}
+
+// textFields parses a slog text record (key=value pairs, quoted when needed).
+func textFields(line string) (map[string]string, bool) {
+    f := map[string]string{}
+    for s := line; s != ""; s = strings.TrimLeft(s, " ") {
+        eq := strings.IndexByte(s, '=')
+        if eq <= 0 || strings.ContainsAny(s[:eq], " \"") { return nil, false }
+        key := s[:eq]
+        s = s[eq+1:]
+        var val string
+        if strings.HasPrefix(s, `"`) {
+            q, err := strconv.QuotedPrefix(s)
+            if err != nil { return nil, false }
+            val, _ = strconv.Unquote(q)
+            s = s[len(q):]
+        } else {
+            end := strings.IndexByte(s, ' ')
+            if end < 0 { end = len(s) }
+            val, s = s[:end], s[end:]
+        }
+        f[key] = val
+    }
+    return f, f["msg"] != ""
+}
+
+// firstEndpoint returns the first address of a logged endpoint or list.
+func firstEndpoint(s string) string {
+    f := strings.FieldsFunc(strings.Trim(s, "[]"), func(r rune) bool { return r == ' ' || r == ',' })
+    if len(f) == 0 { return "" }
+    return f[0]
+}
+
+func firstNonEmpty(vals ...string) string {
+    for _, v := range vals {
+        if v != "" { return v }
+    }
+    return ""
+}
+
+// tailInterval is how often TailLog checks the file for new output.
+var tailInterval = 250 * time.Millisecond
+
+// TailLog follows the log file at path from offset (from its current end if
+// offset < 0) and calls fn for every recognised line until ctx ends. Only
+// complete lines are parsed; a file that shrinks is re-read from the start.
+func TailLog(ctx context.Context, path string, offset int64, fn func(LogEvent)) {
+    if offset < 0 {
+        offset = 0
+        if fi, err := os.Stat(path); err == nil { offset = fi.Size() }
+    }
+    var partial []byte
+    t := time.NewTicker(tailInterval)
+    defer t.Stop()
+    for {
+        if fi, err := os.Stat(path); err == nil {
+            if fi.Size() < offset { offset, partial = 0, nil }
+            if fi.Size() > offset {
+                n, data := readFrom(path, offset)
+                offset += n
+                partial = append(partial, data...)
+                for {
+                    i := bytes.IndexByte(partial, '\n')
+                    if i < 0 { break }
+                    if ev, ok := ParseLine(string(partial[:i])); ok { fn(ev) }
+                    partial = partial[i+1:]
+                }
+            }
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
+
+func readFrom(path string, offset int64) (int64, []byte) {
+    f, err := os.Open(path)
+    if err != nil { return 0, nil }
+    defer f.Close()
+    if _, err := f.Seek(offset, io.SeekStart); err != nil { return 0, nil }
+    b, _ := io.ReadAll(f)
+    return int64(len(b)), b
+}
+
+// String renders the event for status messages and logs.
+func (ev LogEvent) String() string {
+    switch ev.Kind {
+    case LogHandshake:
+        if ev.Endpoint != "" { return "handshake with " + ev.Endpoint }
+        return "handshake complete"
+    case LogEndpoint:
+        return "using endpoint " + ev.Endpoint
+    case LogCountry:
+        return "exit country " + ev.Country
+    case LogTest:
+        if ev.OK { return "connectivity test passed" }
+        return fmt.Sprintf("connectivity test failed: %s", firstNonEmpty(ev.Error, ev.Message))
+    }
+    return firstNonEmpty(ev.Error, ev.Message)
+}
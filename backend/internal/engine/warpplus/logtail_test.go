@@ -0,0 +1,134 @@
+package warpplus
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// parseFixture returns the String form of every event in testdata/name.
+func parseFixture(t *testing.T, name string) ([]LogEvent, []string) {
+    t.Helper()
+    b, err := os.ReadFile(filepath.Join("testdata", name))
+    if err != nil { t.Fatal(err) }
+    var evs []LogEvent
+    var got []string
+    for _, l := range strings.Split(string(b), "\n") {
+        if ev, ok := ParseLine(l); ok {
+            evs = append(evs, ev)
+            got = append(got, string(ev.Kind)+": "+ev.String())
+        }
+    }
+    return evs, got
+}
+
+func assertEvents(t *testing.T, got, want []string) {
+    t.Helper()
+    if !reflect.DeepEqual(got, want) { t.Fatalf("events:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  ")) }
+}
+
+func TestParseLine_Text(t *testing.T) {
+    evs, got := parseFixture(t, "warp-text.log")
+    assertEvents(t, got, []string{
+        "endpoint: using endpoint 162.159.192.7:2408",
+        "handshake: handshake complete",
+        "handshake: handshake with 162.159.192.7:2408",
+        "test: connectivity test passed",
+        "error: write udp4 0.0.0.0:41234->162.159.192.7:2408: sendto: network is unreachable",
+    })
+    if want := time.Date(2024, 6, 1, 10, 15, 3, 903e6, time.UTC); !evs[2].Time.Equal(want) { t.Errorf("time = %v, want %v", evs[2].Time, want) }
+    if evs[3].URL != "http://connectivity.cloudflareclient.com/cdn-cgi/trace" || !evs[3].OK { t.Errorf("test event = %+v", evs[3]) }
+}
+
+func TestParseLine_JSON(t *testing.T) {
+    evs, got := parseFixture(t, "gool-json.log")
+    assertEvents(t, got, []string{
+        "endpoint: using endpoint 188.114.98.224:878",
+        "handshake: handshake with 188.114.98.224:878",
+        "test: connectivity test failed: context deadline exceeded",
+        "error: all endpoints failed",
+    })
+    if evs[2].OK || evs[2].Level != "WARN" || evs[2].URL != "https://www.gstatic.com/generate_204" { t.Errorf("test event = %+v", evs[2]) }
+}
+
+func TestParseLine_Psiphon(t *testing.T) {
+    evs, got := parseFixture(t, "psiphon.log")
+    assertEvents(t, got, []string{
+        "country: exit country DE",
+        "handshake: handshake with 162.159.195.1:500",
+        "country: exit country DE",
+        "error: tunnel failed: dial tcp 203.0.113.7:443: i/o timeout",
+    })
+    if evs[2].Message != "ActiveTunnel" || evs[2].Time.IsZero() { t.Errorf("active tunnel = %+v", evs[2]) }
+}
+
+func TestParseLine_Plain(t *testing.T) {
+    for line, want := range map[string]LogKind{
+        "2024/06/01 10:15:03 handshake complete": LogHandshake,
+        "Error: bind: address already in use":    LogError,
+        "some unrelated chatter":                 "",
+        `time=x level=INFO msg="serving proxy"`:   "",
+        "":                                       "",
+    } {
+        ev, ok := ParseLine(line)
+        if ok != (want != "") || ev.Kind != want { t.Errorf("ParseLine(%q) = %v %q, want %q", line, ok, ev.Kind, want) }
+    }
+}
+
+func TestTailLog(t *testing.T) {
+    defer func(d time.Duration) { tailInterval = d }(tailInterval)
+    tailInterval = 5 * time.Millisecond
+    path := filepath.Join(t.TempDir(), "warp-plus.log")
+    // Output from an earlier run is skipped.
+    if err := os.WriteFile(path, []byte("time=t level=INFO msg=\"handshake complete\" endpoint=192.0.2.1:2408\n"), 0o600); err != nil { t.Fatal(err) }
+
+    var mu sync.Mutex
+    var got []string
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        TailLog(ctx, path, -1, func(ev LogEvent) {
+            mu.Lock()
+            got = append(got, ev.String())
+            mu.Unlock()
+        })
+        close(done)
+    }()
+    wait := func(n int) {
+        t.Helper()
+        deadline := time.Now().Add(2 * time.Second)
+        for {
+            mu.Lock()
+            l := len(got)
+            mu.Unlock()
+            if l >= n { return }
+            if time.Now().After(deadline) { t.Fatalf("got %d events, want %d: %q", l, n, got) }
+            time.Sleep(5 * time.Millisecond)
+        }
+    }
+    appendLog := func(s string) {
+        f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+        if err != nil { t.Fatal(err) }
+        f.WriteString(s)
+        f.Close()
+    }
+    time.Sleep(20 * time.Millisecond)
+    // A line written in two pieces is parsed once complete.
+    appendLog(`time=t level=INFO msg="handshake com`)
+    time.Sleep(20 * time.Millisecond)
+    appendLog("plete\" endpoint=192.0.2.2:2408\n")
+    wait(1)
+    // Restarting the engine truncates the log.
+    if err := os.WriteFile(path, []byte(`{"level":"ERROR","msg":"x","error":"boom"}`+"\n"), 0o600); err != nil { t.Fatal(err) }
+    wait(2)
+    cancel()
+    <-done
+    mu.Lock()
+    defer mu.Unlock()
+    assertEvents(t, got, []string{"handshake with 192.0.2.2:2408", "boom"})
+}
@@ -0,0 +1,253 @@
+package warpplus
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "bulletproof/backend/internal/net/socks5"
+)
+
+// RaceOptions configures Race. Zero values use defaults.
+type RaceOptions struct {
+    Concurrency  int           // warp-plus instances running at once (default 3)
+    Deadline     time.Duration // overall deadline for the race (default 3m)
+    ReadyTimeout time.Duration // per candidate: SOCKS up and check passed (default 35s)
+
+    // Start launches a candidate. Default: New(cfg).Start(context.Background()).
+    Start func(cfg Config) (*Engine, error)
+    // Wait blocks until the candidate's SOCKS port accepts connections. Default: WaitPort.
+    Wait func(ctx context.Context, cfg Config) error
+    // Check verifies that traffic flows through the candidate. Default: DataPathCheck.
+    Check func(ctx context.Context, cfg Config) error
+    // Bind returns a listen address for a candidate when several run at once.
+    // Default: FreeBind.
+    Bind func(base string) (string, error)
+    // Release returns a losing candidate's address obtained from Bind. Optional.
+    Release func(addr string)
+    // OnResult is called once per candidate that finished on its own, i.e.
+    // was not cut short by a winner or the deadline. Calls are serialised.
+    OnResult func(r CandidateResult)
+    // OnWin is called with the winner as soon as it is picked, before the
+    // other candidates are stopped and Race returns, so that the caller can
+    // take over (e.g. supervise) the engine without a gap. Optional.
+    OnWin func(res RaceResult)
+}
+
+// CandidateResult describes how one raced candidate ended.
+type CandidateResult struct {
+    Config  Config
+    Started bool          // the process launched; failures before this are not the endpoint's fault
+    Err     error         // nil for the winner
+    Elapsed time.Duration // from launch until ready or failure
+}
+
+// RaceResult is the winning candidate. Its engine is running.
+type RaceResult struct {
+    Engine  *Engine
+    Config  Config
+    Elapsed time.Duration
+}
+
+// ParseRaceOptions builds options from string values (as carried in
+// ConnectRequest.Options). Empty values keep the defaults.
+func ParseRaceOptions(concurrency, deadline string) (RaceOptions, error) {
+    var o RaceOptions
+    if concurrency != "" {
+        n, err := strconv.Atoi(concurrency)
+        if err != nil || n < 1 { return o, fmt.Errorf("invalid race concurrency: %q", concurrency) }
+        o.Concurrency = n
+    }
+    if deadline != "" {
+        d, err := time.ParseDuration(deadline)
+        if err != nil || d <= 0 { return o, fmt.Errorf("invalid race deadline: %q", deadline) }
+        o.Deadline = d
+    }
+    return o.withDefaults(), nil
+}
+
+func (o RaceOptions) withDefaults() RaceOptions {
+    if o.Concurrency <= 0 { o.Concurrency = 3 }
+    if o.Deadline <= 0 { o.Deadline = 3 * time.Minute }
+    if o.ReadyTimeout <= 0 { o.ReadyTimeout = 35 * time.Second }
+    if o.Start == nil {
+        o.Start = func(cfg Config) (*Engine, error) {
+            eng := New(cfg)
+            return eng, eng.Start(context.Background())
+        }
+    }
+    if o.Bind == nil { o.Bind = FreeBind }
+    if o.Wait == nil { o.Wait = func(ctx context.Context, cfg Config) error { return WaitPort(ctx, cfg.Bind) } }
+    if o.Check == nil { o.Check = func(ctx context.Context, cfg Config) error { return DataPathCheck(ctx, cfg.Bind, cfg.TestURL) } }
+    return o
+}
+
+// Race runs candidates with up to Concurrency warp-plus instances at a time
+// and returns the first one that passes Check; all others are stopped. When
+// more than one instance may run at once, each candidate gets its own port
+// from opts.Bind. Candidates with the same CacheDir run as the same WireGuard
+// device, and concurrent handshakes with one key make the peer switch between
+// them, so those run one at a time.
+func Race(ctx context.Context, cands []Config, opts RaceOptions) (RaceResult, error) {
+    opts = opts.withDefaults()
+    if len(cands) == 0 { return RaceResult{}, errors.New("race: no candidates") }
+    ctx, cancel := context.WithTimeout(ctx, opts.Deadline)
+    defer cancel()
+    parallel := opts.Concurrency > 1 && len(cands) > 1
+
+    var (
+        mu      sync.Mutex
+        won     bool
+        winner  RaceResult
+        lastErr error
+        wg      sync.WaitGroup
+    )
+    // record books a candidate's result and returns its engine if it became
+    // ready after another candidate had already won.
+    record := func(r CandidateResult, eng *Engine, cfg Config) *Engine {
+        mu.Lock()
+        defer mu.Unlock()
+        if r.Err == nil && won { return eng }
+        if parallel && opts.Release != nil && r.Err != nil { opts.Release(cfg.Bind) }
+        if r.Err == nil {
+            won, winner = true, RaceResult{Engine: eng, Config: cfg, Elapsed: r.Elapsed}
+            if opts.OnWin != nil { opts.OnWin(winner) }
+            cancel()
+        } else {
+            // Cancelled by a winner or the overall deadline: not the candidate's fault.
+            if ctx.Err() != nil {
+                if lastErr == nil { lastErr = r.Err }
+                return nil
+            }
+            lastErr = r.Err
+        }
+        if opts.OnResult != nil { opts.OnResult(r) }
+        return nil
+    }
+    sem := make(chan struct{}, opts.Concurrency)
+    devices := map[string]chan struct{}{} // by CacheDir; held while a candidate runs
+launch:
+    for _, cfg := range cands {
+        var dev chan struct{}
+        if cfg.CacheDir != "" {
+            if dev = devices[cfg.CacheDir]; dev == nil {
+                dev = make(chan struct{}, 1)
+                devices[cfg.CacheDir] = dev
+            }
+            select {
+            case dev <- struct{}{}:
+            case <-ctx.Done():
+                break launch
+            }
+        }
+        release := func() { if dev != nil { <-dev } }
+        select {
+        case sem <- struct{}{}:
+        case <-ctx.Done():
+            release()
+            break launch
+        }
+        if ctx.Err() != nil { <-sem; release(); break }
+        if parallel {
+            bind, err := opts.Bind(cfg.Bind)
+            if err != nil { <-sem; release(); lastErr = err; continue }
+            cfg.Bind = bind
+        }
+        wg.Add(1)
+        go func(cfg Config) {
+            defer wg.Done()
+            defer release()
+            defer func() { <-sem }()
+            r, eng := runCandidate(ctx, cfg, opts)
+            // A candidate ready after another won is stopped outside the
+            // lock, and its bind released only once the process is gone.
+            if late := record(r, eng, cfg); late != nil {
+                _ = late.Stop(context.Background())
+                if parallel && opts.Release != nil { opts.Release(cfg.Bind) }
+            }
+        }(cfg)
+    }
+    wg.Wait()
+    if won { return winner, nil }
+    if lastErr == nil { lastErr = ctx.Err() }
+    if lastErr == nil { lastErr = errors.New("race: no candidate became ready") }
+    return RaceResult{}, lastErr
+}
+
+// runCandidate launches one candidate and waits for it to pass the data-path
+// check. On failure the engine is stopped and nil is returned.
+func runCandidate(ctx context.Context, cfg Config, opts RaceOptions) (CandidateResult, *Engine) {
+    r := CandidateResult{Config: cfg}
+    began := time.Now()
+    eng, err := opts.Start(cfg)
+    if err != nil {
+        r.Err = err
+        if eng != nil { _ = eng.Stop(context.Background()) }
+        return r, nil
+    }
+    r.Started = true
+    cctx, cancel := context.WithTimeout(ctx, opts.ReadyTimeout)
+    defer cancel()
+    if err = opts.Wait(cctx, cfg); err == nil {
+        err = opts.Check(cctx, cfg)
+    }
+    r.Elapsed = time.Since(began)
+    if err != nil {
+        _ = eng.Stop(context.Background())
+        r.Err = err
+        return r, nil
+    }
+    return r, eng
+}
+
+// FreeBind returns host:port with a currently free TCP port on the host of
+// base (127.0.0.1 when base is empty or unparsable).
+func FreeBind(base string) (string, error) {
+    host, _, err := net.SplitHostPort(base)
+    if err != nil || host == "" { host = "127.0.0.1" }
+    ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+    if err != nil { return "", err }
+    defer ln.Close()
+    return ln.Addr().String(), nil
+}
+
+// WaitPort polls addr until it accepts TCP connections or ctx is done.
+func WaitPort(ctx context.Context, addr string) error {
+    var d net.Dialer
+    for {
+        dctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+        c, err := d.DialContext(dctx, "tcp", addr)
+        cancel()
+        if err == nil {
+            c.Close()
+            return nil
+        }
+        select {
+        case <-ctx.Done():
+            return fmt.Errorf("timeout waiting for %s", addr)
+        case <-time.After(250 * time.Millisecond):
+        }
+    }
+}
+
+// DataPathCheck fetches testURL through the SOCKS proxy at bind and expects
+// a 2xx or 3xx status. Non-http URLs fall back to the Cloudflare trace page.
+func DataPathCheck(ctx context.Context, bind, testURL string) error {
+    host, path := "connectivity.cloudflareclient.com", "/cdn-cgi/trace"
+    if u, err := url.Parse(testURL); err == nil && u.Scheme == "http" && u.Host != "" && u.Port() == "" {
+        host, path = u.Host, u.RequestURI()
+    }
+    status, _, err := socks5.HTTPGetVia(ctx, bind, host, path, 512)
+    if err != nil { return fmt.Errorf("data path via %s: %w", bind, err) }
+    f := strings.Fields(status)
+    if len(f) < 2 || len(f[1]) != 3 || (f[1][0] != '2' && f[1][0] != '3') {
+        return fmt.Errorf("data path via %s: unexpected status %q", bind, status)
+    }
+    return nil
+}
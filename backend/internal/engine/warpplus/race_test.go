@@ -0,0 +1,127 @@
+package warpplus
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+// blockProc runs until killed.
+type blockProc struct{ once sync.Once; done chan struct{} }
+func newBlockProc() *blockProc { return &blockProc{done: make(chan struct{})} }
+func (p *blockProc) Wait() error { <-p.done; return errors.New("killed") }
+func (p *blockProc) Kill() error { p.once.Do(func() { close(p.done) }); return nil }
+func (p *blockProc) Terminate() error { return p.Kill() }
+
+type procRunner struct{ p *blockProc }
+func (r procRunner) Start(ctx context.Context, name string, args ...string) (Process, error) { return r.p, nil }
+
+func TestRace_FirstHealthyWinsLosersStopped(t *testing.T) {
+    var mu sync.Mutex
+    procs := map[string]*blockProc{}
+    binds := map[string]bool{}
+    var results []CandidateResult
+    opts := RaceOptions{
+        Concurrency: 3,
+        Start: func(cfg Config) (*Engine, error) {
+            e := New(cfg)
+            p := newBlockProc()
+            e.run = procRunner{p}
+            mu.Lock(); procs[cfg.TestURL] = p; binds[cfg.Bind] = true; mu.Unlock()
+            return e, e.Start(context.Background())
+        },
+        Wait: func(ctx context.Context, cfg Config) error { return nil },
+        Check: func(ctx context.Context, cfg Config) error {
+            switch cfg.TestURL {
+            case "bad":
+                return errors.New("no route")
+            case "good":
+                time.Sleep(20 * time.Millisecond)
+                return nil
+            }
+            <-ctx.Done() // "slow" never passes
+            return ctx.Err()
+        },
+        OnResult: func(r CandidateResult) { results = append(results, r) },
+    }
+    // The winner is handed over while the losers still run.
+    var onWin string
+    opts.OnWin = func(res RaceResult) {
+        mu.Lock(); slow := procs["slow"]; mu.Unlock()
+        select {
+        case <-slow.done:
+            onWin = "after losers stopped"
+        default:
+            onWin = res.Config.TestURL
+        }
+    }
+    cands := []Config{{Bind: "127.0.0.1:8086", TestURL: "slow"}, {Bind: "127.0.0.1:8086", TestURL: "bad"}, {Bind: "127.0.0.1:8086", TestURL: "good"}}
+    res, err := Race(context.Background(), cands, opts)
+    if err != nil { t.Fatal(err) }
+    if res.Config.TestURL != "good" || !res.Engine.Active() { t.Fatalf("winner = %+v", res.Config) }
+    if onWin != "good" { t.Fatalf("OnWin = %q", onWin) }
+    if len(binds) != 3 || binds["127.0.0.1:8086"] { t.Fatalf("candidates should get distinct free ports: %v", binds) }
+    select {
+    case <-procs["slow"].done:
+    case <-time.After(time.Second):
+        t.Fatal("losing candidate was not stopped")
+    }
+    if len(results) != 2 || results[0].Config.TestURL != "bad" || results[1].Err != nil {
+        t.Fatalf("results = %+v", results)
+    }
+    _ = res.Engine.Stop(context.Background())
+}
+
+func TestRace_DeadlineAndSequential(t *testing.T) {
+    starts := 0
+    opts := RaceOptions{
+        Concurrency: 1,
+        Deadline:    50 * time.Millisecond,
+        Start: func(cfg Config) (*Engine, error) {
+            starts++
+            e := New(cfg)
+            e.run = procRunner{newBlockProc()}
+            if cfg.Bind != "127.0.0.1:8086" { t.Errorf("sequential race should keep the bind, got %s", cfg.Bind) }
+            return e, e.Start(context.Background())
+        },
+        Wait:  func(ctx context.Context, cfg Config) error { <-ctx.Done(); return ctx.Err() },
+        Check: func(context.Context, Config) error { return nil },
+    }
+    _, err := Race(context.Background(), []Config{{Bind: "127.0.0.1:8086"}, {Bind: "127.0.0.1:8086"}}, opts)
+    if !errors.Is(err, context.DeadlineExceeded) { t.Fatalf("want deadline error, got %v", err) }
+    if starts != 1 { t.Fatalf("deadline should stop launching, starts = %d", starts) }
+}
+
+func TestRace_SharedDeviceRunsOneAtATime(t *testing.T) {
+    var mu sync.Mutex
+    running, most, starts := 0, 0, 0
+    opts := RaceOptions{
+        Concurrency: 3,
+        Start: func(cfg Config) (*Engine, error) {
+            e := New(cfg)
+            e.run = procRunner{newBlockProc()}
+            mu.Lock()
+            starts++
+            if running++; running > most { most = running }
+            mu.Unlock()
+            return e, e.Start(context.Background())
+        },
+        Wait: func(ctx context.Context, cfg Config) error { return nil },
+        Check: func(ctx context.Context, cfg Config) error {
+            time.Sleep(10 * time.Millisecond)
+            mu.Lock(); defer mu.Unlock()
+            running--
+            if cfg.TestURL == "good" { return nil }
+            return errors.New("no route")
+        },
+    }
+    cands := []Config{
+        {CacheDir: "slot", TestURL: "bad"}, {CacheDir: "slot", TestURL: "bad"}, {CacheDir: "slot", TestURL: "good"},
+    }
+    res, err := Race(context.Background(), cands, opts)
+    if err != nil { t.Fatal(err) }
+    defer res.Engine.Stop(context.Background())
+    if starts != 3 || most != 1 { t.Fatalf("starts = %d, most at once = %d; want 3 and 1", starts, most) }
+}
@@ -1,46 +1,213 @@
 package warpplus
 
 import (
-    "bufio"
     "context"
-    "os"
-    "os/exec"
-    "regexp"
-    "runtime"
+    "errors"
+    "math/rand"
+    "net"
+    "net/netip"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
 )
 
+// Endpoint is a scanned WARP endpoint ranked by handshake quality.
 type Endpoint struct {
-    Address string // ip:port
-    Score   int    // optional quality metric if available; 0 if unknown
-}
-
-var reScan = regexp.MustCompile(`(?m)^([0-9\.]+:[0-9]+)(?:\s+(\d+))?$`)
-
-// Scan invokes warp-plus with --scan and parses endpoints from stdout.
-// Note: This relies on warp-plus exposing a scan mode. If not available,
-// callers can ignore errors and fall back to user-provided endpoints.
-func Scan(ctx context.Context, bin string) ([]Endpoint, error) {
-    if bin == "" {
-        // Prefer env if provided (same behavior as Engine default)
-        if env := os.Getenv("WARPPLUS_BIN"); env != "" { bin = env }
-    }
-    if bin == "" {
-        if runtime.GOOS == "windows" { bin = "warp-plus.exe" } else { bin = "warp-plus" }
-    }
-    cmd := exec.CommandContext(ctx, bin, "--scan")
-    stdout, err := cmd.StdoutPipe()
-    if err != nil { return nil, err }
-    if err := cmd.Start(); err != nil { return nil, err }
-    defer cmd.Wait()
-
-    eps := make([]Endpoint, 0, 32)
-    sc := bufio.NewScanner(stdout)
-    for sc.Scan() {
-        line := sc.Text()
-        m := reScan.FindStringSubmatch(line)
-        if len(m) == 0 { continue }
-        ep := Endpoint{Address: m[1]}
-        eps = append(eps, ep)
+    Address  string  `json:"address"`  // ip:port
+    Score    int     `json:"score"`    // 0..100, higher is better; 0 means no handshake
+    RTTMs    int64   `json:"rttMs"`    // median handshake round trip
+    Loss     float64 `json:"loss"`     // fraction of probes without a response
+    Sent     int     `json:"sent"`
+    Received int     `json:"received"`
+}
+
+// DefaultPrefixes are the Cloudflare WARP anycast ranges probed by Scan.
+var DefaultPrefixes = []string{
+    "162.159.192.0/24",
+    "162.159.193.0/24",
+    "162.159.195.0/24",
+    "188.114.96.0/24",
+    "188.114.97.0/24",
+    "188.114.98.0/24",
+    "188.114.99.0/24",
+}
+
+// DefaultPrefixesV6 are the IPv6 WARP ranges, probed when ScanOptions.IPv6 is set.
+var DefaultPrefixesV6 = []string{
+    "2606:4700:d0::/48",
+    "2606:4700:d1::/48",
+}
+
+// DefaultPorts are UDP ports WARP endpoints listen on.
+var DefaultPorts = []int{
+    500, 854, 859, 864, 878, 880, 890, 891, 894, 903, 908, 928, 934, 939, 942,
+    943, 945, 946, 955, 968, 987, 988, 1002, 1010, 1014, 1018, 1070, 1074, 1180,
+    1387, 1701, 1843, 2371, 2408, 2506, 3138, 3476, 3581, 3854, 4177, 4198, 4233,
+    4500, 5279, 5956, 7103, 7152, 7156, 7281, 7559, 8319, 8742, 8854, 8886,
+}
+
+// ScanOptions configures Scan. Zero values use defaults.
+type ScanOptions struct {
+    PrivateKey    string   // base64 X25519 key of the registered identity (required)
+    PeerPublicKey string   // responder key; default CloudflarePublicKey
+    Targets       []string // explicit ip:port list; overrides Prefixes/Ports sampling
+    Prefixes      []string // CIDRs to sample from; default DefaultPrefixes
+    Ports         []int    // ports to sample; default DefaultPorts
+    IPv6          bool     // also sample DefaultPrefixesV6 when Prefixes is empty
+    Samples       int      // number of random ip:port candidates (default 48)
+    Probes        int      // handshakes per candidate (default 3)
+    Timeout       time.Duration // per handshake (default 1s)
+    Concurrency   int      // parallel candidates (default 16)
+    Top           int      // max endpoints returned (default 15; <0 = all responders)
+}
+
+func (o ScanOptions) withDefaults() ScanOptions {
+    if o.PeerPublicKey == "" { o.PeerPublicKey = CloudflarePublicKey }
+    if len(o.Prefixes) == 0 {
+        o.Prefixes = append([]string{}, DefaultPrefixes...)
+        if o.IPv6 { o.Prefixes = append(o.Prefixes, DefaultPrefixesV6...) }
+    }
+    if len(o.Ports) == 0 { o.Ports = DefaultPorts }
+    if o.Samples <= 0 { o.Samples = 48 }
+    if o.Probes <= 0 { o.Probes = 3 }
+    if o.Timeout <= 0 { o.Timeout = time.Second }
+    if o.Concurrency <= 0 { o.Concurrency = 16 }
+    if o.Top == 0 { o.Top = 15 }
+    return o
+}
+
+// Scan probes WARP endpoints with WireGuard handshake initiations signed by
+// the identity key and returns responders ranked by score (best first).
+func Scan(ctx context.Context, opts ScanOptions) ([]Endpoint, error) {
+    opts = opts.withDefaults()
+    priv, err := decodeKey(opts.PrivateKey)
+    if err != nil { return nil, errors.New("scan: invalid private key: " + err.Error()) }
+    peer, err := decodeKey(opts.PeerPublicKey)
+    if err != nil { return nil, errors.New("scan: invalid peer public key: " + err.Error()) }
+    targets := opts.Targets
+    if len(targets) == 0 {
+        if targets, err = sampleTargets(opts.Prefixes, opts.Ports, opts.Samples); err != nil { return nil, err }
+    }
+
+    results := make([]Endpoint, len(targets))
+    sem := make(chan struct{}, opts.Concurrency)
+    var wg sync.WaitGroup
+    for i, addr := range targets {
+        wg.Add(1)
+        go func(i int, addr string) {
+            defer wg.Done()
+            select {
+            case sem <- struct{}{}:
+            case <-ctx.Done():
+                results[i] = Endpoint{Address: addr}
+                return
+            }
+            defer func() { <-sem }()
+            results[i] = probeEndpoint(ctx, addr, priv, peer, opts.Probes, opts.Timeout)
+        }(i, addr)
+    }
+    wg.Wait()
+    if err := ctx.Err(); err != nil { return nil, err }
+
+    eps := make([]Endpoint, 0, len(results))
+    for _, ep := range results {
+        if ep.Received > 0 { eps = append(eps, ep) }
     }
+    Rank(eps)
+    if opts.Top > 0 && len(eps) > opts.Top { eps = eps[:opts.Top] }
     return eps, nil
 }
+
+// Rank sorts endpoints by score, then RTT, best first.
+func Rank(eps []Endpoint) {
+    sort.SliceStable(eps, func(i, j int) bool {
+        if eps[i].Score != eps[j].Score { return eps[i].Score > eps[j].Score }
+        return eps[i].RTTMs < eps[j].RTTMs
+    })
+}
+
+// score maps median RTT and loss to 0..100: 100 at 0ms/no loss, 0 at >=1s or total loss.
+func score(rtt time.Duration, loss float64) int {
+    base := 1 - float64(rtt)/float64(time.Second)
+    if base < 0 { base = 0 }
+    return int(100 * base * (1 - loss))
+}
+
+// probeEndpoint sends n handshake initiations to addr and measures responses.
+func probeEndpoint(ctx context.Context, addr string, priv, peer [32]byte, n int, timeout time.Duration) Endpoint {
+    ep := Endpoint{Address: addr}
+    var d net.Dialer
+    conn, err := d.DialContext(ctx, "udp", addr)
+    if err != nil {
+        ep.Sent, ep.Loss = n, 1
+        return ep
+    }
+    defer conn.Close()
+    rtts := make([]time.Duration, 0, n)
+    buf := make([]byte, 256)
+    for i := 0; i < n && ctx.Err() == nil; i++ {
+        ep.Sent++
+        sender := rand.Uint32()
+        msg, err := buildInitiation(priv, peer, sender, time.Now())
+        if err != nil { continue }
+        begin := time.Now()
+        if _, err := conn.Write(msg); err != nil { continue }
+        deadline := begin.Add(timeout)
+        for {
+            _ = conn.SetReadDeadline(deadline)
+            nr, err := conn.Read(buf)
+            if err != nil { break }
+            if isResponse(buf[:nr], sender) {
+                rtts = append(rtts, time.Since(begin))
+                break
+            }
+        }
+    }
+    ep.Received = len(rtts)
+    if ep.Sent > 0 { ep.Loss = 1 - float64(ep.Received)/float64(ep.Sent) }
+    if len(rtts) > 0 {
+        sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+        med := rtts[len(rtts)/2]
+        ep.RTTMs = med.Milliseconds()
+        ep.Score = score(med, ep.Loss)
+        if ep.Score == 0 { ep.Score = 1 }
+    }
+    return ep
+}
+
+// sampleTargets picks up to n distinct random ip:port pairs from the prefixes.
+func sampleTargets(prefixes []string, ports []int, n int) ([]string, error) {
+    pfx := make([]netip.Prefix, 0, len(prefixes))
+    for _, s := range prefixes {
+        p, err := netip.ParsePrefix(s)
+        if err != nil { return nil, err }
+        pfx = append(pfx, p.Masked())
+    }
+    if len(pfx) == 0 || len(ports) == 0 { return nil, errors.New("scan: no prefixes or ports") }
+    seen := make(map[string]struct{}, n)
+    out := make([]string, 0, n)
+    for tries := 0; len(out) < n && tries < n*10; tries++ {
+        ip := randomAddr(pfx[rand.Intn(len(pfx))])
+        addr := net.JoinHostPort(ip.String(), strconv.Itoa(ports[rand.Intn(len(ports))]))
+        if _, ok := seen[addr]; ok { continue }
+        seen[addr] = struct{}{}
+        out = append(out, addr)
+    }
+    return out, nil
+}
+
+// randomAddr returns a random host address inside p.
+func randomAddr(p netip.Prefix) netip.Addr {
+    b := p.Addr().AsSlice()
+    bits := p.Bits()
+    for i := range b {
+        hostBits := (i+1)*8 - bits
+        if hostBits <= 0 { continue }
+        r := byte(rand.Intn(256))
+        if hostBits < 8 { r &= byte(1<<hostBits - 1) }
+        b[i] |= r
+    }
+    addr, _ := netip.AddrFromSlice(b)
+    return addr
+}
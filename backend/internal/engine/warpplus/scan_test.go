@@ -0,0 +1,112 @@
+package warpplus
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+)
+
+func genKey(t *testing.T) (priv, pub [32]byte) {
+    t.Helper()
+    if _, err := rand.Read(priv[:]); err != nil { t.Fatal(err) }
+    p, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+    if err != nil { t.Fatal(err) }
+    copy(pub[:], p)
+    return priv, pub
+}
+
+// wgResponder answers valid handshake initiations from initiator with a
+// minimal response message, the way a WARP endpoint would.
+func wgResponder(t *testing.T, priv, pub, initiator [32]byte) string {
+    t.Helper()
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { pc.Close() })
+    go func() {
+        buf := make([]byte, 512)
+        for {
+            n, from, err := pc.ReadFrom(buf)
+            if err != nil { return }
+            msg := buf[:n]
+            if n != msgInitiationSize || msg[0] != msgInitiationType { continue }
+            want := mac1(pub, msg[:116])
+            if !hmac.Equal(want[:], msg[116:132]) { continue }
+            ck, h := initialChainHash(pub)
+            ePub := msg[8:40]
+            ck = kdf1(&ck, ePub)
+            mixHash(&h, ePub)
+            ss, err := curve25519.X25519(priv[:], ePub)
+            if err != nil { continue }
+            _, key := kdf2(&ck, ss)
+            aead, _ := chacha20poly1305.New(key[:])
+            var nonce [chacha20poly1305.NonceSize]byte
+            static, err := aead.Open(nil, nonce[:], msg[40:88], h[:])
+            if err != nil || !hmac.Equal(static, initiator[:]) { continue }
+            resp := make([]byte, msgResponseSize)
+            resp[0] = msgResponseType
+            binary.LittleEndian.PutUint32(resp[4:8], 7)
+            copy(resp[8:12], msg[4:8])
+            pc.WriteTo(resp, from)
+        }
+    }()
+    return pc.LocalAddr().String()
+}
+
+func TestScan_LocalResponder(t *testing.T) {
+    cliPriv, cliPub := genKey(t)
+    srvPriv, srvPub := genKey(t)
+    live := wgResponder(t, srvPriv, srvPub, cliPub)
+
+    // A bound but silent socket stands in for an unreachable endpoint.
+    dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer dead.Close()
+
+    eps, err := Scan(context.Background(), ScanOptions{
+        PrivateKey:    base64.StdEncoding.EncodeToString(cliPriv[:]),
+        PeerPublicKey: base64.StdEncoding.EncodeToString(srvPub[:]),
+        Targets:       []string{dead.LocalAddr().String(), live},
+        Probes:        2,
+        Timeout:       200 * time.Millisecond,
+    })
+    if err != nil { t.Fatal(err) }
+    if len(eps) != 1 || eps[0].Address != live {
+        t.Fatalf("want only %s, got %+v", live, eps)
+    }
+    if eps[0].Score <= 0 || eps[0].Received != 2 || eps[0].Loss != 0 {
+        t.Fatalf("unexpected result: %+v", eps[0])
+    }
+}
+
+func TestScan_WrongKeyIgnored(t *testing.T) {
+    cliPriv, _ := genKey(t)
+    _, otherPub := genKey(t)
+    srvPriv, srvPub := genKey(t)
+    live := wgResponder(t, srvPriv, srvPub, otherPub)
+
+    eps, err := Scan(context.Background(), ScanOptions{
+        PrivateKey:    base64.StdEncoding.EncodeToString(cliPriv[:]),
+        PeerPublicKey: base64.StdEncoding.EncodeToString(srvPub[:]),
+        Targets:       []string{live},
+        Probes:        1,
+        Timeout:       100 * time.Millisecond,
+    })
+    if err != nil { t.Fatal(err) }
+    if len(eps) != 0 { t.Fatalf("unregistered key should not get a response: %+v", eps) }
+}
+
+func TestRank(t *testing.T) {
+    eps := []Endpoint{{Address: "a", Score: 50, RTTMs: 10}, {Address: "b", Score: 90, RTTMs: 40}, {Address: "c", Score: 90, RTTMs: 20}}
+    Rank(eps)
+    if eps[0].Address != "c" || eps[1].Address != "b" || eps[2].Address != "a" {
+        t.Fatalf("bad order: %+v", eps)
+    }
+}
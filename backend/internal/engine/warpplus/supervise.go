@@ -0,0 +1,201 @@
+package warpplus
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// RestartMode controls when a supervised engine is restarted after it exits.
+type RestartMode string
+
+const (
+    RestartNever     RestartMode = "never"
+    RestartOnFailure RestartMode = "on-failure" // restart only on non-zero exit
+    RestartAlways    RestartMode = "always"
+)
+
+// RestartPolicy configures supervisor mode. Zero durations and factors fall
+// back to DefaultRestartPolicy values.
+type RestartPolicy struct {
+    Mode           RestartMode
+    InitialBackoff time.Duration // first delay before restarting
+    MaxBackoff     time.Duration // cap for exponential growth
+    Multiplier     float64       // backoff growth factor per attempt
+    Jitter         float64       // fraction (0..1) of each delay that is randomised
+    MaxRestarts    int           // circuit breaker: restarts allowed within Window; 0 = unlimited
+    Window         time.Duration // sliding window for MaxRestarts
+    StableAfter    time.Duration // a run this long resets the backoff
+}
+
+// DefaultRestartPolicy restarts on failure with 1s..30s backoff and gives up
+// after 5 restarts within 5 minutes.
+func DefaultRestartPolicy() RestartPolicy {
+    return RestartPolicy{
+        Mode:           RestartOnFailure,
+        InitialBackoff: time.Second,
+        MaxBackoff:     30 * time.Second,
+        Multiplier:     2,
+        Jitter:         0.2,
+        MaxRestarts:    5,
+        Window:         5 * time.Minute,
+        StableAfter:    time.Minute,
+    }
+}
+
+// ParseRestartPolicy builds a policy from string options (as carried in
+// ConnectRequest.Options). Empty values keep the defaults.
+func ParseRestartPolicy(mode, maxRestarts, window string) (RestartPolicy, error) {
+    p := DefaultRestartPolicy()
+    switch RestartMode(mode) {
+    case "":
+    case RestartNever, RestartOnFailure, RestartAlways:
+        p.Mode = RestartMode(mode)
+    default:
+        return p, fmt.Errorf("unknown restart mode: %s", mode)
+    }
+    if maxRestarts != "" {
+        n, err := strconv.Atoi(maxRestarts)
+        if err != nil || n < 0 { return p, fmt.Errorf("invalid restart limit: %q", maxRestarts) }
+        p.MaxRestarts = n
+    }
+    if window != "" {
+        d, err := time.ParseDuration(window)
+        if err != nil || d <= 0 { return p, fmt.Errorf("invalid restart window: %q", window) }
+        p.Window = d
+    }
+    return p, nil
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+    d := DefaultRestartPolicy()
+    if p.Mode == "" { p.Mode = d.Mode }
+    if p.InitialBackoff <= 0 { p.InitialBackoff = d.InitialBackoff }
+    if p.MaxBackoff <= 0 { p.MaxBackoff = d.MaxBackoff }
+    if p.MaxBackoff < p.InitialBackoff { p.MaxBackoff = p.InitialBackoff }
+    if p.Multiplier < 1 { p.Multiplier = d.Multiplier }
+    if p.Jitter < 0 || p.Jitter > 1 { p.Jitter = d.Jitter }
+    if p.Window <= 0 { p.Window = d.Window }
+    if p.StableAfter <= 0 { p.StableAfter = d.StableAfter }
+    return p
+}
+
+func (p RestartPolicy) shouldRestart(exitErr error) bool {
+    switch p.Mode {
+    case RestartAlways:
+        return true
+    case RestartOnFailure:
+        return exitErr != nil
+    default:
+        return false
+    }
+}
+
+// backoff returns the delay before restart attempt n (1-based), with jitter.
+func (p RestartPolicy) backoff(n int) time.Duration {
+    d := float64(p.InitialBackoff)
+    for i := 1; i < n; i++ {
+        d *= p.Multiplier
+        if d >= float64(p.MaxBackoff) { d = float64(p.MaxBackoff); break }
+    }
+    if p.Jitter > 0 {
+        d += d * p.Jitter * (2*rand.Float64() - 1)
+    }
+    return time.Duration(d)
+}
+
+// SupervisorHooks receive notifications from a supervised engine. Any may be nil.
+type SupervisorHooks struct {
+    // OnRestart is called when a restart is scheduled, before waiting delay.
+    OnRestart func(attempt int, delay time.Duration, exitErr error)
+    // OnRestarted is called after the process was successfully relaunched.
+    OnRestarted func(attempt int)
+    // OnGiveUp is called when the circuit breaker trips; no further restarts happen.
+    OnGiveUp func(err error)
+}
+
+// ErrRestartLimit is wrapped by the error passed to OnGiveUp when the breaker trips.
+var ErrRestartLimit = errors.New("restart limit reached")
+
+type supervisor struct {
+    policy   RestartPolicy
+    hooks    SupervisorHooks
+    mu       sync.Mutex
+    attempt  int
+    restarts []time.Time
+}
+
+// Supervise enables automatic restarts of the warp-plus process according to
+// policy. It may be called before or after Start.
+func (e *Engine) Supervise(policy RestartPolicy, hooks SupervisorHooks) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.sup = &supervisor{policy: policy.withDefaults(), hooks: hooks}
+}
+
+// Restarts returns how many restarts the supervisor attempted within the current window.
+func (e *Engine) Restarts() int {
+    e.mu.RLock()
+    sup := e.sup
+    e.mu.RUnlock()
+    if sup == nil { return 0 }
+    sup.mu.Lock()
+    defer sup.mu.Unlock()
+    return len(sup.restarts)
+}
+
+// next records a restart attempt and returns its number and delay, or an
+// error if the circuit breaker is open.
+func (s *supervisor) next(now time.Time, ranFor time.Duration) (int, time.Duration, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ranFor >= s.policy.StableAfter { s.attempt = 0 }
+    cut := now.Add(-s.policy.Window)
+    kept := s.restarts[:0]
+    for _, t := range s.restarts {
+        if t.After(cut) { kept = append(kept, t) }
+    }
+    s.restarts = kept
+    if s.policy.MaxRestarts > 0 && len(s.restarts) >= s.policy.MaxRestarts {
+        return 0, 0, fmt.Errorf("%w: %d restarts within %s", ErrRestartLimit, len(s.restarts), s.policy.Window)
+    }
+    s.attempt++
+    s.restarts = append(s.restarts, now)
+    return s.attempt, s.policy.backoff(s.attempt), nil
+}
+
+// restartLoop waits out the backoff and relaunches the process until it starts,
+// Stop is called, or the circuit breaker trips.
+func (e *Engine) restartLoop(exitErr error, ranFor time.Duration) {
+    e.mu.RLock()
+    sup, stopCh := e.sup, e.stopCh
+    e.mu.RUnlock()
+    for {
+        attempt, delay, err := sup.next(time.Now(), ranFor)
+        if err != nil {
+            if sup.hooks.OnGiveUp != nil { sup.hooks.OnGiveUp(err) }
+            return
+        }
+        if sup.hooks.OnRestart != nil { sup.hooks.OnRestart(attempt, delay, exitErr) }
+        select {
+        case <-stopCh:
+            return
+        case <-time.After(delay):
+        }
+        e.mu.Lock()
+        if e.stopping || e.active {
+            e.mu.Unlock()
+            return
+        }
+        err = e.spawnLocked()
+        e.mu.Unlock()
+        if err == nil {
+            if sup.hooks.OnRestarted != nil { sup.hooks.OnRestarted(attempt) }
+            return
+        }
+        exitErr, ranFor = err, 0
+    }
+}
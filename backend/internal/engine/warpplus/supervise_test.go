@@ -0,0 +1,64 @@
+package warpplus
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+)
+
+// exitProc exits immediately with err.
+type exitProc struct{ err error }
+func (p exitProc) Wait() error { return p.err }
+func (exitProc) Kill() error { return nil }
+func (exitProc) Terminate() error { return nil }
+
+type countRunner struct{ mu sync.Mutex; starts int }
+func (r *countRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
+    r.mu.Lock(); r.starts++; r.mu.Unlock()
+    return exitProc{err: errors.New("crashed")}, nil
+}
+
+func TestSupervise_BreakerTrips(t *testing.T) {
+    e := New(Config{Mode: "warp"})
+    cr := &countRunner{}
+    e.run = cr
+    gaveUp := make(chan error, 1)
+    var restarts int
+    e.Supervise(RestartPolicy{
+        Mode: RestartOnFailure, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond,
+        MaxRestarts: 3, Window: time.Minute,
+    }, SupervisorHooks{
+        OnRestart: func(int, time.Duration, error) { restarts++ },
+        OnGiveUp:  func(err error) { gaveUp <- err },
+    })
+    if err := e.Start(context.Background()); err != nil { t.Fatal(err) }
+    select {
+    case err := <-gaveUp:
+        if !errors.Is(err, ErrRestartLimit) { t.Fatalf("want ErrRestartLimit, got %v", err) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("supervisor never gave up")
+    }
+    cr.mu.Lock(); defer cr.mu.Unlock()
+    if cr.starts != 4 || restarts != 3 { t.Fatalf("starts=%d restarts=%d, want 4 and 3", cr.starts, restarts) }
+}
+
+func TestSupervise_NeverMode(t *testing.T) {
+    e := New(Config{Mode: "warp"})
+    cr := &countRunner{}
+    e.run = cr
+    e.Supervise(RestartPolicy{Mode: RestartNever}, SupervisorHooks{})
+    if err := e.Start(context.Background()); err != nil { t.Fatal(err) }
+    time.Sleep(20 * time.Millisecond)
+    cr.mu.Lock(); defer cr.mu.Unlock()
+    if cr.starts != 1 { t.Fatalf("starts=%d, want 1", cr.starts) }
+}
+
+func TestRestartPolicy_Backoff(t *testing.T) {
+    p := RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2, Jitter: 0}
+    want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+    for i, w := range want {
+        if got := p.backoff(i + 1); got != w { t.Fatalf("attempt %d: got %v want %v", i+1, got, w) }
+    }
+}
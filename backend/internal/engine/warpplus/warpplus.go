@@ -9,6 +9,9 @@ import (
     "runtime"
     "strings"
     "sync"
+    "time"
+
+    "bulletproof/backend/internal/system/procs"
 )
 
 // Runner abstracts command start for testability.
@@ -20,25 +23,19 @@ type Runner interface {
 type Process interface {
     Wait() error
     Kill() error
+    Terminate() error // ask the process to exit (SIGTERM)
 }
 
-type execRunner struct{}
+// execRunner starts warp-plus with inherited output, recording its PID in pidDir.
+type execRunner struct{ pidDir string }
 
-func (execRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
+func (r execRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
     cmd := exec.CommandContext(ctx, name, args...)
     cmd.Stdout = os.Stdout
     cmd.Stderr = os.Stderr
-    if err := cmd.Start(); err != nil {
-        return nil, err
-    }
-    return &execProcess{cmd: cmd}, nil
+    return procs.Start(cmd, r.pidDir, "warp-plus")
 }
 
-type execProcess struct{ cmd *exec.Cmd }
-
-func (p *execProcess) Wait() error { return p.cmd.Wait() }
-func (p *execProcess) Kill() error { return p.cmd.Process.Kill() }
-
 // Config for starting warp-plus.
 type Config struct {
     Bin       string // path to warp-plus (optional; auto-detect by default)
@@ -49,6 +46,8 @@ type Config struct {
     Country   string // exit country for psiphon/cfon
     CacheDir     string // directory for engine state/cache (recommended)
     LogPath      string // optional log file for stdout/stderr
+    PIDDir       string // optional PID file directory for orphan cleanup (procs.Dir)
+    StopTimeout  time.Duration // grace period between SIGTERM and kill on Stop (default procs.DefaultGrace)
     TestURL      string // override connectivity test URL
     DNS          string // override DNS server used by engine (e.g., 1.1.1.1)
     IPv4Only     bool   // force IPv4 endpoints
@@ -62,11 +61,25 @@ type Engine struct {
     run    Runner
     mu     sync.RWMutex
     proc   Process
+    exited chan struct{} // closed when proc has exited
     active bool
     lastErr error
+    onExit func(err error)
+
+    // supervisor state; see supervise.go
+    sup      *supervisor
+    ctx      context.Context
+    bin      string
+    args     []string
+    stopping bool
+    stopCh   chan struct{}
 }
 
-func New(cfg Config) *Engine { return &Engine{cfg: cfg, run: execRunner{}} }
+func New(cfg Config) *Engine { return &Engine{cfg: cfg, run: execRunner{pidDir: cfg.PIDDir}} }
+
+// OnExit registers a callback invoked (outside the engine lock) whenever the
+// warp-plus process exits, including after Stop.
+func (e *Engine) OnExit(fn func(err error)) { e.mu.Lock(); e.onExit = fn; e.mu.Unlock() }
 
 func defaultBin() string {
     if b := os.Getenv("WARPPLUS_BIN"); b != "" { return b }
@@ -124,41 +137,66 @@ func (e *Engine) Start(ctx context.Context) error {
 
     // If LogPath specified, wrap runner to write to file and annotate command line.
     if e.cfg.LogPath != "" {
-        e.run = &fileRunner{logPath: e.cfg.LogPath}
+        e.run = &fileRunner{logPath: e.cfg.LogPath, pidDir: e.cfg.PIDDir}
     }
-    proc, err := e.run.Start(ctx, bin, args...)
+    e.ctx, e.bin, e.args = ctx, bin, args
+    e.stopping = false
+    e.stopCh = make(chan struct{})
+    return e.spawnLocked()
+}
+
+// spawnLocked launches the process with the arguments prepared by Start and
+// monitors it in the background. Caller must hold e.mu.
+func (e *Engine) spawnLocked() error {
+    proc, err := e.run.Start(e.ctx, e.bin, e.args...)
     if err != nil {
         e.lastErr = err
         return err
     }
-    e.proc = proc
+    exited := make(chan struct{})
+    e.proc, e.exited = proc, exited
     e.active = true
+    started := time.Now()
 
     // Monitor process in background
     go func() {
         err := proc.Wait()
         e.mu.Lock()
-        defer e.mu.Unlock()
         e.lastErr = err
         e.active = false
         e.proc = nil
+        fn := e.onExit
+        restart := !e.stopping && e.sup != nil && e.sup.policy.shouldRestart(err)
+        e.mu.Unlock()
+        close(exited)
+        if fn != nil { fn(err) }
+        if restart { go e.restartLoop(err, time.Since(started)) }
     }()
-
     return nil
 }
 
-func (e *Engine) Stop() error {
+// Stop cancels any pending supervised restart, asks warp-plus to exit and
+// waits until it has. It is killed after Config.StopTimeout or once ctx ends.
+func (e *Engine) Stop(ctx context.Context) error {
     e.mu.Lock()
-    defer e.mu.Unlock()
-    if !e.active || e.proc == nil { return nil }
-    return e.proc.Kill()
+    if !e.stopping && e.stopCh != nil {
+        e.stopping = true
+        close(e.stopCh)
+    }
+    proc, exited, active := e.proc, e.exited, e.active
+    e.mu.Unlock()
+    if !active || proc == nil { return nil }
+    return procs.Stop(ctx, proc, exited, e.cfg.StopTimeout)
 }
 
+// Bind returns the SOCKS address warp-plus was configured to listen on.
+func (e *Engine) Bind() string { return e.cfg.Bind }
+
 func (e *Engine) Active() bool { e.mu.RLock(); defer e.mu.RUnlock(); return e.active }
 func (e *Engine) LastError() error { e.mu.RLock(); defer e.mu.RUnlock(); return e.lastErr }
 
 // fileRunner writes stdout/stderr to a single append-only file.
-type fileRunner struct{ logPath string }
+type fileRunner struct{ logPath, pidDir string }
 
 func (f *fileRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
     // lazy imports: use stdlib already imported above
@@ -173,8 +211,9 @@ func (f *fileRunner) Start(ctx context.Context, name string, args ...string) (Pr
     cmd.Env = sanitizeEnv(os.Environ())
     cmd.Stdout = lf
     cmd.Stderr = lf
-    if err := cmd.Start(); err != nil { return nil, err }
-    return &execProcess{cmd: cmd}, nil
+    // The child has its own copy of the descriptor once started.
+    defer lf.Close()
+    return procs.Start(cmd, f.pidDir, "warp-plus")
 }
 
 // sanitizeEnv removes potentially conflicting variables that some CLI parsers
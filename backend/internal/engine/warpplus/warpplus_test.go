@@ -3,12 +3,16 @@ package warpplus
 import (
     "context"
     "reflect"
+    "sync"
+    "sync/atomic"
     "testing"
+    "time"
 )
 
 type fakeProc struct{}
 func (fakeProc) Wait() error { return nil }
 func (fakeProc) Kill() error { return nil }
+func (fakeProc) Terminate() error { return nil }
 
 type fakeRunner struct{ name string; args []string }
 func (f *fakeRunner) Start(ctx context.Context, name string, args ...string) (Process, error) {
@@ -44,3 +48,35 @@ func TestArgs_Psiphon(t *testing.T) {
     if !reflect.DeepEqual(fr.args, want) { t.Fatalf("args mismatch\nwant=%v\n got=%v", want, fr.args) }
 }
 
+
+// termProc exits shortly after Terminate unless it ignores it, or at once on Kill.
+type termProc struct {
+    done       chan struct{}
+    once       sync.Once
+    ignoreTerm bool
+    killed     atomic.Bool
+}
+
+func (p *termProc) exit()       { p.once.Do(func() { close(p.done) }) }
+func (p *termProc) Wait() error { <-p.done; return nil }
+func (p *termProc) Kill() error { p.killed.Store(true); p.exit(); return nil }
+func (p *termProc) Terminate() error {
+    if !p.ignoreTerm { time.AfterFunc(20*time.Millisecond, p.exit) }
+    return nil
+}
+
+type termRunner struct{ p *termProc }
+
+func (r termRunner) Start(ctx context.Context, name string, args ...string) (Process, error) { return r.p, nil }
+
+func TestStop_WaitsForExit(t *testing.T) {
+    for _, ignore := range []bool{false, true} {
+        p := &termProc{done: make(chan struct{}), ignoreTerm: ignore}
+        e := New(Config{Mode: "warp", StopTimeout: 50 * time.Millisecond})
+        e.run = termRunner{p}
+        if err := e.Start(context.Background()); err != nil { t.Fatal(err) }
+        if err := e.Stop(context.Background()); err != nil { t.Fatal(err) }
+        if e.Active() { t.Fatalf("ignoreTerm=%v: still active after Stop returned", ignore) }
+        if p.killed.Load() != ignore { t.Fatalf("ignoreTerm=%v: killed=%v", ignore, p.killed.Load()) }
+    }
+}
@@ -0,0 +1,238 @@
+// Package httpproxy is an HTTP proxy front end for the local tunnel: CONNECT
+// tunnelling and absolute-URI forwarding over a caller-supplied dialer.
+package httpproxy
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "bulletproof/backend/internal/net/shimsocks"
+)
+
+// Config defines how the HTTP proxy behaves.
+type Config struct {
+    // ListenAddr is the local address to bind, e.g. 127.0.0.1:8100. Leave it
+    // empty when connections are only handed over through ServeConn.
+    ListenAddr string
+    // Dial opens a connection to host:port, e.g. shimsocks.Server.Dial (required).
+    Dial func(ctx context.Context, host string, port int) (net.Conn, error)
+    // Login, if set, requires Proxy-Authorization: Basic on the first request
+    // of each client connection; release is called when the connection ends.
+    Login func(user, pass string) (release func(), err error)
+    // DialTimeout bounds each upstream dial (default 10s).
+    DialTimeout time.Duration
+}
+
+// Server is a minimal HTTP/1.1 forward proxy.
+type Server struct {
+    cfg  Config
+    ln   net.Listener
+    mu   sync.Mutex
+    wg   sync.WaitGroup
+    stop chan struct{}
+    conns map[net.Conn]struct{} // accepted connections, closed on Stop
+}
+
+func New(cfg Config) *Server {
+    if cfg.DialTimeout <= 0 { cfg.DialTimeout = 10 * time.Second }
+    return &Server{cfg: cfg, stop: make(chan struct{}), conns: map[net.Conn]struct{}{}}
+}
+
+// Addr returns the listen address once started, or "".
+func (s *Server) Addr() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ln == nil { return "" }
+    return s.ln.Addr().String()
+}
+
+func (s *Server) Start(ctx context.Context) error {
+    if s.cfg.Dial == nil { return errors.New("httpproxy: missing Dial") }
+    ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+    if err != nil { return err }
+    s.mu.Lock(); s.ln = ln; s.mu.Unlock()
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                select {
+                case <-s.stop:
+                    return
+                default:
+                }
+                continue
+            }
+            s.mu.Lock(); s.conns[conn] = struct{}{}; s.mu.Unlock()
+            s.wg.Add(1)
+            go func(c net.Conn) {
+                defer s.wg.Done()
+                s.ServeConn(c)
+                s.mu.Lock(); delete(s.conns, c); s.mu.Unlock()
+            }(conn)
+        }
+    }()
+    return nil
+}
+
+func (s *Server) Stop() error {
+    s.mu.Lock()
+    if s.ln != nil { _ = s.ln.Close() }
+    // Idle keep-alive clients would otherwise hold Stop for the full grace period.
+    for c := range s.conns { _ = c.Close() }
+    s.mu.Unlock()
+    close(s.stop)
+    done := make(chan struct{})
+    go func(){ s.wg.Wait(); close(done) }()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+    }
+    return nil
+}
+
+// hopHeaders are connection-specific and not forwarded (RFC 9110 7.6.1).
+var hopHeaders = []string{
+    "Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+    "Proxy-Authorization", "Te", "Trailer", "Upgrade",
+}
+
+func stripHop(h http.Header) {
+    for _, f := range h.Values("Connection") {
+        for _, name := range strings.Split(f, ",") {
+            if name = strings.TrimSpace(name); name != "" { h.Del(name) }
+        }
+    }
+    for _, name := range hopHeaders { h.Del(name) }
+}
+
+// ServeConn serves one client connection until it closes. It is also the
+// entry point for connections detected as HTTP on a mixed SOCKS/HTTP port.
+func (s *Server) ServeConn(c net.Conn) {
+    defer c.Close()
+    br := bufio.NewReader(c)
+    authed := s.cfg.Login == nil
+    var (
+        up     net.Conn
+        upR    *bufio.Reader
+        upHost string
+    )
+    defer func() { if up != nil { up.Close() } }()
+    for {
+        req, err := http.ReadRequest(br)
+        if err != nil { return }
+        if !authed {
+            user, pass, ok := proxyAuth(req)
+            if !ok { writeStatus(c, http.StatusProxyAuthRequired, "proxy authentication required"); return }
+            release, err := s.cfg.Login(user, pass)
+            if err != nil {
+                code := http.StatusProxyAuthRequired
+                if errors.Is(err, shimsocks.ErrLimit) { code = http.StatusTooManyRequests }
+                writeStatus(c, code, err.Error())
+                return
+            }
+            defer release()
+            authed = true
+        }
+
+        if req.Method == http.MethodConnect {
+            s.tunnel(c, br, req)
+            return
+        }
+        if req.URL.Scheme != "http" || req.URL.Host == "" {
+            writeStatus(c, http.StatusBadRequest, "absolute http:// URI or CONNECT required")
+            return
+        }
+        host := hostPort(req.URL.Host, 80)
+        if up == nil || upHost != host {
+            if up != nil { up.Close() }
+            up, err = s.dial(host)
+            if err != nil {
+                up = nil
+                dialErr(c, err)
+                return
+            }
+            upR, upHost = bufio.NewReader(up), host
+        }
+
+        stripHop(req.Header)
+        req.RequestURI = ""
+        if err := req.Write(up); err != nil { writeStatus(c, http.StatusBadGateway, err.Error()); return }
+        resp, err := http.ReadResponse(upR, req)
+        if err != nil { writeStatus(c, http.StatusBadGateway, err.Error()); return }
+        // A body without length or chunking runs to EOF, so neither side can be
+        // reused; resp.Write then tells the client with Connection: close.
+        toEOF := resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+        stripHop(resp.Header)
+        err = resp.Write(c)
+        resp.Body.Close()
+        if err != nil || req.Close || resp.Close || toEOF { return }
+    }
+}
+
+// tunnel answers CONNECT and splices the client onto the target.
+func (s *Server) tunnel(c net.Conn, br *bufio.Reader, req *http.Request) {
+    up, err := s.dial(hostPort(req.Host, 443))
+    if err != nil { dialErr(c, err); return }
+    defer up.Close()
+    if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil { return }
+    done := make(chan struct{}, 2)
+    go func() { _, _ = io.Copy(up, br); done <- struct{}{} }()
+    go func() { _, _ = io.Copy(c, up); done <- struct{}{} }()
+    <-done
+}
+
+// dialErr answers a failed upstream dial.
+func dialErr(c net.Conn, err error) {
+    code := http.StatusBadGateway
+    if errors.Is(err, shimsocks.ErrBlocked) { code = http.StatusForbidden }
+    writeStatus(c, code, err.Error())
+}
+
+func (s *Server) dial(hostport string) (net.Conn, error) {
+    host, ps, err := net.SplitHostPort(hostport)
+    if err != nil { return nil, err }
+    port, err := strconv.Atoi(ps)
+    if err != nil { return nil, fmt.Errorf("invalid port in %q", hostport) }
+    ctx, cancel := context.WithTimeout(context.Background(), s.cfg.DialTimeout)
+    defer cancel()
+    return s.cfg.Dial(ctx, host, port)
+}
+
+// hostPort adds def as the port when authority has none.
+func hostPort(authority string, def int) string {
+    if _, _, err := net.SplitHostPort(authority); err == nil { return authority }
+    return net.JoinHostPort(strings.Trim(authority, "[]"), strconv.Itoa(def))
+}
+
+// proxyAuth parses Proxy-Authorization: Basic.
+func proxyAuth(req *http.Request) (string, string, bool) {
+    h := req.Header.Get("Proxy-Authorization")
+    if h == "" { return "", "", false }
+    r := &http.Request{Header: http.Header{"Authorization": {h}}}
+    return r.BasicAuth()
+}
+
+func writeStatus(w io.Writer, code int, msg string) {
+    resp := &http.Response{
+        StatusCode:    code,
+        ProtoMajor:    1,
+        ProtoMinor:    1,
+        Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+        Body:          io.NopCloser(strings.NewReader(msg + "\n")),
+        ContentLength: int64(len(msg) + 1),
+        Close:         true,
+    }
+    if code == http.StatusProxyAuthRequired { resp.Header.Set("Proxy-Authenticate", `Basic realm="bulletproof"`) }
+    _ = resp.Write(w)
+}
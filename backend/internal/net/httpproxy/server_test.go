@@ -0,0 +1,132 @@
+package httpproxy
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "bulletproof/backend/internal/net/shimsocks"
+    "bulletproof/backend/internal/net/socks5"
+)
+
+func directDial(ctx context.Context, host string, port int) (net.Conn, error) {
+    var d net.Dialer
+    return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func origin(t *testing.T, tlsOn bool) *httptest.Server {
+    h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Proxy-Authorization") != "" { http.Error(w, "proxy credentials leaked", 500); return }
+        fmt.Fprintf(w, "hello %s", r.URL.Path)
+    })
+    var srv *httptest.Server
+    if tlsOn { srv = httptest.NewTLSServer(h) } else { srv = httptest.NewServer(h) }
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func client(proxyURL string) *http.Client {
+    u, _ := url.Parse(proxyURL)
+    return &http.Client{
+        Timeout: 5 * time.Second,
+        Transport: &http.Transport{
+            Proxy:           http.ProxyURL(u),
+            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        },
+    }
+}
+
+func get(t *testing.T, c *http.Client, u string) (int, string) {
+    t.Helper()
+    resp, err := c.Get(u)
+    if err != nil { t.Fatalf("GET %s: %v", u, err) }
+    defer resp.Body.Close()
+    b, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, string(b)
+}
+
+func start(t *testing.T, cfg Config) *Server {
+    t.Helper()
+    if cfg.ListenAddr == "" { cfg.ListenAddr = "127.0.0.1:0" }
+    s := New(cfg)
+    if err := s.Start(context.Background()); err != nil { t.Fatal(err) }
+    t.Cleanup(func() { s.Stop() })
+    return s
+}
+
+func TestForwardAndConnect(t *testing.T) {
+    s := start(t, Config{Dial: directDial})
+    c := client("http://" + s.Addr())
+    plain, secure := origin(t, false), origin(t, true)
+    for i := 0; i < 2; i++ { // second request reuses the client connection
+        if code, body := get(t, c, plain.URL+"/a"); code != 200 || body != "hello /a" {
+            t.Fatalf("absolute-URI: %d %q", code, body)
+        }
+    }
+    if code, body := get(t, c, secure.URL+"/b"); code != 200 || body != "hello /b" {
+        t.Fatalf("CONNECT: %d %q", code, body)
+    }
+}
+
+func TestAuth(t *testing.T) {
+    login := func(user, pass string) (func(), error) {
+        if user == "alice" && pass == "secret" { return func() {}, nil }
+        return nil, shimsocks.ErrAuth
+    }
+    s := start(t, Config{Dial: directDial, Login: login})
+    plain := origin(t, false)
+    if code, _ := get(t, client("http://"+s.Addr()), plain.URL); code != http.StatusProxyAuthRequired {
+        t.Fatalf("no credentials: %d, want 407", code)
+    }
+    if code, _ := get(t, client("http://alice:wrong@"+s.Addr()), plain.URL); code != http.StatusProxyAuthRequired {
+        t.Fatalf("wrong password: %d, want 407", code)
+    }
+    if code, body := get(t, client("http://alice:secret@"+s.Addr()), plain.URL+"/ok"); code != 200 || body != "hello /ok" {
+        t.Fatalf("authenticated: %d %q", code, body)
+    }
+}
+
+func TestBadGateway(t *testing.T) {
+    fail := func(context.Context, string, int) (net.Conn, error) { return nil, fmt.Errorf("upstream not ready") }
+    s := start(t, Config{Dial: fail})
+    code, body := get(t, client("http://"+s.Addr()), "http://example.invalid/")
+    if code != http.StatusBadGateway || !strings.Contains(body, "upstream not ready") {
+        t.Fatalf("got %d %q", code, body)
+    }
+}
+
+func TestMixedPort(t *testing.T) {
+    var ss *shimsocks.Server
+    hp := New(Config{Dial: func(ctx context.Context, host string, port int) (net.Conn, error) { return ss.Dial(ctx, host, port) }})
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    bind := ln.Addr().String()
+    ln.Close()
+    ss = shimsocks.New(shimsocks.Config{ListenAddr: bind, AllowDirectFallback: true, Other: hp.ServeConn})
+    if err := ss.Start(context.Background()); err != nil { t.Fatal(err) }
+    defer ss.Stop()
+
+    plain := origin(t, false)
+    c := client("http://" + bind)
+    defer c.CloseIdleConnections() // the shim waits for open connections on Stop
+    if code, body := get(t, c, plain.URL+"/http"); code != 200 || body != "hello /http" {
+        t.Fatalf("HTTP on mixed port: %d %q", code, body)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    u, _ := url.Parse(plain.URL)
+    host, port, _ := net.SplitHostPort(u.Host)
+    p, _ := strconv.Atoi(port)
+    conn, err := socks5.DialVia(ctx, bind, host, p)
+    if err != nil { t.Fatalf("SOCKS on mixed port: %v", err) }
+    conn.Close()
+}
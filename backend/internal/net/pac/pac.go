@@ -0,0 +1,174 @@
+// Package pac generates proxy auto-config files from the session binds,
+// bypass lists and the routing rules.
+package pac
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net"
+    "net/netip"
+    "strings"
+
+    "bulletproof/backend/internal/net/rules"
+)
+
+// Settings are the user's PAC preferences, persisted by the daemon.
+type Settings struct {
+    // ProxyOnlyListed sends only ProxyDomains through the tunnel; everything
+    // else goes DIRECT. Otherwise everything not bypassed is proxied.
+    ProxyOnlyListed bool     `json:"proxyOnlyListed,omitempty"`
+    ProxyDomains    []string `json:"proxyDomains,omitempty"` // "example.com" (and subdomains) or "*.example.com"
+    Bypass          []string `json:"bypass,omitempty"`       // domains as above, or IPv4 CIDRs/addresses
+    // FallbackDirect appends DIRECT to the proxy route so browsers go direct
+    // when the local proxy is down (default true).
+    FallbackDirect *bool `json:"fallbackDirect,omitempty"`
+    // BypassPrivate sends localhost, plain host names, *.local and private
+    // IPv4 ranges DIRECT (default true).
+    BypassPrivate *bool `json:"bypassPrivate,omitempty"`
+}
+
+// Validate reports entries that cannot be expressed in a PAC file.
+func (s Settings) Validate() error {
+    for _, d := range s.ProxyDomains {
+        if _, ok := domainCond(d); !ok { return fmt.Errorf("invalid proxy domain %q", d) }
+    }
+    for _, b := range s.Bypass {
+        if _, ok := netCond(b); ok { continue }
+        if _, ok := domainCond(b); !ok || strings.Contains(b, "/") || strings.Contains(b, ":") { return fmt.Errorf("invalid bypass entry %q (want a domain or IPv4 CIDR)", b) }
+    }
+    return nil
+}
+
+func (s Settings) fallback() bool { return s.FallbackDirect == nil || *s.FallbackDirect }
+func (s Settings) private() bool  { return s.BypassPrivate == nil || *s.BypassPrivate }
+
+// Input is everything a PAC file is generated from.
+type Input struct {
+    Settings Settings
+    Bind     string        // SOCKS5 bind; empty when not connected
+    HTTPBind string        // HTTP proxy bind, if any; preferred by clients without SOCKS5 support
+    Rules    rules.RuleSet // leading domain, keyword and IPv4 CIDR rules are carried over
+}
+
+// File is a generated PAC file.
+type File struct {
+    Script  string
+    Version string // content hash, usable as an ETag
+}
+
+// privateNets are the IPv4 ranges bypassed by BypassPrivate.
+var privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16"}
+
+// Generate builds the PAC file. Conditions are emitted one per line in a
+// small fixed vocabulary: host ==, dnsDomainIs, shExpMatch, isPlainHostName
+// and isInNet guarded by an IPv4-literal test so host names are never resolved.
+// Rules match first-wins, so copying stops at the first rule without a PAC
+// form (regex or port): it might match hosts that later rules would send
+// elsewhere. Those hosts fall through to the bypass list and the default.
+func Generate(in Input) File {
+    proxy := "DIRECT"
+    if in.Bind != "" || in.HTTPBind != "" {
+        var routes []string
+        if in.HTTPBind != "" { routes = append(routes, "PROXY "+in.HTTPBind) }
+        if in.Bind != "" { routes = append(routes, "SOCKS5 "+in.Bind, "SOCKS "+in.Bind) }
+        if in.Settings.fallback() { routes = append(routes, "DIRECT") }
+        proxy = strings.Join(routes, "; ")
+    }
+
+    var body strings.Builder
+    emit := func(cond, route string) { fmt.Fprintf(&body, "  if (%s) return %q;\n", cond, route) }
+    if in.Settings.private() {
+        emit("isPlainHostName(host)", "DIRECT")
+        emit(`host == "localhost" || dnsDomainIs(host, ".localhost")`, "DIRECT")
+        emit(`dnsDomainIs(host, ".local")`, "DIRECT")
+        for _, n := range privateNets {
+            if c, ok := netCond(n); ok { emit(c, "DIRECT") }
+        }
+    }
+    for _, r := range in.Rules.Rules {
+        conds := ruleConds(r)
+        if conds == nil { break }
+        // Blocked destinations go to the proxy, which refuses them.
+        route := proxy
+        if r.Action == rules.Direct { route = "DIRECT" }
+        for _, c := range conds { emit(c, route) }
+    }
+    for _, b := range in.Settings.Bypass {
+        if c, ok := netCond(b); ok {
+            emit(c, "DIRECT")
+        } else if c, ok := domainCond(b); ok {
+            emit(c, "DIRECT")
+        }
+    }
+    def := proxy
+    if in.Settings.ProxyOnlyListed {
+        for _, d := range in.Settings.ProxyDomains {
+            if c, ok := domainCond(d); ok { emit(c, proxy) }
+        }
+        def = "DIRECT"
+    }
+    fmt.Fprintf(&body, "  return %q;\n", def)
+
+    sum := sha256.Sum256([]byte(body.String()))
+    version := hex.EncodeToString(sum[:8])
+    script := "// bulletproof pac " + version + "\n" +
+        "function FindProxyForURL(url, host) {\n" +
+        "  host = host.toLowerCase();\n" +
+        "  var ipv4 = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n" +
+        body.String() +
+        "}\n"
+    return File{Script: script, Version: version}
+}
+
+// domainCond matches a domain and its subdomains ("*.x" matches subdomains only).
+func domainCond(d string) (string, bool) {
+    d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+    if d == "" || strings.ContainsAny(d, `"\ `) { return "", false }
+    if strings.HasPrefix(d, "*.") { return fmt.Sprintf("dnsDomainIs(host, %q)", d[1:]), true }
+    return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", d, "."+d), true
+}
+
+// netCond matches IPv4 literals inside an IPv4 prefix or address.
+func netCond(s string) (string, bool) {
+    s = strings.TrimSpace(s)
+    p, err := netip.ParsePrefix(s)
+    if err != nil {
+        a, aerr := netip.ParseAddr(s)
+        if aerr != nil { return "", false }
+        p = netip.PrefixFrom(a, a.BitLen())
+    }
+    if !p.Addr().Is4() { return "", false }
+    p = p.Masked()
+    mask := net.IP(net.CIDRMask(p.Bits(), 32)).String()
+    return fmt.Sprintf("ipv4 && isInNet(host, %q, %q)", p.Addr().String(), mask), true
+}
+
+// ruleConds translates a routing rule, or returns nil if it has no PAC form
+// (regex and port rules, or values that cannot be quoted).
+func ruleConds(r rules.Rule) []string {
+    v := strings.ToLower(strings.TrimSpace(r.Value))
+    if strings.ContainsAny(v, `"\`) { return nil }
+    var c string
+    ok := false
+    switch r.Type {
+    case rules.TypeDomain:
+        c, ok = fmt.Sprintf("host == %q", strings.TrimSuffix(v, ".")), true
+    case rules.TypeSuffix:
+        c, ok = domainCond(strings.TrimPrefix(v, "*."))
+    case rules.TypeKeyword:
+        c, ok = fmt.Sprintf("shExpMatch(host, %q)", "*"+v+"*"), !strings.ContainsAny(v, "*?")
+    case rules.TypeCIDR:
+        if v != "private" {
+            c, ok = netCond(v)
+            break
+        }
+        var conds []string
+        for _, n := range privateNets {
+            if c, ok := netCond(n); ok { conds = append(conds, c) }
+        }
+        return conds
+    }
+    if !ok { return nil }
+    return []string{c}
+}
@@ -0,0 +1,201 @@
+package pac
+
+import (
+    "net"
+    "path"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+
+    "bulletproof/backend/internal/net/rules"
+)
+
+// evaluator runs generated PAC scripts without a JavaScript engine. It only
+// understands the statement and condition forms Generate emits and fails the
+// test on anything else, so it also pins down the generated vocabulary.
+type evaluator struct {
+    t     *testing.T
+    conds [][]string // per statement: atoms joined by ||
+    route []string
+    def   string
+}
+
+var (
+    reIf     = regexp.MustCompile(`^  if \((.+)\) return ("[^"]*");$`)
+    reReturn = regexp.MustCompile(`^  return ("[^"]*");$`)
+    reEq     = regexp.MustCompile(`^host == ("[^"]*")$`)
+    reDomain = regexp.MustCompile(`^dnsDomainIs\(host, ("[^"]*")\)$`)
+    reShExp  = regexp.MustCompile(`^shExpMatch\(host, ("[^"]*")\)$`)
+    reInNet  = regexp.MustCompile(`^ipv4 && isInNet\(host, ("[^"]*"), ("[^"]*")\)$`)
+    reIPv4   = regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
+)
+
+func parse(t *testing.T, script string) *evaluator {
+    t.Helper()
+    lines := strings.Split(strings.TrimSuffix(script, "\n"), "\n")
+    head := []string{
+        "function FindProxyForURL(url, host) {",
+        "  host = host.toLowerCase();",
+        `  var ipv4 = /^\d+\.\d+\.\d+\.\d+$/.test(host);`,
+    }
+    if len(lines) < 6 || !strings.HasPrefix(lines[0], "// bulletproof pac ") || lines[len(lines)-1] != "}" {
+        t.Fatalf("unexpected PAC layout:\n%s", script)
+    }
+    for i, h := range head {
+        if lines[i+1] != h { t.Fatalf("line %d = %q, want %q", i+2, lines[i+1], h) }
+    }
+    e := &evaluator{t: t}
+    for _, l := range lines[4 : len(lines)-1] {
+        if m := reIf.FindStringSubmatch(l); m != nil {
+            e.conds = append(e.conds, strings.Split(m[1], " || "))
+            e.route = append(e.route, unquote(t, m[2]))
+            continue
+        }
+        if m := reReturn.FindStringSubmatch(l); m != nil && e.def == "" {
+            e.def = unquote(t, m[1])
+            continue
+        }
+        t.Fatalf("unexpected PAC statement %q", l)
+    }
+    if e.def == "" { t.Fatal("PAC has no final return") }
+    return e
+}
+
+func unquote(t *testing.T, s string) string {
+    v, err := strconv.Unquote(s)
+    if err != nil { t.Fatalf("bad string literal %s", s) }
+    return v
+}
+
+func (e *evaluator) find(host string) string {
+    host = strings.ToLower(host)
+    for i, atoms := range e.conds {
+        for _, a := range atoms {
+            if e.atom(a, host) { return e.route[i] }
+        }
+    }
+    return e.def
+}
+
+func (e *evaluator) atom(a, host string) bool {
+    switch {
+    case a == "isPlainHostName(host)":
+        return !strings.Contains(host, ".")
+    case reEq.MatchString(a):
+        return host == unquote(e.t, reEq.FindStringSubmatch(a)[1])
+    case reDomain.MatchString(a):
+        return strings.HasSuffix(host, unquote(e.t, reDomain.FindStringSubmatch(a)[1]))
+    case reShExp.MatchString(a):
+        ok, err := path.Match(unquote(e.t, reShExp.FindStringSubmatch(a)[1]), host)
+        return err == nil && ok
+    case reInNet.MatchString(a):
+        m := reInNet.FindStringSubmatch(a)
+        if !reIPv4.MatchString(host) { return false }
+        ip, pat, mask := net.ParseIP(host).To4(), net.ParseIP(unquote(e.t, m[1])).To4(), net.IPMask(net.ParseIP(unquote(e.t, m[2])).To4())
+        return ip != nil && ip.Mask(mask).Equal(pat)
+    }
+    e.t.Fatalf("unexpected PAC condition %q", a)
+    return false
+}
+
+func boolp(b bool) *bool { return &b }
+
+const socks = "SOCKS5 127.0.0.1:8087; SOCKS 127.0.0.1:8087; DIRECT"
+
+func TestGenerate_ProxyAll(t *testing.T) {
+    rs, err := rules.Parse("test.rules", "suffix corp.example direct\nkeyword ads block\ncidr 203.0.113.0/24 direct\nregex ^x direct\nsuffix example.com proxy\n")
+    if err != nil { t.Fatal(err) }
+    f := Generate(Input{
+        Bind:     "127.0.0.1:8087",
+        Rules:    rs,
+        Settings: Settings{Bypass: []string{"intranet.test", "*.lab.test", "198.51.100.7"}},
+    })
+    e := parse(t, f.Script)
+    cases := map[string]string{
+        "localhost":           "DIRECT",
+        "printer":             "DIRECT",
+        "nas.local":           "DIRECT",
+        "192.168.1.20":        "DIRECT",
+        "172.31.0.1":          "DIRECT",
+        "172.32.0.1":          socks,
+        "git.corp.example":    "DIRECT",
+        "ads.corp.example":    "DIRECT", // earlier direct rule wins, as in the shim
+        "tracker.ads.net":     socks,    // blocked by the shim
+        "203.0.113.9":         "DIRECT",
+        "intranet.test":       "DIRECT",
+        "wiki.intranet.test":  "DIRECT",
+        "lab.test":            socks,
+        "box.lab.test":        "DIRECT",
+        "198.51.100.7":        "DIRECT",
+        "198.51.100.8":        socks,
+        "www.EXAMPLE.org":     socks,
+        "corp.example.evil.x": socks,
+    }
+    for host, want := range cases {
+        if got := e.find(host); got != want { t.Errorf("FindProxyForURL(%q) = %q, want %q", host, got, want) }
+    }
+}
+
+func TestGenerate_StopsAtRulesWithoutPACForm(t *testing.T) {
+    // The regex rule sends corp hosts DIRECT in the shim, so the later
+    // "proxy" rule must not claim them here.
+    rs, err := rules.Parse("test.rules", "suffix lan.example direct\nregex ^.*\\.corp\\.example$ direct\nsuffix corp.example proxy\n")
+    if err != nil { t.Fatal(err) }
+    e := parse(t, Generate(Input{
+        Bind:     "127.0.0.1:8087",
+        Rules:    rs,
+        Settings: Settings{ProxyOnlyListed: true, ProxyDomains: []string{"vpn.example"}},
+    }).Script)
+    cases := map[string]string{
+        "git.lan.example":  "DIRECT", // before the regex rule
+        "git.corp.example": "DIRECT", // after it: left to the default
+        "vpn.example":      socks,
+    }
+    for host, want := range cases {
+        if got := e.find(host); got != want { t.Errorf("FindProxyForURL(%q) = %q, want %q", host, got, want) }
+    }
+}
+
+func TestGenerate_ProxyOnlyListed(t *testing.T) {
+    f := Generate(Input{
+        Bind:     "127.0.0.1:8087",
+        HTTPBind: "127.0.0.1:8100",
+        Settings: Settings{ProxyOnlyListed: true, ProxyDomains: []string{"blocked-site.example", "*.video.example"}, FallbackDirect: boolp(false), BypassPrivate: boolp(false)},
+    })
+    e := parse(t, f.Script)
+    proxied := "PROXY 127.0.0.1:8100; SOCKS5 127.0.0.1:8087; SOCKS 127.0.0.1:8087"
+    cases := map[string]string{
+        "blocked-site.example":     proxied,
+        "cdn.blocked-site.example": proxied,
+        "a.video.example":          proxied,
+        "video.example":            "DIRECT",
+        "example.org":              "DIRECT",
+        "localhost":                "DIRECT", // not listed
+    }
+    for host, want := range cases {
+        if got := e.find(host); got != want { t.Errorf("FindProxyForURL(%q) = %q, want %q", host, got, want) }
+    }
+    if strings.Contains(f.Script, "isPlainHostName") { t.Error("private bypass emitted although disabled") }
+}
+
+func TestGenerate_DisconnectedAndVersion(t *testing.T) {
+    e := parse(t, Generate(Input{}).Script)
+    if got := e.find("example.com"); got != "DIRECT" { t.Fatalf("disconnected: %q", got) }
+
+    a := Generate(Input{Bind: "127.0.0.1:8087"})
+    b := Generate(Input{Bind: "127.0.0.1:8087"})
+    c := Generate(Input{Bind: "127.0.0.1:8088"})
+    if a.Version != b.Version || a.Version == c.Version || len(a.Version) != 16 {
+        t.Fatalf("versions: %q %q %q", a.Version, b.Version, c.Version)
+    }
+    if !strings.Contains(a.Script, a.Version) { t.Fatal("version not embedded in script") }
+}
+
+func TestSettingsValidate(t *testing.T) {
+    ok := Settings{ProxyDomains: []string{"example.com", "*.example.org"}, Bypass: []string{"10.1.0.0/16", "192.0.2.1", "corp.example"}}
+    if err := ok.Validate(); err != nil { t.Fatal(err) }
+    for _, bad := range []Settings{{Bypass: []string{"fd00::/8"}}, {Bypass: []string{"10.0.0.0/40"}}, {ProxyDomains: []string{`a"b`}}} {
+        if err := bad.Validate(); err == nil { t.Errorf("%+v: want error", bad) }
+    }
+}
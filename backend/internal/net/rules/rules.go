@@ -0,0 +1,287 @@
+// Package rules decides per destination whether traffic goes through the
+// tunnel, directly, or nowhere (split tunnelling).
+package rules
+
+import (
+    "bufio"
+    "fmt"
+    "net/netip"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Action is what happens to a matching connection.
+type Action string
+
+const (
+    Proxy  Action = "proxy"  // through the tunnel
+    Direct Action = "direct" // bypass the tunnel
+    Block  Action = "block"  // refuse
+)
+
+// Rule types.
+const (
+    TypeDomain  = "domain"  // exact host name
+    TypeSuffix  = "suffix"  // host name or any subdomain of it
+    TypeKeyword = "keyword" // host name contains the value
+    TypeRegex   = "regex"   // host name matches the regular expression
+    TypeCIDR    = "cidr"    // IP literal inside the prefix ("private" = LAN, loopback and link-local ranges)
+    TypePort    = "port"    // destination port or range, e.g. 22 or 8000-8999
+)
+
+// Rule is one routing rule. Rules are evaluated in order; the first match wins.
+type Rule struct {
+    Type   string `json:"type"`
+    Value  string `json:"value"`
+    Action Action `json:"action"`
+    Source string `json:"source,omitempty"` // file:line it was loaded from
+}
+
+// RuleSet is an ordered list of rules and the action for unmatched traffic.
+type RuleSet struct {
+    Default Action `json:"default,omitempty"` // default Proxy
+    Rules   []Rule `json:"rules"`
+}
+
+// privateRanges back the "cidr private" shorthand.
+var privateRanges = []string{
+    "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+    "127.0.0.0/8", "169.254.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+}
+
+type compiled struct {
+    Rule
+    re       *regexp.Regexp
+    prefixes []netip.Prefix
+    lo, hi   int
+}
+
+func (c *compiled) match(host string, ip netip.Addr, port int) bool {
+    switch c.Type {
+    case TypeDomain:
+        return !ip.IsValid() && host == c.Value
+    case TypeSuffix:
+        return !ip.IsValid() && (host == c.Value || strings.HasSuffix(host, "."+c.Value))
+    case TypeKeyword:
+        return !ip.IsValid() && strings.Contains(host, c.Value)
+    case TypeRegex:
+        return !ip.IsValid() && c.re.MatchString(host)
+    case TypeCIDR:
+        if !ip.IsValid() { return false }
+        for _, p := range c.prefixes {
+            if p.Contains(ip) { return true }
+        }
+        return false
+    case TypePort:
+        return port >= c.lo && port <= c.hi
+    }
+    return false
+}
+
+func compile(r Rule) (compiled, error) {
+    c := compiled{Rule: r}
+    c.Type = strings.ToLower(strings.TrimSpace(r.Type))
+    c.Value = strings.TrimSpace(r.Value)
+    switch c.Action = Action(strings.ToLower(string(r.Action))); c.Action {
+    case Proxy, Direct, Block:
+    default:
+        return c, fmt.Errorf("invalid action %q", r.Action)
+    }
+    if c.Value == "" { return c, fmt.Errorf("%s rule without value", c.Type) }
+    switch c.Type {
+    case TypeDomain, TypeSuffix, TypeKeyword:
+        c.Value = normHost(c.Value)
+        if c.Type == TypeSuffix { c.Value = strings.TrimPrefix(c.Value, "*.") }
+    case TypeRegex:
+        re, err := regexp.Compile(c.Value)
+        if err != nil { return c, err }
+        c.re = re
+    case TypeCIDR:
+        vals := []string{c.Value}
+        if c.Value == "private" { vals = privateRanges }
+        for _, v := range vals {
+            p, err := netip.ParsePrefix(v)
+            if err != nil {
+                a, aerr := netip.ParseAddr(v)
+                if aerr != nil { return c, err }
+                p = netip.PrefixFrom(a, a.BitLen())
+            }
+            c.prefixes = append(c.prefixes, p.Masked())
+        }
+    case TypePort:
+        lo, hi, found := strings.Cut(c.Value, "-")
+        if !found { hi = lo }
+        var err1, err2 error
+        c.lo, err1 = strconv.Atoi(lo)
+        c.hi, err2 = strconv.Atoi(hi)
+        if err1 != nil || err2 != nil || c.lo < 0 || c.hi > 65535 || c.lo > c.hi { return c, fmt.Errorf("invalid port range %q", c.Value) }
+    default:
+        return c, fmt.Errorf("unknown rule type %q", r.Type)
+    }
+    return c, nil
+}
+
+func normHost(h string) string { return strings.TrimSuffix(strings.ToLower(h), ".") }
+
+// Matcher is a compiled RuleSet.
+type Matcher struct {
+    set   RuleSet
+    rules []compiled
+}
+
+// Compile validates rs and prepares it for matching.
+func Compile(rs RuleSet) (*Matcher, error) {
+    m := &Matcher{set: rs}
+    m.set.Rules = make([]Rule, len(rs.Rules))
+    if m.set.Default == "" { m.set.Default = Proxy }
+    switch m.set.Default {
+    case Proxy, Direct, Block:
+    default:
+        return nil, fmt.Errorf("invalid default action %q", rs.Default)
+    }
+    for i, r := range rs.Rules {
+        c, err := compile(r)
+        if err != nil {
+            where := r.Source
+            if where == "" { where = "rule " + strconv.Itoa(i+1) }
+            return nil, fmt.Errorf("%s: %w", where, err)
+        }
+        m.rules = append(m.rules, c)
+        m.set.Rules[i] = c.Rule
+    }
+    return m, nil
+}
+
+// Match returns the action for host:port and the rule that decided it (nil
+// for the default). host may be a name or an IP literal; names are not
+// resolved, so CIDR rules only apply to connections made by IP.
+func (m *Matcher) Match(host string, port int) (Action, *Rule) {
+    if m == nil { return Proxy, nil }
+    host = normHost(strings.Trim(host, "[]"))
+    ip, err := netip.ParseAddr(host)
+    if err == nil { ip = ip.Unmap() }
+    for i := range m.rules {
+        if m.rules[i].match(host, ip, port) { return m.rules[i].Action, &m.set.Rules[i] }
+    }
+    return m.set.Default, nil
+}
+
+// RuleSet returns the rules the matcher was compiled from.
+func (m *Matcher) RuleSet() RuleSet {
+    if m == nil { return RuleSet{Default: Proxy} }
+    rs := m.set
+    rs.Rules = append([]Rule(nil), m.set.Rules...)
+    return rs
+}
+
+// Parse reads the text rule format: one "<type> <value> <action>" per line,
+// "default <action>" to set the default, and '#' comments. name labels rule
+// sources in errors and listings.
+func Parse(name, text string) (RuleSet, error) {
+    var rs RuleSet
+    sc := bufio.NewScanner(strings.NewReader(text))
+    for n := 1; sc.Scan(); n++ {
+        line := sc.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') { line = line[:i] }
+        f := strings.Fields(line)
+        if len(f) == 0 { continue }
+        src := fmt.Sprintf("%s:%d", name, n)
+        if strings.EqualFold(f[0], "default") && len(f) == 2 {
+            switch a := Action(strings.ToLower(f[1])); a {
+            case Proxy, Direct, Block:
+                rs.Default = a
+            default:
+                return rs, fmt.Errorf("%s: invalid default action %q", src, f[1])
+            }
+            continue
+        }
+        if len(f) < 3 { return rs, fmt.Errorf("%s: want \"<type> <value> <action>\"", src) }
+        rs.Rules = append(rs.Rules, Rule{
+            Type:   f[0],
+            Value:  strings.Join(f[1:len(f)-1], " "),
+            Action: Action(f[len(f)-1]),
+            Source: src,
+        })
+    }
+    return rs, sc.Err()
+}
+
+// Format renders rs in the text format read by Parse.
+func Format(rs RuleSet) string {
+    var b strings.Builder
+    if rs.Default != "" { fmt.Fprintf(&b, "default %s\n", rs.Default) }
+    for _, r := range rs.Rules { fmt.Fprintf(&b, "%s %s %s\n", r.Type, r.Value, r.Action) }
+    return b.String()
+}
+
+// Table holds the active rule set. It is safe for concurrent use and is
+// swapped atomically on reload, so open listeners pick up changes at once.
+type Table struct {
+    cur    atomic.Pointer[Matcher]
+    loaded atomic.Pointer[loadInfo]
+}
+
+type loadInfo struct {
+    Files []string
+    At    time.Time
+}
+
+// Ext is the extension of rule files loaded by LoadDir.
+const Ext = ".rules"
+
+// Match applies the active rules. A nil Table routes everything via Proxy.
+func (t *Table) Match(host string, port int) (Action, *Rule) {
+    if t == nil { return Proxy, nil }
+    return t.cur.Load().Match(host, port)
+}
+
+// Set compiles rs and makes it active.
+func (t *Table) Set(rs RuleSet) error {
+    m, err := Compile(rs)
+    if err != nil { return err }
+    t.cur.Store(m)
+    t.loaded.Store(&loadInfo{At: time.Now()})
+    return nil
+}
+
+// LoadDir reads every *.rules file in dir in name order and makes the
+// concatenated rules active; a later file's default overrides an earlier
+// one. A missing dir means no rules. On error the active rules are kept.
+func (t *Table) LoadDir(dir string) error {
+    files, err := filepath.Glob(filepath.Join(dir, "*"+Ext))
+    if err != nil { return err }
+    sort.Strings(files)
+    var all RuleSet
+    for _, f := range files {
+        b, err := os.ReadFile(f)
+        if err != nil { return err }
+        rs, err := Parse(filepath.Base(f), string(b))
+        if err != nil { return err }
+        if rs.Default != "" { all.Default = rs.Default }
+        all.Rules = append(all.Rules, rs.Rules...)
+    }
+    m, err := Compile(all)
+    if err != nil { return err }
+    t.cur.Store(m)
+    t.loaded.Store(&loadInfo{Files: files, At: time.Now()})
+    return nil
+}
+
+// Snapshot describes the active rules for display.
+type Snapshot struct {
+    RuleSet
+    Files    []string  `json:"files,omitempty"`
+    LoadedAt time.Time `json:"loadedAt,omitempty"`
+}
+
+func (t *Table) Snapshot() Snapshot {
+    s := Snapshot{RuleSet: t.cur.Load().RuleSet()}
+    if li := t.loaded.Load(); li != nil { s.Files, s.LoadedAt = li.Files, li.At }
+    return s
+}
@@ -0,0 +1,109 @@
+package rules
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const sample = `
+# intranet and LAN stay off the tunnel
+suffix corp.example direct
+domain Printer.Local. direct
+cidr private direct
+cidr 203.0.113.7 block
+keyword ads block
+regex ^cdn[0-9]+\.example\.net$ direct
+port 25 block
+port 6881-6889 direct
+default proxy
+`
+
+func TestMatch(t *testing.T) {
+    rs, err := Parse("sample.rules", sample)
+    if err != nil { t.Fatal(err) }
+    m, err := Compile(rs)
+    if err != nil { t.Fatal(err) }
+    cases := []struct {
+        host string
+        port int
+        want Action
+    }{
+        {"corp.example", 443, Direct},
+        {"git.corp.example", 443, Direct},
+        {"notcorp.example", 443, Proxy},
+        {"printer.local", 631, Direct},
+        {"192.168.1.10", 80, Direct},
+        {"[fe80::1]", 80, Direct},
+        {"::ffff:10.0.0.1", 80, Direct},
+        {"203.0.113.7", 443, Block},
+        {"203.0.113.8", 443, Proxy},
+        {"tracker.ads.example", 443, Block},
+        {"cdn42.example.net", 443, Direct},
+        {"cdn.example.net", 443, Proxy},
+        {"mail.example.org", 25, Block},
+        {"peer.example.org", 6885, Direct},
+        {"example.org", 443, Proxy},
+    }
+    for _, c := range cases {
+        if got, _ := m.Match(c.host, c.port); got != c.want {
+            t.Errorf("Match(%q, %d) = %s, want %s", c.host, c.port, got, c.want)
+        }
+    }
+    _, rule := m.Match("git.corp.example", 443)
+    if rule == nil || rule.Source != "sample.rules:3" { t.Fatalf("deciding rule = %+v", rule) }
+}
+
+func TestCompileErrors(t *testing.T) {
+    for _, text := range []string{
+        "suffix example.com maybe",
+        "cidr 10.0.0.0/33 direct",
+        "port 9-1 direct",
+        "regex ([ direct",
+        "geoip US direct",
+        "default sideways",
+        "suffix direct",
+    } {
+        rs, err := Parse("bad.rules", text)
+        if err == nil { _, err = Compile(rs) }
+        if err == nil || !strings.Contains(err.Error(), "bad.rules:1") {
+            t.Errorf("%q: err = %v, want error naming bad.rules:1", text, err)
+        }
+    }
+}
+
+func TestTableLoadDir(t *testing.T) {
+    dir := t.TempDir()
+    write := func(name, text string) {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o600); err != nil { t.Fatal(err) }
+    }
+    var tbl Table
+    if act, _ := tbl.Match("example.com", 443); act != Proxy { t.Fatalf("empty table: %s", act) }
+
+    write("10-lan.rules", "cidr private direct\ndefault direct\n")
+    write("20-block.rules", "suffix example.com block\ndefault proxy\n")
+    write("notes.txt", "suffix example.org block\n")
+    if err := tbl.LoadDir(dir); err != nil { t.Fatal(err) }
+    snap := tbl.Snapshot()
+    if len(snap.Rules) != 2 || snap.Default != Proxy || len(snap.Files) != 2 {
+        t.Fatalf("snapshot = %+v", snap)
+    }
+    if act, _ := tbl.Match("www.example.com", 443); act != Block { t.Fatalf("example.com: %s", act) }
+    if act, _ := tbl.Match("example.org", 443); act != Proxy { t.Fatalf("example.org: %s", act) }
+
+    // A broken file keeps the previous rules active.
+    write("30-broken.rules", "nonsense\n")
+    if err := tbl.LoadDir(dir); err == nil { t.Fatal("broken file loaded") }
+    if act, _ := tbl.Match("www.example.com", 443); act != Block { t.Fatalf("rules lost after failed reload: %s", act) }
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+    rs, err := Parse("sample.rules", sample)
+    if err != nil { t.Fatal(err) }
+    again, err := Parse("formatted", Format(rs))
+    if err != nil { t.Fatal(err) }
+    if len(again.Rules) != len(rs.Rules) || again.Default != rs.Default || again.Rules[5].Value != rs.Rules[5].Value {
+        t.Fatalf("round trip changed rules: %+v", again)
+    }
+}
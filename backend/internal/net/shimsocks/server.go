@@ -2,14 +2,19 @@ package shimsocks
 
 import (
     "bufio"
+    "bytes"
     "context"
+    "crypto/subtle"
     "errors"
+    "fmt"
     "io"
     "net"
     "strconv"
+    "strings"
     "sync"
     "time"
 
+    "bulletproof/backend/internal/net/rules"
     sockscli "bulletproof/backend/internal/net/socks5"
 )
 
@@ -22,18 +27,88 @@ type Config struct {
     UpstreamSocks string
     // AllowDirectFallback controls whether to dial directly if UpstreamSocks is not reachable.
     AllowDirectFallback bool
+    // UDPTimeout ends a UDP association after this long without datagrams
+    // (default 2m). The association also ends when its TCP connection closes.
+    UDPTimeout time.Duration
+    // Other, if set, serves connections that do not start with a SOCKS5
+    // greeting on the same listener (a "mixed" port, e.g. an HTTP proxy).
+    Other func(c net.Conn)
+    // Rules routes each destination through the upstream, directly, or
+    // refuses it. nil sends everything through the upstream.
+    Rules *rules.Table
+    // Users enables RFC 1929 username/password auth. When empty, clients
+    // connect without authentication.
+    Users map[string]User
 }
 
-// Server is a minimal SOCKS5 no-auth server with optional upstream chaining.
+// User is a set of shim credentials and their limits.
+type User struct {
+    Password string
+    MaxConns int // concurrent connections allowed; 0 = unlimited
+}
+
+// Server is a minimal SOCKS5 server with optional username/password auth and
+// upstream chaining.
 type Server struct {
     cfg Config
     ln  net.Listener
     mu  sync.Mutex
     wg  sync.WaitGroup
     stop chan struct{}
+    conns map[string]int // open connections per user
+    udp   map[string]bool // upstream address -> supports UDP ASSOCIATE
+}
+
+func New(cfg Config) *Server { return &Server{cfg: cfg, stop: make(chan struct{}), conns: map[string]int{}, udp: map[string]bool{}} }
+
+// ParseUsers builds the user table from connect options: a primary user and
+// password with an optional connection limit, plus a comma-separated list of
+// further user:pass[:maxConns] entries. The primary user is required when
+// the list is set, since the daemon's own clients authenticate with it.
+// Both empty means no authentication.
+func ParseUsers(user, pass, maxConns, list string) (map[string]User, error) {
+    if user == "" && strings.TrimSpace(list) != "" { return nil, errors.New("socks user list requires a primary socks user") }
+    users := map[string]User{}
+    add := func(name, pw, limit string) error {
+        if name == "" || len(name) > 255 || len(pw) > 255 { return fmt.Errorf("invalid socks user %q", name) }
+        u := User{Password: pw}
+        if limit != "" {
+            n, err := strconv.Atoi(limit)
+            if err != nil || n < 0 { return fmt.Errorf("invalid connection limit for socks user %q: %q", name, limit) }
+            u.MaxConns = n
+        }
+        users[name] = u
+        return nil
+    }
+    if user != "" {
+        if err := add(user, pass, maxConns); err != nil { return nil, err }
+    }
+    for _, e := range strings.Split(list, ",") {
+        if e = strings.TrimSpace(e); e == "" { continue }
+        f := strings.SplitN(e, ":", 3)
+        if len(f) < 2 { return nil, fmt.Errorf("invalid socks user entry %q (want user:pass[:maxConns])", e) }
+        limit := ""
+        if len(f) == 3 { limit = f[2] }
+        if err := add(f[0], f[1], limit); err != nil { return nil, err }
+    }
+    if len(users) == 0 { return nil, nil }
+    return users, nil
 }
 
-func New(cfg Config) *Server { return &Server{cfg: cfg, stop: make(chan struct{})} }
+// SetUpstream points new connections at a different upstream SOCKS5 proxy,
+// e.g. once a warp-plus instance has been selected. Open connections are kept.
+func (s *Server) SetUpstream(addr string) {
+    s.mu.Lock()
+    s.cfg.UpstreamSocks = addr
+    s.mu.Unlock()
+    if addr != "" { go s.CheckUDP(context.Background()) }
+}
+
+func (s *Server) upstream() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.cfg.UpstreamSocks
+}
 
 func (s *Server) Start(ctx context.Context) error {
     ln, err := net.Listen("tcp", s.cfg.ListenAddr)
@@ -79,18 +154,23 @@ func (s *Server) handleConn(ctx context.Context, c net.Conn) {
     br := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
     // greeting: version, nmethods, methods...
     h := make([]byte, 2)
+    if s.cfg.Other != nil {
+        if b, err := br.Peek(1); err != nil || b[0] != 0x05 {
+            if err == nil { s.cfg.Other(&peekedConn{Conn: c, r: br.Reader}) }
+            return
+        }
+    }
     if _, err := io.ReadFull(br, h); err != nil { return }
     if h[0] != 0x05 { return }
-    n := int(h[1])
-    if n > 0 { tmp := make([]byte, n); if _, err := io.ReadFull(br, tmp); err != nil { return } }
-    // reply: no-auth
-    if _, err := br.Write([]byte{0x05, 0x00}); err != nil { return }
-    if err := br.Flush(); err != nil { return }
+    methods := make([]byte, int(h[1]))
+    if _, err := io.ReadFull(br, methods); err != nil { return }
+    user, ok := s.negotiate(br, methods)
+    if !ok { return }
 
     // request: ver, cmd, rsv, atyp, dst...
     req := make([]byte, 4)
     if _, err := io.ReadFull(br, req); err != nil { return }
-    if req[0] != 0x05 || req[1] != 0x01 { // only CONNECT
+    if req[0] != 0x05 || (req[1] != 0x01 && req[1] != 0x03) { // CONNECT and UDP ASSOCIATE only
         // reply command not supported
         _ = writeReply(br, 0x07, 0x01, nil)
         return
@@ -116,21 +196,24 @@ func (s *Server) handleConn(ctx context.Context, c net.Conn) {
     if _, err := io.ReadFull(br, portb); err != nil { return }
     port := int(portb[0])<<8 | int(portb[1])
 
-    // Try upstream socks first if configured and reachable
-    var upstream net.Conn
-    var err error
+    if !s.acquire(user) {
+        _ = writeReply(br, 0x02, 0x01, nil) // connection not allowed by ruleset
+        return
+    }
+    defer s.release(user)
+
+    if req[1] == 0x03 {
+        s.associate(ctx, c, br, host)
+        return
+    }
+
     ctxDial, cancel := context.WithTimeout(ctx, 4*time.Second)
     defer cancel()
-    if s.cfg.UpstreamSocks != "" && probeTCP(s.cfg.UpstreamSocks, 500*time.Millisecond) {
-        upstream, err = sockscli.DialVia(ctxDial, s.cfg.UpstreamSocks, host, port)
-    } else if s.cfg.AllowDirectFallback {
-        d := net.Dialer{Timeout: 4 * time.Second}
-        upstream, err = d.DialContext(ctxDial, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
-    } else {
-        err = errors.New("upstream not ready")
-    }
+    upstream, err := s.Dial(ctxDial, host, port)
     if err != nil {
-        _ = writeReply(br, 0x01, atyp, nil) // general failure
+        rep := byte(0x01) // general failure
+        if errors.Is(err, ErrBlocked) { rep = 0x02 } // connection not allowed by ruleset
+        _ = writeReply(br, rep, atyp, nil)
         return
     }
     defer upstream.Close()
@@ -145,6 +228,100 @@ func (s *Server) handleConn(ctx context.Context, c net.Conn) {
     <-done
 }
 
+// negotiate picks the auth method and, for username/password, verifies the
+// credentials. It returns the authenticated user ("" without auth).
+func (s *Server) negotiate(br *bufio.ReadWriter, methods []byte) (string, bool) {
+    want := byte(0x00)
+    if len(s.cfg.Users) > 0 { want = 0x02 }
+    if bytes.IndexByte(methods, want) < 0 {
+        _, _ = br.Write([]byte{0x05, 0xff}) // no acceptable methods
+        _ = br.Flush()
+        return "", false
+    }
+    if _, err := br.Write([]byte{0x05, want}); err != nil { return "", false }
+    if err := br.Flush(); err != nil { return "", false }
+    if want == 0x00 { return "", true }
+
+    // RFC 1929: ver, ulen, uname, plen, passwd
+    h := make([]byte, 2)
+    if _, err := io.ReadFull(br, h); err != nil || h[0] != 0x01 { return "", false }
+    name := make([]byte, int(h[1]))
+    if _, err := io.ReadFull(br, name); err != nil { return "", false }
+    if _, err := io.ReadFull(br, h[:1]); err != nil { return "", false }
+    pass := make([]byte, int(h[0]))
+    if _, err := io.ReadFull(br, pass); err != nil { return "", false }
+    ok := s.checkPassword(string(name), string(pass))
+    status := byte(0x00)
+    if !ok { status = 0x01 }
+    if _, err := br.Write([]byte{0x01, status}); err != nil { return "", false }
+    if err := br.Flush(); err != nil || !ok { return "", false }
+    return string(name), true
+}
+
+func (s *Server) checkPassword(user, pass string) bool {
+    u, found := s.cfg.Users[user]
+    // Compare even for unknown users so timing does not reveal which names exist.
+    return subtle.ConstantTimeCompare([]byte(u.Password), []byte(pass)) == 1 && found
+}
+
+// acquire counts a connection against user's limit.
+func (s *Server) acquire(user string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if max := s.cfg.Users[user].MaxConns; max > 0 && s.conns[user] >= max { return false }
+    s.conns[user]++
+    return true
+}
+
+func (s *Server) release(user string) {
+    s.mu.Lock()
+    s.conns[user]--
+    if s.conns[user] <= 0 { delete(s.conns, user) }
+    s.mu.Unlock()
+}
+
+// Dial connects to host:port the way the shim does for CONNECT: as the rules
+// say, and for tunnelled traffic through the upstream SOCKS when it is
+// reachable, else directly if AllowDirectFallback.
+// Other front ends (e.g. the HTTP proxy) use it to share the same path.
+func (s *Server) Dial(ctx context.Context, host string, port int) (net.Conn, error) {
+    act, _ := s.cfg.Rules.Match(host, port)
+    if act == rules.Block { return nil, ErrBlocked }
+    if act == rules.Proxy {
+        if up := s.upstream(); up != "" && probeTCP(up, 500*time.Millisecond) {
+            return sockscli.DialVia(ctx, up, host, port)
+        }
+        if !s.cfg.AllowDirectFallback { return nil, errors.New("upstream not ready") }
+    }
+    d := net.Dialer{Timeout: 4 * time.Second}
+    return d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Login checks credentials against Users and counts a connection against the
+// user's limit; call release when the connection ends. Without Users every
+// login succeeds.
+func (s *Server) Login(user, pass string) (release func(), err error) {
+    if len(s.cfg.Users) > 0 {
+        if !s.checkPassword(user, pass) { return nil, ErrAuth }
+    } else {
+        user = ""
+    }
+    if !s.acquire(user) { return nil, ErrLimit }
+    return func() { s.release(user) }, nil
+}
+
+// AuthRequired reports whether clients must log in.
+func (s *Server) AuthRequired() bool { return len(s.cfg.Users) > 0 }
+
+var (
+    // ErrAuth is returned by Login for unknown users or wrong passwords.
+    ErrAuth = errors.New("invalid username or password")
+    // ErrLimit is returned by Login when the user has no connections left.
+    ErrLimit = errors.New("connection limit reached")
+    // ErrBlocked is returned by Dial for destinations refused by a block rule.
+    ErrBlocked = errors.New("blocked by rule")
+)
+
 func writeReply(br *bufio.ReadWriter, rep byte, atyp byte, bndAddr []byte) error {
     // ver, rep, rsv
     h := []byte{0x05, rep, 0x00}
@@ -173,6 +350,14 @@ func proxyCopy(dst io.Writer, src io.Reader, done chan struct{}) {
     done <- struct{}{}
 }
 
+// peekedConn is a connection whose first bytes were already buffered in r.
+type peekedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
 func probeTCP(addr string, timeout time.Duration) bool {
     d := net.Dialer{Timeout: timeout}
     c, err := d.Dial("tcp", addr)
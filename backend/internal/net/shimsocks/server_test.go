@@ -0,0 +1,150 @@
+package shimsocks
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "bulletproof/backend/internal/net/rules"
+    "bulletproof/backend/internal/net/socks5"
+)
+
+// echoServer accepts TCP connections and echoes what it reads.
+func echoServer(t *testing.T) (string, int) {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func() { defer c.Close(); _, _ = io.Copy(c, c) }()
+        }
+    }()
+    host, ps, _ := net.SplitHostPort(ln.Addr().String())
+    port, _ := strconv.Atoi(ps)
+    return host, port
+}
+
+func startShim(t *testing.T, users map[string]User) string {
+    t.Helper()
+    s := New(Config{ListenAddr: "127.0.0.1:0", AllowDirectFallback: true, Users: users})
+    if err := s.Start(context.Background()); err != nil { t.Fatal(err) }
+    t.Cleanup(func() { s.Stop() })
+    return s.ln.Addr().String()
+}
+
+func roundTrip(t *testing.T, c net.Conn) {
+    t.Helper()
+    _ = c.SetDeadline(time.Now().Add(2 * time.Second))
+    if _, err := c.Write([]byte("ping")); err != nil { t.Fatal(err) }
+    buf := make([]byte, 4)
+    if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" { t.Fatalf("echo = %q, %v", buf, err) }
+}
+
+func TestAuth(t *testing.T) {
+    host, port := echoServer(t)
+    bind := startShim(t, map[string]User{"alice": {Password: "p@ss:word"}})
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    c, err := socks5.DialVia(ctx, socks5.WithAuth(bind, "alice", "p@ss:word"), host, port)
+    if err != nil { t.Fatalf("authenticated dial: %v", err) }
+    roundTrip(t, c)
+    c.Close()
+
+    if _, err := socks5.DialVia(ctx, socks5.WithAuth(bind, "alice", "wrong"), host, port); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+        t.Fatalf("wrong password: err = %v", err)
+    }
+    if _, err := socks5.DialVia(ctx, socks5.WithAuth(bind, "mallory", "p@ss:word"), host, port); err == nil {
+        t.Fatal("unknown user accepted")
+    }
+    if _, err := socks5.DialVia(ctx, bind, host, port); err == nil {
+        t.Fatal("no-auth client accepted by authenticated shim")
+    }
+}
+
+func TestNoAuthStillWorks(t *testing.T) {
+    host, port := echoServer(t)
+    bind := startShim(t, nil)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    // A client offering credentials falls back to no-auth when the shim has none.
+    c, err := socks5.DialVia(ctx, socks5.WithAuth(bind, "alice", "secret"), host, port)
+    if err != nil { t.Fatal(err) }
+    roundTrip(t, c)
+    c.Close()
+}
+
+func TestMaxConns(t *testing.T) {
+    host, port := echoServer(t)
+    bind := startShim(t, map[string]User{"bob": {Password: "pw", MaxConns: 1}})
+    addr := socks5.WithAuth(bind, "bob", "pw")
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    first, err := socks5.DialVia(ctx, addr, host, port)
+    if err != nil { t.Fatal(err) }
+    roundTrip(t, first)
+    if _, err := socks5.DialVia(ctx, addr, host, port); err == nil {
+        t.Fatal("second connection allowed past MaxConns=1")
+    }
+    first.Close()
+
+    // The slot frees once the first connection is torn down.
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        c, err := socks5.DialVia(ctx, addr, host, port)
+        if err == nil { c.Close(); break }
+        if time.Now().After(deadline) { t.Fatalf("slot not released: %v", err) }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+func TestParseUsers(t *testing.T) {
+    users, err := ParseUsers("alice", "a", "2", "bob:b, carol:c:5")
+    if err != nil { t.Fatal(err) }
+    if len(users) != 3 || users["alice"].MaxConns != 2 || users["bob"].Password != "b" || users["carol"].MaxConns != 5 {
+        t.Fatalf("users = %+v", users)
+    }
+    if users, err := ParseUsers("", "", "", ""); err != nil || users != nil {
+        t.Fatalf("empty: %v, %v", users, err)
+    }
+    for _, bad := range [][4]string{{"", "", "", "bob:b"}, {"alice", "a", "x", ""}, {"alice", "a", "", "bob"}} {
+        if _, err := ParseUsers(bad[0], bad[1], bad[2], bad[3]); err == nil { t.Errorf("ParseUsers%q: want error", bad) }
+    }
+}
+
+func TestRules(t *testing.T) {
+    host, port := echoServer(t)
+    var tbl rules.Table
+    if err := tbl.Set(rules.RuleSet{Default: rules.Proxy, Rules: []rules.Rule{
+        {Type: rules.TypeCIDR, Value: "127.0.0.1", Action: rules.Direct},
+        {Type: rules.TypeSuffix, Value: "blocked.test", Action: rules.Block},
+    }}); err != nil { t.Fatal(err) }
+    // No upstream and no direct fallback: only direct rules get through.
+    s := New(Config{ListenAddr: "127.0.0.1:0", Rules: &tbl})
+    if err := s.Start(context.Background()); err != nil { t.Fatal(err) }
+    defer s.Stop()
+    bind := s.ln.Addr().String()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    c, err := socks5.DialVia(ctx, bind, host, port)
+    if err != nil { t.Fatalf("direct rule: %v", err) }
+    roundTrip(t, c)
+    c.Close()
+
+    if _, err := socks5.DialVia(ctx, bind, "www.blocked.test", 443); !errors.Is(err, socks5.ReplyError(0x02)) {
+        t.Fatalf("block rule: err = %v, want reply 0x02", err)
+    }
+    if _, err := socks5.DialVia(ctx, bind, "example.com", 443); !errors.Is(err, socks5.ReplyError(0x01)) {
+        t.Fatalf("proxy without upstream: err = %v, want reply 0x01", err)
+    }
+}
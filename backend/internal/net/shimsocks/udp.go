@@ -0,0 +1,239 @@
+package shimsocks
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "io"
+    "net"
+    "strconv"
+    "sync/atomic"
+    "time"
+
+    "bulletproof/backend/internal/net/rules"
+    sockscli "bulletproof/backend/internal/net/socks5"
+)
+
+// UDP relay modes reported by UDPMode.
+const (
+    UDPUpstream    = "upstream"    // datagrams go through the upstream's own UDP relay
+    UDPDirect      = "direct"      // upstream lacks UDP; datagrams leave directly (AllowDirectFallback)
+    UDPUnavailable = "unavailable" // upstream lacks UDP; UDP ASSOCIATE is refused
+)
+
+const defaultUDPTimeout = 2 * time.Minute
+
+// CheckUDP asks the current upstream for a UDP association and caches
+// whether it supports one. Only a "command not supported" reply marks it as
+// lacking UDP; other errors leave the answer unknown.
+func (s *Server) CheckUDP(ctx context.Context) {
+    up := s.upstream()
+    if up == "" { return }
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    ctrl, _, err := sockscli.AssociateVia(ctx, up)
+    switch {
+    case err == nil:
+        ctrl.Close()
+        s.setUDP(up, true)
+    case errors.Is(err, sockscli.ErrCommandNotSupported):
+        s.setUDP(up, false)
+    }
+}
+
+func (s *Server) setUDP(up string, ok bool) {
+    s.mu.Lock()
+    s.udp[up] = ok
+    s.mu.Unlock()
+}
+
+// UDPMode reports how UDP ASSOCIATE is served with the current upstream, or
+// "" while the upstream has not been checked yet.
+func (s *Server) UDPMode() string {
+    s.mu.Lock()
+    up, fallback := s.cfg.UpstreamSocks, s.cfg.AllowDirectFallback
+    ok, known := s.udp[up]
+    s.mu.Unlock()
+    switch {
+    case up == "" && fallback, known && !ok && fallback:
+        return UDPDirect
+    case !known:
+        return ""
+    case ok:
+        return UDPUpstream
+    default:
+        return UDPUnavailable
+    }
+}
+
+// associate serves a UDP ASSOCIATE request on control connection c. clientHost
+// is the DST.ADDR from the request; only datagrams from the control
+// connection's peer IP are relayed.
+func (s *Server) associate(ctx context.Context, c net.Conn, br *bufio.ReadWriter, clientHost string) {
+    var (
+        upCtrl  net.Conn
+        upRelay *net.UDPAddr
+        err     error
+    )
+    up := s.upstream()
+    switch {
+    case up != "" && probeTCP(up, 500*time.Millisecond):
+        dctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+        upCtrl, upRelay, err = sockscli.AssociateVia(dctx, up)
+        cancel()
+        if errors.Is(err, sockscli.ErrCommandNotSupported) {
+            s.setUDP(up, false)
+            if !s.cfg.AllowDirectFallback { _ = writeReply(br, 0x07, 0x01, nil); return }
+            err = nil
+        } else if err == nil {
+            s.setUDP(up, true)
+            defer upCtrl.Close()
+        }
+    case s.cfg.AllowDirectFallback:
+    default:
+        err = errors.New("upstream not ready")
+    }
+    if err != nil { _ = writeReply(br, 0x01, 0x01, nil); return }
+
+    host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+    relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+    if err != nil { _ = writeReply(br, 0x01, 0x01, nil); return }
+    defer relay.Close()
+    if err := writeReplyAddr(br, relay.LocalAddr().(*net.UDPAddr)); err != nil { return }
+
+    timeout := s.cfg.UDPTimeout
+    if timeout <= 0 { timeout = defaultUDPTimeout }
+    a := &association{
+        relay:    relay,
+        clientIP: c.RemoteAddr().(*net.TCPAddr).IP,
+        timeout:  timeout,
+    }
+    if ip := net.ParseIP(clientHost); ip != nil && !ip.IsUnspecified() { a.clientIP = ip }
+    a.touch()
+
+    // Datagrams are routed per destination: through the upstream relay when
+    // there is one, otherwise (or for direct rules) straight out.
+    direct, err := net.ListenUDP("udp", nil)
+    if err != nil { return }
+    defer direct.Close()
+    a.direct, a.rules = direct, s.cfg.Rules
+    // The association ends with the control connection, the upstream's
+    // control connection, or the idle timeout.
+    done := make(chan struct{}, 4)
+    go func() { _, _ = io.Copy(io.Discard, br); done <- struct{}{} }()
+    if upCtrl != nil {
+        go func() { _, _ = io.Copy(io.Discard, upCtrl); done <- struct{}{} }()
+        out, err := net.DialUDP("udp", nil, upRelay)
+        if err != nil { return }
+        defer out.Close()
+        a.up = out
+        go func() { a.upstreamToClient(); done <- struct{}{} }()
+    }
+    go func() { a.fromClientLoop(); done <- struct{}{} }()
+    go func() { a.directToClient(); done <- struct{}{} }()
+    select {
+    case <-done:
+    case <-s.stop:
+    }
+}
+
+// association is one client's UDP relay session.
+type association struct {
+    relay    *net.UDPConn // client-facing relay socket
+    up       *net.UDPConn // connected to the upstream's relay; nil without upstream UDP
+    direct   *net.UDPConn // for datagrams that bypass the tunnel
+    rules    *rules.Table
+    clientIP net.IP
+    client   atomic.Pointer[net.UDPAddr] // learned from the first datagram
+    timeout  time.Duration
+    last     atomic.Int64 // unix nanos of the last datagram either way
+}
+
+func (a *association) touch() { a.last.Store(time.Now().UnixNano()) }
+
+// read reads from conn until a datagram arrives, the association has been
+// idle for the timeout, or conn fails.
+func (a *association) read(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, error) {
+    for {
+        _ = conn.SetReadDeadline(time.Now().Add(a.timeout))
+        n, from, err := conn.ReadFromUDP(buf)
+        if err == nil { return n, from, nil }
+        var ne net.Error
+        if !errors.As(err, &ne) || !ne.Timeout() { return 0, nil, err }
+        if time.Since(time.Unix(0, a.last.Load())) >= a.timeout { return 0, nil, err }
+    }
+}
+
+// fromClient reads the next datagram from the associated client, dropping
+// datagrams from other hosts and fragmented ones.
+func (a *association) fromClient(buf []byte) ([]byte, error) {
+    for {
+        n, from, err := a.read(a.relay, buf)
+        if err != nil { return nil, err }
+        if !from.IP.Equal(a.clientIP) { continue }
+        if n < 4 || buf[0] != 0 || buf[1] != 0 || buf[2] != 0 { continue } // malformed or FRAG != 0: drop
+        a.client.Store(from)
+        a.touch()
+        return buf[:n], nil
+    }
+}
+
+func (a *association) toClient(b []byte) {
+    if to := a.client.Load(); to != nil {
+        a.touch()
+        _, _ = a.relay.WriteToUDP(b, to)
+    }
+}
+
+// fromClientLoop routes client datagrams. Tunnelled ones are forwarded to
+// the upstream relay unchanged, since the SOCKS5 header is the same on both.
+func (a *association) fromClientLoop() {
+    buf := make([]byte, 64*1024)
+    for {
+        b, err := a.fromClient(buf)
+        if err != nil { return }
+        host, port, data, err := sockscli.UnpackUDP(b)
+        if err != nil { continue }
+        act, _ := a.rules.Match(host, port)
+        switch {
+        case act == rules.Block:
+        case act == rules.Proxy && a.up != nil:
+            _, _ = a.up.Write(b)
+        default:
+            dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+            if err != nil { continue }
+            _, _ = a.direct.WriteToUDP(data, dst)
+        }
+    }
+}
+
+func (a *association) upstreamToClient() {
+    buf := make([]byte, 64*1024)
+    for {
+        n, _, err := a.read(a.up, buf)
+        if err != nil { return }
+        a.toClient(buf[:n])
+    }
+}
+
+func (a *association) directToClient() {
+    buf := make([]byte, 64*1024)
+    for {
+        n, from, err := a.read(a.direct, buf)
+        if err != nil { return }
+        a.toClient(sockscli.PackUDP(from.IP.String(), from.Port, buf[:n]))
+    }
+}
+
+// writeReplyAddr writes a success reply carrying addr as BND.ADDR/BND.PORT.
+func writeReplyAddr(br *bufio.ReadWriter, addr *net.UDPAddr) error {
+    h := []byte{0x05, 0x00, 0x00}
+    if ip4 := addr.IP.To4(); ip4 != nil {
+        h = append(append(h, 0x01), ip4...)
+    } else {
+        h = append(append(h, 0x04), addr.IP.To16()...)
+    }
+    h = append(h, byte(addr.Port>>8), byte(addr.Port))
+    if _, err := br.Write(h); err != nil { return err }
+    return br.Flush()
+}
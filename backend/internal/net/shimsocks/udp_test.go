@@ -0,0 +1,129 @@
+package shimsocks
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "net"
+    "testing"
+    "time"
+
+    "bulletproof/backend/internal/net/socks5"
+)
+
+// udpEcho echoes datagrams back to their sender.
+func udpEcho(t *testing.T) *net.UDPAddr {
+    t.Helper()
+    pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { pc.Close() })
+    go func() {
+        buf := make([]byte, 2048)
+        for {
+            n, from, err := pc.ReadFromUDP(buf)
+            if err != nil { return }
+            _, _ = pc.WriteToUDP(buf[:n], from)
+        }
+    }()
+    return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// udpRoundTrip associates via bind and sends one datagram to the echo server.
+func udpRoundTrip(t *testing.T, bind string, echo *net.UDPAddr) {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    ctrl, relay, err := socks5.AssociateVia(ctx, bind)
+    if err != nil { t.Fatalf("associate: %v", err) }
+    defer ctrl.Close()
+    conn, err := net.DialUDP("udp", nil, relay)
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+
+    // A fragmented datagram is dropped, not relayed.
+    frag := socks5.PackUDP(echo.IP.String(), echo.Port, []byte("frag"))
+    frag[2] = 1
+    if _, err := conn.Write(frag); err != nil { t.Fatal(err) }
+    if _, err := conn.Write(socks5.PackUDP(echo.IP.String(), echo.Port, []byte("hello"))); err != nil { t.Fatal(err) }
+
+    _ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+    buf := make([]byte, 2048)
+    n, err := conn.Read(buf)
+    if err != nil { t.Fatalf("read: %v", err) }
+    host, port, data, err := socks5.UnpackUDP(buf[:n])
+    if err != nil { t.Fatal(err) }
+    if string(data) != "hello" || port != echo.Port || host != echo.IP.String() {
+        t.Fatalf("got %q from %s:%d", data, host, port)
+    }
+}
+
+func TestUDPDirect(t *testing.T) {
+    echo := udpEcho(t)
+    bind := startShim(t, nil)
+    udpRoundTrip(t, bind, echo)
+}
+
+func TestUDPViaUpstream(t *testing.T) {
+    echo := udpEcho(t)
+    upstream := startShim(t, nil) // UDP-capable upstream with direct egress
+    s := New(Config{ListenAddr: "127.0.0.1:0", UpstreamSocks: upstream})
+    if err := s.Start(context.Background()); err != nil { t.Fatal(err) }
+    defer s.Stop()
+    s.CheckUDP(context.Background())
+    if m := s.UDPMode(); m != UDPUpstream { t.Fatalf("UDPMode = %q, want %q", m, UDPUpstream) }
+    udpRoundTrip(t, s.ln.Addr().String(), echo)
+}
+
+// noUDPUpstream is a SOCKS5 proxy that refuses every command with 0x07.
+func noUDPUpstream(t *testing.T) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func() {
+                defer c.Close()
+                br := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+                h := make([]byte, 2)
+                if _, err := io.ReadFull(br, h); err != nil { return }
+                if _, err := io.ReadFull(br, make([]byte, int(h[1]))); err != nil { return }
+                _, _ = br.Write([]byte{0x05, 0x00})
+                _ = br.Flush()
+                if _, err := io.ReadFull(br, make([]byte, 3)); err != nil { return }
+                _ = writeReply(br, 0x07, 0x01, nil)
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+func TestUDPUnavailable(t *testing.T) {
+    s := New(Config{ListenAddr: "127.0.0.1:0", UpstreamSocks: noUDPUpstream(t)})
+    if err := s.Start(context.Background()); err != nil { t.Fatal(err) }
+    defer s.Stop()
+    if m := s.UDPMode(); m != "" { t.Fatalf("UDPMode before check = %q", m) }
+    s.CheckUDP(context.Background())
+    if m := s.UDPMode(); m != UDPUnavailable { t.Fatalf("UDPMode = %q, want %q", m, UDPUnavailable) }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _, _, err := socks5.AssociateVia(ctx, s.ln.Addr().String())
+    if err == nil { t.Fatal("associate succeeded without UDP upstream") }
+}
+
+// UDPMode is polled by status while the provider swaps the upstream.
+func TestUDPMode_ConcurrentSetUpstream(t *testing.T) {
+    s := New(Config{ListenAddr: "127.0.0.1:0", AllowDirectFallback: true})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 100; i++ { s.SetUpstream("") }
+    }()
+    for i := 0; i < 100; i++ {
+        if m := s.UDPMode(); m != UDPDirect { t.Fatalf("UDPMode = %q", m) }
+    }
+    <-done
+}
@@ -5,57 +5,185 @@ import (
     "context"
     "errors"
     "fmt"
+    "io"
     "net"
+    "net/url"
+    "strconv"
     "strings"
     "time"
 )
 
+// WithAuth returns socksAddr carrying RFC 1929 credentials in the form
+// user:pass@host:port, as accepted by DialVia and the helpers built on it.
+func WithAuth(socksAddr, user, pass string) string {
+    if user == "" { return socksAddr }
+    return url.UserPassword(user, pass).String() + "@" + socksAddr
+}
+
+// SplitAuth separates the credentials added by WithAuth from socksAddr.
+// ok is false when the address carries none.
+func SplitAuth(socksAddr string) (addr, user, pass string, ok bool) {
+    i := strings.LastIndex(socksAddr, "@")
+    if i < 0 { return socksAddr, "", "", false }
+    u, err := url.Parse("socks5://" + socksAddr[:i+1] + "x")
+    if err != nil || u.User == nil { return socksAddr[i+1:], "", "", false }
+    pass, _ = u.User.Password()
+    return socksAddr[i+1:], u.User.Username(), pass, true
+}
+
 // DialVia dials targetHost:targetPort through a SOCKS5 proxy at socksAddr.
-// Only supports no-auth and domain-name addressing for simplicity.
+// socksAddr may carry username/password credentials (see WithAuth); otherwise
+// only no-auth is offered.
 func DialVia(ctx context.Context, socksAddr, targetHost string, targetPort int) (net.Conn, error) {
+    conn, br, err := handshake(ctx, socksAddr)
+    if err != nil { return nil, err }
+    stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+    _, _, err = request(br, cmdConnect, targetHost, targetPort)
+    stop()
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("socks5 connect failed: %w", err)
+    }
+    // set deadlines off; caller can manage via ctx
+    _ = conn.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+// AssociateVia asks the SOCKS5 proxy at socksAddr for a UDP relay. The
+// association lives as long as the returned control connection stays open;
+// datagrams sent to relay must carry the header built by PackUDP.
+func AssociateVia(ctx context.Context, socksAddr string) (ctrl net.Conn, relay *net.UDPAddr, err error) {
+    conn, br, err := handshake(ctx, socksAddr)
+    if err != nil { return nil, nil, err }
+    host, port, err := request(br, cmdAssociate, "0.0.0.0", 0)
+    if err != nil {
+        conn.Close()
+        return nil, nil, fmt.Errorf("socks5 udp associate failed: %w", err)
+    }
+    // An unspecified relay address means "same host as the proxy".
+    if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+        host = conn.RemoteAddr().(*net.TCPAddr).IP.String()
+    }
+    relay, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+    if err != nil { conn.Close(); return nil, nil, err }
+    _ = conn.SetDeadline(time.Time{})
+    return conn, relay, nil
+}
+
+const (
+    cmdConnect   = 0x01
+    cmdAssociate = 0x03
+)
+
+// ReplyError is a non-success reply code from a SOCKS5 proxy.
+type ReplyError byte
+
+func (e ReplyError) Error() string { return fmt.Sprintf("reply 0x%02x", byte(e)) }
+
+// ErrCommandNotSupported is the reply of proxies without UDP ASSOCIATE.
+const ErrCommandNotSupported ReplyError = 0x07
+
+// handshake connects to the proxy and completes method negotiation.
+func handshake(ctx context.Context, socksAddr string) (net.Conn, *bufio.ReadWriter, error) {
+    socksAddr, user, pass, auth := SplitAuth(socksAddr)
     d := net.Dialer{}
     conn, err := d.DialContext(ctx, "tcp", socksAddr)
-    if err != nil { return nil, err }
+    if err != nil { return nil, nil, err }
+    if dl, ok := ctx.Deadline(); ok { _ = conn.SetDeadline(dl) }
+    // Cancelling ctx cuts a stalled handshake short as well.
+    stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+    defer stop()
     br := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+    fail := func(err error) (net.Conn, *bufio.ReadWriter, error) { conn.Close(); return nil, nil, err }
 
-    // greeting: version 5, 1 method, no-auth (0x00)
-    if _, err := br.Write([]byte{0x05, 0x01, 0x00}); err != nil { conn.Close(); return nil, err }
-    if err := br.Flush(); err != nil { conn.Close(); return nil, err }
+    // greeting: version 5, no-auth (0x00) and, with credentials, username/password (0x02)
+    greet := []byte{0x05, 0x01, 0x00}
+    if auth { greet = []byte{0x05, 0x02, 0x00, 0x02} }
+    if _, err := br.Write(greet); err != nil { return fail(err) }
+    if err := br.Flush(); err != nil { return fail(err) }
 
     // response: version, method
     resp := make([]byte, 2)
-    if _, err := br.Read(resp); err != nil { conn.Close(); return nil, err }
-    if resp[0] != 0x05 || resp[1] != 0x00 { conn.Close(); return nil, errors.New("socks5 no-auth not accepted") }
-
-    // connect request
-    host := targetHost
-    if len(host) > 255 { host = host[:255] }
-    req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
-    req = append(req, []byte(host)...)
-    req = append(req, byte((targetPort>>8)&0xff), byte(targetPort&0xff))
-    if _, err := br.Write(req); err != nil { conn.Close(); return nil, err }
-    if err := br.Flush(); err != nil { conn.Close(); return nil, err }
-
-    // connect response: ver, rep, rsv, atyp, bnd.addr, bnd.port
-    h := make([]byte, 4)
-    if _, err := br.Read(h); err != nil { conn.Close(); return nil, err }
-    if h[1] != 0x00 { conn.Close(); return nil, fmt.Errorf("socks5 connect failed: 0x%02x", h[1]) }
-    var toRead int
-    switch h[3] {
-    case 0x01: toRead = 4
+    if _, err := io.ReadFull(br, resp); err != nil { return fail(err) }
+    if resp[0] != 0x05 { return fail(errors.New("socks5: bad version in method reply")) }
+    switch {
+    case resp[1] == 0x00:
+    case resp[1] == 0x02 && auth:
+        if err := authenticate(br, user, pass); err != nil { return fail(err) }
+    case resp[1] == 0x02:
+        return fail(errors.New("socks5: proxy requires username/password"))
+    default:
+        return fail(errors.New("socks5: no acceptable auth method"))
+    }
+    return conn, br, nil
+}
+
+// request sends cmd for host:port and returns the bound address from the reply.
+func request(br *bufio.ReadWriter, cmd byte, host string, port int) (string, int, error) {
+    req := append([]byte{0x05, cmd, 0x00}, appendAddr(nil, host, port)...)
+    if _, err := br.Write(req); err != nil { return "", 0, err }
+    if err := br.Flush(); err != nil { return "", 0, err }
+
+    // reply: ver, rep, rsv, atyp, bnd.addr, bnd.port
+    h := make([]byte, 3)
+    if _, err := io.ReadFull(br, h); err != nil { return "", 0, err }
+    if h[1] != 0x00 { return "", 0, ReplyError(h[1]) }
+    return readAddr(br)
+}
+
+// appendAddr appends atyp, address and port. IP literals are sent as such,
+// everything else as a domain name.
+func appendAddr(b []byte, host string, port int) []byte {
+    if ip := net.ParseIP(host); ip != nil {
+        if ip4 := ip.To4(); ip4 != nil {
+            b = append(append(b, 0x01), ip4...)
+        } else {
+            b = append(append(b, 0x04), ip.To16()...)
+        }
+    } else {
+        if len(host) > 255 { host = host[:255] }
+        b = append(append(b, 0x03, byte(len(host))), host...)
+    }
+    return append(b, byte(port>>8), byte(port))
+}
+
+// readAddr reads atyp, address and port.
+func readAddr(r io.Reader) (string, int, error) {
+    t := make([]byte, 1)
+    if _, err := io.ReadFull(r, t); err != nil { return "", 0, err }
+    var host string
+    switch t[0] {
+    case 0x01, 0x04:
+        ip := make([]byte, 4)
+        if t[0] == 0x04 { ip = make([]byte, 16) }
+        if _, err := io.ReadFull(r, ip); err != nil { return "", 0, err }
+        host = net.IP(ip).String()
     case 0x03:
-        l := make([]byte, 1); if _, err := br.Read(l); err != nil { conn.Close(); return nil, err }
-        toRead = int(l[0])
-    case 0x04: toRead = 16
-    default: conn.Close(); return nil, errors.New("socks5: unknown atyp")
+        if _, err := io.ReadFull(r, t); err != nil { return "", 0, err }
+        name := make([]byte, int(t[0]))
+        if _, err := io.ReadFull(r, name); err != nil { return "", 0, err }
+        host = string(name)
+    default:
+        return "", 0, errors.New("socks5: unknown atyp")
     }
-    if toRead > 0 { tmp := make([]byte, toRead); if _, err := br.Read(tmp); err != nil { conn.Close(); return nil, err } }
-    // read port
-    if _, err := br.Read(make([]byte, 2)); err != nil { conn.Close(); return nil, err }
+    p := make([]byte, 2)
+    if _, err := io.ReadFull(r, p); err != nil { return "", 0, err }
+    return host, int(p[0])<<8 | int(p[1]), nil
+}
 
-    // set deadlines off; caller can manage via ctx
-    _ = conn.SetDeadline(time.Time{})
-    return conn, nil
+// authenticate runs the RFC 1929 username/password sub-negotiation.
+func authenticate(br *bufio.ReadWriter, user, pass string) error {
+    if len(user) > 255 || len(pass) > 255 { return errors.New("socks5: username or password too long") }
+    req := []byte{0x01, byte(len(user))}
+    req = append(req, user...)
+    req = append(req, byte(len(pass)))
+    req = append(req, pass...)
+    if _, err := br.Write(req); err != nil { return err }
+    if err := br.Flush(); err != nil { return err }
+    resp := make([]byte, 2)
+    if _, err := io.ReadFull(br, resp); err != nil { return err }
+    if resp[1] != 0x00 { return errors.New("socks5: authentication failed") }
+    return nil
 }
 
 // HTTPGetVia performs a simple HTTP GET via SOCKS5 and returns status line and body (first up to maxBytes).
@@ -64,6 +192,8 @@ func HTTPGetVia(ctx context.Context, socksAddr, urlHost, urlPath string, maxByte
     conn, err := DialVia(ctx, socksAddr, urlHost, 80)
     if err != nil { return "", "", err }
     defer conn.Close()
+    if dl, ok := ctx.Deadline(); ok { _ = conn.SetDeadline(dl) }
+    defer context.AfterFunc(ctx, func() { conn.Close() })()
     br := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
     req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: bp/1\r\nConnection: close\r\n\r\n", urlPath, urlHost)
     if _, err := br.WriteString(req); err != nil { return "", "", err }
@@ -84,3 +214,32 @@ func HTTPGetVia(ctx context.Context, socksAddr, urlHost, urlPath string, maxByte
     return strings.TrimSpace(status), string(buf[:n]), nil
 }
 
+
+// DownloadVia fetches http://urlHost/urlPath via SOCKS5 and discards up to limit
+// body bytes, returning how many were read and how long the body took.
+func DownloadVia(ctx context.Context, socksAddr, urlHost, urlPath string, limit int64) (int64, time.Duration, error) {
+    if !strings.HasPrefix(urlPath, "/") { urlPath = "/" + urlPath }
+    conn, err := DialVia(ctx, socksAddr, urlHost, 80)
+    if err != nil { return 0, 0, err }
+    defer conn.Close()
+    if dl, ok := ctx.Deadline(); ok { _ = conn.SetDeadline(dl) }
+    defer context.AfterFunc(ctx, func() { conn.Close() })()
+    req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: bp/1\r\nConnection: close\r\n\r\n", urlPath, urlHost)
+    if _, err := conn.Write([]byte(req)); err != nil { return 0, 0, err }
+    br := bufio.NewReader(conn)
+    status, err := br.ReadString('\n')
+    if err != nil { return 0, 0, err }
+    if f := strings.Fields(status); len(f) < 2 || f[1] != "200" {
+        return 0, 0, fmt.Errorf("download %s%s: unexpected status %q", urlHost, urlPath, strings.TrimSpace(status))
+    }
+    for {
+        line, err := br.ReadString('\n')
+        if err != nil { return 0, 0, err }
+        if line == "\r\n" { break }
+    }
+    begin := time.Now()
+    n, err := io.Copy(io.Discard, io.LimitReader(br, limit))
+    elapsed := time.Since(begin)
+    if err != nil && n == 0 { return 0, elapsed, err }
+    return n, elapsed, nil
+}
@@ -0,0 +1,25 @@
+package socks5
+
+import (
+    "bytes"
+    "errors"
+)
+
+// ErrFragmented is returned by UnpackUDP for datagrams with a non-zero FRAG
+// field; fragmentation is optional in RFC 1928 and not supported here.
+var ErrFragmented = errors.New("socks5: fragmented udp datagram")
+
+// PackUDP prepends the SOCKS5 UDP request header (RSV, FRAG=0, address) to data.
+func PackUDP(host string, port int, data []byte) []byte {
+    b := appendAddr([]byte{0x00, 0x00, 0x00}, host, port)
+    return append(b, data...)
+}
+
+// UnpackUDP splits a SOCKS5 UDP datagram into its destination and payload.
+func UnpackUDP(b []byte) (host string, port int, data []byte, err error) {
+    if len(b) < 4 || b[0] != 0 || b[1] != 0 { return "", 0, nil, errors.New("socks5: short or malformed udp datagram") }
+    if b[2] != 0 { return "", 0, nil, ErrFragmented }
+    r := bytes.NewReader(b[3:])
+    if host, port, err = readAddr(r); err != nil { return "", 0, nil, err }
+    return host, port, b[len(b)-r.Len():], nil
+}
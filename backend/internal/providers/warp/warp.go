@@ -1,8 +1,9 @@
+// Package warp implements the providers backed by warp-plus. warp, gool and
+// psiphon share this implementation and differ only in the warp-plus mode.
 package warp
 
 import (
     "context"
-    "encoding/json"
     "errors"
     "fmt"
     "net"
@@ -10,204 +11,552 @@ import (
     "path/filepath"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     "bulletproof/backend/internal/core"
     "bulletproof/backend/internal/engine/singbox"
     "bulletproof/backend/internal/engine/warpplus"
+    "bulletproof/backend/internal/net/httpproxy"
     "bulletproof/backend/internal/net/shimsocks"
+    "bulletproof/backend/internal/net/socks5"
+    "bulletproof/backend/internal/system/procs"
     "bulletproof/backend/internal/system/proxy"
+    "bulletproof/backend/internal/warpreg"
 )
 
 type provider struct{
+    name string // provider name reported in status and events
+    mode string // warp-plus mode: "warp", "gool" or "psiphon"
     st core.Status
+    engMu sync.Mutex // guards eng and gen, which the engine race writes
     eng *warpplus.Engine
+    gen uint64 // bumped by Connect and Disconnect; race results of older sessions are dropped
+    sess *session // the latest Connect's
     sb  *singbox.Engine
-    wantPAC bool
+    sysProxy string // system proxy integration applied: "", "pac" or "manual"
+    stateDir string // where the system proxy snapshot is kept
     ss  *shimsocks.Server
+    hp  *httpproxy.Server // HTTP proxy front end; nil unless options.http is set
+    httpBind string
+    logMu sync.Mutex // guards logSt, which the log tailer writes
+    logSt logStatus
 }
 
-func New() core.Provider { return &provider{} }
+// session is one Connect's reporter and lifetime. The engine race, the
+// warp-plus callbacks and the log tailer outlive Connect; they report through
+// the session they were started for, so that nothing reaches a later one, and
+// stop once Disconnect cancels ctx.
+type session struct {
+    name     string
+    rep      core.Reporter
+    gen      uint64 // p.gen when the session began; see adopt
+    ctx      context.Context
+    cancel   context.CancelFunc
+    raceDone chan struct{} // closed when the engine race has finished; nil until it starts
+    tailDone chan struct{} // closed when the log tailer has returned; set by the race on adopt, nil until then
+    sampleDone chan struct{} // closed when the throughput sample has finished; set by the race, nil until then
+}
+
+func (s *session) emit(t core.EventType, msg string, data map[string]any) {
+    if s.rep == nil { return }
+    s.rep.Emit(core.Event{Type: t, Provider: s.name, Message: msg, Data: data})
+}
+
+func (s *session) transition(to core.Phase, msg string) {
+    if s.rep == nil { return }
+    _ = s.rep.Transition(to, msg)
+}
+
+// waiting are the phases in which a handshake still moves the session on.
+var waiting = []core.Phase{core.PhaseStartingEngine, core.PhaseReconnecting, core.PhaseHandshaking}
+
+// handshake reports a handshake from the warp-plus log. It only moves the
+// phase while the session is still waiting for one; rekeys of a ready,
+// degraded or failed session leave the phase alone.
+func (s *session) handshake(msg string) {
+    if s.rep == nil { return }
+    s.rep.TransitionFrom(waiting, core.PhaseHandshaking, msg)
+}
+
+// end cancels the session and waits until its engine race has stopped its
+// candidates and its log tailer and throughput sample have returned.
+func (s *session) end() {
+    s.cancel()
+    if s.raceDone != nil { <-s.raceDone }
+    if s.tailDone != nil { <-s.tailDone }
+    if s.sampleDone != nil { <-s.sampleDone }
+}
+
+// logStatus is what the warp-plus log has told us about the session.
+type logStatus struct {
+    path      string // log of the adopted engine
+    endpoint  string
+    country   string // Psiphon exit country
+    handshake time.Time
+}
+
+// New returns the plain WARP provider.
+func New() core.Provider { return NewMode("warp", "warp") }
 
-func (p *provider) Name() string { return "warp" }
+// NewMode returns a provider called name that runs warp-plus in mode. Bind
+// selection, integration, retries and status handling are the same for every mode.
+func NewMode(name, mode string) core.Provider { return &provider{name: name, mode: mode} }
+
+func (p *provider) Name() string { return p.name }
 
 func (p *provider) Connect(req core.ConnectRequest) error {
     stateDir := req.Options["stateDir"]
-    // Resolve a stable, available public bind (persist across runs). Use req.Options["bind"]
-    // if provided; otherwise try last persisted bind, then scan 8087-8090.
-    // We intentionally avoid 8086 here because the bundled warp-plus prefers 127.0.0.1:8086
-    // for its internal SOCKS listener across versions.
-    publicBind, err := choosePublicBind(stateDir, bindFrom(req))
+    p.endSession()
+    s := p.beginSession(req.Reporter)
+    restart, err := warpplus.ParseRestartPolicy(req.Options["restart"], req.Options["restartMax"], req.Options["restartWindow"])
+    if err != nil { return err }
+    race, err := warpplus.ParseRaceOptions(req.Options["raceConcurrency"], req.Options["raceDeadline"])
+    if err != nil { return err }
+    // Every candidate runs as the slot's device, which warpplus.Race never
+    // runs twice at once, so a wider race would only hand out unused ports.
+    if v := req.Options["raceConcurrency"]; v != "" && race.Concurrency > 1 {
+        return fmt.Errorf("invalid raceConcurrency: %q (candidates share one WARP device and run one at a time)", v)
+    }
+    race.Concurrency = 1
+    var stopTimeout time.Duration
+    if v := req.Options["stopTimeout"]; v != "" {
+        if stopTimeout, err = time.ParseDuration(v); err != nil || stopTimeout <= 0 { return fmt.Errorf("invalid stopTimeout: %q", v) }
+    }
+    httpMode := req.Options["http"]
+    switch httpMode {
+    case "", "off", "on", "mixed":
+    default:
+        return fmt.Errorf("invalid http option: %q (want off, on or mixed)", httpMode)
+    }
+    ports := req.Ports
+    if ports == nil { ports = core.NewPortAllocator(stateDir) }
+    // The client-facing bind persists across runs; warp-plus gets a free internal
+    // port unless options.engineBind pins one (for builds that ignore --bind).
+    publicBind, err := ports.Public(req.Options["bind"])
+    if err != nil { return err }
+    warpBind, err := ports.Internal(req.Options["engineBind"])
     if err != nil { return err }
-    // where warp-plus actually listens; many builds ignore --bind and stick to 127.0.0.1:8086.
-    // Use the canonical port so readiness checks work and avoid collisions by not using 8086 for publicBind.
-    warpBind := altBind("127.0.0.1:8086", 8086)
-
     baseCfg := warpplus.Config{
         Bin:      req.Options["bin"],
-        Key:      req.Options["key"],
         Endpoint: endpointFrom(req),
         Bind:     warpBind,
-        Mode:     modeFromProvider(req.Provider),
+        Mode:     p.mode,
         Country:  req.ExitCountry,
-        CacheDir: stateDir,
-        LogPath:  filepath.Join(stateDir, "warp-plus.log"),
+        CacheDir: firstNonEmpty(req.Options["identityDir"], stateDir), // holds the slot's device, license included (warpreg.WriteWarpPlus)
+        PIDDir:   procs.Dir(stateDir),
+        StopTimeout: stopTimeout,
         DNS:      firstNonEmpty(req.Options["dns"], os.Getenv("WARPPLUS_DNS")),
         IPv4Only: os.Getenv("WARPPLUS_IPV4") == "1" || os.Getenv("WARPPLUS_IPV4") == "true",
         IPv6Only: os.Getenv("WARPPLUS_IPV6") == "1" || os.Getenv("WARPPLUS_IPV6") == "true",
         Verbose:  os.Getenv("WARPPLUS_VERBOSE") == "1" || os.Getenv("WARPPLUS_VERBOSE") == "true",
     }
     // Start the shim SOCKS immediately so the listening port is available.
+    p.transition(core.PhaseStartingShim, "starting shim socks on "+publicBind)
     allowDirect := os.Getenv("BP_SOCKS_DIRECT_FALLBACK") == "1" || os.Getenv("BP_SOCKS_DIRECT_FALLBACK") == "true"
-    p.ss = shimsocks.New(shimsocks.Config{ListenAddr: publicBind, UpstreamSocks: warpBind, AllowDirectFallback: allowDirect})
+    users, err := shimsocks.ParseUsers(req.Options["socksUser"], req.Options["socksPass"], req.Options["socksMaxConns"], req.Options["socksUsers"])
+    if err != nil { return err }
+    shimCfg := shimsocks.Config{ListenAddr: publicBind, UpstreamSocks: warpBind, AllowDirectFallback: allowDirect, Users: users, Rules: req.Rules}
+    // The HTTP proxy dials through the shim so both share upstream, fallback and user limits.
+    var ss *shimsocks.Server
+    p.httpBind = ""
+    if httpMode == "on" || httpMode == "mixed" {
+        hcfg := httpproxy.Config{Dial: func(ctx context.Context, host string, port int) (net.Conn, error) { return ss.Dial(ctx, host, port) }}
+        if users != nil { hcfg.Login = func(user, pass string) (func(), error) { return ss.Login(user, pass) } }
+        if httpMode == "on" {
+            if hcfg.ListenAddr, err = ports.HTTP(req.Options["httpBind"]); err != nil { return err }
+        } else {
+            p.httpBind = publicBind
+        }
+        p.hp = httpproxy.New(hcfg)
+        if httpMode == "mixed" { shimCfg.Other = p.hp.ServeConn }
+    }
+    ss = shimsocks.New(shimCfg)
+    p.ss = ss
     if err := p.ss.Start(context.Background()); err != nil {
-        p.st = core.Status{Connected: false, Provider: p.Name(), Message: "shim socks failed: " + err.Error()}
+        p.st = core.Status{Provider: p.Name()}
+        p.transition(core.PhaseFailed, "shim socks failed: "+err.Error())
         return err
     }
-    // Persist chosen public bind for next time.
-    _ = persistBind(stateDir, publicBind)
+    if httpMode == "on" {
+        if err := p.hp.Start(context.Background()); err != nil {
+            _ = p.ss.Stop(); p.ss, p.hp = nil, nil
+            p.st = core.Status{Provider: p.Name()}
+            p.transition(core.PhaseFailed, "http proxy failed: "+err.Error())
+            return err
+        }
+        p.httpBind = p.hp.Addr()
+    }
 
-    // Launch warp-plus attempts in the background to avoid blocking the HTTP call.
-    var usedURL string
+    // Launch warp-plus attempts in the background to avoid blocking the HTTP
+    // call; Disconnect cancels them and waits.
+    done := make(chan struct{})
+    s.raceDone = done
     go func() {
-        urls := candidateTestURLs(req)
-        // First phase: try provided/default test URLs.
-        var lastErr error
-        for _, u := range urls {
-            cfg := baseCfg
-            cfg.TestURL = u
-            eng := warpplus.New(cfg)
-            if err := eng.Start(context.Background()); err != nil { lastErr = err; continue }
-            if err := waitPort(cfg.Bind, 45*time.Second); err != nil { _ = eng.Stop(); lastErr = err; continue }
-            p.eng = eng
-            usedURL = u
-            lastErr = nil
-            break
-        }
-        // Second phase: scan endpoints and retry in combination with a shorter URL list.
-        if p.eng == nil {
-            eps, scanErr := warpplus.Scan(context.Background(), baseCfg.Bin)
-            if scanErr == nil && len(eps) > 0 {
-                maxEP := len(eps)
-                if maxEP > 15 { maxEP = 15 }
-                scanURLs := candidateTestURLs(req)
-                if len(scanURLs) > 3 { scanURLs = scanURLs[:3] }
-                for i := 0; i < maxEP && p.eng == nil; i++ {
-                    for _, u := range scanURLs {
-                        cfg := baseCfg
-                        cfg.Endpoint = eps[i].Address
-                        cfg.TestURL = u
-                        eng := warpplus.New(cfg)
-                        if err := eng.Start(context.Background()); err != nil { lastErr = err; continue }
-                        if err := waitPort(cfg.Bind, 35*time.Second); err != nil { _ = eng.Stop(); lastErr = err; continue }
-                        p.eng = eng
-                        usedURL = u + ", ep=" + cfg.Endpoint
-                        lastErr = nil
-                        break
-                    }
-                }
-            }
-            if p.eng == nil && lastErr != nil {
-                // Surface a hint in status for troubleshooting; shim still serves.
-                p.st.Message = "shim active; warp pending: " + lastErr.Error()
-            }
-        }
-        // Once warp-plus SOCKS is up, update status to reflect ready.
-        if p.eng != nil {
-            // In parallel, detect early handshake success to surface better status while SOCKS warms.
-            go detectHandshake(filepath.Join(stateDir, "warp-plus.log"), &p.st)
-            if err := waitPort(warpBind, 3*time.Minute); err == nil {
-                p.st.Message = "connected (warp active)"
-            }
+        defer close(done)
+        used, err := p.connectEngine(s, ss, req, baseCfg, restart, race)
+        if s.ctx.Err() != nil { return } // the session is being torn down
+        if err != nil {
+            // Surface a hint in status for troubleshooting; shim still serves.
+            s.transition(core.PhaseFailed, "shim active; "+p.name+" pending: "+err.Error())
+            return
         }
+        s.transition(core.PhaseReady, "connected ("+p.name+" active; probe="+used+")")
     }()
-    // Integration mode: direct (default), pac, or tun via sing-box
-    switch req.Options["integration"] {
-    case "pac":
-        p.wantPAC = true
-        _ = proxy.EnablePAC(context.Background(), "http://127.0.0.1:4765/proxy.pac")
+    // Integration mode: direct (default), pac, manual (system proxy), or tun via sing-box
+    switch mode := req.Options["integration"]; mode {
+    case "pac", "manual":
+        sys := proxy.Settings{SOCKS: publicBind, HTTP: p.httpBind}
+        if mode == "pac" { sys.PACURL = req.Options["pacURL"] }
+        p.sysProxy, p.stateDir = mode, stateDir
+        if err := proxy.Enable(context.Background(), stateDir, sys); err != nil {
+            p.emit(core.EventError, mode+": "+err.Error(), nil)
+        } else {
+            p.emit(core.EventIntegration, mode+" enabled", map[string]any{"integration": mode, "enabled": true})
+        }
     case "tun":
         // Sing-box should point to public (shim) SOCKS
-        p.sb = singbox.New(singbox.Config{SocksAddr: publicBind, StateDir: stateDir})
+        p.sb = singbox.New(singbox.Config{SocksAddr: socks5.WithAuth(publicBind, req.Options["socksUser"], req.Options["socksPass"]), StateDir: stateDir, PIDDir: procs.Dir(stateDir), StopTimeout: stopTimeout})
         if err := p.sb.Start(context.Background()); err != nil {
-            p.st = core.Status{Connected: false, Provider: p.Name(), Message: "sing-box failed: " + err.Error()}
+            // The manager does not disconnect a failed Connect: stop the shim,
+            // HTTP proxy, log tailer and engine race started above.
+            p.sb = nil
+            _ = p.Disconnect(context.Background())
+            p.st = core.Status{Provider: p.Name()}
+            p.transition(core.PhaseFailed, "sing-box failed: "+err.Error())
             return err
         }
+        p.emit(core.EventIntegration, "tun enabled", map[string]any{"integration": "tun", "enabled": true})
     default:
-        // direct: app uses SOCKS 127.0.0.1:8086; no system changes
+        // direct: app uses the shim SOCKS bind; no system changes
     }
-    msg := "connected (shim; warp warming)"
-    if usedURL != "" { msg = "connected (probe=" + usedURL + ")" }
-    p.st = core.Status{Connected: true, Provider: p.Name(), Message: msg, ExitCountry: req.ExitCountry, Integration: req.Options["integration"], Bind: publicBind, PacEnabled: p.wantPAC, SingBox: p.sb != nil}
+    p.st = core.Status{Provider: p.Name(), ExitCountry: req.ExitCountry, Integration: req.Options["integration"], Bind: publicBind, HTTPBind: p.httpBind, SocksAuth: users != nil, PacEnabled: p.sysProxy == "pac", SingBox: p.sb != nil}
     return nil
 }
 
-func (p *provider) Disconnect() error {
-    if p.sb != nil { _ = p.sb.Stop(); p.sb = nil }
-    if p.wantPAC { _ = proxy.DisablePAC(context.Background()); p.wantPAC = false }
-    if p.eng != nil { _ = p.eng.Stop() }
+func (p *provider) Disconnect(ctx context.Context) error {
+    p.endSession()
+    if p.sb != nil {
+        if err := p.sb.Stop(ctx); err != nil { p.emit(core.EventError, "sing-box: "+err.Error(), nil) }
+        p.sb = nil
+        p.emit(core.EventIntegration, "tun disabled", map[string]any{"integration": "tun", "enabled": false})
+    }
+    if p.sysProxy != "" {
+        // Putting the user's settings back is quick and must not be cut short.
+        if err := proxy.Disable(context.Background(), p.stateDir); err != nil {
+            p.emit(core.EventError, p.sysProxy+": restore system proxy: "+err.Error(), nil)
+        } else {
+            p.emit(core.EventIntegration, p.sysProxy+" disabled", map[string]any{"integration": p.sysProxy, "enabled": false})
+        }
+        p.sysProxy = ""
+    }
+    // Stop waits for warp-plus to exit, so its port is free when Disconnect returns.
+    p.engMu.Lock()
+    eng := p.eng
+    p.eng = nil
+    p.gen++
+    p.engMu.Unlock()
+    if eng != nil {
+        if err := eng.Stop(ctx); err != nil { p.emit(core.EventError, "warp-plus: "+err.Error(), nil) }
+    }
+    if p.hp != nil { _ = p.hp.Stop(); p.hp = nil }
     if p.ss != nil { _ = p.ss.Stop(); p.ss = nil }
+    p.httpBind = ""
     p.st = core.Status{}
+    p.logMu.Lock()
+    p.logSt = logStatus{}
+    p.logMu.Unlock()
     return nil
 }
 
-func (p *provider) Status() core.Status { return p.st }
+// beginSession starts the session for a Connect reporting to rep. Race
+// results of earlier sessions are dropped from now on.
+func (p *provider) beginSession(rep core.Reporter) *session {
+    ctx, cancel := context.WithCancel(context.Background())
+    p.engMu.Lock()
+    p.gen++
+    s := &session{name: p.name, rep: rep, gen: p.gen, ctx: ctx, cancel: cancel}
+    p.engMu.Unlock()
+    p.sess = s
+    return s
+}
 
-func endpointFrom(req core.ConnectRequest) string {
-    if req.Server == "" { return "" }
-    if req.Port > 0 { return req.Server + ":" + strconv.Itoa(req.Port) }
-    return req.Server
+// endSession ends the latest session, if any; see session.end.
+func (p *provider) endSession() {
+    if p.sess != nil { p.sess.end() }
+}
+
+func (p *provider) Status() core.Status {
+    st := p.st
+    p.engMu.Lock()
+    if p.eng != nil { st.EngineBind = p.eng.Bind() }
+    p.engMu.Unlock()
+    if p.ss != nil { st.UDP = p.ss.UDPMode() }
+    p.logMu.Lock()
+    st.Endpoint, st.Handshake, st.EngineLog = p.logSt.endpoint, p.logSt.handshake, p.logSt.path
+    if p.logSt.country != "" { st.ExitCountry = p.logSt.country }
+    p.logMu.Unlock()
+    return st
+}
+
+// tailLog follows the log of the engine adopted by session s until the
+// session ends, and feeds what it recognises into status and the session's
+// events. The race gives every candidate a fresh log, so it is read from the
+// start.
+func (p *provider) tailLog(s *session, path string) {
+    done := make(chan struct{})
+    s.tailDone = done
+    go func() {
+        defer close(done)
+        warpplus.TailLog(s.ctx, path, 0, func(ev warpplus.LogEvent) { p.onLog(s, ev) })
+    }()
+}
+
+// candidateLog returns the log of the n-th candidate of a connect. Each
+// candidate writes its own, so that only the winner's output is followed.
+func candidateLog(stateDir string, n int) string {
+    return filepath.Join(stateDir, fmt.Sprintf("warp-plus.%d.log", n))
 }
 
-func bindFrom(req core.ConnectRequest) string {
-    if b := req.Options["bind"]; b != "" { return b }
-    return "127.0.0.1:8087"
+func (p *provider) onLog(s *session, ev warpplus.LogEvent) {
+    at := ev.Time
+    if at.IsZero() { at = time.Now() }
+    p.logMu.Lock()
+    switch ev.Kind {
+    case warpplus.LogHandshake:
+        p.logSt.handshake = at
+        if ev.Endpoint != "" { p.logSt.endpoint = ev.Endpoint }
+    case warpplus.LogEndpoint:
+        p.logSt.endpoint = ev.Endpoint
+    case warpplus.LogCountry:
+        p.logSt.country = ev.Country
+    }
+    p.logMu.Unlock()
+
+    data := map[string]any{"kind": string(ev.Kind)}
+    switch ev.Kind {
+    case warpplus.LogHandshake:
+        if ev.Endpoint != "" { data["endpoint"] = ev.Endpoint }
+        s.handshake("warp handshake ok; warming")
+        s.emit(core.EventEngineLog, ev.String(), data)
+    case warpplus.LogEndpoint:
+        data["endpoint"] = ev.Endpoint
+        s.emit(core.EventEndpoint, ev.String(), data)
+    case warpplus.LogCountry:
+        data["country"] = ev.Country
+        s.emit(core.EventEngineLog, ev.String(), data)
+    case warpplus.LogTest:
+        data["url"], data["ok"] = ev.URL, ev.OK
+        if ev.Error != "" { data["error"] = ev.Error }
+        s.emit(core.EventEngineLog, ev.String(), data)
+    case warpplus.LogError:
+        s.emit(core.EventError, "warp-plus: "+ev.String(), data)
+    }
+}
+
+// emit publishes an event through the latest session's reporter. Only
+// Connect and Disconnect use it; background work reports through its own
+// session.
+func (p *provider) emit(t core.EventType, msg string, data map[string]any) {
+    if p.sess != nil { p.sess.emit(t, msg, data) }
+}
+
+// transition reports a phase change for the latest session, like emit.
+func (p *provider) transition(to core.Phase, msg string) {
+    if p.sess != nil { p.sess.transition(to, msg) }
+}
+
+// supervise enables warp-plus restarts and mirrors them into the phase of s.
+func (p *provider) supervise(s *session, eng *warpplus.Engine, policy warpplus.RestartPolicy, bind string) {
+    // restarts counts scheduled restarts; a port wait overtaken by a later
+    // crash leaves the phase to that restart.
+    var restarts atomic.Int32
+    eng.Supervise(policy, warpplus.SupervisorHooks{
+        OnRestart: func(attempt int, delay time.Duration, exitErr error) {
+            restarts.Add(1)
+            msg := fmt.Sprintf("warp-plus exited; restarting in %s (attempt %d)", delay.Round(time.Millisecond), attempt)
+            s.transition(core.PhaseReconnecting, msg)
+        },
+        OnRestarted: func(attempt int) {
+            s.emit(core.EventEngineStart, "warp-plus restarted", map[string]any{"attempt": attempt})
+            s.transition(core.PhaseHandshaking, "waiting for restarted warp-plus")
+            // The supervisor waits for this hook; wait for the port on the
+            // side so that another crash meanwhile is restarted at once. The
+            // wait ends with the session.
+            n := restarts.Load()
+            go func() {
+                ctx, cancel := context.WithTimeout(s.ctx, 45*time.Second)
+                defer cancel()
+                err := warpplus.WaitPort(ctx, bind)
+                if s.ctx.Err() != nil || restarts.Load() != n { return }
+                if err != nil {
+                    s.transition(core.PhaseFailed, "warp-plus restarted but SOCKS not ready: "+err.Error())
+                    return
+                }
+                s.transition(core.PhaseReady, "connected ("+p.name+" active; restarted)")
+            }()
+        },
+        OnGiveUp: func(err error) {
+            s.transition(core.PhaseFailed, "warp-plus stopped: "+err.Error())
+        },
+    })
 }
 
-// choosePublicBind selects a bind address, preferring:
-// 1) explicit requested bind if provided and available (excluding 8086);
-// 2) last persisted bind from state if available (excluding 8086);
-// 3) first free port in 8087..8090 on localhost.
-func choosePublicBind(stateDir string, requested string) (string, error) {
-    // helper to test listen
-    tryListen := func(addr string) bool {
-        ln, err := net.Listen("tcp", addr)
-        if err != nil { return false }
-        _ = ln.Close()
-        return true
+// connectEngine races warp-plus candidates: cached endpoints first, then the
+// requested endpoint (or warp-plus's own pick) with each test URL, then freshly
+// scanned endpoints. The winner is supervised and becomes the upstream of ss
+// as soon as it is picked, unless session s has ended by then. It returns a
+// short description of the winning candidate.
+func (p *provider) connectEngine(s *session, ss *shimsocks.Server, req core.ConnectRequest, baseCfg warpplus.Config, restart warpplus.RestartPolicy, race warpplus.RaceOptions) (string, error) {
+    stateDir := req.Options["stateDir"]
+    cache := warpplus.OpenCache(stateDir)
+    ctx, cancel := context.WithTimeout(s.ctx, race.Deadline)
+    defer cancel()
+    adopted := false
+    race.OnWin = func(res warpplus.RaceResult) { adopted = p.adopt(s, ss, res, restart) }
+    urls := candidateTestURLs(req)
+    var cands []warpplus.Config
+    n := 0
+    add := func(cfg warpplus.Config) {
+        cfg.LogPath = candidateLog(stateDir, n)
+        n++
+        cands = append(cands, cfg)
+    }
+    tried := map[string]bool{}
+    if baseCfg.Endpoint == "" {
+        best, _ := cache.Best(3)
+        for _, ep := range best {
+            cfg := baseCfg
+            cfg.Endpoint, cfg.TestURL = ep, urls[0]
+            tried[ep] = true
+            add(cfg)
+        }
     }
-    // 1) requested
-    if requested != "" && !strings.HasSuffix(requested, ":8086") && tryListen(requested) {
-        return requested, nil
+    for _, u := range urls {
+        cfg := baseCfg
+        cfg.TestURL = u
+        add(cfg)
     }
-    // 2) last persisted
-    if last, ok := loadBind(stateDir); ok && !strings.HasSuffix(last, ":8086") && tryListen(last) {
-        return last, nil
+    res, err := p.race(ctx, s, cands, race, cache)
+    if err != nil && ctx.Err() == nil {
+        // Fall back to scanned endpoints with a shorter URL list, spreading
+        // the first rounds across endpoints.
+        eps, scanErr := scanEndpoints(ctx, firstNonEmpty(req.Options["identityDir"], stateDir))
+        if scanErr == nil && len(eps) > 0 {
+            _ = cache.RecordScan(eps)
+            eps = cache.Order(eps)
+            if len(eps) > 15 { eps = eps[:15] }
+            scanURLs := urls
+            if len(scanURLs) > 3 { scanURLs = scanURLs[:3] }
+            cands = cands[:0]
+            for _, u := range scanURLs {
+                for _, ep := range eps {
+                    if tried[ep.Address] { continue }
+                    cfg := baseCfg
+                    cfg.Endpoint, cfg.TestURL = ep.Address, u
+                    add(cfg)
+                }
+            }
+            if len(cands) > 0 { res, err = p.race(ctx, s, cands, race, cache) }
+        }
     }
-    // 3) scan range
-    host := "127.0.0.1"
-    for p := 8087; p <= 8090; p++ {
-        addr := net.JoinHostPort(host, strconv.Itoa(p))
-        if tryListen(addr) { return addr, nil }
+    if err != nil { return "", err }
+    if !adopted {
+        _ = res.Engine.Stop(context.Background())
+        return "", errors.New("session ended before warp-plus was ready")
     }
-    return "", errors.New("no available port in 8087-8090")
+    used := res.Config.TestURL
+    if res.Config.Endpoint != "" { used += ", ep=" + res.Config.Endpoint }
+    return used, nil
 }
 
-func bindPath(stateDir string) string { return filepath.Join(stateDir, "socks-bind.json") }
+// adopt makes a race winner the engine of session s: it is supervised,
+// becomes the upstream of ss and its log is followed. It reports false,
+// leaving the engine to the caller, if the session has ended.
+func (p *provider) adopt(s *session, ss *shimsocks.Server, res warpplus.RaceResult, restart warpplus.RestartPolicy) bool {
+    p.engMu.Lock()
+    defer p.engMu.Unlock()
+    if p.gen != s.gen { return false }
+    p.eng = res.Engine
+    p.logMu.Lock()
+    p.logSt.path = res.Config.LogPath
+    // warp-plus may not log the endpoint it was given.
+    if ep := res.Config.Endpoint; ep != "" { p.logSt.endpoint = ep }
+    p.logMu.Unlock()
+    p.tailLog(s, res.Config.LogPath)
+    p.supervise(s, res.Engine, restart, res.Config.Bind)
+    if ss != nil { ss.SetUpstream(res.Config.Bind) }
+    return true
+}
 
-func persistBind(stateDir, bind string) error {
-    b, _ := json.Marshal(map[string]string{"bind": bind})
-    return os.WriteFile(bindPath(stateDir), b, 0o644)
+// race runs one round of candidates and records endpoint outcomes: a success
+// for the winner and one failure per endpoint whose started candidates all failed.
+func (p *provider) race(ctx context.Context, s *session, cands []warpplus.Config, opts warpplus.RaceOptions, cache *warpplus.EndpointCache) (warpplus.RaceResult, error) {
+    failed := map[string]bool{}
+    opts.Start = func(cfg warpplus.Config) (*warpplus.Engine, error) {
+        if cfg.Endpoint != "" { s.emit(core.EventEndpoint, "trying endpoint "+cfg.Endpoint, map[string]any{"endpoint": cfg.Endpoint}) }
+        _ = os.Remove(cfg.LogPath) // left by an earlier connect
+        eng := newEngine(s, cfg)
+        if err := eng.Start(context.Background()); err != nil { return nil, err }
+        s.emit(core.EventEngineStart, "warp-plus started", map[string]any{"testURL": cfg.TestURL, "endpoint": cfg.Endpoint, "bind": cfg.Bind})
+        s.transition(core.PhaseHandshaking, "waiting for warp handshake")
+        return eng, nil
+    }
+    opts.OnResult = func(r warpplus.CandidateResult) {
+        if r.Config.Endpoint != "" && r.Started && r.Err != nil { failed[r.Config.Endpoint] = true }
+    }
+    s.transition(core.PhaseStartingEngine, fmt.Sprintf("trying %d warp-plus candidates one at a time", len(cands)))
+    res, err := warpplus.Race(ctx, cands, opts)
+    if err == nil && res.Config.Endpoint != "" {
+        delete(failed, res.Config.Endpoint)
+        _ = cache.RecordSuccess(res.Config.Endpoint, res.Elapsed)
+        sampleThroughput(s, cache, res.Config.Endpoint, res.Config.Bind)
+    }
+    for ep := range failed { _ = cache.RecordFailure(ep) }
+    return res, err
 }
 
-func loadBind(stateDir string) (string, bool) {
-    b, err := os.ReadFile(bindPath(stateDir))
-    if err != nil { return "", false }
-    var m map[string]string
-    if json.Unmarshal(b, &m) != nil { return "", false }
-    v := m["bind"]
-    if v == "" { return "", false }
-    return v, true
+// sampleThroughput records a download rate through the fresh tunnel for ep
+// in the background. The sample is abandoned when session s ends.
+func sampleThroughput(s *session, cache *warpplus.EndpointCache, ep, bind string) {
+    done := make(chan struct{})
+    s.sampleDone = done
+    go func() {
+        defer close(done)
+        ctx, cancel := context.WithTimeout(s.ctx, 20*time.Second)
+        defer cancel()
+        kbps, err := warpplus.MeasureThroughput(ctx, bind)
+        if err != nil || s.ctx.Err() != nil { return }
+        _ = cache.RecordThroughput(ep, kbps)
+    }()
+}
+
+// scanEndpoints ranks WARP endpoints using the key of the identity in dir.
+func scanEndpoints(ctx context.Context, dir string) ([]warpplus.Endpoint, error) {
+    id, ok, err := warpreg.Load(dir)
+    if err != nil { return nil, err }
+    if !ok { return nil, errors.New("no WARP identity to scan with") }
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    return warpplus.Scan(ctx, warpplus.ScanOptions{PrivateKey: id.PrivateKey})
+}
+
+// newEngine builds a warp-plus engine that reports its exit through s.
+func newEngine(s *session, cfg warpplus.Config) *warpplus.Engine {
+    eng := warpplus.New(cfg)
+    eng.OnExit(func(err error) {
+        data := map[string]any{"endpoint": cfg.Endpoint}
+        if err != nil { data["error"] = err.Error() }
+        s.emit(core.EventEngineExit, "warp-plus exited", data)
+    })
+    return eng
+}
+
+func endpointFrom(req core.ConnectRequest) string {
+    if req.Server == "" { return "" }
+    if req.Port > 0 { return req.Server + ":" + strconv.Itoa(req.Port) }
+    return req.Server
 }
 
 func firstNonEmpty(values ...string) string {
@@ -266,52 +615,3 @@ func contains(list []string, v string) bool {
     for _, x := range list { if x == v { return true } }
     return false
 }
-
-func modeFromProvider(p string) string {
-    switch p {
-    case "warp":
-        return "warp"
-    case "gool":
-        return "gool"
-    case "psiphon":
-        return "psiphon"
-    default:
-        return "warp"
-    }
-}
-
-// altBind returns a sibling address with the same host and a different port.
-// If base is "127.0.0.1:8086" and alt is 18086, returns "127.0.0.1:18086".
-func altBind(base string, port int) string {
-    host, _, err := net.SplitHostPort(base)
-    if err != nil { return fmt.Sprintf("127.0.0.1:%d", port) }
-    return net.JoinHostPort(host, strconv.Itoa(port))
-}
-
-func waitPort(addr string, timeout time.Duration) error {
-    if addr == "" { addr = "127.0.0.1:8086" }
-    deadline := time.Now().Add(timeout)
-    for time.Now().Before(deadline) {
-        c, err := net.DialTimeout("tcp", addr, 500*time.Millisecond)
-        if err == nil {
-            c.Close()
-            return nil
-        }
-        time.Sleep(250 * time.Millisecond)
-    }
-    return fmt.Errorf("timeout waiting for %s", addr)
-}
-
-// detectHandshake polls the warp-plus log for "handshake complete" to improve user-facing status
-// while the upstream SOCKS may still be warming up or gated by connectivity tests.
-func detectHandshake(logPath string, st *core.Status) {
-    deadline := time.Now().Add(2 * time.Minute)
-    for time.Now().Before(deadline) {
-        b, err := os.ReadFile(logPath)
-        if err == nil && strings.Contains(string(b), "handshake complete") {
-            st.Message = "connected (warp handshake ok; warming)"
-            return
-        }
-        time.Sleep(1500 * time.Millisecond)
-    }
-}
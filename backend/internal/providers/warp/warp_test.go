@@ -0,0 +1,88 @@
+package warp
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+
+    "bulletproof/backend/internal/core"
+    "bulletproof/backend/internal/engine/warpplus"
+)
+
+// recorder is a core.Reporter that keeps a phase and reports illegal
+// transitions as error events, like the manager's.
+type recorder struct {
+    phase  core.Phase
+    events []core.Event
+}
+
+func (r *recorder) Emit(ev core.Event) { r.events = append(r.events, ev) }
+
+func (r *recorder) Transition(to core.Phase, msg string) error {
+    if !core.CanTransition(r.phase, to) {
+        err := fmt.Errorf("%w: %s -> %s", core.ErrIllegalTransition, r.phase, to)
+        r.Emit(core.Event{Type: core.EventError, Message: err.Error()})
+        return err
+    }
+    r.phase = to
+    return nil
+}
+
+func (r *recorder) TransitionFrom(from []core.Phase, to core.Phase, msg string) bool {
+    for _, ph := range from {
+        if ph == r.phase { return r.Transition(to, msg) == nil }
+    }
+    return false
+}
+
+func TestOnLog_HandshakeKeepsReadySession(t *testing.T) {
+    rekey, ok := warpplus.ParseLine(`time=2024-05-01T10:00:00Z level=DEBUG msg="peer(bmXO…fgyo) - Received handshake response"`)
+    if !ok || rekey.Kind != warpplus.LogHandshake { t.Fatalf("rekey line: %+v, %v", rekey, ok) }
+    for _, ph := range []core.Phase{core.PhaseReady, core.PhaseDegraded, core.PhaseFailed} {
+        rep := &recorder{phase: ph}
+        p := &provider{name: "warp", mode: "warp"}
+        s := &session{name: p.name, rep: rep, ctx: context.Background()}
+        p.onLog(s, rekey)
+        if rep.phase != ph { t.Errorf("%s session moved to %s", ph, rep.phase) }
+        for _, ev := range rep.events {
+            if ev.Type == core.EventError { t.Errorf("%s session: error event %q", ph, ev.Message) }
+        }
+        if p.Status().Handshake.IsZero() { t.Errorf("%s session: handshake not recorded", ph) }
+    }
+
+    rep := &recorder{phase: core.PhaseStartingEngine}
+    p := &provider{name: "warp", mode: "warp"}
+    p.onLog(&session{name: p.name, rep: rep, ctx: context.Background()}, rekey)
+    if rep.phase != core.PhaseHandshaking { t.Fatalf("waiting session in %s, want handshaking", rep.phase) }
+}
+
+func TestSampleThroughput_EndsWithSession(t *testing.T) {
+    // A tunnel that accepts connections and never answers.
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer ln.Close()
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            defer c.Close()
+        }
+    }()
+
+    cache := warpplus.OpenCache(t.TempDir())
+    ctx, cancel := context.WithCancel(context.Background())
+    s := &session{name: "warp", ctx: ctx, cancel: cancel}
+    sampleThroughput(s, cache, "162.159.192.1:2408", ln.Addr().String())
+    time.Sleep(50 * time.Millisecond)
+
+    ended := make(chan struct{})
+    go func() { s.end(); close(ended) }()
+    select {
+    case <-ended:
+    case <-time.After(2 * time.Second):
+        t.Fatal("session end did not stop the throughput sample")
+    }
+    if list, _ := cache.List(); len(list) != 0 { t.Fatalf("sample of an ended session recorded: %+v", list) }
+}
@@ -0,0 +1,171 @@
+// Package procs starts helper processes (warp-plus, sing-box) with a PID
+// file each, so that helpers orphaned by a daemon crash can be found and
+// killed on the next start. On Linux helpers also get SIGKILL when the
+// daemon dies.
+package procs
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Dir returns the PID file directory inside a state dir.
+func Dir(stateDir string) string { return filepath.Join(stateDir, "pids") }
+
+// Record is the content of a PID file.
+type Record struct {
+    PID     int       `json:"pid"`
+    Name    string    `json:"name"` // helper kind, e.g. warp-plus
+    Bin     string    `json:"bin"`  // executable as started
+    Started time.Time `json:"started"`
+
+    path string
+}
+
+// Proc is a started helper. It satisfies the engines' Process interfaces.
+type Proc struct {
+    cmd     *exec.Cmd
+    pidPath string
+}
+
+// Start starts cmd in its own process group (tied to the daemon's lifetime
+// where the OS allows it) and, if dir is non-empty, records it there until
+// Wait returns.
+func Start(cmd *exec.Cmd, dir, name string) (*Proc, error) {
+    if cmd.SysProcAttr == nil { cmd.SysProcAttr = sysProcAttr() }
+    if err := startCmd(cmd); err != nil { return nil, err }
+    p := &Proc{cmd: cmd}
+    if dir != "" {
+        r := Record{PID: cmd.Process.Pid, Name: name, Bin: cmd.Path, Started: time.Now().UTC()}
+        // Tracking is best effort; the helper runs either way.
+        if path, err := write(dir, r); err == nil { p.pidPath = path }
+    }
+    return p, nil
+}
+
+// Pid returns the process ID.
+func (p *Proc) Pid() int { return p.cmd.Process.Pid }
+
+// Wait waits for the process to exit and removes its PID file.
+func (p *Proc) Wait() error {
+    err := p.cmd.Wait()
+    if p.pidPath != "" { _ = os.Remove(p.pidPath) }
+    return err
+}
+
+// Kill kills the process and anything else in its process group.
+func (p *Proc) Kill() error {
+    if err := kill(p.cmd.Process.Pid); err != nil { return p.cmd.Process.Kill() }
+    return nil
+}
+
+// Signal sends sig to the process.
+func (p *Proc) Signal(sig os.Signal) error { return p.cmd.Process.Signal(sig) }
+
+// Terminate asks the process group to exit (SIGTERM). Where the OS has no
+// such request, it kills the process.
+func (p *Proc) Terminate() error { return terminate(p.cmd.Process) }
+
+// Stopper is what Stop needs from a process.
+type Stopper interface {
+    Terminate() error
+    Kill() error
+}
+
+// DefaultGrace is how long Stop waits after Terminate before killing.
+const DefaultGrace = 5 * time.Second
+
+// killWait bounds the wait for a killed process to be reaped.
+var killWait = 2 * time.Second
+
+// ErrNoExit is returned by Stop when a process survives being killed.
+var ErrNoExit = errors.New("process did not exit after kill")
+
+// Stop asks p to exit and waits until exited is closed. If p is still
+// running after grace (DefaultGrace if zero) or when ctx ends, it is killed.
+func Stop(ctx context.Context, p Stopper, exited <-chan struct{}, grace time.Duration) error {
+    if grace <= 0 { grace = DefaultGrace }
+    if p.Terminate() == nil {
+        t := time.NewTimer(grace)
+        defer t.Stop()
+        select {
+        case <-exited:
+            return nil
+        case <-t.C:
+        case <-ctx.Done():
+        }
+    }
+    _ = p.Kill()
+    select {
+    case <-exited:
+        return nil
+    case <-time.After(killWait):
+        return ErrNoExit
+    }
+}
+
+func write(dir string, r Record) (string, error) {
+    if err := os.MkdirAll(dir, 0o700); err != nil { return "", err }
+    b, err := json.Marshal(r)
+    if err != nil { return "", err }
+    path := filepath.Join(dir, r.Name+"-"+strconv.Itoa(r.PID)+".json")
+    if err := os.WriteFile(path+".tmp", b, 0o600); err != nil { return "", err }
+    return path, os.Rename(path+".tmp", path)
+}
+
+// List reads the PID files in dir. Unreadable files are skipped.
+func List(dir string) ([]Record, error) {
+    files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil { return nil, err }
+    var out []Record
+    for _, f := range files {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        var r Record
+        if json.Unmarshal(b, &r) != nil || r.PID <= 0 { _ = os.Remove(f); continue }
+        r.path = f
+        out = append(out, r)
+    }
+    return out, nil
+}
+
+// Reap kills every recorded process that is still running the recorded
+// executable and removes the PID files. A PID that has since been reused by
+// another program is left alone. It returns the processes it killed; PID
+// files of processes it failed to kill are kept for the next attempt.
+func Reap(dir string) ([]Record, error) {
+    recs, err := List(dir)
+    if err != nil { return nil, err }
+    var killed []Record
+    var errs []error
+    for _, r := range recs {
+        if exe, ok := exeName(r.PID); ok && sameExe(exe, r.Bin) {
+            if err := kill(r.PID); err != nil {
+                errs = append(errs, fmt.Errorf("kill %s (pid %d): %w", r.Name, r.PID, err))
+                continue
+            }
+            killed = append(killed, r)
+        }
+        _ = os.Remove(r.path)
+    }
+    return killed, errors.Join(errs...)
+}
+
+// sameExe compares executables by base name, ignoring ".exe" and the
+// " (deleted)" suffix Linux adds after an upgrade replaced the binary.
+func sameExe(a, b string) bool {
+    norm := func(s string) string {
+        s = strings.TrimSuffix(s, " (deleted)")
+        if i := strings.LastIndexAny(s, `/\`); i >= 0 { s = s[i+1:] }
+        return strings.TrimSuffix(strings.ToLower(s), ".exe")
+    }
+    return a != "" && b != "" && norm(a) == norm(b)
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package procs
+
+import (
+    "os"
+    "os/exec"
+    "runtime"
+    "strconv"
+    "sync"
+    "syscall"
+)
+
+// sysProcAttr puts the helper in its own process group and asks the kernel
+// to SIGKILL it when the daemon dies. Pdeathsig fires when the forking OS
+// thread exits rather than the process, so startCmd forks from a thread that
+// lives as long as the daemon.
+func sysProcAttr() *syscall.SysProcAttr {
+    return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
+
+type spawn struct {
+    cmd  *exec.Cmd
+    done chan error
+}
+
+var (
+    spawnOnce sync.Once
+    spawns    chan spawn
+)
+
+// startCmd starts cmd on the spawner goroutine. It locks its OS thread and
+// never returns, so the thread is not ended or reused by whatever goroutine
+// happened to call Start.
+func startCmd(cmd *exec.Cmd) error {
+    spawnOnce.Do(func() {
+        spawns = make(chan spawn)
+        go func() {
+            runtime.LockOSThread()
+            for s := range spawns { s.done <- s.cmd.Start() }
+        }()
+    })
+    s := spawn{cmd: cmd, done: make(chan error, 1)}
+    spawns <- s
+    return <-s.done
+}
+
+// exeName returns the executable of a running process.
+func exeName(pid int) (string, bool) {
+    exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+    return exe, err == nil
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package procs
+
+import (
+    "os/exec"
+    "runtime"
+    "testing"
+    "time"
+)
+
+func TestStartOutlivesCallerThread(t *testing.T) {
+    // A goroutine that exits while locked usually takes its thread with it;
+    // a helper forked from that thread would get its parent-death signal.
+    var exited []chan struct{}
+    for i := 0; i < 4; i++ {
+        started := make(chan *Proc)
+        go func() {
+            runtime.LockOSThread()
+            p, err := Start(exec.Command("sleep", "30"), "", "sleeper")
+            if err != nil { t.Errorf("start: %v", err) }
+            started <- p
+        }()
+        p := <-started
+        if p == nil { t.Skip("sleep unavailable") }
+        defer func() { _ = p.Kill() }()
+        done := make(chan struct{})
+        go func() { _ = p.Wait(); close(done) }()
+        exited = append(exited, done)
+    }
+    time.Sleep(300 * time.Millisecond)
+    for i, done := range exited {
+        select {
+        case <-done:
+            t.Errorf("helper %d died with the thread that started it", i)
+        default:
+        }
+    }
+}
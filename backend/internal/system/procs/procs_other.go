@@ -0,0 +1,25 @@
+//go:build unix && !linux
+// +build unix,!linux
+
+package procs
+
+import (
+    "os/exec"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// sysProcAttr puts the helper in its own process group so it can be killed
+// with everything it started. There is no parent-death signal here; orphans
+// are reaped on the next start instead.
+func sysProcAttr() *syscall.SysProcAttr { return &syscall.SysProcAttr{Setpgid: true} }
+
+func startCmd(cmd *exec.Cmd) error { return cmd.Start() }
+
+// exeName returns the executable of a running process.
+func exeName(pid int) (string, bool) {
+    out, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(pid)).Output()
+    name := strings.TrimSpace(string(out))
+    return name, err == nil && name != ""
+}
@@ -0,0 +1,88 @@
+//go:build unix
+// +build unix
+
+package procs
+
+import (
+    "context"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestStartRecordsAndWaitRemoves(t *testing.T) {
+    dir := t.TempDir()
+    p, err := Start(exec.Command("sleep", "30"), dir, "sleeper")
+    if err != nil { t.Skipf("sleep unavailable: %v", err) }
+    recs, err := List(dir)
+    if err != nil || len(recs) != 1 || recs[0].PID != p.Pid() || recs[0].Name != "sleeper" {
+        t.Fatalf("records = %+v, %v", recs, err)
+    }
+    if err := p.Kill(); err != nil { t.Fatal(err) }
+    _ = p.Wait()
+    if recs, _ := List(dir); len(recs) != 0 { t.Fatalf("PID file left after exit: %+v", recs) }
+}
+
+func TestReap(t *testing.T) {
+    dir := t.TempDir()
+    // An orphan from a "previous run": a live helper still on its PID file.
+    orphan, err := Start(exec.Command("sleep", "30"), dir, "sleeper")
+    if err != nil { t.Skipf("sleep unavailable: %v", err) }
+    exited := make(chan struct{})
+    go func() { _ = orphan.cmd.Wait(); close(exited) }()
+
+    // A PID reused by an unrelated program must survive, as must a dead one.
+    if _, err := write(dir, Record{PID: os.Getpid(), Name: "warp-plus", Bin: "/opt/bulletproof/warp-plus"}); err != nil { t.Fatal(err) }
+    if _, err := write(dir, Record{PID: 1 << 22, Name: "sing-box", Bin: "sing-box"}); err != nil { t.Fatal(err) }
+
+    killed, err := Reap(dir)
+    if err != nil { t.Fatal(err) }
+    if len(killed) != 1 || killed[0].PID != orphan.Pid() { t.Fatalf("killed = %+v", killed) }
+    select {
+    case <-exited:
+    case <-time.After(5 * time.Second):
+        t.Fatal("orphan still running")
+    }
+    if left, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(left) != 0 { t.Fatalf("PID files left: %v", left) }
+}
+
+func TestSameExe(t *testing.T) {
+    if !sameExe("/usr/lib/bulletproof/warp-plus (deleted)", "warp-plus") || !sameExe(`C:\bp\WARP-PLUS.EXE`, "warp-plus.exe") {
+        t.Fatal("expected match")
+    }
+    if sameExe("/usr/bin/sleep", "warp-plus") || sameExe("", "") { t.Fatal("unexpected match") }
+}
+
+func startShell(t *testing.T, script string) (*Proc, chan struct{}) {
+    t.Helper()
+    p, err := Start(exec.Command("sh", "-c", script), "", "sh")
+    if err != nil { t.Skipf("sh unavailable: %v", err) }
+    exited := make(chan struct{})
+    go func() { _ = p.Wait(); close(exited) }()
+    time.Sleep(50 * time.Millisecond) // let the shell install its traps
+    return p, exited
+}
+
+func TestStopGraceful(t *testing.T) {
+    p, exited := startShell(t, `trap "exit 0" TERM; while :; do sleep 0.05; done`)
+    began := time.Now()
+    if err := Stop(context.Background(), p, exited, 5*time.Second); err != nil { t.Fatal(err) }
+    if d := time.Since(began); d > 2*time.Second { t.Fatalf("graceful stop took %v", d) }
+}
+
+func TestStopKillsAfterGrace(t *testing.T) {
+    p, exited := startShell(t, `trap "" TERM; while :; do sleep 0.05; done`)
+    began := time.Now()
+    if err := Stop(context.Background(), p, exited, 200*time.Millisecond); err != nil { t.Fatal(err) }
+    if d := time.Since(began); d < 200*time.Millisecond { t.Fatalf("killed before the grace period: %v", d) }
+
+    // A cancelled context skips the grace period.
+    p, exited = startShell(t, `trap "" TERM; while :; do sleep 0.05; done`)
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    began = time.Now()
+    if err := Stop(ctx, p, exited, time.Minute); err != nil { t.Fatal(err) }
+    if d := time.Since(began); d > 2*time.Second { t.Fatalf("cancelled stop took %v", d) }
+}
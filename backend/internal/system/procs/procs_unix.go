@@ -0,0 +1,23 @@
+//go:build unix
+// +build unix
+
+package procs
+
+import (
+    "errors"
+    "os"
+    "syscall"
+)
+
+// kill sends SIGKILL to the process group led by pid, or to pid alone if it
+// does not lead one.
+func kill(pid int) error {
+    if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil || !errors.Is(err, syscall.ESRCH) { return err }
+    return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// terminate sends SIGTERM to the process group led by p, or to p alone.
+func terminate(p *os.Process) error {
+    if err := syscall.Kill(-p.Pid, syscall.SIGTERM); err == nil || !errors.Is(err, syscall.ESRCH) { return err }
+    return p.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package procs
+
+import (
+    "encoding/csv"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+func sysProcAttr() *syscall.SysProcAttr { return nil }
+
+func startCmd(cmd *exec.Cmd) error { return cmd.Start() }
+
+func kill(pid int) error {
+    p, err := os.FindProcess(pid)
+    if err != nil { return err }
+    return p.Kill()
+}
+
+// exeName returns the image name of a running process.
+func exeName(pid int) (string, bool) {
+    out, err := exec.Command("tasklist", "/FI", "PID eq "+strconv.Itoa(pid), "/FO", "CSV", "/NH").Output()
+    if err != nil { return "", false }
+    rec, err := csv.NewReader(strings.NewReader(string(out))).Read()
+    if err != nil || len(rec) < 2 || rec[1] != strconv.Itoa(pid) { return "", false }
+    return rec[0], true
+}
+
+// terminate kills p: console programs cannot be asked to exit on Windows.
+func terminate(p *os.Process) error { return p.Kill() }
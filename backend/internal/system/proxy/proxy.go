@@ -0,0 +1,97 @@
+// Package proxy points the operating system's proxy settings at the daemon,
+// either at its PAC file or directly at the SOCKS/HTTP listeners. The
+// settings found before are snapshotted into the state dir and restored
+// on Disable, or by Recover after a crash.
+package proxy
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os/exec"
+    "strconv"
+)
+
+// backend is the per-OS implementation.
+type backend interface {
+    enable(ctx context.Context, s Settings) error
+    disable(ctx context.Context) error // reset to no proxy
+    capture(ctx context.Context) ([]Entry, error)
+    restore(ctx context.Context, entries []Entry) error
+}
+
+// Enable snapshots the current system proxy settings into stateDir, unless
+// a snapshot from an earlier Enable is still pending, and applies s.
+func Enable(ctx context.Context, stateDir string, s Settings) error {
+    if err := s.validate(); err != nil { return err }
+    _, ok, err := loadSnapshot(stateDir)
+    if err != nil { return err }
+    if !ok {
+        entries, err := system.capture(ctx)
+        if err != nil { return fmt.Errorf("snapshot system proxy: %w", err) }
+        if err := saveSnapshot(stateDir, entries); err != nil { return err }
+    }
+    return system.enable(ctx, s)
+}
+
+// Disable restores the settings snapshotted by Enable. Without a snapshot
+// the system proxy is reset to none.
+func Disable(ctx context.Context, stateDir string) error {
+    restored, err := Recover(ctx, stateDir)
+    if err != nil || restored { return err }
+    return system.disable(ctx)
+}
+
+// Settings describe the system proxy to apply. With PACURL set, desktops
+// are pointed at the PAC file; otherwise SOCKS and HTTP are set manually.
+// SOCKS and HTTP are still used in PAC mode by backends that cannot
+// evaluate PAC files (the Linux shell environment file).
+type Settings struct {
+    PACURL string
+    SOCKS  string   // host:port
+    HTTP   string   // host:port, optional
+    Bypass []string // extra hosts/CIDRs that skip the proxy in manual mode
+}
+
+// Mode is "pac" or "manual".
+func (s Settings) Mode() string {
+    if s.PACURL != "" { return "pac" }
+    return "manual"
+}
+
+// defaultBypass is always excluded from manual proxying.
+var defaultBypass = []string{"localhost", "127.0.0.0/8", "::1"}
+
+func (s Settings) bypass() []string { return append(append([]string(nil), defaultBypass...), s.Bypass...) }
+
+func (s Settings) validate() error {
+    if s.PACURL != "" { return nil }
+    if s.SOCKS == "" && s.HTTP == "" { return fmt.Errorf("no PAC URL or proxy address") }
+    for _, a := range []string{s.SOCKS, s.HTTP} {
+        if a == "" { continue }
+        if _, _, err := splitBind(a); err != nil { return err }
+    }
+    return nil
+}
+
+func splitBind(addr string) (string, int, error) {
+    host, ps, err := net.SplitHostPort(addr)
+    if err != nil { return "", 0, fmt.Errorf("invalid proxy address %q: %w", addr, err) }
+    port, err := strconv.Atoi(ps)
+    if err != nil || port <= 0 || port > 65535 { return "", 0, fmt.Errorf("invalid proxy port in %q", addr) }
+    return host, port, nil
+}
+
+// Runner executes the external tools used to change settings; tests replace
+// it to record commands instead of running them.
+type Runner interface {
+    Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+    out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+    if err != nil { return out, fmt.Errorf("%s: %w: %s", name, err, out) }
+    return out, nil
+}
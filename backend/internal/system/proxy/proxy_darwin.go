@@ -6,45 +6,130 @@ package proxy
 import (
     "context"
     "errors"
-    "os/exec"
+    "strconv"
     "strings"
 )
 
-// EnablePAC sets the Auto Proxy URL for all network services on macOS.
-func EnablePAC(ctx context.Context, pacURL string) error {
-    services, err := listServices(ctx)
+// darwinProxy applies settings to every enabled network service with
+// networksetup.
+type darwinProxy struct{ run Runner }
+
+var system backend = &darwinProxy{run: execRunner{}}
+
+// kinds maps the proxy kinds networksetup manages to their get, set and
+// set-state flags.
+var kinds = []struct{ key, get, set, state string }{
+    {"socks", "-getsocksfirewallproxy", "-setsocksfirewallproxy", "-setsocksfirewallproxystate"},
+    {"web", "-getwebproxy", "-setwebproxy", "-setwebproxystate"},
+    {"secureweb", "-getsecurewebproxy", "-setsecurewebproxy", "-setsecurewebproxystate"},
+}
+
+func (d *darwinProxy) enable(ctx context.Context, s Settings) error {
+    services, err := d.services(ctx)
     if err != nil { return err }
-    for _, s := range services {
-        if s == "" || strings.HasPrefix(s, "*") { continue }
-        _ = run(ctx, "networksetup", "-setautoproxyurl", s, pacURL)
-        _ = run(ctx, "networksetup", "-setautoproxystate", s, "on")
+    for _, svc := range services {
+        if s.PACURL != "" {
+            _ = d.cmd(ctx, "-setautoproxyurl", svc, s.PACURL)
+            _ = d.cmd(ctx, "-setautoproxystate", svc, "on")
+            continue
+        }
+        if s.SOCKS != "" {
+            host, port, _ := splitBind(s.SOCKS)
+            _ = d.cmd(ctx, "-setsocksfirewallproxy", svc, host, strconv.Itoa(port))
+            _ = d.cmd(ctx, "-setsocksfirewallproxystate", svc, "on")
+        }
+        if s.HTTP != "" {
+            host, port, _ := splitBind(s.HTTP)
+            _ = d.cmd(ctx, "-setwebproxy", svc, host, strconv.Itoa(port))
+            _ = d.cmd(ctx, "-setsecurewebproxy", svc, host, strconv.Itoa(port))
+        }
+        _ = d.cmd(ctx, append([]string{"-setproxybypassdomains", svc}, s.bypass()...)...)
     }
     return nil
 }
 
-// DisablePAC clears the Auto Proxy URL for all services on macOS.
-func DisablePAC(ctx context.Context) error {
-    services, err := listServices(ctx)
+func (d *darwinProxy) disable(ctx context.Context) error {
+    services, err := d.services(ctx)
     if err != nil { return err }
-    for _, s := range services {
-        if s == "" || strings.HasPrefix(s, "*") { continue }
-        _ = run(ctx, "networksetup", "-setautoproxystate", s, "off")
+    for _, svc := range services {
+        _ = d.cmd(ctx, "-setautoproxystate", svc, "off")
+        for _, k := range kinds { _ = d.cmd(ctx, k.state, svc, "off") }
     }
     return nil
 }
 
-func listServices(ctx context.Context) ([]string, error) {
-    out, err := exec.CommandContext(ctx, "networksetup", "-listallnetworkservices").CombinedOutput()
+// capture records networksetup's own report of each setting per service.
+func (d *darwinProxy) capture(ctx context.Context) ([]Entry, error) {
+    services, err := d.services(ctx)
     if err != nil { return nil, err }
-    lines := strings.Split(string(out), "\n")
-    if len(lines) == 0 { return nil, errors.New("no services") }
-    // First line is a header
-    if strings.HasPrefix(lines[0], "An asterisk (*) shows") { lines = lines[1:] }
-    return lines, nil
+    var out []Entry
+    get := func(svc, key, flag string) error {
+        b, err := d.run.Run(ctx, "networksetup", flag, svc)
+        if err != nil { return err }
+        out = append(out, Entry{Tool: "networksetup", Target: svc, Key: key, Value: string(b)})
+        return nil
+    }
+    for _, svc := range services {
+        if err := get(svc, "autoproxy", "-getautoproxyurl"); err != nil { return nil, err }
+        for _, k := range kinds {
+            if err := get(svc, k.key, k.get); err != nil { return nil, err }
+        }
+        if err := get(svc, "bypass", "-getproxybypassdomains"); err != nil { return nil, err }
+    }
+    return out, nil
 }
 
-func run(ctx context.Context, name string, args ...string) error {
-    cmd := exec.CommandContext(ctx, name, args...)
-    return cmd.Run()
+func (d *darwinProxy) restore(ctx context.Context, entries []Entry) error {
+    var errs []error
+    for _, e := range entries {
+        f, svc := fields(e.Value), e.Target
+        switch e.Key {
+        case "autoproxy":
+            if u := f["URL"]; u != "" && u != "(null)" { errs = append(errs, d.cmd(ctx, "-setautoproxyurl", svc, u)) }
+            errs = append(errs, d.cmd(ctx, "-setautoproxystate", svc, onOff(f["Enabled"])))
+        case "bypass":
+            domains := []string{"Empty"}
+            if !strings.HasPrefix(e.Value, "There aren't any") { domains = strings.Fields(e.Value) }
+            errs = append(errs, d.cmd(ctx, append([]string{"-setproxybypassdomains", svc}, domains...)...))
+        default:
+            for _, k := range kinds {
+                if k.key != e.Key { continue }
+                if f["Server"] != "" { errs = append(errs, d.cmd(ctx, k.set, svc, f["Server"], f["Port"])) }
+                errs = append(errs, d.cmd(ctx, k.state, svc, onOff(f["Enabled"])))
+            }
+        }
+    }
+    return errors.Join(errs...)
 }
 
+// fields parses networksetup's "Key: value" lines.
+func fields(out string) map[string]string {
+    f := map[string]string{}
+    for _, l := range strings.Split(out, "\n") {
+        if k, v, ok := strings.Cut(l, ":"); ok { f[strings.TrimSpace(k)] = strings.TrimSpace(v) }
+    }
+    return f
+}
+
+func onOff(enabled string) string {
+    if enabled == "Yes" || enabled == "1" { return "on" }
+    return "off"
+}
+
+func (d *darwinProxy) services(ctx context.Context) ([]string, error) {
+    out, err := d.run.Run(ctx, "networksetup", "-listallnetworkservices")
+    if err != nil { return nil, err }
+    var services []string
+    for _, l := range strings.Split(string(out), "\n") {
+        // The header and disabled services (marked with '*') are skipped.
+        if l == "" || strings.HasPrefix(l, "*") || strings.HasPrefix(l, "An asterisk (*) shows") { continue }
+        services = append(services, l)
+    }
+    if len(services) == 0 { return nil, errors.New("no services") }
+    return services, nil
+}
+
+func (d *darwinProxy) cmd(ctx context.Context, args ...string) error {
+    _, err := d.run.Run(ctx, "networksetup", args...)
+    return err
+}
@@ -0,0 +1,246 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// EnvFile is where the shell fallback writes proxy variables; source it from
+// a shell profile.
+func EnvFile() string { return system.(*linuxProxy).envFile() }
+
+// linuxProxy applies settings to the running desktop: GNOME (and
+// derivatives) via gsettings, KDE via kwriteconfig. Without either, an
+// environment file for shells is written instead.
+type linuxProxy struct {
+    run      Runner
+    getenv   func(string) string
+    lookPath func(string) (string, error)
+}
+
+var system backend = &linuxProxy{run: execRunner{}, getenv: os.Getenv, lookPath: exec.LookPath}
+
+const (
+    gnomeSchema = "org.gnome.system.proxy"
+    kdeGroup    = "Proxy Settings"
+)
+
+// gnomeDesktops use org.gnome.system.proxy.
+var gnomeDesktops = map[string]bool{"gnome": true, "ubuntu": true, "unity": true, "cinnamon": true, "x-cinnamon": true, "budgie": true, "pantheon": true}
+
+// desktops reports whether GNOME settings apply and which kwriteconfig to
+// use for KDE ("" if not KDE). A desktop only counts if its tool is installed.
+func (l *linuxProxy) desktops() (gnome bool, kde string) {
+    for _, d := range strings.Split(strings.ToLower(l.getenv("XDG_CURRENT_DESKTOP")), ":") {
+        switch {
+        case gnomeDesktops[d]:
+            _, err := l.lookPath("gsettings")
+            gnome = gnome || err == nil
+        case d == "kde":
+            kde = l.kdeTool()
+        }
+    }
+    return gnome, kde
+}
+
+// kdeTool picks kwriteconfig6 or kwriteconfig5, preferring the session's version.
+func (l *linuxProxy) kdeTool() string {
+    tools := []string{"kwriteconfig5", "kwriteconfig6"}
+    if l.getenv("KDE_SESSION_VERSION") != "5" { tools[0], tools[1] = tools[1], tools[0] }
+    for _, t := range tools {
+        if _, err := l.lookPath(t); err == nil { return t }
+    }
+    return ""
+}
+
+func (l *linuxProxy) enable(ctx context.Context, s Settings) error {
+    if err := s.validate(); err != nil { return err }
+    gnome, kde := l.desktops()
+    var errs []error
+    if gnome { errs = append(errs, l.gnome(ctx, s)) }
+    if kde != "" { errs = append(errs, l.kde(ctx, kde, s)) }
+    if !gnome && kde == "" {
+        if s.SOCKS == "" && s.HTTP == "" { return errors.New("no GNOME or KDE proxy settings found, and shells cannot use a PAC file") }
+        return l.writeEnv(s)
+    }
+    return errors.Join(errs...)
+}
+
+func (l *linuxProxy) disable(ctx context.Context) error {
+    gnome, kde := l.desktops()
+    var errs []error
+    if gnome { errs = append(errs, l.gsettings(ctx, gnomeSchema, "mode", "none")) }
+    if kde != "" { errs = append(errs, l.kdeWrite(ctx, kde, [][2]string{{"ProxyType", "0"}})) }
+    if err := os.Remove(l.envFile()); err != nil && !os.IsNotExist(err) { errs = append(errs, err) }
+    return errors.Join(errs...)
+}
+
+func (l *linuxProxy) gsettings(ctx context.Context, schema, key, val string) error {
+    _, err := l.run.Run(ctx, "gsettings", "set", schema, key, val)
+    return err
+}
+
+// gvString quotes s as a GVariant string literal.
+func gvString(s string) string {
+    return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func (l *linuxProxy) gnome(ctx context.Context, s Settings) error {
+    type kv struct{ schema, key, val string }
+    var sets []kv
+    if s.PACURL != "" {
+        sets = []kv{{gnomeSchema, "autoconfig-url", gvString(s.PACURL)}, {gnomeSchema, "mode", "auto"}}
+    } else {
+        hostPort := func(schema, addr string) {
+            host, port := "", 0
+            if addr != "" { host, port, _ = splitBind(addr) }
+            sets = append(sets, kv{schema, "host", gvString(host)}, kv{schema, "port", strconv.Itoa(port)})
+        }
+        hostPort(gnomeSchema+".socks", s.SOCKS)
+        hostPort(gnomeSchema+".http", s.HTTP)
+        hostPort(gnomeSchema+".https", s.HTTP)
+        ignore := make([]string, 0, len(s.bypass()))
+        for _, b := range s.bypass() { ignore = append(ignore, gvString(b)) }
+        sets = append(sets, kv{gnomeSchema, "ignore-hosts", "[" + strings.Join(ignore, ", ") + "]"}, kv{gnomeSchema, "mode", "manual"})
+    }
+    for _, e := range sets {
+        if err := l.gsettings(ctx, e.schema, e.key, e.val); err != nil { return err }
+    }
+    return nil
+}
+
+// kdeProxy renders an address in kioslaverc's "scheme://host port" form.
+func kdeProxy(scheme, addr string) string {
+    if addr == "" { return "" }
+    host, port, _ := splitBind(addr)
+    if strings.Contains(host, ":") { host = "[" + host + "]" }
+    return fmt.Sprintf("%s://%s %d", scheme, host, port)
+}
+
+func (l *linuxProxy) kde(ctx context.Context, tool string, s Settings) error {
+    if s.PACURL != "" {
+        return l.kdeWrite(ctx, tool, [][2]string{{"Proxy Config Script", s.PACURL}, {"ProxyType", "2"}})
+    }
+    return l.kdeWrite(ctx, tool, [][2]string{
+        {"socksProxy", kdeProxy("socks", s.SOCKS)},
+        {"httpProxy", kdeProxy("http", s.HTTP)},
+        {"httpsProxy", kdeProxy("http", s.HTTP)},
+        {"NoProxyFor", strings.Join(s.bypass(), ",")},
+        {"ProxyType", "1"},
+    })
+}
+
+var kdeNotifyArgs = []string{"--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:"}
+
+// kdeWrite sets keys in kioslaverc and asks running KIO workers to reload.
+func (l *linuxProxy) kdeWrite(ctx context.Context, tool string, kvs [][2]string) error {
+    for _, kv := range kvs {
+        if _, err := l.run.Run(ctx, tool, "--file", "kioslaverc", "--group", kdeGroup, "--key", kv[0], kv[1]); err != nil { return err }
+    }
+    // Best effort: without a session bus the settings still apply to new apps.
+    _, _ = l.run.Run(ctx, "dbus-send", kdeNotifyArgs...)
+    return nil
+}
+
+func (l *linuxProxy) envFile() string {
+    dir := l.getenv("XDG_CONFIG_HOME")
+    if dir == "" { dir = filepath.Join(l.getenv("HOME"), ".config") }
+    return filepath.Join(dir, "bulletproof", "proxy.env")
+}
+
+// shQuote quotes s for a POSIX shell; nothing inside single quotes is expanded.
+func shQuote(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" }
+
+// writeEnv writes lower- and upper-case proxy variables for shells.
+func (l *linuxProxy) writeEnv(s Settings) error {
+    var b strings.Builder
+    b.WriteString("# Written by bulletproof while connected; removed on disconnect.\n")
+    export := func(name, val string) { fmt.Fprintf(&b, "export %s=%s %s=%s\n", name, shQuote(val), strings.ToUpper(name), shQuote(val)) }
+    if s.SOCKS != "" { export("all_proxy", "socks5h://"+s.SOCKS) }
+    if s.HTTP != "" {
+        export("http_proxy", "http://"+s.HTTP)
+        export("https_proxy", "http://"+s.HTTP)
+    }
+    export("no_proxy", strings.Join(s.bypass(), ","))
+    p := l.envFile()
+    if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil { return err }
+    if err := os.WriteFile(p+".tmp", []byte(b.String()), 0o644); err != nil { return err }
+    return os.Rename(p+".tmp", p)
+}
+
+// gnomeKeys are captured in restore order; mode comes last so the other
+// values are in place when it switches them back on.
+var gnomeKeys = [][2]string{
+    {gnomeSchema, "autoconfig-url"}, {gnomeSchema, "ignore-hosts"},
+    {gnomeSchema + ".socks", "host"}, {gnomeSchema + ".socks", "port"},
+    {gnomeSchema + ".http", "host"}, {gnomeSchema + ".http", "port"},
+    {gnomeSchema + ".https", "host"}, {gnomeSchema + ".https", "port"},
+    {gnomeSchema, "mode"},
+}
+
+// kdeKeys are the kioslaverc keys enable writes, ProxyType last.
+var kdeKeys = []string{"Proxy Config Script", "socksProxy", "httpProxy", "httpsProxy", "NoProxyFor", "ProxyType"}
+
+func (l *linuxProxy) capture(ctx context.Context) ([]Entry, error) {
+    gnome, kde := l.desktops()
+    var out []Entry
+    if gnome {
+        for _, k := range gnomeKeys {
+            v, err := l.run.Run(ctx, "gsettings", "get", k[0], k[1])
+            if err != nil { return nil, err }
+            out = append(out, Entry{Tool: "gsettings", Target: k[0], Key: k[1], Value: strings.TrimSpace(string(v))})
+        }
+    }
+    if kde != "" {
+        read := strings.Replace(kde, "kwrite", "kread", 1)
+        for _, k := range kdeKeys {
+            v, err := l.run.Run(ctx, read, "--file", "kioslaverc", "--group", kdeGroup, "--key", k)
+            if err != nil { return nil, err }
+            val := strings.TrimSuffix(string(v), "\n")
+            out = append(out, Entry{Tool: "kioslaverc", Target: kdeGroup, Key: k, Value: val, Unset: val == ""})
+        }
+    }
+    p := l.envFile()
+    b, err := os.ReadFile(p)
+    if err != nil && !os.IsNotExist(err) { return nil, err }
+    return append(out, Entry{Tool: "envfile", Target: p, Value: string(b), Unset: err != nil}), nil
+}
+
+// restore writes every entry back, continuing past failures.
+func (l *linuxProxy) restore(ctx context.Context, entries []Entry) error {
+    var errs []error
+    kdeChanged := false
+    for _, e := range entries {
+        switch e.Tool {
+        case "gsettings":
+            errs = append(errs, l.gsettings(ctx, e.Target, e.Key, e.Value))
+        case "kioslaverc":
+            tool := l.kdeTool()
+            if tool == "" { errs = append(errs, errors.New("kwriteconfig not found")); continue }
+            args := []string{"--file", "kioslaverc", "--group", e.Target, "--key", e.Key, e.Value}
+            if e.Unset { args[len(args)-1] = "--delete" }
+            _, err := l.run.Run(ctx, tool, args...)
+            errs = append(errs, err)
+            kdeChanged = true
+        case "envfile":
+            if e.Unset {
+                if err := os.Remove(e.Target); err != nil && !os.IsNotExist(err) { errs = append(errs, err) }
+            } else {
+                errs = append(errs, os.WriteFile(e.Target, []byte(e.Value), 0o644))
+            }
+        default:
+            errs = append(errs, fmt.Errorf("unknown snapshot entry %q", e.Tool))
+        }
+    }
+    if kdeChanged { _, _ = l.run.Run(ctx, "dbus-send", kdeNotifyArgs...) }
+    return errors.Join(errs...)
+}
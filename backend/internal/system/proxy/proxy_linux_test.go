@@ -0,0 +1,219 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+    "context"
+    "errors"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// recorder logs commands and answers them from out, keyed by command line.
+type recorder struct {
+    cmds []string
+    out  map[string]string
+}
+
+func (r *recorder) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+    cmd := strings.Join(append([]string{name}, args...), " ")
+    r.cmds = append(r.cmds, cmd)
+    return []byte(r.out[cmd]), nil
+}
+
+// fakeLinux returns a linuxProxy for the given environment whose only
+// installed tools are listed in tools.
+func fakeLinux(t *testing.T, env map[string]string, tools ...string) (*linuxProxy, *recorder) {
+    t.Helper()
+    if env["XDG_CONFIG_HOME"] == "" { env["XDG_CONFIG_HOME"] = t.TempDir() }
+    rec := &recorder{}
+    l := &linuxProxy{
+        run:    rec,
+        getenv: func(k string) string { return env[k] },
+        lookPath: func(name string) (string, error) {
+            for _, t := range tools {
+                if t == name { return "/usr/bin/" + name, nil }
+            }
+            return "", errors.New("not found")
+        },
+    }
+    return l, rec
+}
+
+func assertCmds(t *testing.T, got, want []string) {
+    t.Helper()
+    if !reflect.DeepEqual(got, want) { t.Fatalf("commands:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  ")) }
+}
+
+const kdeNotify = "dbus-send --type=signal /KIO/Scheduler org.kde.KIO.Scheduler.reparseSlaveConfiguration string:"
+
+func TestGNOME(t *testing.T) {
+    l, rec := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "ubuntu:GNOME"}, "gsettings")
+    ctx := context.Background()
+    if err := l.enable(ctx, Settings{PACURL: "http://127.0.0.1:4765/proxy.pac"}); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{
+        "gsettings set org.gnome.system.proxy autoconfig-url 'http://127.0.0.1:4765/proxy.pac'",
+        "gsettings set org.gnome.system.proxy mode auto",
+    })
+
+    rec.cmds = nil
+    if err := l.enable(ctx, Settings{SOCKS: "127.0.0.1:8087", Bypass: []string{"corp.example"}}); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{
+        "gsettings set org.gnome.system.proxy.socks host '127.0.0.1'",
+        "gsettings set org.gnome.system.proxy.socks port 8087",
+        "gsettings set org.gnome.system.proxy.http host ''",
+        "gsettings set org.gnome.system.proxy.http port 0",
+        "gsettings set org.gnome.system.proxy.https host ''",
+        "gsettings set org.gnome.system.proxy.https port 0",
+        "gsettings set org.gnome.system.proxy ignore-hosts ['localhost', '127.0.0.0/8', '::1', 'corp.example']",
+        "gsettings set org.gnome.system.proxy mode manual",
+    })
+
+    rec.cmds = nil
+    if err := l.disable(ctx); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{"gsettings set org.gnome.system.proxy mode none"})
+}
+
+func TestKDE(t *testing.T) {
+    l, rec := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "KDE", "KDE_SESSION_VERSION": "6"}, "kwriteconfig5", "kwriteconfig6")
+    ctx := context.Background()
+    kw := "kwriteconfig6 --file kioslaverc --group Proxy Settings --key "
+    if err := l.enable(ctx, Settings{PACURL: "http://127.0.0.1:4765/proxy.pac"}); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{kw + "Proxy Config Script http://127.0.0.1:4765/proxy.pac", kw + "ProxyType 2", kdeNotify})
+
+    rec.cmds = nil
+    if err := l.enable(ctx, Settings{SOCKS: "127.0.0.1:8087", HTTP: "127.0.0.1:8100"}); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{
+        kw + "socksProxy socks://127.0.0.1 8087",
+        kw + "httpProxy http://127.0.0.1 8100",
+        kw + "httpsProxy http://127.0.0.1 8100",
+        kw + "NoProxyFor localhost,127.0.0.0/8,::1",
+        kw + "ProxyType 1",
+        kdeNotify,
+    })
+
+    rec.cmds = nil
+    if err := l.disable(ctx); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{kw + "ProxyType 0", kdeNotify})
+
+    // Plasma 5 sessions prefer kwriteconfig5.
+    l5, rec5 := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "KDE", "KDE_SESSION_VERSION": "5"}, "kwriteconfig5", "kwriteconfig6")
+    if err := l5.disable(ctx); err != nil { t.Fatal(err) }
+    if !strings.HasPrefix(rec5.cmds[0], "kwriteconfig5 ") { t.Fatalf("commands = %q", rec5.cmds) }
+}
+
+func TestEnvFileFallback(t *testing.T) {
+    // A GNOME session without gsettings installed falls back as well.
+    l, rec := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "GNOME"})
+    ctx := context.Background()
+    if err := l.enable(ctx, Settings{PACURL: "http://127.0.0.1:4765/proxy.pac", SOCKS: "127.0.0.1:8087", HTTP: "127.0.0.1:8100"}); err != nil { t.Fatal(err) }
+    if len(rec.cmds) != 0 { t.Fatalf("unexpected commands %q", rec.cmds) }
+    b, err := os.ReadFile(l.envFile())
+    if err != nil { t.Fatal(err) }
+    for _, want := range []string{
+        `export all_proxy='socks5h://127.0.0.1:8087' ALL_PROXY='socks5h://127.0.0.1:8087'`,
+        `export https_proxy='http://127.0.0.1:8100' HTTPS_PROXY='http://127.0.0.1:8100'`,
+        `export no_proxy='localhost,127.0.0.0/8,::1' NO_PROXY='localhost,127.0.0.0/8,::1'`,
+    } {
+        if !strings.Contains(string(b), want) { t.Errorf("env file lacks %q:\n%s", want, b) }
+    }
+    if err := l.disable(ctx); err != nil { t.Fatal(err) }
+    if _, err := os.Stat(l.envFile()); !os.IsNotExist(err) { t.Fatalf("env file not removed: %v", err) }
+
+    if err := l.enable(ctx, Settings{PACURL: "http://127.0.0.1:4765/proxy.pac"}); err == nil { t.Fatal("PAC-only settings accepted without a desktop") }
+    if err := l.enable(ctx, Settings{SOCKS: "nonsense"}); err == nil { t.Fatal("invalid SOCKS address accepted") }
+}
+
+func TestShQuote(t *testing.T) {
+    for in, want := range map[string]string{
+        "socks5h://127.0.0.1:8087": `'socks5h://127.0.0.1:8087'`,
+        "$(touch x):1080":          `'$(touch x):1080'`,
+        "`id`'; rm -rf ~ #":        `'` + "`id`" + `'\''; rm -rf ~ #'`,
+    } {
+        if got := shQuote(in); got != want { t.Errorf("shQuote(%q) = %s, want %s", in, got, want) }
+    }
+}
+
+// useSystem makes l the package backend for the test.
+func useSystem(t *testing.T, l *linuxProxy) {
+    prev := system
+    system = l
+    t.Cleanup(func() { system = prev })
+}
+
+func TestSnapshotRestoreGNOME(t *testing.T) {
+    l, rec := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "GNOME"}, "gsettings")
+    useSystem(t, l)
+    rec.out = map[string]string{
+        "gsettings get org.gnome.system.proxy mode":           "'manual'\n",
+        "gsettings get org.gnome.system.proxy autoconfig-url": "''\n",
+        "gsettings get org.gnome.system.proxy ignore-hosts":   "['localhost', 'intranet']\n",
+        "gsettings get org.gnome.system.proxy.socks host":     "'10.0.0.5'\n",
+        "gsettings get org.gnome.system.proxy.socks port":     "1080\n",
+    }
+    ctx, dir := context.Background(), t.TempDir()
+    if err := Enable(ctx, dir, Settings{PACURL: "http://127.0.0.1:4765/proxy.pac"}); err != nil { t.Fatal(err) }
+    if _, err := os.Stat(filepath.Join(dir, SnapshotFile)); err != nil { t.Fatalf("no snapshot: %v", err) }
+    if len(rec.cmds) != len(gnomeKeys)+2 || !strings.HasPrefix(rec.cmds[0], "gsettings get ") { t.Fatalf("commands = %q", rec.cmds) }
+
+    // A second Enable keeps the original snapshot instead of capturing our own settings.
+    rec.cmds = nil
+    if err := Enable(ctx, dir, Settings{SOCKS: "127.0.0.1:8087"}); err != nil { t.Fatal(err) }
+    for _, c := range rec.cmds {
+        if strings.HasPrefix(c, "gsettings get ") { t.Fatalf("snapshot retaken: %q", c) }
+    }
+
+    // The daemon restarts after a crash and finds the snapshot.
+    rec.cmds = nil
+    restored, err := Recover(ctx, dir)
+    if err != nil || !restored { t.Fatalf("Recover = %v, %v", restored, err) }
+    assertCmds(t, rec.cmds, []string{
+        "gsettings set org.gnome.system.proxy autoconfig-url ''",
+        "gsettings set org.gnome.system.proxy ignore-hosts ['localhost', 'intranet']",
+        "gsettings set org.gnome.system.proxy.socks host '10.0.0.5'",
+        "gsettings set org.gnome.system.proxy.socks port 1080",
+        "gsettings set org.gnome.system.proxy.http host ",
+        "gsettings set org.gnome.system.proxy.http port ",
+        "gsettings set org.gnome.system.proxy.https host ",
+        "gsettings set org.gnome.system.proxy.https port ",
+        "gsettings set org.gnome.system.proxy mode 'manual'",
+    })
+    if _, err := os.Stat(filepath.Join(dir, SnapshotFile)); !os.IsNotExist(err) { t.Fatalf("snapshot kept after restore: %v", err) }
+    if restored, err := Recover(ctx, dir); restored || err != nil { t.Fatalf("second Recover = %v, %v", restored, err) }
+
+    // Without a snapshot Disable resets to no proxy.
+    rec.cmds = nil
+    if err := Disable(ctx, dir); err != nil { t.Fatal(err) }
+    assertCmds(t, rec.cmds, []string{"gsettings set org.gnome.system.proxy mode none"})
+}
+
+func TestSnapshotRestoreKDEAndEnvFile(t *testing.T) {
+    l, rec := fakeLinux(t, map[string]string{"XDG_CURRENT_DESKTOP": "KDE"}, "kwriteconfig6")
+    useSystem(t, l)
+    kr := "kreadconfig6 --file kioslaverc --group Proxy Settings --key "
+    rec.out = map[string]string{kr + "ProxyType": "1\n", kr + "httpProxy": "http://proxy.corp 3128\n"}
+    env := l.envFile()
+    if err := os.MkdirAll(filepath.Dir(env), 0o700); err != nil { t.Fatal(err) }
+    if err := os.WriteFile(env, []byte("export all_proxy=socks5h://old:1080\n"), 0o644); err != nil { t.Fatal(err) }
+
+    ctx, dir := context.Background(), t.TempDir()
+    if err := Enable(ctx, dir, Settings{SOCKS: "127.0.0.1:8087"}); err != nil { t.Fatal(err) }
+    rec.cmds = nil
+    if err := os.Remove(env); err != nil { t.Fatal(err) }
+    if err := Disable(ctx, dir); err != nil { t.Fatal(err) }
+    kw := "kwriteconfig6 --file kioslaverc --group Proxy Settings --key "
+    assertCmds(t, rec.cmds, []string{
+        kw + "Proxy Config Script --delete",
+        kw + "socksProxy --delete",
+        kw + "httpProxy http://proxy.corp 3128",
+        kw + "httpsProxy --delete",
+        kw + "NoProxyFor --delete",
+        kw + "ProxyType 1",
+        kdeNotify,
+    })
+    if b, err := os.ReadFile(env); err != nil || string(b) != "export all_proxy=socks5h://old:1080\n" { t.Fatalf("env file = %q, %v", b, err) }
+}
@@ -1,5 +1,5 @@
-//go:build !darwin
-// +build !darwin
+//go:build !darwin && !linux
+// +build !darwin,!linux
 
 package proxy
 
@@ -8,6 +8,13 @@ import (
     "errors"
 )
 
-func EnablePAC(ctx context.Context, pacURL string) error { return errors.New("PAC control not implemented for this OS") }
-func DisablePAC(ctx context.Context) error { return errors.New("PAC control not implemented for this OS") }
+var system backend = unsupported{}
 
+var errUnsupported = errors.New("system proxy control not implemented for this OS")
+
+type unsupported struct{}
+
+func (unsupported) enable(ctx context.Context, s Settings) error         { return errUnsupported }
+func (unsupported) disable(ctx context.Context) error                    { return errUnsupported }
+func (unsupported) capture(ctx context.Context) ([]Entry, error)         { return nil, errUnsupported }
+func (unsupported) restore(ctx context.Context, entries []Entry) error   { return errUnsupported }
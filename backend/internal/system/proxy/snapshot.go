@@ -0,0 +1,62 @@
+package proxy
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+    "time"
+)
+
+// SnapshotFile holds the settings captured by Enable until they are restored.
+const SnapshotFile = "system-proxy.json"
+
+// Entry is one captured setting, stored as the tool reported it so it can be
+// written back unchanged.
+type Entry struct {
+    Tool   string `json:"tool"`   // gsettings, kioslaverc, envfile, networksetup
+    Target string `json:"target"` // schema, config group, file path or network service
+    Key    string `json:"key,omitempty"`
+    Value  string `json:"value"`
+    Unset  bool   `json:"unset,omitempty"` // the key or file did not exist
+}
+
+// Snapshot is the system proxy configuration found before Enable.
+type Snapshot struct {
+    OS      string    `json:"os"`
+    Taken   time.Time `json:"taken"`
+    Entries []Entry   `json:"entries"`
+}
+
+func snapshotPath(stateDir string) string { return filepath.Join(stateDir, SnapshotFile) }
+
+func loadSnapshot(stateDir string) (Snapshot, bool, error) {
+    var snap Snapshot
+    b, err := os.ReadFile(snapshotPath(stateDir))
+    if os.IsNotExist(err) { return snap, false, nil }
+    if err != nil { return snap, false, err }
+    if err := json.Unmarshal(b, &snap); err != nil { return snap, false, fmt.Errorf("%s: %w", SnapshotFile, err) }
+    return snap, true, nil
+}
+
+func saveSnapshot(stateDir string, entries []Entry) error {
+    b, err := json.MarshalIndent(Snapshot{OS: runtime.GOOS, Taken: time.Now().UTC(), Entries: entries}, "", "  ")
+    if err != nil { return err }
+    p := snapshotPath(stateDir)
+    if err := os.MkdirAll(stateDir, 0o700); err != nil { return err }
+    if err := os.WriteFile(p+".tmp", b, 0o600); err != nil { return err }
+    return os.Rename(p+".tmp", p)
+}
+
+// Recover restores a pending snapshot, e.g. one left behind when the daemon
+// died while the system proxy pointed at it. It reports whether there was
+// one; the snapshot is kept if restoring fails so a later call can retry.
+func Recover(ctx context.Context, stateDir string) (bool, error) {
+    snap, ok, err := loadSnapshot(stateDir)
+    if err != nil || !ok { return false, err }
+    if snap.OS != runtime.GOOS { return false, fmt.Errorf("%s was taken on %s", SnapshotFile, snap.OS) }
+    if err := system.restore(ctx, snap.Entries); err != nil { return false, fmt.Errorf("restore system proxy: %w", err) }
+    return true, os.Remove(snapshotPath(stateDir))
+}
@@ -0,0 +1,168 @@
+package warpreg
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "regexp"
+    "strconv"
+    "time"
+)
+
+var (
+    // ErrNoIdentity is returned by operations that need a registered device.
+    ErrNoIdentity = errors.New("no WARP identity registered")
+    // ErrNoToken is returned by API operations on an identity imported
+    // without a device token, such as one from a WireGuard config.
+    ErrNoToken = errors.New("identity has no device token (imported from a WireGuard config)")
+    // ErrInvalidLicense is returned for keys that are not xxxxxxxx-xxxxxxxx-xxxxxxxx.
+    ErrInvalidLicense = errors.New("invalid license key: want xxxxxxxx-xxxxxxxx-xxxxxxxx")
+)
+
+// Account is the WARP account behind a device, as last fetched.
+type Account struct {
+    ID            string    `json:"id"`
+    Type          string    `json:"type"`                  // "free", "limited" (WARP+ with a data quota) or "unlimited"
+    WarpPlus      bool      `json:"warp_plus"`
+    PremiumData   int64     `json:"premium_data"`          // WARP+ bytes left
+    Quota         int64     `json:"quota,omitempty"`       // WARP+ bytes granted
+    ReferralCount int       `json:"referral_count"`
+    Devices       []Device  `json:"devices,omitempty"`
+    Updated       time.Time `json:"updated"`
+}
+
+// Device is one device registered to the account.
+type Device struct {
+    ID      string `json:"id"`
+    Name    string `json:"name,omitempty"`
+    Model   string `json:"model,omitempty"`
+    Type    string `json:"type,omitempty"`
+    Active  bool   `json:"active"`
+    Created string `json:"created,omitempty"`
+    Current bool   `json:"current,omitempty"` // the device of this identity
+}
+
+// Config is the WireGuard configuration the API assigned to the device.
+type Config struct {
+    ClientID      string   `json:"client_id,omitempty"` // base64; its bytes go in the reserved header field
+    PeerPublicKey string   `json:"peer_public_key"`
+    Endpoints     []string `json:"endpoints"`           // host:port; hostname first, then v4 and v6
+    AddressV4     string   `json:"address_v4,omitempty"`
+    AddressV6     string   `json:"address_v6,omitempty"`
+}
+
+// DefaultPort is used for peer endpoints the API reports with port 0.
+const DefaultPort = 2408
+
+// apiAccount is the account object of the client API.
+type apiAccount struct {
+    ID            string `json:"id"`
+    AccountType   string `json:"account_type"`
+    WarpPlus      bool   `json:"warp_plus"`
+    PremiumData   int64  `json:"premium_data"`
+    Quota         int64  `json:"quota"`
+    ReferralCount int    `json:"referral_count"`
+    License       string `json:"license"`
+}
+
+func (a apiAccount) account() *Account {
+    if a.ID == "" { return nil }
+    return &Account{ID: a.ID, Type: a.AccountType, WarpPlus: a.WarpPlus, PremiumData: a.PremiumData, Quota: a.Quota, ReferralCount: a.ReferralCount, Updated: time.Now().UTC()}
+}
+
+// apiConfig is the config object of the client API.
+type apiConfig struct {
+    ClientID string `json:"client_id"`
+    Peers    []struct {
+        PublicKey string `json:"public_key"`
+        Endpoint  struct{ V4, V6, Host string } `json:"endpoint"`
+    } `json:"peers"`
+    Interface struct {
+        Addresses struct{ V4, V6 string } `json:"addresses"`
+    } `json:"interface"`
+}
+
+func (c apiConfig) config() *Config {
+    if len(c.Peers) == 0 { return nil }
+    out := &Config{ClientID: c.ClientID, PeerPublicKey: c.Peers[0].PublicKey, AddressV4: c.Interface.Addresses.V4, AddressV6: c.Interface.Addresses.V6}
+    ep := c.Peers[0].Endpoint
+    for _, a := range []string{ep.Host, ep.V4, ep.V6} {
+        if a == "" { continue }
+        host, port, err := net.SplitHostPort(a)
+        if err != nil { host, port = a, "0" }
+        if port == "0" { port = strconv.Itoa(DefaultPort) }
+        out.Endpoints = append(out.Endpoints, net.JoinHostPort(host, port))
+    }
+    return out
+}
+
+var licenseRe = regexp.MustCompile(`^[A-Za-z0-9]{8}-[A-Za-z0-9]{8}-[A-Za-z0-9]{8}$`)
+
+// ValidLicense reports whether key looks like a WARP+ license key
+// (three groups of eight letters or digits).
+func ValidLicense(key string) bool { return licenseRe.MatchString(key) }
+
+// MaskLicense hides all but the last four characters of a license key.
+func MaskLicense(key string) string {
+    if len(key) <= 4 { return key }
+    b := []byte(key)
+    for i := range b[:len(b)-4] {
+        if b[i] != '-' { b[i] = '*' }
+    }
+    return string(b)
+}
+
+// SetLicense binds a WARP+ license key to the registered device's account,
+// then refreshes and saves the account info.
+func SetLicense(ctx context.Context, stateDir, key string) (Identity, error) {
+    if !ValidLicense(key) { return Identity{}, ErrInvalidLicense }
+    id, ok, err := Load(stateDir)
+    if err != nil { return Identity{}, err }
+    if !ok { return Identity{}, ErrNoIdentity }
+    if id.Token == "" { return Identity{}, ErrNoToken }
+    if err := call(ctx, http.MethodPut, "/reg/"+id.DeviceID+"/account", id.Token, map[string]string{"license": key}, nil); err != nil {
+        return Identity{}, fmt.Errorf("bind license: %w", err)
+    }
+    id.License = key
+    if err := save(stateDir, id); err != nil { return Identity{}, err }
+    return RefreshAccount(ctx, stateDir)
+}
+
+// RefreshAccount fetches the device's account info (type, WARP+ data left,
+// referrals, devices) and WireGuard config and saves them in the identity file.
+func RefreshAccount(ctx context.Context, stateDir string) (Identity, error) {
+    id, ok, err := Load(stateDir)
+    if err != nil { return Identity{}, err }
+    if !ok { return Identity{}, ErrNoIdentity }
+    if err := refresh(ctx, &id); err != nil { return Identity{}, err }
+    if err := save(stateDir, id); err != nil { return Identity{}, err }
+    return id, nil
+}
+
+// refresh fills id's account, devices and config from the API and checks
+// that the device still has id's public key.
+func refresh(ctx context.Context, id *Identity) error {
+    if id.DeviceID == "" || id.Token == "" { return ErrNoToken }
+    var dev struct {
+        Key     string     `json:"key"`
+        Account apiAccount `json:"account"`
+        Config  apiConfig  `json:"config"`
+    }
+    if err := call(ctx, http.MethodGet, "/reg/"+id.DeviceID, id.Token, nil, &dev); err != nil {
+        return fmt.Errorf("fetch device: %w", err)
+    }
+    if dev.Key != "" && id.PublicKey != "" && dev.Key != id.PublicKey { return errors.New("the device is registered with a different public key") }
+    a := dev.Account.account()
+    if a == nil { return errors.New("invalid device response") }
+    // Some account types may not list devices; the rest is still worth keeping.
+    var devices []Device
+    if err := call(ctx, http.MethodGet, "/reg/"+id.DeviceID+"/account/devices", id.Token, nil, &devices); err == nil {
+        for i := range devices { devices[i].Current = devices[i].ID == id.DeviceID }
+        a.Devices = devices
+    }
+    id.Account, id.AccountID = a, a.ID
+    if c := dev.Config.config(); c != nil { id.Config = c }
+    return nil
+}
@@ -0,0 +1,141 @@
+package warpreg
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+
+    "rsc.io/qr"
+)
+
+// ErrNoConfig is returned when exporting an identity whose WireGuard config
+// was never fetched; RefreshAccount fetches it.
+var ErrNoConfig = errors.New("identity has no WireGuard config; refresh it first")
+
+// Export defaults shared by every format.
+const (
+    exportMTU = 1280
+    exportDNS = "1.1.1.1, 1.0.0.1, 2606:4700:4700::1111, 2606:4700:4700::1001"
+)
+
+// allowedIPs routes everything through the tunnel.
+var allowedIPs = []string{"0.0.0.0/0", "::/0"}
+
+// addresses returns the interface addresses as host prefixes.
+func (c *Config) addresses() []string {
+    var out []string
+    if c.AddressV4 != "" { out = append(out, c.AddressV4+"/32") }
+    if c.AddressV6 != "" { out = append(out, c.AddressV6+"/128") }
+    return out
+}
+
+// endpoint returns the preferred peer endpoint.
+func (c *Config) endpoint() string {
+    if len(c.Endpoints) == 0 { return "engage.cloudflareclient.com:" + strconv.Itoa(DefaultPort) }
+    return c.Endpoints[0]
+}
+
+// Reserved returns the three bytes WARP expects in the reserved header
+// field, decoded from ClientID, or nil if it is unset or malformed.
+func (c *Config) Reserved() []int {
+    b, err := base64.StdEncoding.DecodeString(c.ClientID)
+    if err != nil || len(b) != 3 { return nil }
+    return []int{int(b[0]), int(b[1]), int(b[2])}
+}
+
+func exportable(id Identity) (*Config, error) {
+    if id.PrivateKey == "" { return nil, errors.New("identity has no private key") }
+    if id.Config == nil || id.Config.PeerPublicKey == "" { return nil, ErrNoConfig }
+    return id.Config, nil
+}
+
+// WireGuardConf renders id as a wg-quick configuration, as accepted by the
+// WireGuard apps and most routers.
+func WireGuardConf(id Identity) (string, error) {
+    c, err := exportable(id)
+    if err != nil { return "", err }
+    var b strings.Builder
+    b.WriteString("[Interface]\n")
+    fmt.Fprintf(&b, "PrivateKey = %s\n", id.PrivateKey)
+    fmt.Fprintf(&b, "Address = %s\n", strings.Join(c.addresses(), ", "))
+    fmt.Fprintf(&b, "DNS = %s\n", exportDNS)
+    fmt.Fprintf(&b, "MTU = %d\n", exportMTU)
+    b.WriteString("\n[Peer]\n")
+    fmt.Fprintf(&b, "PublicKey = %s\n", c.PeerPublicKey)
+    fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+    fmt.Fprintf(&b, "Endpoint = %s\n", c.endpoint())
+    return b.String(), nil
+}
+
+// SingBoxOutbound renders id as a sing-box WireGuard outbound tagged tag.
+func SingBoxOutbound(id Identity, tag string) (map[string]any, error) {
+    c, err := exportable(id)
+    if err != nil { return nil, err }
+    host, port, err := net.SplitHostPort(c.endpoint())
+    if err != nil { return nil, err }
+    portNum, _ := strconv.Atoi(port)
+    out := map[string]any{
+        "type":            "wireguard",
+        "tag":             tag,
+        "server":          host,
+        "server_port":     portNum,
+        "local_address":   c.addresses(),
+        "private_key":     id.PrivateKey,
+        "peer_public_key": c.PeerPublicKey,
+        "mtu":             exportMTU,
+    }
+    if r := c.Reserved(); r != nil { out["reserved"] = r }
+    return out, nil
+}
+
+// XrayOutbound renders id as an Xray WireGuard outbound tagged tag.
+func XrayOutbound(id Identity, tag string) (map[string]any, error) {
+    c, err := exportable(id)
+    if err != nil { return nil, err }
+    settings := map[string]any{
+        "secretKey": id.PrivateKey,
+        "address":   c.addresses(),
+        "peers":     []map[string]any{{"publicKey": c.PeerPublicKey, "endpoint": c.endpoint(), "allowedIPs": allowedIPs}},
+        "mtu":       exportMTU,
+    }
+    if r := c.Reserved(); r != nil { settings["reserved"] = r }
+    return map[string]any{"protocol": "wireguard", "tag": tag, "settings": settings}, nil
+}
+
+// QRPNG encodes text as a QR code PNG with a quiet zone.
+func QRPNG(text string) ([]byte, error) {
+    c, err := qr.Encode(text, qr.M)
+    if err != nil { return nil, err }
+    return c.PNG(), nil
+}
+
+// QRTerminal encodes text as a QR code drawn with half-block characters, two
+// modules per character. Light modules are drawn, so the code scans from a
+// terminal with a dark background.
+func QRTerminal(text string) (string, error) {
+    c, err := qr.Encode(text, qr.L)
+    if err != nil { return "", err }
+    const quiet = 2
+    light := func(x, y int) bool { return !c.Black(x, y) }
+    var b strings.Builder
+    for y := -quiet; y < c.Size+quiet; y += 2 {
+        for x := -quiet; x < c.Size+quiet; x++ {
+            top, bottom := light(x, y), y+1 < c.Size+quiet && light(x, y+1)
+            switch {
+            case top && bottom:
+                b.WriteString("█")
+            case top:
+                b.WriteString("▀")
+            case bottom:
+                b.WriteString("▄")
+            default:
+                b.WriteString(" ")
+            }
+        }
+        b.WriteString("\n")
+    }
+    return b.String(), nil
+}
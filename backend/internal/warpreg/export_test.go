@@ -0,0 +1,72 @@
+package warpreg
+
+import (
+    "bytes"
+    "encoding/json"
+    "image/png"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+var exportID = Identity{
+    DeviceID:   "dev-1",
+    PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+    PublicKey:  "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=",
+    Config: &Config{
+        ClientID:      "q2xE",
+        PeerPublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+        Endpoints:     []string{"engage.cloudflareclient.com:2408", "162.159.192.7:2408"},
+        AddressV4:     "172.16.0.2",
+        AddressV6:     "2606:4700:110:8a36::1",
+    },
+}
+
+func TestWireGuardConf(t *testing.T) {
+    got, err := WireGuardConf(exportID)
+    if err != nil { t.Fatal(err) }
+    want := `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 172.16.0.2/32, 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1, 1.0.0.1, 2606:4700:4700::1111, 2606:4700:4700::1001
+MTU = 1280
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = engage.cloudflareclient.com:2408
+`
+    if got != want { t.Fatalf("conf:\n%s\nwant:\n%s", got, want) }
+    if _, err := WireGuardConf(Identity{PrivateKey: "x"}); err != ErrNoConfig { t.Fatalf("without config: %v", err) }
+}
+
+func TestOutbounds(t *testing.T) {
+    sb, err := SingBoxOutbound(exportID, "warp")
+    if err != nil { t.Fatal(err) }
+    b, _ := json.Marshal(sb)
+    want := `{"local_address":["172.16.0.2/32","2606:4700:110:8a36::1/128"],"mtu":1280,"peer_public_key":"bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=","private_key":"yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=","reserved":[171,108,68],"server":"engage.cloudflareclient.com","server_port":2408,"tag":"warp","type":"wireguard"}`
+    if string(b) != want { t.Fatalf("sing-box:\n%s\nwant:\n%s", b, want) }
+
+    x, err := XrayOutbound(exportID, "warp")
+    if err != nil { t.Fatal(err) }
+    b, _ = json.Marshal(x)
+    want = `{"protocol":"wireguard","settings":{"address":["172.16.0.2/32","2606:4700:110:8a36::1/128"],"mtu":1280,"peers":[{"allowedIPs":["0.0.0.0/0","::/0"],"endpoint":"engage.cloudflareclient.com:2408","publicKey":"bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="}],"reserved":[171,108,68],"secretKey":"yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="},"tag":"warp"}`
+    if string(b) != want { t.Fatalf("xray:\n%s\nwant:\n%s", b, want) }
+}
+
+func TestQR(t *testing.T) {
+    conf, _ := WireGuardConf(exportID)
+    b, err := QRPNG(conf)
+    if err != nil { t.Fatal(err) }
+    img, err := png.Decode(bytes.NewReader(b))
+    if err != nil { t.Fatal(err) }
+    if r := img.Bounds(); r.Dx() != r.Dy() || r.Dx() < 200 { t.Fatalf("PNG bounds %v", r) }
+
+    term, err := QRTerminal(conf)
+    if err != nil { t.Fatal(err) }
+    lines := strings.Split(strings.TrimSuffix(term, "\n"), "\n")
+    width := utf8.RuneCountInString(lines[0])
+    // Two rows per line, plus a two-module quiet zone on each side.
+    if width < 25 || len(lines) != (width+1)/2 { t.Fatalf("terminal QR is %d wide and %d lines", width, len(lines)) }
+    if lines[0] != strings.Repeat("█", width) { t.Fatalf("quiet zone missing: %q", lines[0]) }
+}
@@ -0,0 +1,190 @@
+package warpreg
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/ecdh"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/netip"
+    "strings"
+)
+
+// Import formats.
+const (
+    FormatWgcf      = "wgcf"        // wgcf-account.toml
+    FormatWarpPlus  = "warp-plus"   // warp-plus's cached identity JSON
+    FormatNative    = "bulletproof" // a copy of warp_identity.json
+    FormatWireGuard = "wireguard"   // wg-quick .conf, e.g. wgcf-profile.conf
+)
+
+// ErrIdentityExists is returned by Import when an identity is already saved
+// and replacing it was not requested.
+var ErrIdentityExists = errors.New("an identity already exists")
+
+// ImportOptions control Import.
+type ImportOptions struct {
+    Replace bool // overwrite an existing identity
+    Offline bool // skip checking the device and fetching its account from the API
+}
+
+// ParseImport reads an identity from a wgcf account file, a warp-plus or
+// bulletproof identity JSON, or a WireGuard config, and checks its key pair.
+// It returns the identity and the detected format.
+func ParseImport(data []byte) (Identity, string, error) {
+    data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+    var id Identity
+    var format string
+    var err error
+    switch {
+    case bytes.HasPrefix(data, []byte("{")):
+        id, format, err = parseJSON(data)
+    case bytes.Contains(data, []byte("[Interface]")):
+        id, format, err = parseConf(data)
+    default:
+        id, format, err = parseWgcf(data)
+    }
+    if err != nil { return Identity{}, "", err }
+    pub, err := publicKey(id.PrivateKey)
+    if err != nil { return Identity{}, "", err }
+    if id.PublicKey != "" && id.PublicKey != pub { return Identity{}, "", errors.New("public key does not belong to the private key") }
+    id.PublicKey = pub
+    if id.Config != nil {
+        if _, err := decodeKey32(id.Config.PeerPublicKey); err != nil { return Identity{}, "", fmt.Errorf("peer public key: %w", err) }
+    }
+    if (id.DeviceID == "") != (id.Token == "") { return Identity{}, "", errors.New("device ID and token must be given together") }
+    return id, format, nil
+}
+
+// Import parses data (see ParseImport) and saves it as the identity. Unless
+// opts.Offline is set, an identity with a device token is checked against
+// the API, which also detects the account type and fetches the config.
+func Import(ctx context.Context, stateDir string, data []byte, opts ImportOptions) (Identity, string, error) {
+    id, format, err := ParseImport(data)
+    if err != nil { return Identity{}, "", err }
+    if _, ok, err := Load(stateDir); err != nil {
+        return Identity{}, "", err
+    } else if ok && !opts.Replace {
+        return Identity{}, "", ErrIdentityExists
+    }
+    if id.Token != "" && !opts.Offline {
+        if err := refresh(ctx, &id); err != nil { return Identity{}, "", err }
+    }
+    if err := save(stateDir, id); err != nil { return Identity{}, "", err }
+    return id, format, nil
+}
+
+func decodeKey32(s string) ([]byte, error) {
+    b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+    if err != nil { return nil, errors.New("not base64") }
+    if len(b) != 32 { return nil, errors.New("not a 32-byte key") }
+    return b, nil
+}
+
+// publicKey derives the base64 X25519 public key of a base64 private key.
+func publicKey(priv string) (string, error) {
+    b, err := decodeKey32(priv)
+    if err != nil { return "", fmt.Errorf("private key: %w", err) }
+    k, err := ecdh.X25519().NewPrivateKey(b)
+    if err != nil { return "", fmt.Errorf("private key: %w", err) }
+    return base64.StdEncoding.EncodeToString(k.PublicKey().Bytes()), nil
+}
+
+// parseJSON reads bulletproof's own identity file or warp-plus's, which is
+// the API's device object plus the private key.
+func parseJSON(data []byte) (Identity, string, error) {
+    var probe struct {
+        PublicKey string `json:"public_key"`
+    }
+    if err := json.Unmarshal(data, &probe); err != nil { return Identity{}, "", err }
+    if probe.PublicKey != "" {
+        var id Identity
+        if err := json.Unmarshal(data, &id); err != nil { return Identity{}, "", err }
+        return id, FormatNative, nil
+    }
+    var wp struct {
+        ID         string     `json:"id"`
+        Token      string     `json:"token"`
+        Key        string     `json:"key"`
+        PrivateKey string     `json:"private_key"`
+        Account    apiAccount `json:"account"`
+        Config     apiConfig  `json:"config"`
+    }
+    if err := json.Unmarshal(data, &wp); err != nil { return Identity{}, "", err }
+    if wp.PrivateKey == "" { return Identity{}, "", errors.New("identity JSON has no private_key") }
+    return Identity{
+        DeviceID:   wp.ID,
+        Token:      wp.Token,
+        AccountID:  wp.Account.ID,
+        PrivateKey: wp.PrivateKey,
+        PublicKey:  wp.Key,
+        License:    wp.Account.License,
+        Account:    wp.Account.account(),
+        Config:     wp.Config.config(),
+    }, FormatWarpPlus, nil
+}
+
+// parseWgcf reads the flat key = 'value' pairs of wgcf-account.toml.
+func parseWgcf(data []byte) (Identity, string, error) {
+    kv := map[string]string{}
+    sc := bufio.NewScanner(bytes.NewReader(data))
+    for sc.Scan() {
+        line := strings.TrimSpace(sc.Text())
+        if line == "" || strings.HasPrefix(line, "#") { continue }
+        k, v, ok := strings.Cut(line, "=")
+        if !ok { return Identity{}, "", fmt.Errorf("unrecognised identity format: %q", line) }
+        kv[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `'"`)
+    }
+    if kv["private_key"] == "" { return Identity{}, "", errors.New("wgcf account has no private_key") }
+    return Identity{DeviceID: kv["device_id"], Token: kv["access_token"], PrivateKey: kv["private_key"], License: kv["license_key"]}, FormatWgcf, nil
+}
+
+// parseConf reads a wg-quick config. It carries no device ID or token, so
+// the identity can be exported and used to scan but not refreshed.
+func parseConf(data []byte) (Identity, string, error) {
+    var id Identity
+    c := &Config{}
+    section := ""
+    sc := bufio.NewScanner(bytes.NewReader(data))
+    for sc.Scan() {
+        line := strings.TrimSpace(sc.Text())
+        if i := strings.IndexByte(line, '#'); i >= 0 { line = strings.TrimSpace(line[:i]) }
+        if line == "" { continue }
+        if strings.HasPrefix(line, "[") {
+            if section == "[peer]" { break } // first peer only
+            section = strings.ToLower(line)
+            continue
+        }
+        k, v, ok := strings.Cut(line, "=")
+        if !ok { return Identity{}, "", fmt.Errorf("bad config line %q", line) }
+        k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+        switch section + k {
+        case "[interface]privatekey":
+            id.PrivateKey = v
+        case "[interface]address":
+            for _, a := range strings.Split(v, ",") {
+                a = strings.TrimSpace(a)
+                p, err := netip.ParsePrefix(a)
+                if err != nil {
+                    // A bare address is a single host: /32 or /128.
+                    addr, aerr := netip.ParseAddr(a)
+                    if aerr != nil { return Identity{}, "", fmt.Errorf("address %q: %w", a, err) }
+                    p = netip.PrefixFrom(addr, addr.BitLen())
+                }
+                if p.Addr().Is4() { c.AddressV4 = p.Addr().String() } else { c.AddressV6 = p.Addr().String() }
+            }
+        case "[peer]publickey":
+            c.PeerPublicKey = v
+        case "[peer]endpoint":
+            if _, _, err := net.SplitHostPort(v); err != nil { return Identity{}, "", fmt.Errorf("endpoint %q: %w", v, err) }
+            c.Endpoints = []string{v}
+        }
+    }
+    if id.PrivateKey == "" || c.PeerPublicKey == "" { return Identity{}, "", errors.New("WireGuard config needs [Interface] PrivateKey and [Peer] PublicKey") }
+    id.Config = c
+    return id, FormatWireGuard, nil
+}
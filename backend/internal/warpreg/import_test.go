@@ -0,0 +1,111 @@
+package warpreg
+
+import (
+    "context"
+    "crypto/ecdh"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func keyPair(t *testing.T) (priv, pub string) {
+    t.Helper()
+    k, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil { t.Fatal(err) }
+    return base64.StdEncoding.EncodeToString(k.Bytes()), base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+}
+
+func TestImport_Wgcf(t *testing.T) {
+    f := newFakeAPI(t)
+    priv, pub := keyPair(t)
+    f.devices["wgcf-dev"] = &fakeDevice{token: "wgcf-token", key: pub, account: apiAccount{ID: "acct-u", AccountType: "unlimited", WarpPlus: true}}
+    toml := fmt.Sprintf("access_token = 'wgcf-token'\ndevice_id = 'wgcf-dev'\nlicense_key = 'a1B2c3D4-e5F6g7H8-i9J0k1L2'\nprivate_key = '%s'\n", priv)
+    ctx, dir := context.Background(), t.TempDir()
+
+    id, format, err := Import(ctx, dir, []byte(toml), ImportOptions{})
+    if err != nil { t.Fatal(err) }
+    if format != FormatWgcf || id.DeviceID != "wgcf-dev" || id.PublicKey != pub || id.License != "a1B2c3D4-e5F6g7H8-i9J0k1L2" { t.Fatalf("identity = %+v (%s)", id, format) }
+    // The account type and config come from the API.
+    if id.Account == nil || id.Account.Type != "unlimited" || id.Config == nil || id.Config.PeerPublicKey == "" { t.Fatalf("account %+v, config %+v", id.Account, id.Config) }
+    saved, ok, _ := Load(dir)
+    if !ok || saved.Token != "wgcf-token" { t.Fatalf("saved = %+v", saved) }
+
+    // An existing identity is kept unless replacing is asked for.
+    if _, _, err := Import(ctx, dir, []byte(toml), ImportOptions{}); err != ErrIdentityExists { t.Fatalf("second import: %v", err) }
+
+    // A device that was re-keyed elsewhere is refused.
+    f.devices["wgcf-dev"].key = "someone-else"
+    if _, _, err := Import(ctx, dir, []byte(toml), ImportOptions{Replace: true}); err == nil || !strings.Contains(err.Error(), "different public key") { t.Fatalf("re-keyed device: %v", err) }
+    // Without the API the file is taken as is.
+    if id, _, err := Import(ctx, dir, []byte(toml), ImportOptions{Replace: true, Offline: true}); err != nil || id.Account != nil { t.Fatalf("offline import = %+v, %v", id, err) }
+}
+
+func TestParseImport_WarpPlusAndNative(t *testing.T) {
+    priv, pub := keyPair(t)
+    wp := fmt.Sprintf(`{"id":"wp-dev","key":%q,"token":"wp-token","private_key":%q,
+        "account":{"id":"acct-1","account_type":"limited","warp_plus":true,"premium_data":1024,"license":"a1B2c3D4-e5F6g7H8-i9J0k1L2"},
+        "config":{"client_id":"q2xE","peers":[{"public_key":"bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=","endpoint":{"v4":"162.159.192.1:0","host":"engage.cloudflareclient.com:2408"}}],
+        "interface":{"addresses":{"v4":"172.16.0.2","v6":"2606:4700:110:8a36::1"}}}}`, pub, priv)
+    id, format, err := ParseImport([]byte(wp))
+    if err != nil { t.Fatal(err) }
+    if format != FormatWarpPlus || id.DeviceID != "wp-dev" || id.Account.Type != "limited" || id.Account.PremiumData != 1024 || id.Config.Reserved() == nil || id.Config.AddressV6 == "" {
+        t.Fatalf("warp-plus identity = %+v %+v %+v", id, id.Account, id.Config)
+    }
+
+    // Our own file round-trips.
+    back, format, err := ParseImport(mustJSON(id))
+    if err != nil || format != FormatNative || back.Token != "wp-token" || back.Config.ClientID != "q2xE" { t.Fatalf("native = %+v (%s), %v", back, format, err) }
+
+    _, otherPub := keyPair(t)
+    bad := strings.Replace(wp, pub, otherPub, 1)
+    if _, _, err := ParseImport([]byte(bad)); err == nil || !strings.Contains(err.Error(), "does not belong") { t.Fatalf("mismatched key pair: %v", err) }
+}
+
+func TestParseImport_WireGuardConf(t *testing.T) {
+    priv, pub := keyPair(t)
+    conf := fmt.Sprintf(`# wgcf-profile.conf
+[Interface]
+PrivateKey = %s
+Address = 172.16.0.2/32
+Address = 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1
+MTU = 1280
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = engage.cloudflareclient.com:2408
+`, priv)
+    id, format, err := ParseImport([]byte(conf))
+    if err != nil { t.Fatal(err) }
+    c := id.Config
+    if format != FormatWireGuard || id.PublicKey != pub || id.DeviceID != "" || c.AddressV4 != "172.16.0.2" || c.AddressV6 != "2606:4700:110:8a36::1" || c.Endpoints[0] != "engage.cloudflareclient.com:2408" {
+        t.Fatalf("conf identity = %+v %+v", id, c)
+    }
+    // It exports back to the same settings.
+    out, err := WireGuardConf(id)
+    if err != nil || !strings.Contains(out, "PrivateKey = "+priv) || !strings.Contains(out, "Address = 172.16.0.2/32, 2606:4700:110:8a36::1/128") { t.Fatalf("export:\n%s\n%v", out, err) }
+
+    // Saved without a device, it still counts as an identity, but cannot be refreshed.
+    dir := t.TempDir()
+    if _, _, err := Import(context.Background(), dir, []byte(conf), ImportOptions{}); err != nil { t.Fatal(err) }
+    if _, ok, _ := Load(dir); !ok { t.Fatal("conf identity not loaded") }
+    if _, err := RefreshAccount(context.Background(), dir); err != ErrNoToken { t.Fatalf("refresh: %v", err) }
+
+    // Addresses without a prefix length are host addresses.
+    bare := strings.NewReplacer("172.16.0.2/32", "172.16.0.2", "::1/128", "::1").Replace(conf)
+    id, _, err = ParseImport([]byte(bare))
+    if err != nil || id.Config.AddressV4 != "172.16.0.2" || id.Config.AddressV6 != "2606:4700:110:8a36::1" { t.Fatalf("bare addresses = %+v, %v", id.Config, err) }
+
+    for _, bad := range []string{
+        strings.Replace(conf, priv, "c2hvcnQ=", 1),
+        strings.Replace(conf, "PublicKey = bmXOC", "PublicKey = !!", 1),
+        strings.Replace(conf, "172.16.0.2/32", "172.16.0", 1),
+        "private_key = 'abc'",
+        `{"id":"x"}`,
+    } {
+        if _, _, err := ParseImport([]byte(bad)); err == nil { t.Errorf("accepted %q", bad) }
+    }
+}
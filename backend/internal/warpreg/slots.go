@@ -0,0 +1,238 @@
+package warpreg
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Identity slots are named identities. The default slot is the identity kept
+// directly in the state dir; every other slot is a directory under
+// <state>/identities with its own identity file. The active slot and the
+// rotation schedule are kept in <state>/identities.json.
+const (
+    DefaultSlot = "default"
+    slotsDir    = "identities"
+    slotsFile   = "identities.json"
+)
+
+var (
+    // ErrSlotExists is returned when creating a slot that already has an identity.
+    ErrSlotExists = errors.New("identity slot already exists")
+    // ErrSlotNotFound is returned for slots without an identity.
+    ErrSlotNotFound = errors.New("identity slot not found")
+    // ErrNoOtherSlot is returned by Rotate when no other slot has an identity to move to.
+    ErrNoOtherSlot = errors.New("no other identity slot to rotate to")
+)
+
+// Slots is the slot bookkeeping in identities.json.
+type Slots struct {
+    Active       string    `json:"active"`
+    RotateEvery  string    `json:"rotateEvery,omitempty"`  // Go duration; "" disables scheduled rotation
+    RotateFresh  bool      `json:"rotateFresh,omitempty"`  // scheduled rotations register a new slot
+    RotateRetire bool      `json:"rotateRetire,omitempty"` // scheduled rotations delete and unregister the slot left
+    LastRotated  time.Time `json:"lastRotated,omitempty"`
+}
+
+// Slot is one named identity.
+type Slot struct {
+    Name     string   `json:"name"`
+    Active   bool     `json:"active"`
+    Exists   bool     `json:"exists"` // an identity is saved in the slot
+    Identity Identity `json:"-"`
+}
+
+// RotateOptions describe a rotation, on demand or scheduled.
+type RotateOptions struct {
+    Fresh  bool // register a new slot instead of moving to the next existing one
+    Retire bool // then delete the slot rotated away from and unregister its device (never the default slot)
+}
+
+// slotsMu serialises read-modify-write cycles of identities.json.
+var slotsMu sync.Mutex
+
+var slotRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ValidSlot reports whether name can name a slot: up to 32 lower-case
+// letters, digits, '-' and '_'.
+func ValidSlot(name string) bool { return slotRe.MatchString(name) }
+
+// SlotDir returns the directory holding the slot's identity. It is also the
+// slot's warp-plus cache dir, so each slot runs as its own device.
+func SlotDir(stateDir, name string) string {
+    if name == "" || name == DefaultSlot { return stateDir }
+    return filepath.Join(stateDir, slotsDir, name)
+}
+
+// LoadSlots reads identities.json; without one the default slot is active.
+func LoadSlots(stateDir string) (Slots, error) {
+    s := Slots{Active: DefaultSlot}
+    b, err := os.ReadFile(filepath.Join(stateDir, slotsFile))
+    if os.IsNotExist(err) { return s, nil }
+    if err != nil { return s, err }
+    if err := json.Unmarshal(b, &s); err != nil { return Slots{Active: DefaultSlot}, err }
+    if s.Active == "" { s.Active = DefaultSlot }
+    return s, nil
+}
+
+func saveSlots(stateDir string, s Slots) error {
+    if err := os.MkdirAll(stateDir, 0o755); err != nil { return err }
+    p := filepath.Join(stateDir, slotsFile)
+    if err := os.WriteFile(p+".tmp", mustJSON(s), 0o600); err != nil { return err }
+    return os.Rename(p+".tmp", p)
+}
+
+// updateSlots applies fn to the saved slot state under slotsMu.
+func updateSlots(stateDir string, fn func(*Slots) error) (Slots, error) {
+    slotsMu.Lock()
+    defer slotsMu.Unlock()
+    s, err := LoadSlots(stateDir)
+    if err != nil { return s, err }
+    if err := fn(&s); err != nil { return s, err }
+    return s, saveSlots(stateDir, s)
+}
+
+// Active returns the active slot and its directory. An unreadable
+// identities.json falls back to the default slot.
+func Active(stateDir string) (name, dir string) {
+    s, _ := LoadSlots(stateDir)
+    return s.Active, SlotDir(stateDir, s.Active)
+}
+
+// SetActive makes name the active slot. The slot need not have an identity
+// yet; the next connect registers one.
+func SetActive(stateDir, name string) error {
+    if !ValidSlot(name) { return fmt.Errorf("invalid slot name %q", name) }
+    _, err := updateSlots(stateDir, func(s *Slots) error { s.Active = name; return nil })
+    return err
+}
+
+// ListSlots returns the default slot and every slot directory, by name.
+func ListSlots(stateDir string) ([]Slot, error) {
+    s, err := LoadSlots(stateDir)
+    if err != nil { return nil, err }
+    names := []string{DefaultSlot}
+    entries, err := os.ReadDir(filepath.Join(stateDir, slotsDir))
+    if err != nil && !os.IsNotExist(err) { return nil, err }
+    for _, e := range entries {
+        if e.IsDir() && ValidSlot(e.Name()) && e.Name() != DefaultSlot { names = append(names, e.Name()) }
+    }
+    sort.Strings(names[1:])
+    var out []Slot
+    for _, n := range names {
+        id, ok, err := Load(SlotDir(stateDir, n))
+        if err != nil { return nil, fmt.Errorf("slot %s: %w", n, err) }
+        out = append(out, Slot{Name: n, Active: n == s.Active, Exists: ok, Identity: id})
+    }
+    return out, nil
+}
+
+// CreateSlot registers a new device in slot name.
+func CreateSlot(ctx context.Context, stateDir, name string) (Identity, error) {
+    if !ValidSlot(name) { return Identity{}, fmt.Errorf("invalid slot name %q", name) }
+    dir := SlotDir(stateDir, name)
+    if _, ok, err := Load(dir); err != nil {
+        return Identity{}, err
+    } else if ok {
+        return Identity{}, ErrSlotExists
+    }
+    return EnsureIdentity(ctx, dir)
+}
+
+// DeleteSlot removes slot name, first unregistering its device from the API
+// if unregister is set; a failed unregistration leaves the slot in place.
+// Deleting the active slot makes the default slot active. The default slot
+// itself only loses its identity file, like Reset.
+func DeleteSlot(ctx context.Context, stateDir, name string, unregister bool) error {
+    if !ValidSlot(name) { return fmt.Errorf("invalid slot name %q", name) }
+    dir := SlotDir(stateDir, name)
+    id, ok, err := Load(dir)
+    if err != nil { return err }
+    if !ok { return ErrSlotNotFound }
+    if unregister && id.Token != "" {
+        if err := call(ctx, http.MethodDelete, "/reg/"+id.DeviceID, id.Token, nil, nil); err != nil { return fmt.Errorf("unregister device: %w", err) }
+    }
+    if name == DefaultSlot {
+        err = Reset(stateDir)
+    } else {
+        err = os.RemoveAll(dir)
+    }
+    if err != nil { return err }
+    _, err = updateSlots(stateDir, func(s *Slots) error {
+        if s.Active == name { s.Active = DefaultSlot }
+        return nil
+    })
+    return err
+}
+
+// Rotate switches the active slot: to a newly registered one if fresh is
+// set, otherwise to the next slot with an identity, in name order. The slot
+// rotated away from is kept; callers retire it with DeleteSlot once nothing
+// runs on it.
+func Rotate(ctx context.Context, stateDir string, fresh bool) (from, to string, err error) {
+    cur, _ := LoadSlots(stateDir)
+    from = cur.Active
+    if fresh {
+        base := "rot-" + time.Now().UTC().Format("20060102-150405")
+        to = base
+        for i := 2; ; i++ {
+            if _, err := os.Stat(SlotDir(stateDir, to)); os.IsNotExist(err) { break }
+            to = fmt.Sprintf("%s-%d", base, i)
+        }
+        if _, err := CreateSlot(ctx, stateDir, to); err != nil { return from, "", err }
+    } else {
+        slots, err := ListSlots(stateDir)
+        if err != nil { return from, "", err }
+        var names []string
+        at := -1
+        for _, s := range slots {
+            if !s.Exists && s.Name != from { continue }
+            if s.Name == from { at = len(names) }
+            names = append(names, s.Name)
+        }
+        if len(names) < 2 { return from, "", ErrNoOtherSlot }
+        to = names[(at+1)%len(names)]
+    }
+    if _, err := updateSlots(stateDir, func(s *Slots) error {
+        s.Active, s.LastRotated = to, time.Now().UTC()
+        return nil
+    }); err != nil { return from, "", err }
+    return from, to, nil
+}
+
+// SetSchedule sets up scheduled rotation every interval (0 disables it).
+// The first rotation is one interval from now.
+func SetSchedule(stateDir string, every time.Duration, opts RotateOptions) (Slots, error) {
+    if every != 0 && every < time.Minute { return Slots{}, errors.New("rotation interval must be at least 1m") }
+    return updateSlots(stateDir, func(s *Slots) error {
+        s.RotateEvery, s.RotateFresh, s.RotateRetire = "", opts.Fresh, opts.Retire
+        if every > 0 {
+            s.RotateEvery, s.LastRotated = every.String(), time.Now().UTC()
+        }
+        return nil
+    })
+}
+
+// Interval returns the scheduled rotation interval, 0 if there is none.
+func (s Slots) Interval() time.Duration {
+    every, err := time.ParseDuration(s.RotateEvery)
+    if err != nil || every < 0 { return 0 }
+    return every
+}
+
+// RotationDue reports whether a scheduled rotation is due at now.
+func (s Slots) RotationDue(now time.Time) bool {
+    every := s.Interval()
+    return every > 0 && !now.Before(s.LastRotated.Add(every))
+}
+
+// Schedule returns the options scheduled rotations use.
+func (s Slots) Schedule() RotateOptions { return RotateOptions{Fresh: s.RotateFresh, Retire: s.RotateRetire} }
@@ -0,0 +1,89 @@
+package warpreg
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func slotNames(t *testing.T, dir string) (names []string, active string) {
+    t.Helper()
+    slots, err := ListSlots(dir)
+    if err != nil { t.Fatal(err) }
+    for _, s := range slots {
+        if !s.Exists { continue }
+        names = append(names, s.Name)
+        if s.Active { active = s.Name }
+    }
+    return names, active
+}
+
+func TestSlots_CreateRotateDelete(t *testing.T) {
+    f := newFakeAPI(t)
+    ctx, dir := context.Background(), t.TempDir()
+
+    // Without identities.json the existing identity is the active default slot.
+    if name, d := Active(dir); name != DefaultSlot || d != dir { t.Fatalf("Active = %q, %q", name, d) }
+    if _, err := EnsureIdentity(ctx, dir); err != nil { t.Fatal(err) }
+    if _, _, err := Rotate(ctx, dir, false); err != ErrNoOtherSlot { t.Fatalf("Rotate with one slot = %v", err) }
+
+    if _, err := CreateSlot(ctx, dir, "Bad Name"); err == nil { t.Fatal("invalid slot name accepted") }
+    for _, n := range []string{"work", "alt"} {
+        if _, err := CreateSlot(ctx, dir, n); err != nil { t.Fatal(err) }
+    }
+    if _, err := CreateSlot(ctx, dir, "work"); err != ErrSlotExists { t.Fatalf("duplicate CreateSlot = %v", err) }
+    names, active := slotNames(t, dir)
+    if len(names) != 3 || names[0] != DefaultSlot || names[1] != "alt" || names[2] != "work" || active != DefaultSlot { t.Fatalf("slots = %v, active %q", names, active) }
+    work, _, _ := Load(SlotDir(dir, "work"))
+    if work.DeviceID != "dev-2" { t.Fatalf("work slot device = %q", work.DeviceID) }
+
+    // Rotation cycles through existing slots in name order.
+    for _, want := range []string{"alt", "work", DefaultSlot} {
+        _, to, err := Rotate(ctx, dir, false)
+        if err != nil || to != want { t.Fatalf("Rotate = %q, %v; want %q", to, err, want) }
+    }
+
+    // A fresh rotation registers a new slot; retiring the one left
+    // unregisters its device.
+    if err := SetActive(dir, "work"); err != nil { t.Fatal(err) }
+    from, to, err := Rotate(ctx, dir, true)
+    if err != nil || from != "work" || to == "" { t.Fatalf("fresh Rotate = %q -> %q, %v", from, to, err) }
+    if err := DeleteSlot(ctx, dir, from, true); err != nil { t.Fatal(err) }
+    if _, ok := f.devices["dev-2"]; ok { t.Error("retired device still registered") }
+    if _, err := os.Stat(SlotDir(dir, "work")); !os.IsNotExist(err) { t.Errorf("retired slot dir: %v", err) }
+    if name, d := Active(dir); name != to || d != filepath.Join(dir, "identities", to) { t.Fatalf("Active = %q, %q", name, d) }
+
+    // Deleting the active slot falls back to the default one; the default
+    // slot loses only its identity file.
+    if err := DeleteSlot(ctx, dir, to, false); err != nil { t.Fatal(err) }
+    if name, _ := Active(dir); name != DefaultSlot { t.Fatalf("active after delete = %q", name) }
+    if len(f.devices) != 3 { t.Errorf("delete without unregister removed a device: %d left", len(f.devices)) }
+    if err := DeleteSlot(ctx, dir, DefaultSlot, true); err != nil { t.Fatal(err) }
+    if _, ok := f.devices["dev-1"]; ok { t.Error("default device still registered") }
+    if _, err := os.Stat(filepath.Join(dir, "identities.json")); err != nil { t.Errorf("slot state removed with the default identity: %v", err) }
+    if err := DeleteSlot(ctx, dir, DefaultSlot, true); err != ErrSlotNotFound { t.Fatalf("second delete = %v", err) }
+}
+
+func TestSlots_UnregisterFailureKeepsSlot(t *testing.T) {
+    f := newFakeAPI(t)
+    ctx, dir := context.Background(), t.TempDir()
+    if _, err := CreateSlot(ctx, dir, "spare"); err != nil { t.Fatal(err) }
+    f.devices["dev-1"].token = "revoked"
+    if err := DeleteSlot(ctx, dir, "spare", true); err == nil { t.Fatal("unregister with a stale token succeeded") }
+    if _, ok, _ := Load(SlotDir(dir, "spare")); !ok { t.Fatal("slot removed after failed unregistration") }
+    if err := DeleteSlot(ctx, dir, "spare", false); err != nil { t.Fatal(err) }
+}
+
+func TestSlots_Schedule(t *testing.T) {
+    dir := t.TempDir()
+    if _, err := SetSchedule(dir, time.Second, RotateOptions{}); err == nil { t.Fatal("sub-minute interval accepted") }
+    s, err := SetSchedule(dir, time.Hour, RotateOptions{Fresh: true})
+    if err != nil { t.Fatal(err) }
+    if s.Interval() != time.Hour || s.Schedule() != (RotateOptions{Fresh: true}) || s.Active != DefaultSlot { t.Fatalf("schedule = %+v", s) }
+    if s.RotationDue(time.Now()) { t.Error("rotation due right after scheduling") }
+    if !s.RotationDue(time.Now().Add(time.Hour)) { t.Error("rotation not due after the interval") }
+    s, _ = SetSchedule(dir, 0, RotateOptions{})
+    if s.RotationDue(time.Now().Add(24 * time.Hour)) { t.Error("disabled schedule still due") }
+}
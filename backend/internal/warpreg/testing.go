@@ -0,0 +1,14 @@
+package warpreg
+
+import "testing"
+
+// SaveForTest saves an offline identity (a fixed key pair, no device) in
+// stateDir, so tests elsewhere can connect or manage slots without
+// registering a device.
+func SaveForTest(t testing.TB, stateDir string) {
+    t.Helper()
+    const priv = "cGxhY2Vob2xkZXIta2V5LW5vdC11c2VkLWluLXRlc3Q="
+    pub, err := publicKey(priv)
+    if err != nil { t.Fatal(err) }
+    if err := save(stateDir, Identity{PrivateKey: priv, PublicKey: pub}); err != nil { t.Fatal(err) }
+}
@@ -0,0 +1,114 @@
+package warpreg
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+)
+
+// warp-plus keeps the device it runs as in <cache-dir>/primary/wgcf-identity.json
+// (gool mode a second one under secondary/) and registers a device of its own
+// when the file is missing. WriteWarpPlus puts the slot's device there, so
+// that the device carrying traffic is the one SetLicense bound the key to.
+const warpPlusFile = "wgcf-identity.json"
+
+// warpPlusIdentity is warp-plus's identity file: the API's device object
+// plus the private key.
+type warpPlusIdentity struct {
+    ID         string     `json:"id"`
+    Token      string     `json:"token"`
+    Key        string     `json:"key"`
+    PrivateKey string     `json:"private_key"`
+    Account    apiAccount `json:"account"`
+    Config     struct {
+        ClientID string         `json:"client_id"`
+        Peers    []warpPlusPeer `json:"peers"`
+        Interface struct {
+            Addresses struct {
+                V4 string `json:"v4"`
+                V6 string `json:"v6"`
+            } `json:"addresses"`
+        } `json:"interface"`
+    } `json:"config"`
+}
+
+type warpPlusPeer struct {
+    PublicKey string `json:"public_key"`
+    Endpoint  struct {
+        V4   string `json:"v4"`
+        V6   string `json:"v6"`
+        Host string `json:"host"`
+    } `json:"endpoint"`
+}
+
+func warpPlusPath(dir, sub string) string { return filepath.Join(dir, sub, warpPlusFile) }
+
+// loadWarpPlus reads warp-plus's identity under dir/sub; ok is false if there is none.
+func loadWarpPlus(dir, sub string) (wp warpPlusIdentity, ok bool, err error) {
+    b, err := os.ReadFile(warpPlusPath(dir, sub))
+    if os.IsNotExist(err) { return wp, false, nil }
+    if err != nil { return wp, false, err }
+    if err := json.Unmarshal(b, &wp); err != nil { return wp, false, fmt.Errorf("warp-plus identity: %w", err) }
+    return wp, true, nil
+}
+
+// WriteWarpPlus saves the identity in dir as the device warp-plus runs as
+// with --cache-dir dir. A config missing from older identity files is
+// fetched first. A device warp-plus registered there by itself is
+// unregistered, as nothing else knows about it; if that fails the error
+// names the device left registered, but the identity is still written.
+func WriteWarpPlus(ctx context.Context, dir string) error {
+    id, ok, err := Load(dir)
+    if err != nil { return err }
+    if !ok { return ErrNoIdentity }
+    if id.Config == nil && id.Token != "" {
+        if id, err = RefreshAccount(ctx, dir); err != nil { return err }
+    }
+    c, err := exportable(id)
+    if err != nil { return err }
+
+    wp := warpPlusIdentity{ID: id.DeviceID, Token: id.Token, Key: id.PublicKey, PrivateKey: id.PrivateKey, Account: apiAccount{ID: id.AccountID, License: id.License}}
+    if a := id.Account; a != nil {
+        wp.Account = apiAccount{ID: a.ID, AccountType: a.Type, WarpPlus: a.WarpPlus, PremiumData: a.PremiumData, Quota: a.Quota, ReferralCount: a.ReferralCount, License: id.License}
+    }
+    wp.Config.ClientID = c.ClientID
+    wp.Config.Interface.Addresses.V4, wp.Config.Interface.Addresses.V6 = c.AddressV4, c.AddressV6
+    peer := warpPlusPeer{PublicKey: c.PeerPublicKey}
+    for _, ep := range c.Endpoints {
+        host, _, err := net.SplitHostPort(ep)
+        if err != nil { continue }
+        ip := net.ParseIP(host)
+        switch {
+        case ip == nil:
+            if peer.Endpoint.Host == "" { peer.Endpoint.Host = ep }
+        case ip.To4() != nil:
+            if peer.Endpoint.V4 == "" { peer.Endpoint.V4 = ep }
+        default:
+            if peer.Endpoint.V6 == "" { peer.Endpoint.V6 = ep }
+        }
+    }
+    wp.Config.Peers = []warpPlusPeer{peer}
+
+    var leaked error
+    if old, ok, err := loadWarpPlus(dir, "primary"); err == nil && ok && old.ID != "" && old.ID != id.DeviceID {
+        leaked = unregisterWarpPlus(ctx, old)
+    }
+    p := warpPlusPath(dir, "primary")
+    if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { return err }
+    if err := os.WriteFile(p+".tmp", mustJSON(wp), 0o600); err != nil { return err }
+    if err := os.Rename(p+".tmp", p); err != nil { return err }
+    return leaked
+}
+
+// unregisterWarpPlus deletes a device warp-plus registered by itself.
+func unregisterWarpPlus(ctx context.Context, wp warpPlusIdentity) error {
+    if wp.Token == "" { return nil }
+    if err := call(ctx, http.MethodDelete, "/reg/"+wp.ID, wp.Token, nil, nil); err != nil {
+        return fmt.Errorf("unregister warp-plus device %s: %w", wp.ID, err)
+    }
+    return nil
+}
@@ -0,0 +1,42 @@
+package warpreg
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestWriteWarpPlus_HandsOverLicensedDevice(t *testing.T) {
+    f := newFakeAPI(t)
+    f.licenses["a1B2c3D4-e5F6g7H8-i9J0k1L2"] = apiAccount{ID: "acct-plus", AccountType: "limited", WarpPlus: true}
+    ctx, dir := context.Background(), t.TempDir()
+    if err := WriteWarpPlus(ctx, dir); err != ErrNoIdentity { t.Fatalf("without identity: %v", err) }
+    if _, err := EnsureIdentity(ctx, dir); err != nil { t.Fatal(err) }
+    id, err := SetLicense(ctx, dir, "a1B2c3D4-e5F6g7H8-i9J0k1L2")
+    if err != nil { t.Fatal(err) }
+
+    // warp-plus registered a device of its own there earlier.
+    own, err := Register(ctx)
+    if err != nil { t.Fatal(err) }
+    cached := filepath.Join(dir, "primary", "wgcf-identity.json")
+    if err := os.MkdirAll(filepath.Dir(cached), 0o755); err != nil { t.Fatal(err) }
+    if err := os.WriteFile(cached, []byte(`{"id":"`+own.DeviceID+`","token":"`+own.Token+`"}`), 0o600); err != nil { t.Fatal(err) }
+
+    if err := WriteWarpPlus(ctx, dir); err != nil { t.Fatal(err) }
+    if _, ok := f.devices[own.DeviceID]; ok { t.Error("warp-plus's own device still registered") }
+    b, err := os.ReadFile(cached)
+    if err != nil { t.Fatal(err) }
+    got, format, err := ParseImport(b)
+    if err != nil || format != FormatWarpPlus { t.Fatalf("cache identity: %s, %v", format, err) }
+    if got.DeviceID != id.DeviceID || got.Token != id.Token || got.PrivateKey != id.PrivateKey || got.License != id.License || !got.Account.WarpPlus || !reflect.DeepEqual(got.Config, id.Config) {
+        t.Fatalf("cache identity = %+v %+v, want %+v %+v", got, got.Config, id, id.Config)
+    }
+
+    // A device that cannot be unregistered is named, and replaced anyway.
+    if err := os.WriteFile(cached, []byte(`{"id":"dev-9","token":"stale"}`), 0o600); err != nil { t.Fatal(err) }
+    if err := WriteWarpPlus(ctx, dir); err == nil || !strings.Contains(err.Error(), "dev-9") { t.Fatalf("stale device: %v", err) }
+    if wp, _, _ := loadWarpPlus(dir, "primary"); wp.ID != id.DeviceID { t.Fatalf("cache identity not replaced: %q", wp.ID) }
+}
@@ -12,18 +12,33 @@ import (
     "net/http"
     "os"
     "path/filepath"
+    "strings"
     "time"
 )
 
+// BaseURL is the Cloudflare client API the package talks to. WARP_API_URL
+// overrides it, e.g. to point at a stand-in.
+var BaseURL = "https://api.cloudflareclient.com/v0a0"
+
+func init() {
+    if u := os.Getenv("WARP_API_URL"); u != "" { BaseURL = u }
+}
+
 type Identity struct {
     DeviceID    string `json:"id"`
     Token       string `json:"token"`
     AccountID   string `json:"account_id,omitempty"`
     PrivateKey  string `json:"private_key"` // base64 X25519 private key
     PublicKey   string `json:"public_key"`  // base64 X25519 public key
-    License     string `json:"license,omitempty"`
+    License     string `json:"license,omitempty"`   // WARP+ key bound with SetLicense
+    Account     *Account `json:"account,omitempty"` // as last fetched from the API
+    Config      *Config  `json:"config,omitempty"`  // WireGuard peer and addresses
 }
 
+// usable reports whether id names a device, or at least holds a key pair
+// (identities imported from a WireGuard config have no device ID).
+func (id Identity) usable() bool { return id.DeviceID != "" || id.PrivateKey != "" }
+
 const identityFile = "warp_identity.json"
 
 func identityPath(stateDir string) string { return filepath.Join(stateDir, identityFile) }
@@ -42,7 +57,7 @@ func Load(stateDir string) (Identity, bool, error) {
     if err := json.Unmarshal(b, &id); err != nil {
         return Identity{}, false, err
     }
-    if id.DeviceID == "" { return Identity{}, false, nil }
+    if !id.usable() { return Identity{}, false, nil }
     return id, true, nil
 }
 
@@ -59,19 +74,25 @@ func EnsureIdentity(ctx context.Context, stateDir string) (Identity, error) {
     // Load existing
     if b, err := os.ReadFile(identityPath(stateDir)); err == nil && len(b) > 0 {
         var id Identity
-        if json.Unmarshal(b, &id) == nil && id.DeviceID != "" {
+        if json.Unmarshal(b, &id) == nil && id.usable() {
             return id, nil
         }
     }
     // Register new
     id, err := Register(ctx)
     if err != nil { return Identity{}, err }
-    // Persist
-    if err := os.MkdirAll(stateDir, 0o755); err != nil { return Identity{}, err }
-    if err := os.WriteFile(identityPath(stateDir), mustJSON(id), 0o600); err != nil { return Identity{}, err }
+    if err := save(stateDir, id); err != nil { return Identity{}, err }
     return id, nil
 }
 
+// save writes id to the identity file atomically.
+func save(stateDir string, id Identity) error {
+    if err := os.MkdirAll(stateDir, 0o755); err != nil { return err }
+    p := identityPath(stateDir)
+    if err := os.WriteFile(p+".tmp", mustJSON(id), 0o600); err != nil { return err }
+    return os.Rename(p+".tmp", p)
+}
+
 // Register creates a new device identity using Cloudflare’s registration endpoint.
 // Note: endpoint version may change; v0a0 is widely accepted and forwards internally.
 func Register(ctx context.Context) (Identity, error) {
@@ -93,26 +114,13 @@ func Register(ctx context.Context) (Identity, error) {
         "serial_number": fmt.Sprintf("bp-%d", time.Now().UnixNano()),
         "locale":       "en_US",
     }
-    payload, _ := json.Marshal(body)
-
-    req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.cloudflareclient.com/v0a0/reg", io.NopCloser(bytesReader(payload)))
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("User-Agent", "okhttp/3.12.1")
-    resp, err := http.DefaultClient.Do(req)
-    if err != nil { return Identity{}, err }
-    defer resp.Body.Close()
-    if resp.StatusCode >= 300 {
-        b, _ := io.ReadAll(resp.Body)
-        return Identity{}, fmt.Errorf("reg failed: %s", string(b))
-    }
     var out struct {
         ID     string `json:"id"`
         Token  string `json:"token"`
-        Account struct{ ID string `json:"id"` } `json:"account"`
-    }
-    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-        return Identity{}, err
+        Account apiAccount `json:"account"`
+        Config  apiConfig  `json:"config"`
     }
+    if err := call(ctx, http.MethodPost, "/reg", "", body, &out); err != nil { return Identity{}, fmt.Errorf("reg failed: %w", err) }
     if out.ID == "" || out.Token == "" { return Identity{}, errors.New("invalid reg response") }
     return Identity{
         DeviceID:  out.ID,
@@ -120,9 +128,47 @@ func Register(ctx context.Context) (Identity, error) {
         AccountID: out.Account.ID,
         PrivateKey: privB64,
         PublicKey:  pubB64,
+        Account:   out.Account.account(),
+        Config:    out.Config.config(),
     }, nil
 }
 
+// call sends a JSON request to the client API, authenticated with token if
+// set, and decodes the response into out unless it is nil.
+func call(ctx context.Context, method, path, token string, in, out any) error {
+    var body io.Reader
+    if in != nil {
+        b, err := json.Marshal(in)
+        if err != nil { return err }
+        body = bytesReader(b)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(BaseURL, "/")+path, body)
+    if err != nil { return err }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "okhttp/3.12.1")
+    if token != "" { req.Header.Set("Authorization", "Bearer "+token) }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+        return apiError(resp.Status, b)
+    }
+    if out == nil { return nil }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// apiError prefers the messages of a Cloudflare error envelope over the raw body.
+func apiError(status string, body []byte) error {
+    var env struct{ Errors []struct{ Message string `json:"message"` } `json:"errors"` }
+    var msgs []string
+    if json.Unmarshal(body, &env) == nil {
+        for _, e := range env.Errors { msgs = append(msgs, e.Message) }
+    }
+    if len(msgs) == 0 { msgs = []string{strings.TrimSpace(string(body))} }
+    return fmt.Errorf("%s: %s", status, strings.Join(msgs, "; "))
+}
+
 // Helper to avoid importing bytes for a small reader.
 type br struct{ b []byte; i int }
 func bytesReader(b []byte) *br { return &br{b:b} }
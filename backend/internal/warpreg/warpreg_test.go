@@ -0,0 +1,167 @@
+package warpreg
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// fakeAPI is a stand-in for the Cloudflare client API with just enough
+// behaviour for warpreg: registration and unregistration, the device with
+// its config, and the device's account.
+type fakeAPI struct {
+    mu       sync.Mutex
+    devices  map[string]*fakeDevice // by device ID
+    licenses map[string]apiAccount  // valid WARP+ keys and the account they grant
+    calls    []string
+}
+
+type fakeDevice struct {
+    token, key string
+    account    apiAccount
+}
+
+// fakeConfig is what the API assigns every device, ports included.
+var fakeConfig = map[string]any{
+    "client_id": "q2xE",
+    "peers": []map[string]any{{
+        "public_key": "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+        "endpoint":   map[string]string{"v4": "162.159.192.7:0", "v6": "[2606:4700:d0::a29f:c007]:0", "host": "engage.cloudflareclient.com:2408"},
+    }},
+    "interface": map[string]any{"addresses": map[string]string{"v4": "172.16.0.2", "v6": "2606:4700:110:8a36::1"}},
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+    t.Helper()
+    f := &fakeAPI{devices: map[string]*fakeDevice{}, licenses: map[string]apiAccount{}}
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    prev := BaseURL
+    BaseURL = srv.URL + "/v0a0"
+    t.Cleanup(func() { BaseURL = prev })
+    return f
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+    fail := func(code int, msg string) {
+        w.WriteHeader(code)
+        fmt.Fprintf(w, `{"success":false,"errors":[{"code":%d,"message":%q}]}`, code, msg)
+    }
+    path := strings.TrimPrefix(r.URL.Path, "/v0a0")
+    if r.Method == http.MethodPost && path == "/reg" {
+        var in struct{ Key string `json:"key"` }
+        if json.NewDecoder(r.Body).Decode(&in) != nil || in.Key == "" { fail(400, "bad request"); return }
+        n := len(f.devices) + 1
+        d := &fakeDevice{token: fmt.Sprintf("token-%d", n), key: in.Key, account: apiAccount{ID: fmt.Sprintf("acct-%d", n), AccountType: "free", License: "free0000-free0000-free0000"}}
+        f.devices[fmt.Sprintf("dev-%d", n)] = d
+        json.NewEncoder(w).Encode(map[string]any{"id": fmt.Sprintf("dev-%d", n), "token": d.token, "account": d.account, "config": fakeConfig})
+        return
+    }
+    parts := strings.Split(strings.TrimPrefix(path, "/reg/"), "/")
+    d := f.devices[parts[0]]
+    if d == nil || !strings.HasPrefix(path, "/reg/") { fail(404, "not found"); return }
+    if r.Header.Get("Authorization") != "Bearer "+d.token { fail(401, "Unauthorized"); return }
+    switch {
+    case len(parts) == 1 && r.Method == http.MethodDelete:
+        delete(f.devices, parts[0])
+        w.WriteHeader(http.StatusNoContent)
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        json.NewEncoder(w).Encode(map[string]any{"id": parts[0], "key": d.key, "account": d.account, "config": fakeConfig})
+    case len(parts) == 3 && parts[1] == "account" && parts[2] == "devices" && r.Method == http.MethodGet:
+        var out []map[string]any
+        for id, o := range f.devices {
+            if o.account.ID == d.account.ID { out = append(out, map[string]any{"id": id, "name": "bp " + id, "model": "Bulletproof", "type": "Android", "active": true, "created": "2024-06-01T10:00:00Z"}) }
+        }
+        json.NewEncoder(w).Encode(out)
+    case len(parts) == 2 && parts[1] == "account" && r.Method == http.MethodPut:
+        var in struct{ License string `json:"license"` }
+        json.NewDecoder(r.Body).Decode(&in)
+        a, ok := f.licenses[in.License]
+        if !ok { fail(400, "Invalid license"); return }
+        a.License = in.License
+        d.account = a
+        json.NewEncoder(w).Encode(a)
+    default:
+        fail(404, "not found")
+    }
+}
+
+func TestRegisterAndLicense(t *testing.T) {
+    f := newFakeAPI(t)
+    f.licenses["a1B2c3D4-e5F6g7H8-i9J0k1L2"] = apiAccount{ID: "acct-plus", AccountType: "limited", WarpPlus: true, PremiumData: 1 << 30, Quota: 1 << 30, ReferralCount: 3}
+    ctx, dir := context.Background(), t.TempDir()
+
+    if _, err := SetLicense(ctx, dir, "a1B2c3D4-e5F6g7H8-i9J0k1L2"); err != ErrNoIdentity { t.Fatalf("SetLicense without identity = %v", err) }
+    id, err := EnsureIdentity(ctx, dir)
+    if err != nil { t.Fatal(err) }
+    if id.DeviceID != "dev-1" || id.Token != "token-1" || id.Account == nil || id.Account.Type != "free" { t.Fatalf("identity = %+v", id) }
+
+    if _, err := SetLicense(ctx, dir, "not-a-key"); err == nil { t.Fatal("malformed key accepted") }
+    if _, err := SetLicense(ctx, dir, "zzzzzzzz-zzzzzzzz-zzzzzzzz"); err == nil || !strings.Contains(err.Error(), "Invalid license") { t.Fatalf("unknown key: %v", err) }
+    id, err = SetLicense(ctx, dir, "a1B2c3D4-e5F6g7H8-i9J0k1L2")
+    if err != nil { t.Fatal(err) }
+    a := id.Account
+    if id.License != "a1B2c3D4-e5F6g7H8-i9J0k1L2" || id.AccountID != "acct-plus" || a.Type != "limited" || !a.WarpPlus || a.PremiumData != 1<<30 || a.ReferralCount != 3 {
+        t.Fatalf("after SetLicense: %+v %+v", id, a)
+    }
+
+    // The result is persisted, and the key pair survives.
+    saved, ok, err := Load(dir)
+    if err != nil || !ok { t.Fatalf("Load = %v, %v", ok, err) }
+    if saved.License != id.License || saved.Account == nil || saved.Account.PremiumData != 1<<30 || saved.PrivateKey == "" { t.Fatalf("saved = %+v", saved) }
+
+    // Refresh picks up quota usage.
+    f.devices["dev-1"].account.PremiumData = 1 << 20
+    id, err = RefreshAccount(ctx, dir)
+    if err != nil || id.Account.PremiumData != 1<<20 { t.Fatalf("RefreshAccount = %+v, %v", id.Account, err) }
+
+    // A revoked token surfaces the API's message.
+    f.devices["dev-1"].token = "rotated"
+    if _, err := RefreshAccount(ctx, dir); err == nil || !strings.Contains(err.Error(), "Unauthorized") { t.Fatalf("stale token: %v", err) }
+}
+
+func TestMaskLicense(t *testing.T) {
+    if got := MaskLicense("a1B2c3D4-e5F6g7H8-i9J0k1L2"); got != "********-********-****k1L2" { t.Fatalf("MaskLicense = %q", got) }
+    if got := MaskLicense(""); got != "" { t.Fatalf("MaskLicense(\"\") = %q", got) }
+}
+
+func TestRefreshAccount_DevicesAndConfig(t *testing.T) {
+    f := newFakeAPI(t)
+    ctx, dir := context.Background(), t.TempDir()
+    id, err := EnsureIdentity(ctx, dir)
+    if err != nil { t.Fatal(err) }
+    want := &Config{
+        ClientID:      "q2xE",
+        PeerPublicKey: "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+        Endpoints:     []string{"engage.cloudflareclient.com:2408", "162.159.192.7:2408", "[2606:4700:d0::a29f:c007]:2408"},
+        AddressV4:     "172.16.0.2",
+        AddressV6:     "2606:4700:110:8a36::1",
+    }
+    if !reflect.DeepEqual(id.Config, want) { t.Fatalf("config at registration = %+v", id.Config) }
+
+    // A second device shares the account.
+    f.devices["dev-9"] = &fakeDevice{token: "t9", account: f.devices["dev-1"].account}
+    f.devices["dev-1"].account.PremiumData = 5 << 20
+    id, err = RefreshAccount(ctx, dir)
+    if err != nil { t.Fatal(err) }
+    if id.Account.PremiumData != 5<<20 || len(id.Account.Devices) != 2 || id.Account.Updated.IsZero() { t.Fatalf("account = %+v", id.Account) }
+    current := 0
+    for _, d := range id.Account.Devices {
+        if d.Current {
+            current++
+            if d.ID != "dev-1" { t.Errorf("current device = %q", d.ID) }
+        }
+    }
+    if current != 1 { t.Errorf("%d current devices", current) }
+    saved, _, _ := Load(dir)
+    if !reflect.DeepEqual(saved.Config, want) || len(saved.Account.Devices) != 2 { t.Fatalf("saved = %+v", saved) }
+}
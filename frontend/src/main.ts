@@ -223,7 +223,7 @@ ipcMain.handle('bp-connect', async (_evt, payload: any) => {
   try {
     const res = await fetch('http://127.0.0.1:4765/v1/connect', {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: { 'Content-Type': 'application/json', 'X-Bulletproof-Client': 'electron' },
       body: JSON.stringify(payload || {}),
     });
     return await res.json();
@@ -234,7 +234,7 @@ ipcMain.handle('bp-connect', async (_evt, payload: any) => {
 
 ipcMain.handle('bp-disconnect', async () => {
   try {
-    const res = await fetch('http://127.0.0.1:4765/v1/disconnect', { method: 'POST' });
+    const res = await fetch('http://127.0.0.1:4765/v1/disconnect', { method: 'POST', headers: { 'X-Bulletproof-Client': 'electron' } });
     return await res.json();
   } catch (e:any) {
     return { error: e?.message || 'backend disconnect failed' };
@@ -245,7 +245,7 @@ ipcMain.handle('bp-proxy-test', async (_evt, bind?: string) => {
   try {
     const url = new URL('http://127.0.0.1:4765/v1/test/socks');
     if (bind) url.searchParams.set('bind', bind);
-    const res = await fetch(url.toString());
+    const res = await fetch(url.toString(), { headers: { 'X-Bulletproof-Client': 'electron' } });
     return await res.json();
   } catch (e:any) {
     return { error: e?.message || 'proxy test failed' };
@@ -279,7 +279,7 @@ ipcMain.handle('bp-identity', async () => {
 
 ipcMain.handle('bp-identity-reset', async () => {
   try {
-    const res = await fetch('http://127.0.0.1:4765/v1/identity/reset', { method: 'POST' });
+    const res = await fetch('http://127.0.0.1:4765/v1/identity/reset', { method: 'POST', headers: { 'X-Bulletproof-Client': 'electron' } });
     return await res.json();
   } catch (e:any) {
     return { error: e?.message || 'identity reset failed' };
@@ -14,13 +14,10 @@ try {
     };
     g.electron = {
       status: () => api('/v1/status'),
-      connect: (payload: any) => api('/v1/connect', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(payload || {}) }),
-      disconnect: () => api('/v1/disconnect', { method: 'POST' }),
-      proxyTest: (bind?: string) => {
-        const url = new URL('http://127.0.0.1:4765/v1/test/socks');
-        if (bind) url.searchParams.set('bind', bind);
-        return fetch(url.toString()).then(r => r.json());
-      },
+      // State changes are refused from web pages (see X-Bulletproof-Client).
+      connect: async () => ({ error: 'connect unavailable without preload' }),
+      disconnect: async () => ({ error: 'disconnect unavailable without preload' }),
+      proxyTest: async () => ({ error: 'proxy test unavailable without preload' }),
       probePort: async (bind?: string) => {
         try {
           const diag = await api('/v1/diag');
@@ -28,11 +25,11 @@ try {
         } catch { return { listening: false }; }
       },
       identity: () => api('/v1/identity'),
-      identityReset: () => api('/v1/identity/reset', { method: 'POST' }),
       diag: () => api('/v1/diag'),
       // Optional dev-only utilities; return errors if UI tries to call them
       ping: async () => ({ error: 'ping unavailable without preload' }),
       speedTest: async () => ({ error: 'speed test unavailable without preload' }),
+      identityReset: async () => ({ error: 'identity reset unavailable without preload' }),
     };
     // eslint-disable-next-line no-console
     console.log('[bp] preload bridge missing; installed HTTP fallback');